@@ -4,10 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"strings"
 	"syscall"
 	"time"
 
@@ -16,13 +19,26 @@ import (
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/selection"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/utils/clock"
 
+	"github.com/castai/gpu-metrics-exporter/internal/alerting"
 	"github.com/castai/gpu-metrics-exporter/internal/castai"
 	"github.com/castai/gpu-metrics-exporter/internal/config"
+	"github.com/castai/gpu-metrics-exporter/internal/discovery"
+	"github.com/castai/gpu-metrics-exporter/internal/events"
 	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/gpu-metrics-exporter/internal/ha"
+	"github.com/castai/gpu-metrics-exporter/internal/health"
+	"github.com/castai/gpu-metrics-exporter/internal/otlp"
+	"github.com/castai/gpu-metrics-exporter/internal/relabel"
+	"github.com/castai/gpu-metrics-exporter/internal/remotewrite"
+	"github.com/castai/gpu-metrics-exporter/internal/rowsink"
 	"github.com/castai/gpu-metrics-exporter/internal/server"
+	"github.com/castai/gpu-metrics-exporter/internal/webhook"
 	"github.com/castai/gpu-metrics-exporter/internal/workload"
 	"github.com/castai/logging"
 	"github.com/castai/metrics"
@@ -95,7 +111,11 @@ func run(cfg *config.Config, log *logging.Logger) error {
 		cancel()
 	}()
 
-	dynClient, err := newDynamicClient(cfg)
+	restConfig, err := newRestConfig(cfg)
+	if err != nil {
+		log.WithField("error", err.Error()).Fatal("failed to create kubernetes client config")
+	}
+	dynClient, err := dynamic.NewForConfig(restConfig)
 	if err != nil {
 		log.WithField("error", err.Error()).Fatal("failed to create kubernetes dynamic client")
 	}
@@ -124,7 +144,24 @@ func run(cfg *config.Config, log *logging.Logger) error {
 	}
 
 	client := setupCastAIClient(log, cfg)
-	scraper := exporter.NewScraper(&http.Client{}, log)
+	scrapeClient, err := exporter.NewScrapeHTTPClient(exporter.ScrapeClientConfig{
+		CAFile:                cfg.DCGMClient.TLSCAFile,
+		CertFile:              cfg.DCGMClient.TLSCertFile,
+		KeyFile:               cfg.DCGMClient.TLSKeyFile,
+		ServerName:            cfg.DCGMClient.TLSServerName,
+		InsecureSkipVerify:    cfg.DCGMClient.TLSInsecureSkipVerify,
+		BearerTokenFile:       cfg.DCGMClient.BearerTokenFile,
+		BasicAuthUsername:     cfg.DCGMClient.BasicAuthUsername,
+		BasicAuthPasswordFile: cfg.DCGMClient.BasicAuthPasswordFile,
+	}, Version)
+	if err != nil {
+		log.WithField("error", err.Error()).Fatal("failed to create dcgm-exporter http client")
+	}
+	scraper := exporter.NewScraper(exporter.ScraperConfig{
+		Concurrency:  cfg.ScrapeConcurrency,
+		Timeout:      cfg.ScrapeTimeout,
+		MaxBodyBytes: cfg.ScrapeMaxBodyBytes,
+	}, scrapeClient, log)
 	workloadResolver, err := workload.NewResolver(dynClient, workload.Config{
 		LabelKeys: []string{workloadsLabelKey},
 		CacheSize: workloadCacheSize,
@@ -133,35 +170,293 @@ func run(cfg *config.Config, log *logging.Logger) error {
 		log.WithField("error", err.Error()).Fatal("failed to create workload resolver")
 	}
 
-	mapper := exporter.NewMapper(cfg.NodeName, workloadResolver, log)
+	var sinks []exporter.Sink
+	if cfg.RemoteWrite.URL != "" {
+		remoteWriteSink, err := setupRemoteWriteSink(log, cfg)
+		if err != nil {
+			log.WithField("error", err.Error()).Fatal("failed to create remote-write sink")
+		}
+		go func() {
+			if err := remoteWriteSink.Start(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				log.WithField("error", err.Error()).Error("error in remote-write sink")
+			}
+		}()
+		defer func() {
+			// the shards stop with the context, the samples they didn't send yet are flushed by Close
+			cancel()
+			ctx, closeCancel := context.WithTimeout(context.Background(), cfg.RemoteWrite.Timeout)
+			defer closeCancel()
+			if err := remoteWriteSink.Close(ctx); err != nil {
+				log.WithField("error", err.Error()).Warn("failed to flush remote-write sink")
+			}
+		}()
+		sinks = append(sinks, remoteWriteSink)
+	}
+	if cfg.OTLP.Endpoint != "" {
+		otlpSink, err := otlp.NewSink(ctx, otlp.Config{
+			Endpoint:  cfg.OTLP.Endpoint,
+			Protocol:  cfg.OTLP.Protocol,
+			Headers:   cfg.OTLP.Headers,
+			CAFile:    cfg.OTLP.CAFile,
+			CertFile:  cfg.OTLP.CertFile,
+			KeyFile:   cfg.OTLP.KeyFile,
+			Timeout:   cfg.OTLP.Timeout,
+			ClusterID: cfg.ClusterID,
+		}, Version)
+		if err != nil {
+			log.WithField("error", err.Error()).Fatal("failed to create OTLP sink")
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.OTLP.Timeout)
+			defer cancel()
+			if err := otlpSink.Shutdown(ctx); err != nil {
+				log.WithField("error", err.Error()).Warn("failed to shut down OTLP sink")
+			}
+		}()
+		sinks = append(sinks, otlpSink)
+	}
+	if cfg.FileSink.Path != "" {
+		fileSink, err := rowsink.NewFileSink(rowsink.FileConfig{
+			Path:       cfg.FileSink.Path,
+			Format:     cfg.FileSink.Format,
+			MaxSize:    cfg.FileSink.MaxSize,
+			MaxAge:     cfg.FileSink.MaxAge,
+			MaxBackups: cfg.FileSink.MaxBackups,
+			Compress:   cfg.FileSink.Compress,
+		}, log)
+		if err != nil {
+			log.WithField("error", err.Error()).Fatal("failed to create file sink")
+		}
+		defer func() {
+			if err := fileSink.Close(); err != nil {
+				log.WithField("error", err.Error()).Warn("failed to close file sink")
+			}
+		}()
+		sinks = append(sinks, fileSink)
+	}
+	if len(cfg.Kafka.Brokers) > 0 {
+		kafkaSink, kafkaWriter, err := setupKafkaSink(cfg)
+		if err != nil {
+			log.WithField("error", err.Error()).Fatal("failed to create kafka sink")
+		}
+		defer kafkaWriter.Close()
+		sinks = append(sinks, kafkaSink)
+	}
+
+	if cfg.Webhook.URL != "" {
+		webhookSink, err := setupWebhookSink(log, cfg)
+		if err != nil {
+			log.WithField("error", err.Error()).Fatal("failed to create webhook sink")
+		}
+		sinks = append(sinks, webhookSink)
+	}
+
+	var discoverer exporter.Discoverer
+	if cfg.DCGMDiscovery.Service != "" {
+		namespace, name, _ := strings.Cut(cfg.DCGMDiscovery.Service, "/")
+		// replicas split the endpoints of the whole cluster between them
+		nodeName := cfg.NodeName
+		if cfg.HA.Mode != "" {
+			nodeName = ""
+		}
+		discoverer = discovery.NewEndpointSliceDiscoverer(discovery.EndpointSliceConfig{
+			Namespace: namespace,
+			Service:   name,
+			PortName:  cfg.DCGMDiscovery.ServicePortName,
+			Scheme:    cfg.DCGMScheme,
+			Path:      cfg.DCGMMetricsEndpoint,
+			NodeName:  nodeName,
+		}, dynClient)
+	}
+	nodeNameSources := make([]exporter.NodeNameSource, len(cfg.NodeNameSources))
+	for i, source := range cfg.NodeNameSources {
+		nodeNameSources[i] = exporter.NodeNameSource(source)
+	}
+	if cfg.DCGMDiscovery.StaticTargets != "" || len(cfg.DCGMDiscovery.TargetFiles) > 0 {
+		fileDiscoverer, err := setupDiscoverer(log, cfg, nodeNameSources)
+		if err != nil {
+			log.WithField("error", err.Error()).Fatal("failed to create target discovery")
+		}
+		go func() {
+			if err := fileDiscoverer.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				log.WithField("error", err.Error()).Error("error in target discovery")
+			}
+		}()
+		discoverer = fileDiscoverer
+	}
+
+	var kubeClient kubernetes.Interface
+	if cfg.HA.Mode != "" {
+		kubeClient, err = kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			log.WithField("error", err.Error()).Fatal("failed to create kubernetes client")
+		}
+	}
+
+	var shard exporter.Shard
+	if cfg.HA.Mode == config.HAModeSharding {
+		sharder := ha.NewSharder(ha.ShardingConfig{
+			Namespace:     cfg.HA.Namespace,
+			Group:         cfg.HA.LeaseName,
+			Identity:      cfg.HA.Identity,
+			LeaseDuration: cfg.HA.LeaseDuration,
+			RenewInterval: cfg.HA.RetryPeriod,
+		}, kubeClient, log)
+		go func() {
+			if err := sharder.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				log.WithField("error", err.Error()).Error("error in sharding")
+			}
+		}()
+		shard = sharder
+	}
+
+	// in leader-election mode the exporter is enabled once this replica is elected
+	enabled := cfg.HA.Mode != config.HAModeLeaderElection
+
+	var xidRecorder exporter.XIDRecorder
+	if cfg.XIDEvents {
+		hostname, _ := os.Hostname()
+		xidRecorder = events.NewRecorder(events.Config{Component: "gpu-metrics-exporter", Instance: hostname}, dynClient, log)
+	}
+
+	var observers []exporter.BatchObserver
+	if cfg.Health.Enabled {
+		healthCfg := health.Config{
+			XIDHold:                  cfg.Health.XIDHold,
+			MaxThermalViolationRatio: cfg.Health.MaxThermalViolationRatio,
+			MaxPowerViolationRatio:   cfg.Health.MaxPowerViolationRatio,
+			MaxGPUTemperature:        cfg.Health.MaxGPUTemperature,
+			MaxMemoryTemperature:     cfg.Health.MaxMemoryTemperature,
+			UnhealthyThreshold:       cfg.Health.UnhealthyThreshold,
+			HealthyThreshold:         cfg.Health.HealthyThreshold,
+			DryRun:                   cfg.Health.DryRun,
+		}
+		for _, severity := range cfg.Health.XIDSeverities {
+			healthCfg.XIDSeverities = append(healthCfg.XIDSeverities, exporter.XIDSeverity(severity))
+		}
+		if cfg.Health.Taint != "" {
+			healthCfg.Taint, err = health.ParseTaint(cfg.Health.Taint)
+			if err != nil {
+				log.WithField("error", err.Error()).Fatal("failed to parse HEALTH_TAINT")
+			}
+		}
+		observers = append(observers, health.NewController(healthCfg, dynClient, log, clock.RealClock{}))
+	}
+
+	var relabeler exporter.Relabeler
+	if cfg.RelabelConfigFile != "" {
+		r, err := relabel.LoadFile(cfg.RelabelConfigFile)
+		if err != nil {
+			log.WithField("error", err.Error()).Fatal("failed to load relabel configs")
+		}
+		relabeler = r
+	}
+
+	var idleDetector *exporter.IdleDetector
+	var idleAnnotator workload.Annotator
+	if cfg.Idle.Enabled {
+		idleDetector = exporter.NewIdleDetector(exporter.IdleConfig{
+			MaxUtilization:   cfg.Idle.MaxUtilization,
+			MaxSMActive:      cfg.Idle.MaxSMActive,
+			MinDuration:      cfg.Idle.MinDuration,
+			AnnotateInterval: cfg.Idle.AnnotateInterval,
+		})
+		mux.HandleFunc("/api/v1/idle", server.JSONHandler(func() any { return idleDetector.Report() }))
+		if cfg.Idle.Annotate {
+			idleAnnotator = workload.NewAnnotator(dynClient)
+		}
+	}
+
+	if cfg.Alerting.RulesFile != "" {
+		alertingEngine, err := setupAlerting(log, cfg, dynClient)
+		if err != nil {
+			log.WithField("error", err.Error()).Fatal("failed to create alerting")
+		}
+		sinks = append(sinks, alertingEngine)
+	}
+
+	var extraMetrics *regexp.Regexp
+	if cfg.ExtraMetrics != "" {
+		// anchored like the regular expressions of Prometheus
+		extraMetrics = regexp.MustCompile("^(?:" + cfg.ExtraMetrics + ")$")
+	}
+
+	mapper := exporter.NewMapper(exporter.MapperConfig{
+		NodeName:        cfg.NodeName,
+		NodeNameSources: nodeNameSources,
+		ExtraMetrics:    extraMetrics,
+	}, workloadResolver, log)
 	ex := exporter.NewExporter(exporter.Config{
-		ExportInterval:   cfg.ExportInterval,
-		Selector:         labelSelector.String(),
-		DCGMExporterPort: cfg.DCGMPort,
-		DCGMExporterPath: cfg.DCGMMetricsEndpoint,
-		DCGMExporterHost: cfg.DCGMHost,
-		Enabled:          true,
-		NodeName:         cfg.NodeName,
-	}, dynClient, log, scraper, mapper, client, metricClient)
+		ExportInterval:     cfg.ExportInterval,
+		Selector:           labelSelector.String(),
+		DCGMExporterScheme: cfg.DCGMScheme,
+		DCGMExporterPort:   cfg.DCGMPort,
+		DCGMExporterPath:   cfg.DCGMMetricsEndpoint,
+		DCGMExporterHost:   cfg.DCGMHost,
+		DCGMExporterSocket: cfg.DCGMSocket,
+		Discoverer:         discoverer,
+		Shard:              shard,
+		Enabled:            enabled,
+		NodeName:           cfg.NodeName,
+		Energy: exporter.EnergyConfig{
+			MaxGap:               cfg.Energy.MaxGap,
+			CarbonIntensity:      cfg.Energy.CarbonIntensity,
+			CarbonIntensityZones: cfg.Energy.CarbonIntensityZones,
+			ZoneLabel:            cfg.Energy.ZoneLabel,
+		},
+		ClockEvents:        exporter.ClockEventsConfig{MaxGap: cfg.ClockEventsMaxGap},
+		XIDRecorder:        xidRecorder,
+		Observers:          observers,
+		Idle:               idleDetector,
+		IdleAnnotator:      idleAnnotator,
+		Relabeler:          relabeler,
+		InvalidValuePolicy: exporter.InvalidValuePolicy(cfg.InvalidValuePolicy),
+		ExtraMetrics:       extraMetrics,
+	}, dynClient, log, scraper, mapper, client, metricClient, sinks...)
+
+	if cfg.HA.Mode == config.HAModeLeaderElection {
+		go func() {
+			err := ha.RunLeaderElection(ctx, kubeClient, ha.LeaderElectionConfig{
+				Namespace:     cfg.HA.Namespace,
+				LeaseName:     cfg.HA.LeaseName,
+				Identity:      cfg.HA.Identity,
+				LeaseDuration: cfg.HA.LeaseDuration,
+				RenewDeadline: cfg.HA.RenewDeadline,
+				RetryPeriod:   cfg.HA.RetryPeriod,
+			}, ex, log)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				log.WithField("error", err.Error()).Error("error in leader election")
+				cancel()
+			}
+		}()
+	}
 
+	exporterDone := make(chan struct{})
 	go func() {
+		defer close(exporterDone)
 		if err := ex.Start(ctx); err != nil && !errors.Is(err, context.Canceled) {
 			log.Errorf("exporter stopped with error %v", err)
 			cancel()
 		}
 	}()
+	// deferred after the sinks so that it runs before they are flushed and closed, which must not happen while the
+	// exporter is still writing them
+	defer func() {
+		cancel()
+		<-exporterDone
+	}()
 
 	return srv.ListenAndServe()
 }
 
-func newDynamicClient(cfg *config.Config) (dynamic.Interface, error) {
+func newRestConfig(cfg *config.Config) (*rest.Config, error) {
 	restConfig, err := clientcmd.BuildConfigFromFlags("", cfg.KubeConfigPath)
 	if err != nil {
 		return nil, err
 	}
 	restConfig.RateLimiter = flowcontrol.NewTokenBucketRateLimiter(float32(10), 25)
 
-	return dynamic.NewForConfig(restConfig)
+	return restConfig, nil
 }
 
 func selectorFromMap(labelMap map[string]string) (labels.Selector, error) {
@@ -195,3 +490,131 @@ func setupCastAIClient(log *logging.Logger, cfg *config.Config) castai.Client {
 
 	return castai.NewClient(clientConfig, log, restyClient, Version)
 }
+
+func setupRemoteWriteSink(log *logging.Logger, cfg *config.Config) (remotewrite.Sink, error) {
+	httpClient := &http.Client{
+		Timeout: cfg.RemoteWrite.Timeout,
+		Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			ForceAttemptHTTP2: true,
+		},
+	}
+
+	return remotewrite.NewSink(remotewrite.Config{
+		URL:               cfg.RemoteWrite.URL,
+		Headers:           cfg.RemoteWrite.Headers,
+		ExternalLabels:    cfg.RemoteWrite.ExternalLabels,
+		Shards:            cfg.RemoteWrite.Shards,
+		QueueCapacity:     cfg.RemoteWrite.QueueCapacity,
+		MaxSamplesPerSend: cfg.RemoteWrite.MaxSamplesPerSend,
+		BatchSendDeadline: cfg.RemoteWrite.BatchSendDeadline,
+	}, httpClient, log, Version)
+}
+
+func setupDiscoverer(log *logging.Logger, cfg *config.Config, nodeNameSources []exporter.NodeNameSource) (*discovery.Discoverer, error) {
+	var static []discovery.TargetGroup
+	if cfg.DCGMDiscovery.StaticTargets != "" {
+		var err error
+		static, err = discovery.ParseTargetGroups([]byte(cfg.DCGMDiscovery.StaticTargets))
+		if err != nil {
+			return nil, fmt.Errorf("parsing DCGM_STATIC_TARGETS: %w", err)
+		}
+	}
+
+	// replicas split the targets of the whole cluster between them
+	nodeName := cfg.NodeName
+	if cfg.HA.Mode != "" {
+		nodeName = ""
+	}
+
+	return discovery.NewDiscoverer(discovery.Config{
+		Scheme:          cfg.DCGMScheme,
+		Path:            cfg.DCGMMetricsEndpoint,
+		Static:          static,
+		Files:           cfg.DCGMDiscovery.TargetFiles,
+		RefreshInterval: cfg.DCGMDiscovery.TargetFilesRefreshInterval,
+		NodeName:        nodeName,
+		NodeNameSources: nodeNameSources,
+	}, log), nil
+}
+
+func setupKafkaSink(cfg *config.Config) (exporter.Sink, io.Closer, error) {
+	kafkaConfig := rowsink.KafkaConfig{
+		Brokers:      cfg.Kafka.Brokers,
+		Topic:        cfg.Kafka.Topic,
+		Key:          cfg.Kafka.Key,
+		Format:       cfg.Kafka.Format,
+		WriteTimeout: cfg.Kafka.WriteTimeout,
+	}
+
+	writer, err := rowsink.NewKafkaWriter(kafkaConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	sink, err := rowsink.NewKafkaSink(kafkaConfig, writer)
+	if err != nil {
+		_ = writer.Close()
+		return nil, nil, err
+	}
+
+	return sink, writer, nil
+}
+
+func setupAlerting(log *logging.Logger, cfg *config.Config, dynClient dynamic.Interface) (exporter.Sink, error) {
+	rules, err := alerting.LoadRules(cfg.Alerting.RulesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var notifiers []alerting.Notifier
+	for _, output := range cfg.Alerting.Outputs {
+		switch output {
+		case config.AlertingOutputLog:
+			notifiers = append(notifiers, alerting.NewLogNotifier(log))
+		case config.AlertingOutputEvent:
+			hostname, _ := os.Hostname()
+			notifiers = append(notifiers, events.NewRecorder(events.Config{Component: "gpu-metrics-exporter", Instance: hostname}, dynClient, log))
+		case config.AlertingOutputWebhook:
+			httpClient := &http.Client{
+				Timeout: cfg.Alerting.WebhookTimeout,
+				Transport: &http.Transport{
+					Proxy:             http.ProxyFromEnvironment,
+					ForceAttemptHTTP2: true,
+				},
+			}
+			notifier, err := webhook.NewAlertNotifier(webhook.Config{
+				URL:       cfg.Alerting.WebhookURL,
+				Headers:   cfg.Alerting.WebhookHeaders,
+				Secret:    cfg.Alerting.WebhookSecret,
+				ClusterID: cfg.ClusterID,
+			}, httpClient, log, Version)
+			if err != nil {
+				return nil, err
+			}
+			notifiers = append(notifiers, notifier)
+		}
+	}
+
+	log.Infof("evaluating %d alerting rules", len(rules))
+	// a few failed exports in a row don't resolve alerts
+	return alerting.NewEngine(rules, notifiers, clock.RealClock{}, 3*cfg.ExportInterval), nil
+}
+
+func setupWebhookSink(log *logging.Logger, cfg *config.Config) (exporter.Sink, error) {
+	httpClient := &http.Client{
+		Timeout: cfg.Webhook.Timeout,
+		Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			ForceAttemptHTTP2: true,
+		},
+	}
+
+	return webhook.NewSink(webhook.Config{
+		URL:             cfg.Webhook.URL,
+		Headers:         cfg.Webhook.Headers,
+		Secret:          cfg.Webhook.Secret,
+		TemplateFile:    cfg.Webhook.TemplateFile,
+		MaxRequestBytes: cfg.Webhook.MaxRequestBytes,
+		ClusterID:       cfg.ClusterID,
+	}, httpClient, log, Version)
+}
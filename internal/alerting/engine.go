@@ -0,0 +1,372 @@
+package alerting
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/utils/clock"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+)
+
+const sinkName = "alerting"
+
+// State is the state of an alert which notifiers are told about.
+type State string
+
+const (
+	StateFiring   = State("firing")
+	StateResolved = State("resolved")
+)
+
+// Alert is a rule which fired, or resolved, for a group.
+type Alert struct {
+	Rule     string  `json:"rule"`
+	Severity string  `json:"severity"`
+	Summary  string  `json:"summary"`
+	State    State   `json:"state"`
+	GroupBy  GroupBy `json:"group_by"`
+	// Labels identify the group, e.g. node_name and device_uuid of a GPU.
+	Labels map[string]string `json:"labels"`
+	// Value is the last value of the group compared to the threshold.
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+	// ActiveAt is when the condition started to hold, the alert fires once it held for the For of its rule.
+	ActiveAt   time.Time         `json:"active_at"`
+	FiredAt    time.Time         `json:"fired_at"`
+	ResolvedAt time.Time         `json:"resolved_at,omitempty"`
+	Nodes      []string          `json:"nodes,omitempty"`
+	Pods       []exporter.PodRef `json:"pods,omitempty"`
+}
+
+// Notifier is told when alerts fire and resolve.
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, alert Alert) error
+}
+
+type alertKey struct {
+	rule  string
+	group string
+}
+
+type alertState struct {
+	alert  Alert
+	firing bool
+	// missingSince is when the group stopped having a value, zero while it has one.
+	missingSince time.Time
+}
+
+// Engine evaluates the rules over the GPU metric rows of every export. It's an exporter.EmptyBatchSink, so it sees
+// the same rows as the other destinations, and none when an export collected no rows. A condition has to hold in consecutive exports for For of its rule before the
+// alert fires, and the alert resolves as soon as the condition no longer holds. Groups which are no longer reported,
+// or have no value, e.g. because a scrape failed, keep their alerts for the longer of For and the missing grace
+// period before they resolve.
+type Engine struct {
+	rules        []Rule
+	notifiers    []Notifier
+	clock        clock.PassiveClock
+	missingGrace time.Duration
+
+	mu     sync.Mutex
+	alerts map[alertKey]*alertState
+}
+
+func NewEngine(rules []Rule, notifiers []Notifier, clk clock.PassiveClock, missingGrace time.Duration) *Engine {
+	return &Engine{
+		rules:        rules,
+		notifiers:    notifiers,
+		clock:        clk,
+		missingGrace: missingGrace,
+		alerts:       make(map[alertKey]*alertState),
+	}
+}
+
+func (e *Engine) Name() string {
+	return sinkName
+}
+
+// WritesEmptyBatches makes the exporter write the engine when an export collected no rows, so that the alerts of
+// the groups which went missing resolve after the grace period.
+func (e *Engine) WritesEmptyBatches() {}
+
+func (e *Engine) Write(ctx context.Context, metrics []exporter.GPUMetric) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.clock.Now()
+
+	var errs []error
+	for _, rule := range e.rules {
+		groups := groupRows(rule, metrics)
+		keys := make([]string, 0, len(groups))
+		for key := range groups {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			g := groups[key]
+			value := g.aggregate(rule.Aggregation)
+			akey := alertKey{rule: rule.Name, group: key}
+			state, found := e.alerts[akey]
+
+			// groups without a value, e.g. when the metric isn't exposed, are neither holding nor not holding
+			if math.IsNaN(value) {
+				if found {
+					errs = append(errs, e.missing(ctx, rule, akey, state, now)...)
+				}
+				continue
+			}
+			if !ops[rule.Op](value, rule.Threshold) {
+				if found {
+					errs = append(errs, e.resolve(ctx, akey, state, now)...)
+				}
+				continue
+			}
+
+			if !found {
+				state = &alertState{alert: Alert{
+					Rule:      rule.Name,
+					Severity:  rule.Severity,
+					Summary:   rule.Summary,
+					GroupBy:   rule.GroupBy,
+					Threshold: rule.Threshold,
+					ActiveAt:  now,
+				}}
+				e.alerts[akey] = state
+			}
+			state.missingSince = time.Time{}
+			state.alert.Labels = g.labels
+			state.alert.Value = value
+			state.alert.Nodes = g.nodes()
+			state.alert.Pods = g.pods()
+
+			if !state.firing && now.Sub(state.alert.ActiveAt) >= rule.For.Duration {
+				state.firing = true
+				state.alert.State = StateFiring
+				state.alert.FiredAt = now
+				errs = append(errs, e.notify(ctx, state.alert)...)
+			}
+		}
+
+		for akey, state := range e.alerts {
+			if _, found := groups[akey.group]; !found && akey.rule == rule.Name {
+				errs = append(errs, e.missing(ctx, rule, akey, state, now)...)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Firing returns the alerts which are firing, ordered by rule and group.
+func (e *Engine) Firing() []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	keys := make([]alertKey, 0, len(e.alerts))
+	for key, state := range e.alerts {
+		if state.firing {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		if keys[a].rule != keys[b].rule {
+			return keys[a].rule < keys[b].rule
+		}
+		return keys[a].group < keys[b].group
+	})
+
+	alerts := make([]Alert, 0, len(keys))
+	for _, key := range keys {
+		alerts = append(alerts, e.alerts[key].alert)
+	}
+	return alerts
+}
+
+// missing resolves an alert whose group has been missing for the longer of For of its rule and the missing grace
+// period, and keeps it otherwise.
+func (e *Engine) missing(ctx context.Context, rule Rule, key alertKey, state *alertState, now time.Time) []error {
+	if state.missingSince.IsZero() {
+		state.missingSince = now
+	}
+	if now.Sub(state.missingSince) < max(rule.For.Duration, e.missingGrace) {
+		return nil
+	}
+	return e.resolve(ctx, key, state, now)
+}
+
+// resolve drops the state of an alert, notifying of its resolution if it fired.
+func (e *Engine) resolve(ctx context.Context, key alertKey, state *alertState, now time.Time) []error {
+	delete(e.alerts, key)
+	if !state.firing {
+		return nil
+	}
+	state.alert.State = StateResolved
+	state.alert.ResolvedAt = now
+	return e.notify(ctx, state.alert)
+}
+
+func (e *Engine) notify(ctx context.Context, alert Alert) []error {
+	var errs []error
+	for _, notifier := range e.notifiers {
+		if err := notifier.Notify(ctx, alert); err != nil {
+			errs = append(errs, fmt.Errorf("notifying %s of alert %s: %w", notifier.Name(), alert.Rule, err))
+		}
+	}
+	return errs
+}
+
+type group struct {
+	labels  map[string]string
+	values  []float64
+	nodeSet map[string]struct{}
+	podSet  map[exporter.PodRef]struct{}
+}
+
+// groupRows splits the rows into the groups the rule is evaluated for, keyed by their labels.
+func groupRows(rule Rule, metrics []exporter.GPUMetric) map[string]*group {
+	value := field(rule.Metric)
+	groups := make(map[string]*group)
+	for i := range metrics {
+		m := &metrics[i]
+		labels := groupLabels(rule.GroupBy, m)
+		if labels == nil {
+			continue
+		}
+		key := groupKey(labels)
+		g, found := groups[key]
+		if !found {
+			g = &group{
+				labels:  labels,
+				nodeSet: make(map[string]struct{}),
+				podSet:  make(map[exporter.PodRef]struct{}),
+			}
+			groups[key] = g
+		}
+
+		v, ok := value(m)
+		if !ok || math.IsNaN(v) {
+			continue
+		}
+		g.values = append(g.values, v)
+		if m.NodeName != "" {
+			g.nodeSet[m.NodeName] = struct{}{}
+		}
+		if pod := (exporter.PodRef{Namespace: m.Namespace, Name: m.Pod}); pod.Name != "" {
+			g.podSet[pod] = struct{}{}
+		}
+	}
+	return groups
+}
+
+// groupLabels returns the labels identifying the group of a row, nil if the row doesn't belong to a group.
+func groupLabels(groupBy GroupBy, m *exporter.GPUMetric) map[string]string {
+	var labels map[string]string
+	switch groupBy {
+	case GroupByGPU:
+		if m.DeviceUUID == "" {
+			return nil
+		}
+		labels = map[string]string{
+			"node_name":   m.NodeName,
+			"device_uuid": m.DeviceUUID,
+			"device_id":   m.DeviceID,
+			"model_name":  m.ModelName,
+		}
+		if m.MIGProfile != "" || m.MIGInstanceID != "" {
+			labels["mig_profile"] = m.MIGProfile
+			labels["mig_instance_id"] = m.MIGInstanceID
+		}
+	case GroupByPod:
+		if m.Pod == "" {
+			return nil
+		}
+		labels = map[string]string{
+			"namespace": m.Namespace,
+			"pod":       m.Pod,
+		}
+	case GroupByWorkload:
+		if m.WorkloadName == "" {
+			return nil
+		}
+		labels = map[string]string{
+			"namespace":     m.Namespace,
+			"workload_kind": m.WorkloadKind,
+			"workload_name": m.WorkloadName,
+		}
+	}
+	return labels
+}
+
+// groupKey joins the sorted labels of a group.
+func groupKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(labels[name])
+		b.WriteByte(',')
+	}
+	return b.String()
+}
+
+func (g *group) aggregate(aggregation Aggregation) float64 {
+	if len(g.values) == 0 {
+		return math.NaN()
+	}
+	result := g.values[0]
+	for _, v := range g.values[1:] {
+		switch aggregation {
+		case AggregationMin:
+			result = math.Min(result, v)
+		case AggregationMax:
+			result = math.Max(result, v)
+		default:
+			result += v
+		}
+	}
+	if aggregation == AggregationAvg {
+		result /= float64(len(g.values))
+	}
+	return result
+}
+
+func (g *group) nodes() []string {
+	nodes := make([]string, 0, len(g.nodeSet))
+	for node := range g.nodeSet {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func (g *group) pods() []exporter.PodRef {
+	if len(g.podSet) == 0 {
+		return nil
+	}
+	pods := make([]exporter.PodRef, 0, len(g.podSet))
+	for pod := range g.podSet {
+		pods = append(pods, pod)
+	}
+	sort.Slice(pods, func(a, b int) bool {
+		if pods[a].Namespace != pods[b].Namespace {
+			return pods[a].Namespace < pods[b].Namespace
+		}
+		return pods[a].Name < pods[b].Name
+	})
+	return pods
+}
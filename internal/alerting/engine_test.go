@@ -0,0 +1,259 @@
+package alerting_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/castai/gpu-metrics-exporter/internal/alerting"
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+)
+
+type recordingNotifier struct {
+	alerts []alerting.Alert
+	err    error
+}
+
+func (n *recordingNotifier) Name() string {
+	return "recording"
+}
+
+func (n *recordingNotifier) Notify(_ context.Context, alert alerting.Alert) error {
+	n.alerts = append(n.alerts, alert)
+	return n.err
+}
+
+func gpuRow(uuid, pod string, temperature float64, idle bool) exporter.GPUMetric {
+	return exporter.GPUMetric{
+		NodeName:     "node-1",
+		DeviceUUID:   uuid,
+		DeviceID:     "0",
+		ModelName:    "A100",
+		Namespace:    "ml",
+		Pod:          pod,
+		WorkloadKind: "Job",
+		WorkloadName: "training",
+		Temperature:  &temperature,
+		Idle:         &idle,
+	}
+}
+
+func TestEngine(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("fires once the condition held for the duration and resolves when it no longer holds", func(t *testing.T) {
+		r := require.New(t)
+		clock := clocktesting.NewFakePassiveClock(start)
+		notifier := &recordingNotifier{}
+		engine := alerting.NewEngine([]alerting.Rule{{
+			Name:        "GPUHot",
+			Metric:      string(exporter.MetricGPUTemperature),
+			Op:          ">",
+			Threshold:   85,
+			For:         metav1Duration(5 * time.Minute),
+			GroupBy:     alerting.GroupByGPU,
+			Aggregation: alerting.AggregationAvg,
+			Severity:    "critical",
+			Summary:     "GPU is hot",
+		}}, []alerting.Notifier{notifier}, clock, time.Minute)
+		r.Equal("alerting", engine.Name())
+
+		r.NoError(engine.Write(ctx, []exporter.GPUMetric{gpuRow("GPU-1", "", 90, false), gpuRow("GPU-2", "", 60, false)}))
+		clock.SetTime(start.Add(4 * time.Minute))
+		r.NoError(engine.Write(ctx, []exporter.GPUMetric{gpuRow("GPU-1", "", 91, false), gpuRow("GPU-2", "", 60, false)}))
+		r.Empty(notifier.alerts)
+		r.Empty(engine.Firing())
+
+		clock.SetTime(start.Add(5 * time.Minute))
+		r.NoError(engine.Write(ctx, []exporter.GPUMetric{gpuRow("GPU-1", "", 92, false), gpuRow("GPU-2", "", 60, false)}))
+		r.Len(notifier.alerts, 1)
+		r.Equal(alerting.Alert{
+			Rule:      "GPUHot",
+			Severity:  "critical",
+			Summary:   "GPU is hot",
+			State:     alerting.StateFiring,
+			GroupBy:   alerting.GroupByGPU,
+			Labels:    map[string]string{"node_name": "node-1", "device_uuid": "GPU-1", "device_id": "0", "model_name": "A100"},
+			Value:     92,
+			Threshold: 85,
+			ActiveAt:  start,
+			FiredAt:   start.Add(5 * time.Minute),
+			Nodes:     []string{"node-1"},
+		}, notifier.alerts[0])
+		r.Len(engine.Firing(), 1)
+
+		// firing alerts aren't notified again
+		clock.SetTime(start.Add(6 * time.Minute))
+		r.NoError(engine.Write(ctx, []exporter.GPUMetric{gpuRow("GPU-1", "", 92, false)}))
+		r.Len(notifier.alerts, 1)
+
+		clock.SetTime(start.Add(7 * time.Minute))
+		r.NoError(engine.Write(ctx, []exporter.GPUMetric{gpuRow("GPU-1", "", 80, false)}))
+		r.Len(notifier.alerts, 2)
+		r.Equal(alerting.StateResolved, notifier.alerts[1].State)
+		r.Equal(start.Add(7*time.Minute), notifier.alerts[1].ResolvedAt)
+		r.Empty(engine.Firing())
+	})
+
+	t.Run("restarts the duration when the condition stops holding before firing", func(t *testing.T) {
+		r := require.New(t)
+		clock := clocktesting.NewFakePassiveClock(start)
+		notifier := &recordingNotifier{}
+		engine := alerting.NewEngine([]alerting.Rule{{
+			Name: "GPUHot", Metric: string(exporter.MetricGPUTemperature), Op: ">", Threshold: 85,
+			For: metav1Duration(5 * time.Minute), GroupBy: alerting.GroupByGPU, Aggregation: alerting.AggregationAvg,
+		}}, []alerting.Notifier{notifier}, clock, time.Minute)
+
+		r.NoError(engine.Write(ctx, []exporter.GPUMetric{gpuRow("GPU-1", "", 90, false)}))
+		clock.SetTime(start.Add(3 * time.Minute))
+		r.NoError(engine.Write(ctx, []exporter.GPUMetric{gpuRow("GPU-1", "", 70, false)}))
+		clock.SetTime(start.Add(4 * time.Minute))
+		r.NoError(engine.Write(ctx, []exporter.GPUMetric{gpuRow("GPU-1", "", 90, false)}))
+		clock.SetTime(start.Add(8 * time.Minute))
+		r.NoError(engine.Write(ctx, []exporter.GPUMetric{gpuRow("GPU-1", "", 90, false)}))
+		r.Empty(notifier.alerts)
+
+		clock.SetTime(start.Add(9 * time.Minute))
+		r.NoError(engine.Write(ctx, []exporter.GPUMetric{gpuRow("GPU-1", "", 90, false)}))
+		r.Len(notifier.alerts, 1)
+		r.Equal(start.Add(4*time.Minute), notifier.alerts[0].ActiveAt)
+	})
+
+	t.Run("groups by pod and workload and resolves groups which are no longer reported", func(t *testing.T) {
+		r := require.New(t)
+		clock := clocktesting.NewFakePassiveClock(start)
+		notifier := &recordingNotifier{}
+		engine := alerting.NewEngine([]alerting.Rule{
+			{
+				Name: "PodIdle", Metric: string(exporter.MetricIdle), Op: "==", Threshold: 1,
+				For: metav1Duration(30 * time.Minute), GroupBy: alerting.GroupByPod, Aggregation: alerting.AggregationMin,
+			},
+			{
+				Name: "WorkloadHot", Metric: string(exporter.MetricGPUTemperature), Op: ">", Threshold: 85,
+				GroupBy: alerting.GroupByWorkload, Aggregation: alerting.AggregationMax,
+			},
+		}, []alerting.Notifier{notifier}, clock, time.Minute)
+
+		rows := []exporter.GPUMetric{
+			gpuRow("GPU-1", "trainer-0", 90, true),
+			gpuRow("GPU-2", "trainer-0", 60, true),
+			gpuRow("GPU-3", "trainer-1", 60, false),
+			// GPUs which aren't assigned to a pod aren't part of pod or workload groups
+			gpuRow("GPU-4", "", 99, true),
+		}
+		rows[3].WorkloadName = ""
+		r.NoError(engine.Write(ctx, rows))
+		r.Len(notifier.alerts, 1)
+		r.Equal("WorkloadHot", notifier.alerts[0].Rule)
+		r.Equal(map[string]string{"namespace": "ml", "workload_kind": "Job", "workload_name": "training"}, notifier.alerts[0].Labels)
+		r.Equal(90.0, notifier.alerts[0].Value)
+		r.Equal([]exporter.PodRef{{Namespace: "ml", Name: "trainer-0"}, {Namespace: "ml", Name: "trainer-1"}}, notifier.alerts[0].Pods)
+
+		clock.SetTime(start.Add(30 * time.Minute))
+		r.NoError(engine.Write(ctx, rows))
+		r.Len(notifier.alerts, 2)
+		r.Equal("PodIdle", notifier.alerts[1].Rule)
+		r.Equal(map[string]string{"namespace": "ml", "pod": "trainer-0"}, notifier.alerts[1].Labels)
+
+		// missing groups resolve after the longer of the rule's duration and the grace period
+		clock.SetTime(start.Add(31 * time.Minute))
+		r.NoError(engine.Write(ctx, nil))
+		r.Len(notifier.alerts, 2)
+
+		clock.SetTime(start.Add(32 * time.Minute))
+		r.NoError(engine.Write(ctx, nil))
+		r.Len(notifier.alerts, 3)
+		r.Equal("WorkloadHot", notifier.alerts[2].Rule)
+		r.Equal(alerting.StateResolved, notifier.alerts[2].State)
+
+		clock.SetTime(start.Add(60 * time.Minute))
+		r.NoError(engine.Write(ctx, nil))
+		r.Len(notifier.alerts, 3)
+
+		clock.SetTime(start.Add(61 * time.Minute))
+		r.NoError(engine.Write(ctx, nil))
+		r.Len(notifier.alerts, 4)
+		r.Equal("PodIdle", notifier.alerts[3].Rule)
+		r.Equal(alerting.StateResolved, notifier.alerts[3].State)
+		r.Equal(start.Add(61*time.Minute), notifier.alerts[3].ResolvedAt)
+	})
+
+	t.Run("keeps alerts while their group has no value for the grace period", func(t *testing.T) {
+		r := require.New(t)
+		clock := clocktesting.NewFakePassiveClock(start)
+		notifier := &recordingNotifier{}
+		engine := alerting.NewEngine([]alerting.Rule{{
+			Name: "GPUHot", Metric: string(exporter.MetricGPUTemperature), Op: ">", Threshold: 85,
+			GroupBy: alerting.GroupByGPU, Aggregation: alerting.AggregationAvg,
+		}}, []alerting.Notifier{notifier}, clock, 2*time.Minute)
+		noTemperature := gpuRow("GPU-1", "", 0, false)
+		noTemperature.Temperature = nil
+
+		r.NoError(engine.Write(ctx, []exporter.GPUMetric{gpuRow("GPU-1", "", 90, false)}))
+		r.Len(notifier.alerts, 1)
+
+		// a failed scrape neither resolves the alert nor notifies it again once the group is back
+		clock.SetTime(start.Add(time.Minute))
+		r.NoError(engine.Write(ctx, []exporter.GPUMetric{noTemperature}))
+		clock.SetTime(start.Add(2 * time.Minute))
+		r.NoError(engine.Write(ctx, nil))
+		clock.SetTime(start.Add(3 * time.Minute))
+		r.NoError(engine.Write(ctx, []exporter.GPUMetric{gpuRow("GPU-1", "", 91, false)}))
+		r.Len(notifier.alerts, 1)
+		r.Len(engine.Firing(), 1)
+
+		// the grace period restarts once the group has a value again
+		clock.SetTime(start.Add(4 * time.Minute))
+		r.NoError(engine.Write(ctx, []exporter.GPUMetric{noTemperature}))
+		clock.SetTime(start.Add(5 * time.Minute))
+		r.NoError(engine.Write(ctx, []exporter.GPUMetric{noTemperature}))
+		r.Len(notifier.alerts, 1)
+
+		clock.SetTime(start.Add(6 * time.Minute))
+		r.NoError(engine.Write(ctx, []exporter.GPUMetric{noTemperature}))
+		r.Len(notifier.alerts, 2)
+		r.Equal(alerting.StateResolved, notifier.alerts[1].State)
+		r.Empty(engine.Firing())
+	})
+
+	t.Run("resolves alerts once exports collected no rows for the grace period", func(t *testing.T) {
+		r := require.New(t)
+		clock := clocktesting.NewFakePassiveClock(start)
+		notifier := &recordingNotifier{}
+		// the exporter writes the engine even when every scrape failed
+		var engine exporter.EmptyBatchSink = alerting.NewEngine([]alerting.Rule{{
+			Name: "GPUHot", Metric: string(exporter.MetricGPUTemperature), Op: ">", Threshold: 85,
+			GroupBy: alerting.GroupByGPU, Aggregation: alerting.AggregationAvg,
+		}}, []alerting.Notifier{notifier}, clock, 2*time.Minute)
+
+		r.NoError(engine.Write(ctx, []exporter.GPUMetric{gpuRow("GPU-1", "", 90, false)}))
+		clock.SetTime(start.Add(time.Minute))
+		r.NoError(engine.Write(ctx, nil))
+		r.Len(notifier.alerts, 1)
+
+		clock.SetTime(start.Add(3 * time.Minute))
+		r.NoError(engine.Write(ctx, nil))
+		r.Len(notifier.alerts, 2)
+		r.Equal(alerting.StateResolved, notifier.alerts[1].State)
+	})
+
+	t.Run("returns notifier errors", func(t *testing.T) {
+		r := require.New(t)
+		clock := clocktesting.NewFakePassiveClock(start)
+		failing := &recordingNotifier{err: errors.New("unavailable")}
+		working := &recordingNotifier{}
+		engine := alerting.NewEngine([]alerting.Rule{{
+			Name: "GPUHot", Metric: string(exporter.MetricGPUTemperature), Op: ">", Threshold: 85,
+			GroupBy: alerting.GroupByGPU, Aggregation: alerting.AggregationAvg,
+		}}, []alerting.Notifier{failing, working}, clock, time.Minute)
+
+		err := engine.Write(ctx, []exporter.GPUMetric{gpuRow("GPU-1", "", 90, false)})
+		r.ErrorContains(err, "notifying recording of alert GPUHot: unavailable")
+		r.Len(working.alerts, 1)
+	})
+}
@@ -0,0 +1,55 @@
+package alerting
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/castai/logging"
+)
+
+// LogNotifier logs firing alerts as warnings and resolved ones as info.
+type LogNotifier struct {
+	log *logging.Logger
+}
+
+func NewLogNotifier(log *logging.Logger) *LogNotifier {
+	return &LogNotifier{log: log}
+}
+
+func (n *LogNotifier) Name() string {
+	return "log"
+}
+
+func (n *LogNotifier) Notify(_ context.Context, alert Alert) error {
+	log := n.log.With(
+		"rule", alert.Rule,
+		"severity", alert.Severity,
+		"group", formatLabels(alert.Labels),
+		"value", alert.Value,
+		"threshold", alert.Threshold,
+	)
+	if alert.State == StateResolved {
+		log.Infof("alert %s resolved", alert.Rule)
+		return nil
+	}
+	log.Warnf("alert %s firing: %s", alert.Rule, alert.Summary)
+	return nil
+}
+
+// formatLabels formats the labels of a group in their key order, e.g. namespace=ns,pod=p.
+func formatLabels(labels map[string]string) string {
+	return strings.TrimSuffix(groupKey(labels), ",")
+}
+
+// Message describes an alert in a sentence, e.g. for Kubernetes Events.
+func (a Alert) Message() string {
+	summary := a.Summary
+	if summary == "" {
+		summary = a.Rule
+	}
+	if a.State == StateResolved {
+		return fmt.Sprintf("Resolved: %s (%s)", summary, formatLabels(a.Labels))
+	}
+	return fmt.Sprintf("%s (%s), value %g", summary, formatLabels(a.Labels), a.Value)
+}
@@ -0,0 +1,142 @@
+package alerting
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+)
+
+// GroupBy is what a rule is evaluated for.
+type GroupBy string
+
+const (
+	// GroupByGPU evaluates a rule per GPU, or MIG instance.
+	GroupByGPU = GroupBy("gpu")
+	// GroupByPod evaluates a rule per pod, GPUs which aren't assigned to a pod are skipped.
+	GroupByPod = GroupBy("pod")
+	// GroupByWorkload evaluates a rule per workload, GPUs whose pod has no known workload are skipped.
+	GroupByWorkload = GroupBy("workload")
+)
+
+// Aggregation combines the values of the rows of a group, e.g. of the GPUs of a pod, into the value compared to
+// the threshold.
+type Aggregation string
+
+const (
+	AggregationAvg = Aggregation("avg")
+	AggregationMin = Aggregation("min")
+	AggregationMax = Aggregation("max")
+)
+
+// Rule fires an alert for every group whose value has been compared true to the threshold for at least For.
+type Rule struct {
+	Name string `json:"name"`
+	// Metric is one of the names of exporter.GPUMetricFields, e.g. DCGM_FI_DEV_GPU_TEMP or gpu_idle.
+	Metric      string          `json:"metric"`
+	Op          string          `json:"op"`
+	Threshold   float64         `json:"threshold"`
+	For         metav1.Duration `json:"for"`
+	GroupBy     GroupBy         `json:"groupBy"`
+	Aggregation Aggregation     `json:"aggregation"`
+	Severity    string          `json:"severity"`
+	Summary     string          `json:"summary"`
+}
+
+type ruleFile struct {
+	Rules []Rule `json:"rules"`
+}
+
+var ops = map[string]func(value, threshold float64) bool{
+	">":  func(value, threshold float64) bool { return value > threshold },
+	">=": func(value, threshold float64) bool { return value >= threshold },
+	"<":  func(value, threshold float64) bool { return value < threshold },
+	"<=": func(value, threshold float64) bool { return value <= threshold },
+	"==": func(value, threshold float64) bool { return value == threshold },
+	"!=": func(value, threshold float64) bool { return value != threshold },
+}
+
+// LoadRules reads the rules of a YAML, or JSON, file in the format
+//
+//	rules:
+//	  - name: GPUHot
+//	    metric: DCGM_FI_DEV_GPU_TEMP
+//	    op: ">"
+//	    threshold: 85
+//	    for: 5m
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading alerting rules: %w", err)
+	}
+	return ParseRules(data)
+}
+
+// ParseRules parses the rules and fills in their defaults, grouping by GPU, averaging and warning severity.
+func ParseRules(data []byte) ([]Rule, error) {
+	var file ruleFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing alerting rules: %w", err)
+	}
+
+	names := make(map[string]struct{}, len(file.Rules))
+	for i := range file.Rules {
+		rule := &file.Rules[i]
+		if rule.GroupBy == "" {
+			rule.GroupBy = GroupByGPU
+		}
+		if rule.Aggregation == "" {
+			rule.Aggregation = AggregationAvg
+		}
+		if rule.Severity == "" {
+			rule.Severity = "warning"
+		}
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("alerting rule %d: %w", i, err)
+		}
+		if _, found := names[rule.Name]; found {
+			return nil, fmt.Errorf("alerting rule %q is defined twice", rule.Name)
+		}
+		names[rule.Name] = struct{}{}
+	}
+	return file.Rules, nil
+}
+
+func (r *Rule) validate() error {
+	if r.Name == "" {
+		return errors.New("name is required")
+	}
+	if field(r.Metric) == nil {
+		return fmt.Errorf("unknown metric %q", r.Metric)
+	}
+	if ops[r.Op] == nil {
+		return fmt.Errorf("unsupported op %q, expected one of >, >=, <, <=, ==, !=", r.Op)
+	}
+	if r.For.Duration < 0 {
+		return errors.New("for can't be negative")
+	}
+	switch r.GroupBy {
+	case GroupByGPU, GroupByPod, GroupByWorkload:
+	default:
+		return fmt.Errorf("unsupported groupBy %q, expected %q, %q or %q", r.GroupBy, GroupByGPU, GroupByPod, GroupByWorkload)
+	}
+	switch r.Aggregation {
+	case AggregationAvg, AggregationMin, AggregationMax:
+	default:
+		return fmt.Errorf("unsupported aggregation %q, expected %q, %q or %q", r.Aggregation, AggregationAvg, AggregationMin, AggregationMax)
+	}
+	return nil
+}
+
+func field(metric string) func(m *exporter.GPUMetric) (float64, bool) {
+	for _, f := range exporter.GPUMetricFields {
+		if string(f.Name) == metric {
+			return f.Value
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package alerting_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gpu-metrics-exporter/internal/alerting"
+)
+
+func metav1Duration(d time.Duration) metav1.Duration {
+	return metav1.Duration{Duration: d}
+}
+
+func TestParseRules(t *testing.T) {
+	t.Run("parses rules and fills in defaults", func(t *testing.T) {
+		r := require.New(t)
+		rules, err := alerting.ParseRules([]byte(`
+rules:
+  - name: GPUIdleWhileAllocated
+    metric: gpu_idle
+    op: "=="
+    threshold: 1
+    for: 30m
+    groupBy: pod
+    aggregation: min
+    summary: GPU is allocated but idle
+  - name: GPUHot
+    metric: DCGM_FI_DEV_GPU_TEMP
+    op: ">"
+    threshold: 85
+    severity: critical
+`))
+		r.NoError(err)
+		r.Equal([]alerting.Rule{
+			{
+				Name:        "GPUIdleWhileAllocated",
+				Metric:      "gpu_idle",
+				Op:          "==",
+				Threshold:   1,
+				For:         metav1Duration(30 * time.Minute),
+				GroupBy:     alerting.GroupByPod,
+				Aggregation: alerting.AggregationMin,
+				Severity:    "warning",
+				Summary:     "GPU is allocated but idle",
+			},
+			{
+				Name:        "GPUHot",
+				Metric:      "DCGM_FI_DEV_GPU_TEMP",
+				Op:          ">",
+				Threshold:   85,
+				GroupBy:     alerting.GroupByGPU,
+				Aggregation: alerting.AggregationAvg,
+				Severity:    "critical",
+			},
+		}, rules)
+	})
+
+	for name, tt := range map[string]struct {
+		rules string
+		err   string
+	}{
+		"unknown metric":  {`rules: [{name: a, metric: nope, op: ">"}]`, `unknown metric "nope"`},
+		"unsupported op":  {`rules: [{name: a, metric: gpu_idle, op: "=>"}]`, `unsupported op "=>"`},
+		"unknown group":   {`rules: [{name: a, metric: gpu_idle, op: ">", groupBy: node}]`, `unsupported groupBy "node"`},
+		"missing name":    {`rules: [{metric: gpu_idle, op: ">"}]`, "name is required"},
+		"duplicate name":  {`rules: [{name: a, metric: gpu_idle, op: ">"}, {name: a, metric: gpu_idle, op: "<"}]`, `"a" is defined twice`},
+		"unknown field":   {`rules: [{name: a, metric: gpu_idle, op: ">", duration: 5m}]`, "unknown field"},
+		"negative for":    {`rules: [{name: a, metric: gpu_idle, op: ">", for: -1m}]`, "for can't be negative"},
+		"bad aggregation": {`rules: [{name: a, metric: gpu_idle, op: ">", aggregation: sum}]`, `unsupported aggregation "sum"`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := alerting.ParseRules([]byte(tt.rules))
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+}
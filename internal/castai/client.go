@@ -6,11 +6,9 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"time"
 
 	"github.com/go-resty/resty/v2"
 	"google.golang.org/protobuf/proto"
-	"k8s.io/apimachinery/pkg/util/wait"
 
 	"github.com/castai/gpu-metrics-exporter/pb"
 	"github.com/castai/logging"
@@ -18,17 +16,9 @@ import (
 
 const (
 	tokenHeader = "X-API-Key" // #nosec G101
-	retryCount  = 5
 )
 
 var (
-	backoff = wait.Backoff{
-		Steps:    retryCount,
-		Duration: 50 * time.Millisecond,
-		Factor:   8,
-		Jitter:   0.15,
-	}
-
 	contentTypeHeader = http.CanonicalHeaderKey("Content-Type")
 	contentType       = "application/protobuf"
 
@@ -77,27 +67,16 @@ func (c client) UploadBatch(ctx context.Context, batch *pb.MetricsBatch) error {
 		return err
 	}
 
-	return wait.ExponentialBackoffWithContext(ctx, backoff, func(ctx context.Context) (done bool, err error) {
+	return Retry(ctx, c.log, func(ctx context.Context) (*http.Response, error) {
 		resp, err := c.restyClient.R().
 			SetContext(ctx).
 			SetBody(buffer).
 			Post(fmt.Sprintf("/v1/kubernetes/clusters/%s/gpu-metrics", c.cfg.ClusterID))
-
 		if err != nil {
-			c.log.WithField("error", err.Error()).Error("error making http request")
-			return false, nil
+			return nil, err
 		}
 
-		statusCode := resp.StatusCode()
-		switch {
-		case statusCode >= 200 && statusCode < 300:
-			return true, nil
-		case statusCode >= 400 && statusCode < 500:
-			return true, fmt.Errorf("status code: %d, status: %s", statusCode, resp.Status())
-		default:
-			c.log.Errorf("server error or unexpected status code: %d, status: %s", statusCode, resp.Status())
-			return false, nil
-		}
+		return resp.RawResponse, nil
 	})
 }
 
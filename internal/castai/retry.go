@@ -0,0 +1,88 @@
+package castai
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/castai/logging"
+)
+
+const retryCount = 5
+
+var (
+	backoff = wait.Backoff{
+		Steps:    retryCount,
+		Duration: 50 * time.Millisecond,
+		Factor:   8,
+		Jitter:   0.15,
+	}
+
+	retryAfterHeader = http.CanonicalHeaderKey("Retry-After")
+)
+
+// SendFunc makes a single request attempt and returns the response, with its body already read and closed, err is
+// set only when no response was received.
+type SendFunc func(ctx context.Context) (*http.Response, error)
+
+// Retry calls send with exponential backoff. Failed requests, rate limited requests and server errors are retried,
+// other client errors are returned right away as retrying them can't succeed. Rate limited requests are retried
+// no earlier than their Retry-After, and not at all when that's past the deadline of the context.
+func Retry(ctx context.Context, log *logging.Logger, send SendFunc) error {
+	b := backoff
+	for attempt := 1; ; attempt++ {
+		resp, err := send(ctx)
+
+		var retryAfter time.Duration
+		switch {
+		case err != nil:
+			log.WithField("error", err.Error()).Error("error making http request")
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			return nil
+		case resp.StatusCode == http.StatusTooManyRequests:
+			retryAfter = parseRetryAfter(resp.Header.Get(retryAfterHeader), time.Now())
+			log.Warnf("rate limited, status code: %d, status: %s", resp.StatusCode, resp.Status)
+			err = fmt.Errorf("status code: %d, status: %s", resp.StatusCode, resp.Status)
+		case resp.StatusCode >= 400 && resp.StatusCode < 500:
+			return fmt.Errorf("status code: %d, status: %s", resp.StatusCode, resp.Status)
+		default:
+			log.Errorf("server error or unexpected status code: %d, status: %s", resp.StatusCode, resp.Status)
+			err = fmt.Errorf("status code: %d, status: %s", resp.StatusCode, resp.Status)
+		}
+
+		if attempt == retryCount {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		delay := max(b.Step(), retryAfter)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return fmt.Errorf("retrying in %s would exceed the deadline: %w", delay.Round(time.Millisecond), err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// parseRetryAfter returns how long to wait according to a Retry-After header, which is either a number of seconds
+// or an HTTP date, and zero when it's missing or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0)
+	}
+	return 0
+}
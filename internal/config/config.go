@@ -1,8 +1,11 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"net/url"
+	"os"
+	"regexp"
 	"strings"
 	"time"
 
@@ -14,15 +17,188 @@ type Config struct {
 	LogLevel            string            `envconfig:"LOG_LEVEL" default:"info"`
 	KubeConfigPath      string            `envconfig:"KUBE_CONFIG_PATH" default:""`
 	DCGMLabels          map[string]string `envconfig:"DCGM_LABELS" default:"app.kubernetes.io/name:dcgm-exporter"`
+	DCGMScheme          string            `envconfig:"DCGM_SCHEME" default:"http"`
 	DCGMPort            int               `envconfig:"DCGM_PORT" default:"9400"`
 	DCGMMetricsEndpoint string            `envconfig:"DCGM_METRICS_ENDPOINT" default:"/metrics"`
 	DCGMHost            string            `envconfig:"DCGM_HOST"`
+	DCGMSocket          string            `envconfig:"DCGM_SOCKET"`
+	DCGMDiscovery       DiscoveryConfig   `envconfig:"DCGM"`
+	DCGMClient          DCGMClientConfig  `envconfig:"DCGM"`
 	NodeName            string            `envconfig:"NODE_NAME"`
+	NodeNameSources     []string          `envconfig:"NODE_NAME_SOURCES" default:"target,config,label"`
 	ExportInterval      time.Duration     `envconfig:"EXPORT_INTERVAL" default:"15s"`
+	ScrapeConcurrency   int               `envconfig:"SCRAPE_CONCURRENCY" default:"15"`
+	ScrapeTimeout       time.Duration     `envconfig:"SCRAPE_TIMEOUT" default:"10s"`
+	ScrapeMaxBodyBytes  int64             `envconfig:"SCRAPE_MAX_BODY_BYTES" default:"16777216"`
 	CastAPI             string            `envconfig:"CAST_API" default:"https://api.cast.ai"`
 	ClusterID           string            `envconfig:"CLUSTER_ID"`
 	APIKey              string            `envconfig:"API_KEY"` // nolint:gosec // G117: false positive
 	TelemetryURL        string            `envconfig:"TELEMETRY_URL" default:""`
+	RemoteWrite         RemoteWriteConfig `envconfig:"REMOTE_WRITE"`
+	OTLP                OTLPConfig        `envconfig:"OTLP"`
+	FileSink            FileSinkConfig    `envconfig:"FILE_SINK"`
+	Kafka               KafkaConfig       `envconfig:"KAFKA"`
+	Webhook             WebhookConfig     `envconfig:"WEBHOOK"`
+	HA                  HAConfig          `envconfig:"HA"`
+	Energy              EnergyConfig      `envconfig:"ENERGY"`
+	ClockEventsMaxGap   time.Duration     `envconfig:"CLOCK_EVENTS_MAX_GAP" default:"1m"`
+	XIDEvents           bool              `envconfig:"XID_EVENTS"`
+	Health              HealthConfig      `envconfig:"HEALTH"`
+	Alerting            AlertingConfig    `envconfig:"ALERTING"`
+	Idle                IdleConfig        `envconfig:"IDLE"`
+	RelabelConfigFile   string            `envconfig:"RELABEL_CONFIG_FILE"`
+	InvalidValuePolicy  string            `envconfig:"INVALID_VALUE_POLICY" default:"drop"`
+	ExtraMetrics        string            `envconfig:"EXTRA_METRICS"`
+}
+
+// DCGMClientConfig configures TLS and authentication of the requests scraping dcgm-exporters.
+type DCGMClientConfig struct {
+	TLSCAFile             string `envconfig:"TLS_CA_FILE"`
+	TLSCertFile           string `envconfig:"TLS_CERT_FILE"`
+	TLSKeyFile            string `envconfig:"TLS_KEY_FILE"`
+	TLSServerName         string `envconfig:"TLS_SERVER_NAME"`
+	TLSInsecureSkipVerify bool   `envconfig:"TLS_INSECURE_SKIP_VERIFY"`
+	BearerTokenFile       string `envconfig:"BEARER_TOKEN_FILE"`
+	BasicAuthUsername     string `envconfig:"BASIC_AUTH_USERNAME"`
+	BasicAuthPasswordFile string `envconfig:"BASIC_AUTH_PASSWORD_FILE"`
+}
+
+// DiscoveryConfig configures where dcgm-exporters are found instead of the pods matching DCGM_LABELS. StaticTargets
+// holds target groups in the Prometheus file_sd format, as YAML or JSON, and TargetFiles are files in the same
+// format. Service is the namespace/name of a Service whose EndpointSlices are scraped.
+type DiscoveryConfig struct {
+	Service                    string        `envconfig:"SERVICE"`
+	ServicePortName            string        `envconfig:"SERVICE_PORT_NAME" default:"gpu-metrics"`
+	StaticTargets              string        `envconfig:"STATIC_TARGETS"`
+	TargetFiles                []string      `envconfig:"TARGET_FILES"`
+	TargetFilesRefreshInterval time.Duration `envconfig:"TARGET_FILES_REFRESH_INTERVAL" default:"5m"`
+}
+
+const (
+	HAModeLeaderElection = "leader-election"
+	HAModeSharding       = "sharding"
+
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// HAConfig configures running several replicas of the cluster-wide exporter. In leader-election mode one replica
+// exports while the others stand by, in sharding mode the replicas split the dcgm-exporters between them. Leases
+// are created in Namespace, which defaults to the namespace of the pod, and Identity defaults to the hostname.
+type HAConfig struct {
+	Mode          string        `envconfig:"MODE"`
+	Namespace     string        `envconfig:"NAMESPACE"`
+	Identity      string        `envconfig:"IDENTITY"`
+	LeaseName     string        `envconfig:"LEASE_NAME" default:"gpu-metrics-exporter"`
+	LeaseDuration time.Duration `envconfig:"LEASE_DURATION" default:"15s"`
+	RenewDeadline time.Duration `envconfig:"RENEW_DEADLINE" default:"10s"`
+	RetryPeriod   time.Duration `envconfig:"RETRY_PERIOD" default:"2s"`
+}
+
+// EnergyConfig configures integrating the power of GPUs into their energy. Power samples further apart than MaxGap
+// aren't integrated. Carbon estimates are added when CarbonIntensity, in gCO2e/kWh, is set, CarbonIntensityZones
+// overrides it for the GPUs whose ZoneLabel has the zone as value.
+type EnergyConfig struct {
+	MaxGap               time.Duration      `envconfig:"MAX_GAP" default:"1m"`
+	CarbonIntensity      float64            `envconfig:"CARBON_INTENSITY"`
+	CarbonIntensityZones map[string]float64 `envconfig:"CARBON_INTENSITY_ZONES"`
+	ZoneLabel            string             `envconfig:"ZONE_LABEL" default:"zone"`
+}
+
+// HealthConfig configures the controller reflecting the health of the GPUs of a node in its GPUHealthy condition,
+// and in Taint, formatted as key=value:effect, when it's set. Ratios and temperatures of 0 disable their rule.
+type HealthConfig struct {
+	Enabled                  bool          `envconfig:"ENABLED"`
+	DryRun                   bool          `envconfig:"DRY_RUN"`
+	XIDSeverities            []string      `envconfig:"XID_SEVERITIES" default:"hardware"`
+	XIDHold                  time.Duration `envconfig:"XID_HOLD" default:"15m"`
+	MaxThermalViolationRatio float64       `envconfig:"MAX_THERMAL_VIOLATION_RATIO" default:"0.2"`
+	MaxPowerViolationRatio   float64       `envconfig:"MAX_POWER_VIOLATION_RATIO"`
+	MaxGPUTemperature        float64       `envconfig:"MAX_GPU_TEMPERATURE" default:"90"`
+	MaxMemoryTemperature     float64       `envconfig:"MAX_MEMORY_TEMPERATURE" default:"95"`
+	UnhealthyThreshold       int           `envconfig:"UNHEALTHY_THRESHOLD" default:"2"`
+	HealthyThreshold         int           `envconfig:"HEALTHY_THRESHOLD" default:"5"`
+	Taint                    string        `envconfig:"TAINT"`
+}
+
+// IdleConfig configures detecting pods and workloads which leave their GPUs idle. A GPU is idle while its
+// utilization, in percent, is at most MaxUtilization and its SM activity at most MaxSMActive. Pods and workloads
+// idle for MinDuration are reported and, with Annotate, their workloads are annotated every AnnotateInterval.
+type IdleConfig struct {
+	Enabled          bool          `envconfig:"ENABLED"`
+	MaxUtilization   float64       `envconfig:"MAX_UTILIZATION" default:"1"`
+	MaxSMActive      float64       `envconfig:"MAX_SM_ACTIVE" default:"0.01"`
+	MinDuration      time.Duration `envconfig:"MIN_DURATION" default:"30m"`
+	Annotate         bool          `envconfig:"ANNOTATE"`
+	AnnotateInterval time.Duration `envconfig:"ANNOTATE_INTERVAL" default:"5m"`
+}
+
+const (
+	AlertingOutputLog     = "log"
+	AlertingOutputEvent   = "event"
+	AlertingOutputWebhook = "webhook"
+)
+
+// AlertingConfig configures evaluating the alerting rules of RulesFile, it's disabled when RulesFile is empty.
+// Alerts are sent to every output of Outputs, the webhook output posts them to WebhookURL.
+type AlertingConfig struct {
+	RulesFile      string            `envconfig:"RULES_FILE"`
+	Outputs        []string          `envconfig:"OUTPUTS" default:"log"`
+	WebhookURL     string            `envconfig:"WEBHOOK_URL"`
+	WebhookHeaders map[string]string `envconfig:"WEBHOOK_HEADERS"`
+	WebhookSecret  string            `envconfig:"WEBHOOK_SECRET"` // nolint:gosec // G117: false positive
+	WebhookTimeout time.Duration     `envconfig:"WEBHOOK_TIMEOUT" default:"10s"`
+}
+
+// RemoteWriteConfig configures the optional Prometheus remote-write sink, it's disabled when URL is empty.
+type RemoteWriteConfig struct {
+	URL               string            `envconfig:"URL"`
+	Headers           map[string]string `envconfig:"HEADERS"`
+	ExternalLabels    map[string]string `envconfig:"EXTERNAL_LABELS"`
+	Shards            int               `envconfig:"SHARDS" default:"2"`
+	QueueCapacity     int               `envconfig:"QUEUE_CAPACITY" default:"10000"`
+	MaxSamplesPerSend int               `envconfig:"MAX_SAMPLES_PER_SEND" default:"2000"`
+	BatchSendDeadline time.Duration     `envconfig:"BATCH_SEND_DEADLINE" default:"5s"`
+	Timeout           time.Duration     `envconfig:"TIMEOUT" default:"30s"`
+}
+
+// OTLPConfig configures the optional OpenTelemetry metrics sink, it's disabled when Endpoint is empty.
+type OTLPConfig struct {
+	Endpoint string            `envconfig:"ENDPOINT"`
+	Protocol string            `envconfig:"PROTOCOL" default:"grpc"`
+	Headers  map[string]string `envconfig:"HEADERS"`
+	CAFile   string            `envconfig:"CA_FILE"`
+	CertFile string            `envconfig:"CERT_FILE"`
+	KeyFile  string            `envconfig:"KEY_FILE"`
+	Timeout  time.Duration     `envconfig:"TIMEOUT" default:"10s"`
+}
+
+// FileSinkConfig configures the optional sink writing GPU metric rows to a local file, it's disabled when Path is empty.
+type FileSinkConfig struct {
+	Path       string        `envconfig:"PATH"`
+	Format     string        `envconfig:"FORMAT" default:"json"`
+	MaxSize    int64         `envconfig:"MAX_SIZE" default:"104857600"`
+	MaxAge     time.Duration `envconfig:"MAX_AGE" default:"1h"`
+	MaxBackups int           `envconfig:"MAX_BACKUPS" default:"24"`
+	Compress   bool          `envconfig:"COMPRESS" default:"true"`
+}
+
+// KafkaConfig configures the optional sink producing GPU metric rows to Kafka, it's disabled when Brokers is empty.
+type KafkaConfig struct {
+	Brokers      []string      `envconfig:"BROKERS"`
+	Topic        string        `envconfig:"TOPIC" default:"gpu-metrics"`
+	Key          string        `envconfig:"KEY" default:"device_uuid"`
+	Format       string        `envconfig:"FORMAT" default:"avro"`
+	WriteTimeout time.Duration `envconfig:"WRITE_TIMEOUT" default:"10s"`
+}
+
+// WebhookConfig configures the optional sink posting GPU metric rows to an HTTP endpoint, it's disabled when URL is empty.
+type WebhookConfig struct {
+	URL             string            `envconfig:"URL"`
+	Headers         map[string]string `envconfig:"HEADERS"`
+	Secret          string            `envconfig:"SECRET"` // nolint:gosec // G117: false positive
+	TemplateFile    string            `envconfig:"TEMPLATE_FILE"`
+	MaxRequestBytes int               `envconfig:"MAX_REQUEST_BYTES" default:"1048576"`
+	Timeout         time.Duration     `envconfig:"TIMEOUT" default:"30s"`
 }
 
 func deriveTelemetryURL(apiURL string) string {
@@ -83,9 +259,115 @@ func GetFromEnvironment() (*Config, error) {
 		return nil, err
 	}
 
+	if cfg.DCGMScheme != "http" && cfg.DCGMScheme != "https" {
+		return nil, fmt.Errorf("invalid DCGM_SCHEME %q, expected http or https", cfg.DCGMScheme)
+	}
+
+	if service := cfg.DCGMDiscovery.Service; service != "" {
+		if namespace, name, found := strings.Cut(service, "/"); !found || namespace == "" || name == "" {
+			return nil, fmt.Errorf("invalid DCGM_SERVICE %q, expected namespace/name", service)
+		}
+		if cfg.DCGMDiscovery.StaticTargets != "" || len(cfg.DCGMDiscovery.TargetFiles) > 0 {
+			return nil, errors.New("DCGM_SERVICE can't be used together with DCGM_STATIC_TARGETS or DCGM_TARGET_FILES")
+		}
+	}
+
+	if client := cfg.DCGMClient; (client.TLSCertFile == "") != (client.TLSKeyFile == "") {
+		return nil, errors.New("DCGM_TLS_CERT_FILE and DCGM_TLS_KEY_FILE must be set together")
+	}
+	if client := cfg.DCGMClient; client.BearerTokenFile != "" && (client.BasicAuthUsername != "" || client.BasicAuthPasswordFile != "") {
+		return nil, errors.New("DCGM_BEARER_TOKEN_FILE can't be used together with basic auth")
+	}
+	if (cfg.OTLP.CertFile == "") != (cfg.OTLP.KeyFile == "") {
+		return nil, errors.New("OTLP_CERT_FILE and OTLP_KEY_FILE must be set together")
+	}
+
+	for _, source := range cfg.NodeNameSources {
+		if source != "target" && source != "config" && source != "label" {
+			return nil, fmt.Errorf("invalid NODE_NAME_SOURCES %q, expected target, config or label", source)
+		}
+	}
+
+	if cfg.InvalidValuePolicy != "drop" && cfg.InvalidValuePolicy != "zero" {
+		return nil, fmt.Errorf("invalid INVALID_VALUE_POLICY %q, expected drop or zero", cfg.InvalidValuePolicy)
+	}
+	if cfg.ExtraMetrics != "" {
+		if _, err := regexp.Compile("^(?:" + cfg.ExtraMetrics + ")$"); err != nil {
+			return nil, fmt.Errorf("invalid EXTRA_METRICS %q: %w", cfg.ExtraMetrics, err)
+		}
+	}
+	if cfg.Energy.CarbonIntensity < 0 {
+		return nil, fmt.Errorf("invalid ENERGY_CARBON_INTENSITY %v, expected a non-negative value", cfg.Energy.CarbonIntensity)
+	}
+	for zone, intensity := range cfg.Energy.CarbonIntensityZones {
+		if intensity < 0 {
+			return nil, fmt.Errorf("invalid ENERGY_CARBON_INTENSITY_ZONES intensity %v of zone %q, expected a non-negative value", intensity, zone)
+		}
+	}
+
+	if cfg.Health.UnhealthyThreshold < 1 || cfg.Health.HealthyThreshold < 1 {
+		return nil, errors.New("HEALTH_UNHEALTHY_THRESHOLD and HEALTH_HEALTHY_THRESHOLD must be at least 1")
+	}
+
+	for _, output := range cfg.Alerting.Outputs {
+		switch output {
+		case AlertingOutputLog, AlertingOutputEvent:
+		case AlertingOutputWebhook:
+			if cfg.Alerting.WebhookURL == "" {
+				return nil, errors.New("ALERTING_WEBHOOK_URL is required by the webhook output")
+			}
+		default:
+			return nil, fmt.Errorf("invalid ALERTING_OUTPUTS %q, expected log, event or webhook", output)
+		}
+	}
+
+	// a workload is only idle when all of its GPUs are, so annotating requires a single exporter seeing every node
+	if cfg.Idle.Annotate && (cfg.HA.Mode == HAModeSharding || cfg.HA.Mode == "" && cfg.NodeName != "") {
+		return nil, errors.New("IDLE_ANNOTATE requires HA_MODE=leader-election, or NODE_NAME to be empty without HA_MODE")
+	}
+
+	if err := resolveHA(&cfg.HA); err != nil {
+		return nil, err
+	}
+
 	if cfg.TelemetryURL == "" {
 		cfg.TelemetryURL = deriveTelemetryURL(cfg.CastAPI)
 	}
 
 	return cfg, nil
 }
+
+func resolveHA(cfg *HAConfig) error {
+	switch cfg.Mode {
+	case "":
+		return nil
+	case HAModeLeaderElection, HAModeSharding:
+	default:
+		return fmt.Errorf("invalid HA_MODE %q, expected %s or %s", cfg.Mode, HAModeLeaderElection, HAModeSharding)
+	}
+
+	// the same constraints as client-go's leader election, whose jitter lengthens the retry period by up to 20%
+	if cfg.LeaseDuration <= cfg.RenewDeadline || float64(cfg.RenewDeadline) <= 1.2*float64(cfg.RetryPeriod) {
+		return errors.New("HA_LEASE_DURATION must be greater than HA_RENEW_DEADLINE, which must be greater than 1.2 times HA_RETRY_PERIOD")
+	}
+	if cfg.RetryPeriod <= 0 {
+		return errors.New("HA_RETRY_PERIOD must be positive")
+	}
+
+	if cfg.Identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("getting hostname for HA_IDENTITY: %w", err)
+		}
+		cfg.Identity = hostname
+	}
+	if cfg.Namespace == "" {
+		namespace, err := os.ReadFile(serviceAccountNamespaceFile)
+		if err != nil {
+			return fmt.Errorf("HA_NAMESPACE is required outside of a pod: %w", err)
+		}
+		cfg.Namespace = strings.TrimSpace(string(namespace))
+	}
+
+	return nil
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -91,3 +92,197 @@ func TestDeriveTelemetryURL(t *testing.T) {
 		})
 	}
 }
+
+func TestGetFromEnvironment(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		err    string
+		assert func(r *require.Assertions, cfg *Config)
+	}{
+		{
+			name: "defaults",
+			assert: func(r *require.Assertions, cfg *Config) {
+				r.Equal("http", cfg.DCGMScheme)
+				r.Equal([]string{"target", "config", "label"}, cfg.NodeNameSources)
+				r.Equal("drop", cfg.InvalidValuePolicy)
+				r.Equal([]string{AlertingOutputLog}, cfg.Alerting.Outputs)
+				r.Equal(2, cfg.Health.UnhealthyThreshold)
+				r.Equal(5, cfg.Health.HealthyThreshold)
+				r.Equal(5*time.Minute, cfg.DCGMDiscovery.TargetFilesRefreshInterval)
+				r.False(cfg.XIDEvents)
+				r.Empty(cfg.HA.Mode)
+				r.Equal("telemetry.prod-master.cast.ai", cfg.TelemetryURL)
+			},
+		},
+		{
+			name: "invalid scheme",
+			env:  map[string]string{"DCGM_SCHEME": "ftp"},
+			err:  `invalid DCGM_SCHEME "ftp"`,
+		},
+		{
+			name: "TLS certificate without key",
+			env:  map[string]string{"DCGM_TLS_CERT_FILE": "/certs/tls.crt"},
+			err:  "DCGM_TLS_CERT_FILE and DCGM_TLS_KEY_FILE must be set together",
+		},
+		{
+			name: "TLS key without certificate",
+			env:  map[string]string{"DCGM_TLS_KEY_FILE": "/certs/tls.key"},
+			err:  "DCGM_TLS_CERT_FILE and DCGM_TLS_KEY_FILE must be set together",
+		},
+		{
+			name: "bearer token and basic auth",
+			env:  map[string]string{"DCGM_BEARER_TOKEN_FILE": "/token", "DCGM_BASIC_AUTH_USERNAME": "admin"},
+			err:  "DCGM_BEARER_TOKEN_FILE can't be used together with basic auth",
+		},
+		{
+			name: "OTLP certificate without key",
+			env:  map[string]string{"OTLP_CERT_FILE": "/certs/tls.crt"},
+			err:  "OTLP_CERT_FILE and OTLP_KEY_FILE must be set together",
+		},
+		{
+			name: "service without namespace",
+			env:  map[string]string{"DCGM_SERVICE": "nvidia-dcgm-exporter"},
+			err:  `invalid DCGM_SERVICE "nvidia-dcgm-exporter", expected namespace/name`,
+		},
+		{
+			name: "service and static targets",
+			env:  map[string]string{"DCGM_SERVICE": "gpu-operator/nvidia-dcgm-exporter", "DCGM_STATIC_TARGETS": "- targets: [gpu-1:9400]"},
+			err:  "DCGM_SERVICE can't be used together with DCGM_STATIC_TARGETS or DCGM_TARGET_FILES",
+		},
+		{
+			name: "service and target files",
+			env:  map[string]string{"DCGM_SERVICE": "gpu-operator/nvidia-dcgm-exporter", "DCGM_TARGET_FILES": "/targets.yaml"},
+			err:  "DCGM_SERVICE can't be used together with DCGM_STATIC_TARGETS or DCGM_TARGET_FILES",
+		},
+		{
+			name: "node name sources",
+			env:  map[string]string{"NODE_NAME_SOURCES": "label,target"},
+			assert: func(r *require.Assertions, cfg *Config) {
+				r.Equal([]string{"label", "target"}, cfg.NodeNameSources)
+			},
+		},
+		{
+			name: "invalid node name source",
+			env:  map[string]string{"NODE_NAME_SOURCES": "target,hostname"},
+			err:  `invalid NODE_NAME_SOURCES "hostname", expected target, config or label`,
+		},
+		{
+			name: "invalid value policy",
+			env:  map[string]string{"INVALID_VALUE_POLICY": "clamp"},
+			err:  `invalid INVALID_VALUE_POLICY "clamp", expected drop or zero`,
+		},
+		{
+			name: "extra metrics",
+			env:  map[string]string{"EXTRA_METRICS": "DCGM_FI_PROF_.*|DCGM_FI_DEV_ECC_.*"},
+			assert: func(r *require.Assertions, cfg *Config) {
+				r.Equal("DCGM_FI_PROF_.*|DCGM_FI_DEV_ECC_.*", cfg.ExtraMetrics)
+			},
+		},
+		{
+			name: "invalid extra metrics",
+			env:  map[string]string{"EXTRA_METRICS": "DCGM_FI_(PROF"},
+			err:  `invalid EXTRA_METRICS "DCGM_FI_(PROF"`,
+		},
+		{
+			name: "negative carbon intensity",
+			env:  map[string]string{"ENERGY_CARBON_INTENSITY": "-1"},
+			err:  "invalid ENERGY_CARBON_INTENSITY -1, expected a non-negative value",
+		},
+		{
+			name: "negative carbon intensity of a zone",
+			env:  map[string]string{"ENERGY_CARBON_INTENSITY_ZONES": "eu-west-1:-5"},
+			err:  `invalid ENERGY_CARBON_INTENSITY_ZONES intensity -5 of zone "eu-west-1", expected a non-negative value`,
+		},
+		{
+			name: "unhealthy threshold",
+			env:  map[string]string{"HEALTH_UNHEALTHY_THRESHOLD": "0"},
+			err:  "HEALTH_UNHEALTHY_THRESHOLD and HEALTH_HEALTHY_THRESHOLD must be at least 1",
+		},
+		{
+			name: "healthy threshold",
+			env:  map[string]string{"HEALTH_HEALTHY_THRESHOLD": "0"},
+			err:  "HEALTH_UNHEALTHY_THRESHOLD and HEALTH_HEALTHY_THRESHOLD must be at least 1",
+		},
+		{
+			name: "invalid alerting output",
+			env:  map[string]string{"ALERTING_RULES_FILE": "/rules.yaml", "ALERTING_OUTPUTS": "log,pagerduty"},
+			err:  `invalid ALERTING_OUTPUTS "pagerduty", expected log, event or webhook`,
+		},
+		{
+			name: "alerting webhook output without URL",
+			env:  map[string]string{"ALERTING_RULES_FILE": "/rules.yaml", "ALERTING_OUTPUTS": "webhook"},
+			err:  "ALERTING_WEBHOOK_URL is required by the webhook output",
+		},
+		{
+			name: "invalid HA mode",
+			env:  map[string]string{"HA_MODE": "active-active"},
+			err:  `invalid HA_MODE "active-active", expected leader-election or sharding`,
+		},
+		{
+			name: "HA",
+			env:  map[string]string{"HA_MODE": "sharding", "HA_NAMESPACE": "castai-agent", "HA_IDENTITY": "exporter-0"},
+			assert: func(r *require.Assertions, cfg *Config) {
+				r.Equal(HAConfig{
+					Mode:          HAModeSharding,
+					Namespace:     "castai-agent",
+					Identity:      "exporter-0",
+					LeaseName:     "gpu-metrics-exporter",
+					LeaseDuration: 15 * time.Second,
+					RenewDeadline: 10 * time.Second,
+					RetryPeriod:   2 * time.Second,
+				}, cfg.HA)
+			},
+		},
+		{
+			name: "HA lease duration shorter than the renew deadline",
+			env:  map[string]string{"HA_MODE": "leader-election", "HA_NAMESPACE": "castai-agent", "HA_LEASE_DURATION": "10s"},
+			err:  "HA_LEASE_DURATION must be greater than HA_RENEW_DEADLINE",
+		},
+		{
+			name: "HA renew deadline shorter than the retry period",
+			env:  map[string]string{"HA_MODE": "leader-election", "HA_NAMESPACE": "castai-agent", "HA_RETRY_PERIOD": "9s"},
+			err:  "which must be greater than 1.2 times HA_RETRY_PERIOD",
+		},
+		{
+			name: "HA without retry period",
+			env:  map[string]string{"HA_MODE": "sharding", "HA_NAMESPACE": "castai-agent", "HA_RETRY_PERIOD": "0s"},
+			err:  "HA_RETRY_PERIOD must be positive",
+		},
+		{
+			name: "idle annotation on a node",
+			env:  map[string]string{"IDLE_ANNOTATE": "true", "NODE_NAME": "gpu-node-1"},
+			err:  "IDLE_ANNOTATE requires HA_MODE=leader-election",
+		},
+		{
+			name: "idle annotation with sharding",
+			env:  map[string]string{"IDLE_ANNOTATE": "true", "HA_MODE": "sharding", "HA_NAMESPACE": "castai-agent"},
+			err:  "IDLE_ANNOTATE requires HA_MODE=leader-election",
+		},
+		{
+			name: "idle annotation with leader election",
+			env: map[string]string{
+				"IDLE_ANNOTATE": "true", "NODE_NAME": "gpu-node-1", "HA_MODE": "leader-election", "HA_NAMESPACE": "castai-agent",
+			},
+			assert: func(r *require.Assertions, cfg *Config) {
+				r.True(cfg.Idle.Annotate)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := require.New(t)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			cfg, err := GetFromEnvironment()
+			if tt.err != "" {
+				r.ErrorContains(err, tt.err)
+				return
+			}
+			r.NoError(err)
+			tt.assert(r, cfg)
+		})
+	}
+}
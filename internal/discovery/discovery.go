@@ -0,0 +1,243 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"sigs.k8s.io/yaml"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/logging"
+)
+
+const (
+	// Labels starting with the reserved prefix configure the target and aren't added to the measurements.
+	reservedLabelPrefix = "__"
+	schemeLabel         = "__scheme__"
+	metricsPathLabel    = "__metrics_path__"
+	nodeNameLabel       = "__node_name__"
+	hostnameLabel       = "Hostname"
+)
+
+// TargetGroup is a list of dcgm-exporter addresses sharing the same labels, in the format of Prometheus file_sd.
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+type Config struct {
+	// Scheme and Path are used for targets which don't set them through the __scheme__ and __metrics_path__ labels.
+	Scheme string
+	Path   string
+	Static []TargetGroup
+	// Files are read again when they change and every RefreshInterval, in case a change was missed. Directories
+	// which can't be watched are retried every RefreshInterval as well.
+	Files           []string
+	RefreshInterval time.Duration
+	// NodeName limits the targets to the ones of the node when set, e.g. when an exporter runs on every node. The
+	// node of a target is resolved like the mapper does, __node_name__ being its target source and a Hostname label
+	// its label source, in the order of NodeNameSources or exporter.DefaultNodeNameSources.
+	NodeName        string
+	NodeNameSources []exporter.NodeNameSource
+}
+
+// Discoverer provides the static targets and the ones listed in the files.
+type Discoverer struct {
+	cfg Config
+	log *logging.Logger
+
+	mu         sync.RWMutex
+	fileGroups map[string][]TargetGroup
+}
+
+// ParseTargetGroups parses a list of target groups from YAML or JSON.
+func ParseTargetGroups(data []byte) ([]TargetGroup, error) {
+	var groups []TargetGroup
+	if err := yaml.UnmarshalStrict(data, &groups); err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		for _, target := range group.Targets {
+			if target == "" {
+				return nil, errors.New("empty target")
+			}
+		}
+	}
+	return groups, nil
+}
+
+// NewDiscoverer creates a discoverer and reads the files for the first time, files which can't be read are
+// logged and retried by Run.
+func NewDiscoverer(cfg Config, log *logging.Logger) *Discoverer {
+	d := &Discoverer{
+		cfg:        cfg,
+		log:        log,
+		fileGroups: make(map[string][]TargetGroup, len(cfg.Files)),
+	}
+	if len(d.cfg.NodeNameSources) == 0 {
+		d.cfg.NodeNameSources = exporter.DefaultNodeNameSources
+	}
+	for _, file := range cfg.Files {
+		d.readFile(file)
+	}
+	return d
+}
+
+// Run watches the files for changes until the context is done.
+func (d *Discoverer) Run(ctx context.Context) error {
+	if len(d.cfg.Files) == 0 {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("creating file watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	// directories are watched rather than the files, so that files replaced by a rename, e.g. ConfigMap updates,
+	// are still followed
+	files := make(map[string]struct{}, len(d.cfg.Files))
+	// unwatched holds the directories which couldn't be watched yet, e.g. because they don't exist, they are
+	// retried on every refresh
+	unwatched := make(map[string]struct{})
+	for _, file := range d.cfg.Files {
+		files[filepath.Clean(file)] = struct{}{}
+		unwatched[filepath.Dir(file)] = struct{}{}
+	}
+	watch := func() {
+		for dir := range unwatched {
+			if err := watcher.Add(dir); err != nil {
+				d.log.With("directory", dir, "error", err.Error()).Warn("failed to watch target files, retrying on the next refresh")
+				continue
+			}
+			delete(unwatched, dir)
+		}
+	}
+	watch()
+
+	var refresh <-chan time.Time
+	if d.cfg.RefreshInterval > 0 {
+		ticker := time.NewTicker(d.cfg.RefreshInterval)
+		defer ticker.Stop()
+		refresh = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event := <-watcher.Events:
+			// ConfigMap updates swap a symlink in the directory, so every file is read again on any change
+			if _, found := files[filepath.Clean(event.Name)]; found || strings.HasPrefix(filepath.Base(event.Name), "..") {
+				for _, file := range d.cfg.Files {
+					d.readFile(file)
+				}
+			}
+		case err := <-watcher.Errors:
+			d.log.WithField("error", err.Error()).Warn("error while watching target files")
+		case <-refresh:
+			watch()
+			for _, file := range d.cfg.Files {
+				d.readFile(file)
+			}
+		}
+	}
+}
+
+// readFile replaces the targets of the file, the targets of a removed file are dropped like with Prometheus
+// file_sd, and the previous ones are kept when it can't be read or parsed.
+func (d *Discoverer) readFile(file string) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		d.mu.Lock()
+		delete(d.fileGroups, file)
+		d.mu.Unlock()
+		return
+	}
+	if err == nil {
+		var groups []TargetGroup
+		if groups, err = ParseTargetGroups(data); err == nil {
+			d.mu.Lock()
+			d.fileGroups[file] = groups
+			d.mu.Unlock()
+			return
+		}
+	}
+	d.log.With("file", file, "error", err.Error()).Warn("failed to read targets, keeping the previous ones")
+}
+
+// Targets returns the static targets followed by the ones of the files, targets with the same URL are only
+// returned once. With NodeName, targets of other nodes or without a node are skipped.
+func (d *Discoverer) Targets(_ context.Context) ([]exporter.Target, error) {
+	groups := append([]TargetGroup{}, d.cfg.Static...)
+	d.mu.RLock()
+	for _, file := range d.cfg.Files {
+		groups = append(groups, d.fileGroups[file]...)
+	}
+	d.mu.RUnlock()
+
+	seen := make(map[string]struct{})
+	var targets []exporter.Target
+	for _, group := range groups {
+		for _, address := range group.Targets {
+			target := d.target(address, group.Labels)
+			if d.cfg.NodeName != "" && d.nodeName(target) != d.cfg.NodeName {
+				continue
+			}
+			if _, found := seen[target.URL]; found {
+				continue
+			}
+			seen[target.URL] = struct{}{}
+			targets = append(targets, target)
+		}
+	}
+
+	return targets, nil
+}
+
+// nodeName returns the node of a target as the mapper resolves it. The configured node name isn't one of the
+// sources here, as every target would belong to the node otherwise.
+func (d *Discoverer) nodeName(target exporter.Target) string {
+	return exporter.ResolveNodeName(d.cfg.NodeNameSources, target.NodeName, "", target.Labels[hostnameLabel])
+}
+
+func (d *Discoverer) target(address string, groupLabels map[string]string) exporter.Target {
+	scheme, path := d.cfg.Scheme, d.cfg.Path
+	var target exporter.Target
+	for name, value := range groupLabels {
+		switch name {
+		case schemeLabel:
+			scheme = value
+		case metricsPathLabel:
+			path = value
+		case nodeNameLabel:
+			target.NodeName = value
+		default:
+			if strings.HasPrefix(name, reservedLabelPrefix) {
+				continue
+			}
+			if target.Labels == nil {
+				target.Labels = make(map[string]string, len(groupLabels))
+			}
+			target.Labels[name] = value
+		}
+	}
+
+	// full URLs, e.g. of unix sockets, are scraped as they are
+	target.URL = address
+	if !strings.Contains(address, "://") {
+		target.URL = fmt.Sprintf("%s://%s%s", scheme, address, path)
+	}
+
+	return target
+}
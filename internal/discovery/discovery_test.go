@@ -0,0 +1,222 @@
+package discovery_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/castai/gpu-metrics-exporter/internal/discovery"
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/logging"
+)
+
+func TestParseTargetGroups(t *testing.T) {
+	t.Run("parses file_sd JSON", func(t *testing.T) {
+		r := require.New(t)
+
+		groups, err := discovery.ParseTargetGroups([]byte(`[{"targets": ["gpu-1:9400", "gpu-2:9400"], "labels": {"rack": "r1"}}]`))
+		r.NoError(err)
+		r.Equal([]discovery.TargetGroup{{Targets: []string{"gpu-1:9400", "gpu-2:9400"}, Labels: map[string]string{"rack": "r1"}}}, groups)
+	})
+
+	t.Run("parses file_sd YAML", func(t *testing.T) {
+		r := require.New(t)
+
+		groups, err := discovery.ParseTargetGroups([]byte(`
+- targets:
+    - gpu-1:9400
+  labels:
+    rack: r1
+- targets:
+    - gpu-2:9400
+`))
+		r.NoError(err)
+		r.Equal([]discovery.TargetGroup{
+			{Targets: []string{"gpu-1:9400"}, Labels: map[string]string{"rack": "r1"}},
+			{Targets: []string{"gpu-2:9400"}},
+		}, groups)
+	})
+
+	t.Run("rejects unknown fields and empty targets", func(t *testing.T) {
+		r := require.New(t)
+
+		_, err := discovery.ParseTargetGroups([]byte(`[{"target": ["gpu-1:9400"]}]`))
+		r.Error(err)
+		_, err = discovery.ParseTargetGroups([]byte(`[{"targets": [""]}]`))
+		r.Error(err)
+	})
+}
+
+func TestDiscoverer_Targets(t *testing.T) {
+	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
+
+	t.Run("builds targets out of static groups", func(t *testing.T) {
+		r := require.New(t)
+
+		d := discovery.NewDiscoverer(discovery.Config{
+			Scheme: "http",
+			Path:   "/metrics",
+			Static: []discovery.TargetGroup{
+				{
+					Targets: []string{"10.0.0.1:9400", "10.0.0.2:9400"},
+					Labels:  map[string]string{"rack": "r1", "__node_name__": "gpu-host-1", "__meta_ignored": "x"},
+				},
+				{
+					Targets: []string{"dcgm.monitoring.svc:9400", "10.0.0.1:9400"},
+					Labels:  map[string]string{"__scheme__": "https", "__metrics_path__": "/dcgm/metrics"},
+				},
+				{
+					Targets: []string{"unix:///var/run/dcgm/dcgm.sock:/metrics"},
+				},
+			},
+		}, log)
+
+		targets, err := d.Targets(context.Background())
+		r.NoError(err)
+		r.Equal([]exporter.Target{
+			{URL: "http://10.0.0.1:9400/metrics", NodeName: "gpu-host-1", Labels: map[string]string{"rack": "r1"}},
+			{URL: "http://10.0.0.2:9400/metrics", NodeName: "gpu-host-1", Labels: map[string]string{"rack": "r1"}},
+			{URL: "https://dcgm.monitoring.svc:9400/dcgm/metrics"},
+			{URL: "https://10.0.0.1:9400/dcgm/metrics"},
+			{URL: "unix:///var/run/dcgm/dcgm.sock:/metrics"},
+		}, targets)
+	})
+
+	t.Run("only returns the targets of the node", func(t *testing.T) {
+		r := require.New(t)
+
+		d := discovery.NewDiscoverer(discovery.Config{
+			Scheme: "http",
+			Path:   "/metrics",
+			Static: []discovery.TargetGroup{
+				{Targets: []string{"10.0.0.1:9400"}, Labels: map[string]string{"__node_name__": "gpu-host-1"}},
+				{Targets: []string{"10.0.0.2:9400"}, Labels: map[string]string{"__node_name__": "gpu-host-2"}},
+				{Targets: []string{"10.0.0.3:9400"}},
+			},
+			NodeName: "gpu-host-1",
+		}, log)
+
+		targets, err := d.Targets(context.Background())
+		r.NoError(err)
+		r.Equal([]exporter.Target{{URL: "http://10.0.0.1:9400/metrics", NodeName: "gpu-host-1"}}, targets)
+	})
+
+	t.Run("resolves the node of the targets in the order of the node name sources", func(t *testing.T) {
+		static := []discovery.TargetGroup{
+			{
+				Targets: []string{"10.0.0.1:9400"},
+				Labels:  map[string]string{"__node_name__": "gpu-host-1", "Hostname": "gpu-host-2"},
+			},
+			{Targets: []string{"10.0.0.2:9400"}, Labels: map[string]string{"Hostname": "gpu-host-1"}},
+		}
+		urls := func(sources ...exporter.NodeNameSource) []string {
+			d := discovery.NewDiscoverer(discovery.Config{
+				Scheme:          "http",
+				Path:            "/metrics",
+				Static:          static,
+				NodeName:        "gpu-host-1",
+				NodeNameSources: sources,
+			}, log)
+			targets, err := d.Targets(context.Background())
+			require.NoError(t, err)
+			var urls []string
+			for _, target := range targets {
+				urls = append(urls, target.URL)
+			}
+			return urls
+		}
+
+		r := require.New(t)
+		r.Equal([]string{"http://10.0.0.1:9400/metrics", "http://10.0.0.2:9400/metrics"}, urls())
+		r.Equal([]string{"http://10.0.0.2:9400/metrics"}, urls(exporter.NodeNameSourceLabel, exporter.NodeNameSourceTarget))
+		r.Equal([]string{"http://10.0.0.1:9400/metrics"}, urls(exporter.NodeNameSourceTarget))
+	})
+
+	t.Run("follows changes of the target files", func(t *testing.T) {
+		r := require.New(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		file := filepath.Join(t.TempDir(), "targets.yaml")
+		r.NoError(os.WriteFile(file, []byte("- targets: [gpu-1:9400]\n"), 0o600))
+
+		d := discovery.NewDiscoverer(discovery.Config{
+			Scheme: "http",
+			Path:   "/metrics",
+			Files:  []string{file},
+		}, log)
+		urls := func() []string {
+			targets, err := d.Targets(ctx)
+			r.NoError(err)
+			var urls []string
+			for _, target := range targets {
+				urls = append(urls, target.URL)
+			}
+			return urls
+		}
+		r.Equal([]string{"http://gpu-1:9400/metrics"}, urls())
+
+		done := make(chan error, 1)
+		go func() { done <- d.Run(ctx) }()
+		// give the watcher time to start
+		time.Sleep(100 * time.Millisecond)
+
+		// files are replaced by a rename, like configuration management tools do
+		tmp := file + ".tmp"
+		r.NoError(os.WriteFile(tmp, []byte("- targets: [gpu-1:9400, gpu-2:9400]\n"), 0o600))
+		r.NoError(os.Rename(tmp, file))
+		r.Eventually(func() bool {
+			return len(urls()) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+
+		// invalid contents keep the previous targets
+		r.NoError(os.WriteFile(tmp, []byte("targets: gpu-3:9400"), 0o600))
+		r.NoError(os.Rename(tmp, file))
+		time.Sleep(200 * time.Millisecond)
+		r.Equal([]string{"http://gpu-1:9400/metrics", "http://gpu-2:9400/metrics"}, urls())
+
+		// the targets of a removed file are dropped
+		r.NoError(os.Remove(file))
+		r.Eventually(func() bool {
+			return len(urls()) == 0
+		}, 5*time.Second, 10*time.Millisecond)
+
+		cancel()
+		r.ErrorIs(<-done, context.Canceled)
+	})
+
+	t.Run("retries watching directories which don't exist yet", func(t *testing.T) {
+		r := require.New(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		dir := filepath.Join(t.TempDir(), "targets")
+		file := filepath.Join(dir, "targets.yaml")
+		d := discovery.NewDiscoverer(discovery.Config{
+			Scheme:          "http",
+			Path:            "/metrics",
+			Files:           []string{file},
+			RefreshInterval: 50 * time.Millisecond,
+		}, log)
+		targets, err := d.Targets(ctx)
+		r.NoError(err)
+		r.Empty(targets)
+
+		done := make(chan error, 1)
+		go func() { done <- d.Run(ctx) }()
+
+		r.NoError(os.Mkdir(dir, 0o700))
+		r.NoError(os.WriteFile(file, []byte("- targets: [gpu-1:9400]\n"), 0o600))
+		r.Eventually(func() bool {
+			targets, err := d.Targets(ctx)
+			return err == nil && len(targets) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		cancel()
+		r.ErrorIs(<-done, context.Canceled)
+	})
+}
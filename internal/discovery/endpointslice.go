@@ -0,0 +1,118 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+)
+
+var endpointSliceGVR = schema.GroupVersionResource{Group: "discovery.k8s.io", Version: "v1", Resource: "endpointslices"}
+
+type EndpointSliceConfig struct {
+	// Namespace and Service identify the Service whose endpoints are scraped.
+	Namespace string
+	Service   string
+	// PortName is the name of the Service port serving the metrics, it may be empty when the Service has a single
+	// port.
+	PortName string
+	Scheme   string
+	Path     string
+	// NodeName limits the endpoints to the ones on the node when set, e.g. when an exporter runs on every node.
+	NodeName string
+}
+
+// EndpointSliceDiscoverer provides the ready endpoints of a Service, e.g. the nvidia-dcgm-exporter Service of
+// the NVIDIA GPU Operator.
+type EndpointSliceDiscoverer struct {
+	cfg     EndpointSliceConfig
+	dynamic dynamic.Interface
+}
+
+func NewEndpointSliceDiscoverer(cfg EndpointSliceConfig, dynClient dynamic.Interface) *EndpointSliceDiscoverer {
+	return &EndpointSliceDiscoverer{
+		cfg:     cfg,
+		dynamic: dynClient,
+	}
+}
+
+func (d *EndpointSliceDiscoverer) Targets(ctx context.Context) ([]exporter.Target, error) {
+	list, err := d.dynamic.Resource(endpointSliceGVR).Namespace(d.cfg.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: discoveryv1.LabelServiceName + "=" + d.cfg.Service,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting endpoint slices of service %s/%s %w", d.cfg.Namespace, d.cfg.Service, err)
+	}
+
+	seen := make(map[string]struct{})
+	var targets []exporter.Target
+	for i := range list.Items {
+		var slice discoveryv1.EndpointSlice
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(list.Items[i].Object, &slice); err != nil {
+			return nil, fmt.Errorf("converting unstructured to endpoint slice: %w", err)
+		}
+		if slice.AddressType == discoveryv1.AddressTypeFQDN {
+			continue
+		}
+
+		port, found := d.port(slice.Ports)
+		if !found {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			// a nil ready condition means unknown, which consumers should interpret as ready
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			if len(endpoint.Addresses) == 0 {
+				continue
+			}
+			if d.cfg.NodeName != "" && (endpoint.NodeName == nil || *endpoint.NodeName != d.cfg.NodeName) {
+				continue
+			}
+
+			address := net.JoinHostPort(endpoint.Addresses[0], strconv.Itoa(int(port)))
+			target := exporter.Target{URL: fmt.Sprintf("%s://%s%s", d.cfg.Scheme, address, d.cfg.Path)}
+			if endpoint.NodeName != nil {
+				target.NodeName = *endpoint.NodeName
+			}
+			key := target.URL
+			if ref := endpoint.TargetRef; ref != nil && ref.Kind == "Pod" {
+				target.Pod = ref.Name
+				target.Namespace = ref.Namespace
+				key = ref.Namespace + "/" + ref.Name
+			}
+
+			// dual stack Services have a slice per address family, and an endpoint may briefly be in two slices
+			// while they are updated, every pod is scraped once
+			if _, found := seen[key]; found {
+				continue
+			}
+			seen[key] = struct{}{}
+			targets = append(targets, target)
+		}
+	}
+
+	return targets, nil
+}
+
+func (d *EndpointSliceDiscoverer) port(ports []discoveryv1.EndpointPort) (int32, bool) {
+	for _, port := range ports {
+		if port.Port == nil {
+			continue
+		}
+		if (port.Name != nil && *port.Name == d.cfg.PortName) || (d.cfg.PortName == "" && len(ports) == 1) {
+			return *port.Port, true
+		}
+	}
+	return 0, false
+}
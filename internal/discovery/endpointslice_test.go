@@ -0,0 +1,131 @@
+package discovery_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+
+	"github.com/castai/gpu-metrics-exporter/internal/discovery"
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func endpoint(ip, node, pod string, ready *bool) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		Addresses:  []string{ip},
+		Conditions: discoveryv1.EndpointConditions{Ready: ready},
+		NodeName:   ptr(node),
+		TargetRef:  &corev1.ObjectReference{Kind: "Pod", Namespace: "gpu-operator", Name: pod},
+	}
+}
+
+func TestEndpointSliceDiscoverer_Targets(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = discoveryv1.AddToScheme(scheme)
+
+	ports := []discoveryv1.EndpointPort{
+		{Name: ptr("gpu-metrics"), Port: ptr(int32(9400))},
+		{Name: ptr("health"), Port: ptr(int32(9401))},
+	}
+	dynClient := fakedynamic.NewSimpleDynamicClient(scheme,
+		&discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "nvidia-dcgm-exporter-v4",
+				Namespace: "gpu-operator",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "nvidia-dcgm-exporter"},
+			},
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Ports:       ports,
+			Endpoints: []discoveryv1.Endpoint{
+				endpoint("10.0.0.1", "gpu-node-1", "nvidia-dcgm-exporter-a", ptr(true)),
+				endpoint("10.0.0.2", "gpu-node-2", "nvidia-dcgm-exporter-b", nil),
+				endpoint("10.0.0.3", "gpu-node-3", "nvidia-dcgm-exporter-c", ptr(false)),
+			},
+		},
+		&discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "nvidia-dcgm-exporter-v6",
+				Namespace: "gpu-operator",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "nvidia-dcgm-exporter"},
+			},
+			AddressType: discoveryv1.AddressTypeIPv6,
+			Ports:       ports,
+			Endpoints: []discoveryv1.Endpoint{
+				endpoint("fd00::1", "gpu-node-1", "nvidia-dcgm-exporter-a", ptr(true)),
+			},
+		},
+		&discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "other",
+				Namespace: "gpu-operator",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "other"},
+			},
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Ports:       ports,
+			Endpoints:   []discoveryv1.Endpoint{endpoint("10.0.0.9", "gpu-node-9", "other", nil)},
+		},
+	)
+
+	t.Run("scrapes ready endpoints of the service on the named port", func(t *testing.T) {
+		r := require.New(t)
+
+		d := discovery.NewEndpointSliceDiscoverer(discovery.EndpointSliceConfig{
+			Namespace: "gpu-operator",
+			Service:   "nvidia-dcgm-exporter",
+			PortName:  "gpu-metrics",
+			Scheme:    "http",
+			Path:      "/metrics",
+		}, dynClient)
+
+		targets, err := d.Targets(context.Background())
+		r.NoError(err)
+		r.ElementsMatch([]exporter.Target{
+			{URL: "http://10.0.0.1:9400/metrics", NodeName: "gpu-node-1", Pod: "nvidia-dcgm-exporter-a", Namespace: "gpu-operator"},
+			{URL: "http://10.0.0.2:9400/metrics", NodeName: "gpu-node-2", Pod: "nvidia-dcgm-exporter-b", Namespace: "gpu-operator"},
+		}, targets)
+	})
+
+	t.Run("scrapes the endpoints of its own node", func(t *testing.T) {
+		r := require.New(t)
+
+		d := discovery.NewEndpointSliceDiscoverer(discovery.EndpointSliceConfig{
+			Namespace: "gpu-operator",
+			Service:   "nvidia-dcgm-exporter",
+			PortName:  "gpu-metrics",
+			Scheme:    "http",
+			Path:      "/metrics",
+			NodeName:  "gpu-node-2",
+		}, dynClient)
+
+		targets, err := d.Targets(context.Background())
+		r.NoError(err)
+		r.Equal([]exporter.Target{
+			{URL: "http://10.0.0.2:9400/metrics", NodeName: "gpu-node-2", Pod: "nvidia-dcgm-exporter-b", Namespace: "gpu-operator"},
+		}, targets)
+	})
+
+	t.Run("skips slices without the named port", func(t *testing.T) {
+		r := require.New(t)
+
+		d := discovery.NewEndpointSliceDiscoverer(discovery.EndpointSliceConfig{
+			Namespace: "gpu-operator",
+			Service:   "nvidia-dcgm-exporter",
+			PortName:  "metrics",
+			Scheme:    "http",
+			Path:      "/metrics",
+		}, dynClient)
+
+		targets, err := d.Targets(context.Background())
+		r.NoError(err)
+		r.Empty(targets)
+	})
+}
@@ -0,0 +1,183 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/castai/gpu-metrics-exporter/internal/alerting"
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/logging"
+)
+
+var (
+	eventGVR = schema.GroupVersionResource{Group: "", Version: "v1", Resource: "events"}
+	nodeGVR  = schema.GroupVersionResource{Group: "", Version: "v1", Resource: "nodes"}
+	podGVR   = schema.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
+)
+
+// xidReasons are the reasons of the events of XID errors by severity.
+var xidReasons = map[exporter.XIDSeverity]string{
+	exporter.XIDSeverityApplication: "GPUApplicationError",
+	exporter.XIDSeverityHardware:    "GPUHardwareError",
+	exporter.XIDSeverityDriver:      "GPUDriverError",
+	exporter.XIDSeverityUnknown:     "GPUXIDError",
+}
+
+type Config struct {
+	// Component is the source of the events, e.g. gpu-metrics-exporter.
+	Component string
+	// Instance identifies the replica reporting the events, e.g. its pod name.
+	Instance string
+}
+
+// Recorder creates Kubernetes Events on the Node and the pods of GPUs which reported an XID error, or which an alert
+// fired for, so that they show up in kubectl describe.
+type Recorder struct {
+	cfg     Config
+	dynamic dynamic.Interface
+	log     *logging.Logger
+}
+
+func NewRecorder(cfg Config, dynClient dynamic.Interface, log *logging.Logger) *Recorder {
+	return &Recorder{
+		cfg:     cfg,
+		dynamic: dynClient,
+		log:     log,
+	}
+}
+
+func (r *Recorder) RecordXID(ctx context.Context, xid exporter.XIDError) {
+	reason, found := xidReasons[xid.Severity]
+	if !found {
+		reason = xidReasons[exporter.XIDSeverityUnknown]
+	}
+	message := fmt.Sprintf("GPU %s (%s) on node %s reported XID %d, %s error: %s",
+		xid.DeviceID, xid.DeviceUUID, xid.NodeName, xid.Code, xid.Severity, xid.Description)
+
+	var refs []corev1.ObjectReference
+	if xid.NodeName != "" {
+		refs = append(refs, r.reference(ctx, nodeGVR, "Node", "", xid.NodeName))
+	}
+	for _, pod := range xid.Pods {
+		refs = append(refs, r.reference(ctx, podGVR, "Pod", pod.Namespace, pod.Name))
+	}
+
+	for _, ref := range refs {
+		if err := r.create(ctx, ref, corev1.EventTypeWarning, reason, message, xid.NodeName); err != nil {
+			r.log.With(
+				"kind", ref.Kind,
+				"name", ref.Name,
+				"error", err.Error(),
+			).Warn("failed to record event of XID error")
+		}
+	}
+}
+
+// reference points at the object an event is about, the UID is left empty when the object can't be read, e.g.
+// for lack of permissions, the event is still listed among the events of the namespace then.
+func (r *Recorder) reference(
+	ctx context.Context,
+	gvr schema.GroupVersionResource,
+	kind, namespace, name string,
+) corev1.ObjectReference {
+	ref := corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       kind,
+		Namespace:  namespace,
+		Name:       name,
+	}
+
+	var obj *unstructured.Unstructured
+	var err error
+	if namespace == "" {
+		obj, err = r.dynamic.Resource(gvr).Get(ctx, name, metav1.GetOptions{})
+	} else {
+		obj, err = r.dynamic.Resource(gvr).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+	if err != nil {
+		r.log.With("kind", kind, "name", name, "error", err.Error()).Debug("failed to get object of event")
+		return ref
+	}
+	ref.UID = obj.GetUID()
+	return ref
+}
+
+// Name tells the recorder apart from the other notifiers of alerts.
+func (r *Recorder) Name() string {
+	return "event"
+}
+
+// Notify records a Warning event when an alert fires and a Normal one when it resolves, with the rule as reason.
+// Alerts of GPUs are recorded on their Node, the ones of pods and workloads on the pods.
+func (r *Recorder) Notify(ctx context.Context, alert alerting.Alert) error {
+	eventType := corev1.EventTypeWarning
+	if alert.State == alerting.StateResolved {
+		eventType = corev1.EventTypeNormal
+	}
+	var node string
+	if len(alert.Nodes) == 1 {
+		node = alert.Nodes[0]
+	}
+
+	var refs []corev1.ObjectReference
+	if alert.GroupBy == alerting.GroupByGPU {
+		for _, node := range alert.Nodes {
+			refs = append(refs, r.reference(ctx, nodeGVR, "Node", "", node))
+		}
+	} else {
+		for _, pod := range alert.Pods {
+			refs = append(refs, r.reference(ctx, podGVR, "Pod", pod.Namespace, pod.Name))
+		}
+	}
+
+	var errs []error
+	for _, ref := range refs {
+		if err := r.create(ctx, ref, eventType, alert.Rule, alert.Message(), node); err != nil {
+			errs = append(errs, fmt.Errorf("recording event on %s %s: %w", ref.Kind, ref.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Recorder) create(ctx context.Context, ref corev1.ObjectReference, eventType, reason, message, node string) error {
+	// the kubelet records the events of nodes in the default namespace as well
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+
+	now := time.Now()
+	event := &corev1.Event{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Event"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", ref.Name, now.UnixNano()),
+			Namespace: namespace,
+		},
+		InvolvedObject:      ref,
+		Reason:              reason,
+		Message:             message,
+		Type:                eventType,
+		Source:              corev1.EventSource{Component: r.cfg.Component, Host: node},
+		FirstTimestamp:      metav1.NewTime(now),
+		LastTimestamp:       metav1.NewTime(now),
+		Count:               1,
+		ReportingController: r.cfg.Component,
+		ReportingInstance:   r.cfg.Instance,
+	}
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(event)
+	if err != nil {
+		return fmt.Errorf("converting event to unstructured: %w", err)
+	}
+	_, err = r.dynamic.Resource(eventGVR).Namespace(namespace).Create(ctx, &unstructured.Unstructured{Object: obj}, metav1.CreateOptions{})
+	return err
+}
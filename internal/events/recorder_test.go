@@ -0,0 +1,133 @@
+package events_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+
+	"github.com/castai/gpu-metrics-exporter/internal/alerting"
+	"github.com/castai/gpu-metrics-exporter/internal/events"
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/logging"
+)
+
+func TestRecorder_RecordXID(t *testing.T) {
+	r := require.New(t)
+	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
+
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	dynClient := fakedynamic.NewSimpleDynamicClient(scheme,
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "gpu-node-1", UID: "node-uid"}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "trainer", Namespace: "ml", UID: "pod-uid"}},
+	)
+
+	recorder := events.NewRecorder(events.Config{Component: "gpu-metrics-exporter", Instance: "exporter-0"}, dynClient, log)
+	severity, description := exporter.ClassifyXID(79)
+	recorder.RecordXID(context.Background(), exporter.XIDError{
+		NodeName:    "gpu-node-1",
+		DeviceUUID:  "GPU-1",
+		DeviceID:    "0",
+		Code:        79,
+		Severity:    severity,
+		Description: description,
+		Pods:        []exporter.PodRef{{Namespace: "ml", Name: "trainer"}, {Namespace: "ml", Name: "gone"}},
+	})
+
+	events := func(namespace string) []corev1.Event {
+		list, err := dynClient.Resource(schema.GroupVersionResource{Version: "v1", Resource: "events"}).
+			Namespace(namespace).List(context.Background(), metav1.ListOptions{})
+		r.NoError(err)
+		var got []corev1.Event
+		for _, item := range list.Items {
+			var event corev1.Event
+			r.NoError(runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &event))
+			got = append(got, event)
+		}
+		return got
+	}
+
+	nodeEvents := events("default")
+	r.Len(nodeEvents, 1)
+	r.Equal(corev1.ObjectReference{APIVersion: "v1", Kind: "Node", Name: "gpu-node-1", UID: "node-uid"}, nodeEvents[0].InvolvedObject)
+	r.Equal("GPUHardwareError", nodeEvents[0].Reason)
+	r.Equal(corev1.EventTypeWarning, nodeEvents[0].Type)
+	r.Equal("GPU 0 (GPU-1) on node gpu-node-1 reported XID 79, hardware error: GPU has fallen off the bus", nodeEvents[0].Message)
+	r.Equal("gpu-metrics-exporter", nodeEvents[0].ReportingController)
+	r.Equal("exporter-0", nodeEvents[0].ReportingInstance)
+
+	podEvents := events("ml")
+	r.Len(podEvents, 2)
+	refs := []corev1.ObjectReference{podEvents[0].InvolvedObject, podEvents[1].InvolvedObject}
+	r.ElementsMatch([]corev1.ObjectReference{
+		{APIVersion: "v1", Kind: "Pod", Namespace: "ml", Name: "trainer", UID: "pod-uid"},
+		// events are recorded even when the pod can't be read
+		{APIVersion: "v1", Kind: "Pod", Namespace: "ml", Name: "gone"},
+	}, refs)
+}
+
+func TestRecorder_Notify(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
+
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	dynClient := fakedynamic.NewSimpleDynamicClient(scheme,
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "gpu-node-1", UID: "node-uid"}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "trainer", Namespace: "ml", UID: "pod-uid"}},
+	)
+	recorder := events.NewRecorder(events.Config{Component: "gpu-metrics-exporter", Instance: "exporter-0"}, dynClient, log)
+	r.Equal("event", recorder.Name())
+
+	list := func(namespace string) []corev1.Event {
+		list, err := dynClient.Resource(schema.GroupVersionResource{Version: "v1", Resource: "events"}).
+			Namespace(namespace).List(ctx, metav1.ListOptions{})
+		r.NoError(err)
+		var got []corev1.Event
+		for _, item := range list.Items {
+			var event corev1.Event
+			r.NoError(runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &event))
+			got = append(got, event)
+		}
+		return got
+	}
+
+	r.NoError(recorder.Notify(ctx, alerting.Alert{
+		Rule:    "GPUHot",
+		Summary: "GPU is hot",
+		State:   alerting.StateFiring,
+		GroupBy: alerting.GroupByGPU,
+		Labels:  map[string]string{"node_name": "gpu-node-1", "device_uuid": "GPU-1"},
+		Value:   91,
+		Nodes:   []string{"gpu-node-1"},
+		Pods:    []exporter.PodRef{{Namespace: "ml", Name: "trainer"}},
+	}))
+	nodeEvents := list("default")
+	r.Len(nodeEvents, 1)
+	r.Equal(corev1.ObjectReference{APIVersion: "v1", Kind: "Node", Name: "gpu-node-1", UID: "node-uid"}, nodeEvents[0].InvolvedObject)
+	r.Equal("GPUHot", nodeEvents[0].Reason)
+	r.Equal(corev1.EventTypeWarning, nodeEvents[0].Type)
+	r.Equal("GPU is hot (device_uuid=GPU-1,node_name=gpu-node-1), value 91", nodeEvents[0].Message)
+	r.Empty(list("ml"))
+
+	r.NoError(recorder.Notify(ctx, alerting.Alert{
+		Rule:    "PodIdle",
+		State:   alerting.StateResolved,
+		GroupBy: alerting.GroupByPod,
+		Labels:  map[string]string{"namespace": "ml", "pod": "trainer"},
+		Nodes:   []string{"gpu-node-1"},
+		Pods:    []exporter.PodRef{{Namespace: "ml", Name: "trainer"}},
+	}))
+	podEvents := list("ml")
+	r.Len(podEvents, 1)
+	r.Equal(corev1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: "ml", Name: "trainer", UID: "pod-uid"}, podEvents[0].InvolvedObject)
+	r.Equal(corev1.EventTypeNormal, podEvents[0].Type)
+	r.Equal("Resolved: PodIdle (namespace=ml,pod=trainer)", podEvents[0].Message)
+}
@@ -0,0 +1,229 @@
+package exporter
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/castai/gpu-metrics-exporter/pb"
+)
+
+const (
+	// MetricClocksEventReason is 1 for every reason holding the clocks of a GPU back and 0 for the others, the
+	// reason label holds the name of the reason.
+	MetricClocksEventReason = MetricName("gpu_clocks_event_reason")
+	// MetricClocksEventSeconds is the time a reason held the clocks of a GPU back since the exporter started.
+	MetricClocksEventSeconds = MetricName("gpu_clocks_event_seconds")
+
+	clocksEventReasonLabel = "reason"
+)
+
+// clocksEventReason is a bit of DCGM_FI_DEV_CLOCKS_EVENT_REASONS, see DCGM_CLOCKS_EVENT_REASON_* in dcgm_fields.h.
+type clocksEventReason struct {
+	name  string
+	bit   uint64
+	field func(m *GPUMetric) *bool
+}
+
+var clocksEventReasons = []clocksEventReason{
+	{name: "gpu_idle", bit: 0x1, field: func(m *GPUMetric) *bool { return &m.ClocksEventGPUIdle }},
+	{name: "applications_clocks_setting", bit: 0x2, field: func(m *GPUMetric) *bool { return &m.ClocksEventApplicationsClocks }},
+	{name: "sw_power_cap", bit: 0x4, field: func(m *GPUMetric) *bool { return &m.ClocksEventSWPowerCap }},
+	{name: "hw_slowdown", bit: 0x8, field: func(m *GPUMetric) *bool { return &m.ClocksEventHWSlowdown }},
+	{name: "sync_boost", bit: 0x10, field: func(m *GPUMetric) *bool { return &m.ClocksEventSyncBoost }},
+	{name: "sw_thermal_slowdown", bit: 0x20, field: func(m *GPUMetric) *bool { return &m.ClocksEventSWThermal }},
+	{name: "hw_thermal_slowdown", bit: 0x40, field: func(m *GPUMetric) *bool { return &m.ClocksEventHWThermal }},
+	{name: "hw_power_brake_slowdown", bit: 0x80, field: func(m *GPUMetric) *bool { return &m.ClocksEventHWPowerBrake }},
+	{name: "display_clock_setting", bit: 0x100, field: func(m *GPUMetric) *bool { return &m.ClocksEventDisplayClock }},
+}
+
+// clocksEventMask converts the bitmask, which dcgm-exporter exposes as a float, back to an integer. Values which
+// can't be a bitmask have no reasons set.
+func clocksEventMask(value float64) uint64 {
+	if math.IsNaN(value) || value < 0 || value >= math.MaxUint64 {
+		return 0
+	}
+	return uint64(value)
+}
+
+func (m *GPUMetric) setClocksEventReasons(value float64) {
+	mask := clocksEventMask(value)
+	for _, reason := range clocksEventReasons {
+		*reason.field(m) = mask&reason.bit != 0
+	}
+}
+
+// clocksEventReasonMeasurements decodes a DCGM_FI_DEV_CLOCKS_EVENT_REASONS measurement into a measurement per reason.
+func clocksEventReasonMeasurements(value float64, labels []*pb.Metric_Label) []*pb.Metric_Measurement {
+	mask := clocksEventMask(value)
+	measurements := make([]*pb.Metric_Measurement, 0, len(clocksEventReasons))
+	for _, reason := range clocksEventReasons {
+		measurements = append(measurements, &pb.Metric_Measurement{
+			Value:  boolToFloat(mask&reason.bit != 0),
+			Labels: withLabel(labels, clocksEventReasonLabel, reason.name),
+		})
+	}
+	return measurements
+}
+
+type ClockEventsConfig struct {
+	// MaxGap is the longest interval between two scrapes which is counted, the reasons of longer intervals, e.g.
+	// while a dcgm-exporter was unavailable, are unknown.
+	MaxGap time.Duration
+}
+
+type clocksEventSeries struct {
+	labels  []*pb.Metric_Label
+	seconds []float64
+
+	// the previous sample
+	at   time.Time
+	mask uint64
+}
+
+// clocksEventTimer counts how long every reason held the clocks of every GPU back. The reasons of a scrape are
+// assumed to hold until the next scrape of the GPU.
+type clocksEventTimer struct {
+	cfg    ClockEventsConfig
+	series map[gpuSeriesKey]*clocksEventSeries
+}
+
+// gpuSeriesKey identifies a GPU, or a MIG instance, of a node.
+type gpuSeriesKey struct {
+	node          string
+	uuid          string
+	migProfile    string
+	migInstanceID string
+}
+
+func newClocksEventTimer(cfg ClockEventsConfig) *clocksEventTimer {
+	return &clocksEventTimer{
+		cfg:    cfg,
+		series: make(map[gpuSeriesKey]*clocksEventSeries),
+	}
+}
+
+// update counts the time since the previous scrape of the GPUs in the batch and returns their
+// gpu_clocks_event_seconds metric, nil if the batch has no clocks event reasons.
+func (c *clocksEventTimer) update(batch *pb.MetricsBatch, results []ScrapeResult) *pb.Metric {
+	scrapedAt, latest := scrapeTimes(results)
+
+	var keys []gpuSeriesKey
+	seen := make(map[gpuSeriesKey]struct{})
+	for _, metric := range batch.Metrics {
+		if metric.Name != MetricClocksEventReasons {
+			continue
+		}
+		for _, measurement := range metric.Measurements {
+			key := gpuSeriesKey{
+				node:          labelValue(measurement.Labels, nodeNameLabel),
+				uuid:          labelValue(measurement.Labels, gpuUUIDLabel),
+				migProfile:    labelValue(measurement.Labels, gpuMIGProfile),
+				migInstanceID: labelValue(measurement.Labels, gpuInstanceID),
+			}
+			// measurements of pods sharing a GPU repeat its reasons
+			if _, found := seen[key]; found || key.uuid == "" {
+				continue
+			}
+			seen[key] = struct{}{}
+
+			at, found := scrapedAt[key.node]
+			if !found {
+				at = latest
+			}
+
+			series, found := c.series[key]
+			if !found {
+				series = &clocksEventSeries{
+					labels:  gpuLabels(measurement.Labels),
+					seconds: make([]float64, len(clocksEventReasons)),
+				}
+				c.series[key] = series
+			}
+			series.add(at, clocksEventMask(measurement.Value), c.cfg.MaxGap)
+			keys = append(keys, key)
+		}
+	}
+
+	for key, series := range c.series {
+		if latest.Sub(series.at) > seriesRetention {
+			delete(c.series, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Slice(keys, func(a, b int) bool { return keys[a].less(keys[b]) })
+
+	metric := &pb.Metric{Name: MetricClocksEventSeconds}
+	for _, key := range keys {
+		series := c.series[key]
+		for i, reason := range clocksEventReasons {
+			metric.Measurements = append(metric.Measurements, &pb.Metric_Measurement{
+				Value:  series.seconds[i],
+				Labels: withLabel(series.labels, clocksEventReasonLabel, reason.name),
+			})
+		}
+	}
+	return metric
+}
+
+// forget drops the series of the node, e.g. when another replica took over the node.
+func (c *clocksEventTimer) forget(node string) {
+	for key := range c.series {
+		if key.node == node {
+			delete(c.series, key)
+		}
+	}
+}
+
+func (s *clocksEventSeries) add(at time.Time, mask uint64, maxGap time.Duration) {
+	if !s.at.IsZero() {
+		if !at.After(s.at) {
+			return
+		}
+		elapsed := at.Sub(s.at)
+		if maxGap <= 0 || elapsed <= maxGap {
+			for i, reason := range clocksEventReasons {
+				if s.mask&reason.bit != 0 {
+					s.seconds[i] += elapsed.Seconds()
+				}
+			}
+		}
+	}
+	s.at = at
+	s.mask = mask
+}
+
+func (k gpuSeriesKey) less(o gpuSeriesKey) bool {
+	if k.node != o.node {
+		return k.node < o.node
+	}
+	if k.uuid != o.uuid {
+		return k.uuid < o.uuid
+	}
+	if k.migProfile != o.migProfile {
+		return k.migProfile < o.migProfile
+	}
+	return k.migInstanceID < o.migInstanceID
+}
+
+// gpuLabels keeps the labels identifying the GPU of a measurement.
+func gpuLabels(labels []*pb.Metric_Label) []*pb.Metric_Label {
+	kept := make([]*pb.Metric_Label, 0, len(labels))
+	for _, label := range labels {
+		switch label.Name {
+		case nodeNameLabel, gpuUUIDLabel, gpuIDLabel, modelNameLabel, deviceLabel, gpuMIGProfile, gpuInstanceID:
+			kept = append(kept, label)
+		}
+	}
+	return kept
+}
+
+// withLabel returns a copy of the labels with another label appended.
+func withLabel(labels []*pb.Metric_Label, name, value string) []*pb.Metric_Label {
+	copied := make([]*pb.Metric_Label, len(labels), len(labels)+1)
+	copy(copied, labels)
+	return append(copied, &pb.Metric_Label{Name: name, Value: value})
+}
@@ -0,0 +1,128 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/castai/gpu-metrics-exporter/pb"
+)
+
+func TestClocksEventTimer_Update(t *testing.T) {
+	const (
+		idle      = 0x1
+		powerCap  = 0x4
+		hwThermal = 0x40
+	)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	type step struct {
+		at      time.Duration
+		reasons map[string]float64
+		// seconds are keyed by node/uuid/reason, reasons which never held are left out.
+		seconds map[string]float64
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "counts the time every reason held until the next scrape",
+			steps: []step{
+				{reasons: map[string]float64{"GPU-1": idle}, seconds: map[string]float64{}},
+				{
+					at:      15 * time.Second,
+					reasons: map[string]float64{"GPU-1": powerCap | hwThermal},
+					seconds: map[string]float64{"node-a/GPU-1/gpu_idle": 15},
+				},
+				{
+					at:      45 * time.Second,
+					reasons: map[string]float64{"GPU-1": powerCap},
+					seconds: map[string]float64{
+						"node-a/GPU-1/gpu_idle": 15, "node-a/GPU-1/sw_power_cap": 30, "node-a/GPU-1/hw_thermal_slowdown": 30,
+					},
+				},
+				// the dcgm-exporter was unavailable for longer than the max gap
+				{
+					at:      5 * time.Minute,
+					reasons: map[string]float64{"GPU-1": idle},
+					seconds: map[string]float64{
+						"node-a/GPU-1/gpu_idle": 15, "node-a/GPU-1/sw_power_cap": 30, "node-a/GPU-1/hw_thermal_slowdown": 30,
+					},
+				},
+			},
+		},
+		{
+			name: "only reports the GPUs of the batch",
+			steps: []step{
+				{reasons: map[string]float64{"GPU-1": idle, "GPU-2": powerCap}, seconds: map[string]float64{}},
+				{
+					at:      10 * time.Second,
+					reasons: map[string]float64{"GPU-1": idle},
+					seconds: map[string]float64{"node-a/GPU-1/gpu_idle": 10},
+				},
+			},
+		},
+		{
+			name: "forgets GPUs which haven't been scraped for the retention",
+			steps: []step{
+				{reasons: map[string]float64{"GPU-1": idle, "GPU-2": idle}, seconds: map[string]float64{}},
+				{
+					at:      10 * time.Second,
+					reasons: map[string]float64{"GPU-1": idle, "GPU-2": idle},
+					seconds: map[string]float64{"node-a/GPU-1/gpu_idle": 10, "node-a/GPU-2/gpu_idle": 10},
+				},
+				{
+					at:      10*time.Second + seriesRetention + time.Second,
+					reasons: map[string]float64{"GPU-1": idle},
+					seconds: map[string]float64{"node-a/GPU-1/gpu_idle": 10},
+				},
+				{
+					at:      20*time.Second + seriesRetention,
+					reasons: map[string]float64{"GPU-1": idle, "GPU-2": idle},
+					seconds: map[string]float64{"node-a/GPU-1/gpu_idle": 19},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := require.New(t)
+			timer := newClocksEventTimer(ClockEventsConfig{MaxGap: time.Minute})
+
+			for i, step := range tt.steps {
+				metric := &pb.Metric{Name: MetricClocksEventReasons}
+				for uuid, reasons := range step.reasons {
+					// pods sharing the GPU report the same reasons
+					for _, pod := range []string{"a", "b"} {
+						metric.Measurements = append(metric.Measurements, &pb.Metric_Measurement{Value: reasons, Labels: []*pb.Metric_Label{
+							{Name: nodeNameLabel, Value: "node-a"},
+							{Name: gpuUUIDLabel, Value: uuid},
+							{Name: podLabel, Value: pod},
+						}})
+					}
+				}
+				results := []ScrapeResult{{Target: Target{NodeName: "node-a"}, Timestamp: start.Add(step.at)}}
+
+				seconds := timer.update(&pb.MetricsBatch{Metrics: []*pb.Metric{metric}}, results)
+				r.NotNil(seconds, "step %d", i)
+				r.Len(seconds.Measurements, len(step.reasons)*len(clocksEventReasons), "step %d", i)
+				got := make(map[string]float64)
+				for _, m := range seconds.Measurements {
+					if m.Value > 0 {
+						got[labelValue(m.Labels, nodeNameLabel)+"/"+labelValue(m.Labels, gpuUUIDLabel)+"/"+
+							labelValue(m.Labels, clocksEventReasonLabel)] = m.Value
+					}
+				}
+				r.Equal(step.seconds, got, "step %d", i)
+			}
+		})
+	}
+
+	t.Run("returns nil without clocks event reasons", func(t *testing.T) {
+		r := require.New(t)
+		timer := newClocksEventTimer(ClockEventsConfig{})
+		r.Nil(timer.update(&pb.MetricsBatch{}, nil))
+	})
+}
@@ -0,0 +1,76 @@
+package exporter_test
+
+import (
+	"context"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	workload_mock "github.com/castai/gpu-metrics-exporter/mock/workload"
+	"github.com/castai/gpu-metrics-exporter/pb"
+	"github.com/castai/logging"
+)
+
+func TestMetricMapper_ClocksEventReasons(t *testing.T) {
+	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
+	resolver := workload_mock.NewMockResolver(t)
+	mapper := exporter.NewMapper(exporter.MapperConfig{NodeName: "gpu-node-1"}, resolver, log)
+
+	// SW power cap, HW thermal slowdown and a bit no reason is known for
+	families := exporter.MetricFamilyMap{
+		exporter.MetricClocksEventReasons: {
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{newLabelPair("UUID", "GPU-1")},
+					Gauge: newGauge(0x4 | 0x40 | 0x1000),
+				},
+			},
+		},
+	}
+
+	t.Run("decodes the bitmask into a measurement per reason", func(t *testing.T) {
+		r := require.New(t)
+
+		got := mapper.Map([]exporter.ScrapeResult{{Families: families}})
+
+		reasons := make(map[string]float64)
+		for _, metric := range got.Metrics {
+			if metric.Name != exporter.MetricClocksEventReason {
+				continue
+			}
+			for _, m := range metric.Measurements {
+				r.Equal([]*pb.Metric_Label{{Name: "UUID", Value: "GPU-1"}, {Name: "Hostname", Value: "gpu-node-1"}}, m.Labels[:2])
+				r.Equal("reason", m.Labels[2].Name)
+				reasons[m.Labels[2].Value] = m.Value
+			}
+		}
+		r.Equal(map[string]float64{
+			"gpu_idle":                    0,
+			"applications_clocks_setting": 0,
+			"sw_power_cap":                1,
+			"hw_slowdown":                 0,
+			"sync_boost":                  0,
+			"sw_thermal_slowdown":         0,
+			"hw_thermal_slowdown":         1,
+			"hw_power_brake_slowdown":     0,
+			"display_clock_setting":       0,
+		}, reasons)
+	})
+
+	t.Run("decodes the bitmask into row fields", func(t *testing.T) {
+		r := require.New(t)
+
+		got := mapper.MapToAvro(context.Background(), []exporter.ScrapeResult{{Families: families}})
+
+		r.Len(got, 1)
+		r.True(got[0].ClocksEventSWPowerCap)
+		r.True(got[0].ClocksEventHWThermal)
+		r.False(got[0].ClocksEventGPUIdle)
+		r.False(got[0].ClocksEventHWSlowdown)
+		r.False(got[0].ClocksEventHWPowerBrake)
+		r.Equal(float64(0x4|0x40|0x1000), *got[0].ClocksEventReasons)
+	})
+}
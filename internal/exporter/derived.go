@@ -0,0 +1,275 @@
+package exporter
+
+import (
+	client_model "github.com/prometheus/client_model/go"
+
+	"github.com/castai/gpu-metrics-exporter/pb"
+)
+
+// Derived metrics are computed per GPU from the DCGM metrics of the same scrape, so that consumers don't have to
+// recompute them.
+const (
+	// MetricFramebufferUtilization is the used share of the framebuffer in percent.
+	MetricFramebufferUtilization = MetricName("gpu_framebuffer_utilization_percent")
+	// MetricPowerUtilization is the power usage in percent of the power limit.
+	MetricPowerUtilization = MetricName("gpu_power_utilization_percent")
+	// MetricTensorActiveShare is the share of the active SM cycles in which the tensor cores were busy, 0 to 1.
+	MetricTensorActiveShare = MetricName("gpu_tensor_active_share")
+	// MetricEffectiveUtilization scores how well the GPU is used from 0 to 1, see effectiveUtilization.
+	MetricEffectiveUtilization = MetricName("gpu_effective_utilization")
+	// MetricIdle is 1 when the effective utilization is below idleThreshold and 0 otherwise.
+	MetricIdle = MetricName("gpu_idle")
+)
+
+// idleThreshold is the effective utilization below which a GPU is considered idle.
+const idleThreshold = 0.01
+
+// Weights of the effective utilization when profiling metrics are available. SM activity dominates since it's the
+// closest to how much of the GPU does work, occupancy and memory bandwidth tell how well that work uses it.
+const (
+	effectiveSMActiveWeight    = 0.6
+	effectiveSMOccupancyWeight = 0.2
+	effectiveDRAMActiveWeight  = 0.2
+)
+
+var profilingMetrics = []MetricName{
+	MetricStreamingMultiProcessorActive,
+	MetricStreamingMultiProcessorOccupancy,
+	MetricDRAMActive,
+}
+
+type derivedMetric struct {
+	name MetricName
+	// inputs are the DCGM metrics the value is computed from, it's only mapped when one of them was reported.
+	inputs []MetricName
+	value  func(m *GPUMetric) (float64, bool)
+}
+
+var derivedMetrics = []derivedMetric{
+	{
+		name:   MetricFramebufferUtilization,
+		inputs: []MetricName{MetricFrameBufferUsed},
+		value:  framebufferUtilization,
+	},
+	{
+		name:   MetricPowerUtilization,
+		inputs: []MetricName{MetricPowerLimit},
+		value:  powerUtilization,
+	},
+	{
+		name:   MetricTensorActiveShare,
+		inputs: []MetricName{MetricStreamingMultiProcessorTensorActive},
+		value:  tensorActiveShare,
+	},
+	{
+		name:   MetricEffectiveUtilization,
+		inputs: append([]MetricName{MetricGPUUtilization}, profilingMetrics...),
+		value: func(m *GPUMetric) (float64, bool) {
+			return valueOf(m.EffectiveUtilization)
+		},
+	},
+	{
+		name:   MetricIdle,
+		inputs: append([]MetricName{MetricGPUUtilization}, profilingMetrics...),
+		value: func(m *GPUMetric) (float64, bool) {
+			return boolValueOf(m.Idle)
+		},
+	},
+}
+
+// derive computes the derived fields from the DCGM fields, the ones which can't be computed are nil.
+func (m *GPUMetric) derive() {
+	m.FramebufferUtilization = derivedValue(framebufferUtilization(m))
+	m.PowerUtilization = derivedValue(powerUtilization(m))
+	m.TensorActiveShare = derivedValue(tensorActiveShare(m))
+	m.EffectiveUtilization = derivedValue(effectiveUtilization(m))
+	m.Idle = nil
+	if effective, ok := valueOf(m.EffectiveUtilization); ok {
+		idle := effective < idleThreshold
+		m.Idle = &idle
+	}
+}
+
+func derivedValue(value float64, ok bool) *float64 {
+	if !ok {
+		return nil
+	}
+	return &value
+}
+
+// framebufferUtilization relates the used framebuffer to the total one, which is the sum of the used and the free
+// framebuffer when dcgm-exporter doesn't report it.
+func framebufferUtilization(m *GPUMetric) (float64, bool) {
+	used, ok := valueOf(m.FramebufferUsed)
+	if !ok {
+		return 0, false
+	}
+	total := orZero(m.FramebufferTotal)
+	if total == 0 {
+		total = used + orZero(m.FramebufferFree)
+	}
+	if total <= 0 {
+		return 0, false
+	}
+	return used / total * 100, true
+}
+
+func powerUtilization(m *GPUMetric) (float64, bool) {
+	usage, ok := valueOf(m.PowerUsage)
+	limit := orZero(m.PowerLimit)
+	if !ok || limit <= 0 {
+		return 0, false
+	}
+	return usage / limit * 100, true
+}
+
+// tensorActiveShare is 0 for GPUs without active SMs. Both ratios are averaged over the sampling period by DCGM,
+// so the share is capped at 1.
+func tensorActiveShare(m *GPUMetric) (float64, bool) {
+	tensorActive, ok := valueOf(m.TensorActive)
+	if !ok {
+		return 0, false
+	}
+	smActive := orZero(m.SMActive)
+	if smActive <= 0 {
+		return 0, true
+	}
+	return min(tensorActive/smActive, 1), true
+}
+
+// effectiveUtilization weighs the SM activity, the SM occupancy and the memory bandwidth utilization when
+// profiling metrics are reported. Otherwise it falls back to the GPU utilization, which only tells whether a
+// kernel was running and overestimates how much of the GPU is used. GPUs which reported neither have none.
+func effectiveUtilization(m *GPUMetric) (float64, bool) {
+	smActive, smOccupancy, dramActive := orZero(m.SMActive), orZero(m.SMOccupancy), orZero(m.DRAMActive)
+	if smActive > 0 || smOccupancy > 0 || dramActive > 0 {
+		return min(effectiveSMActiveWeight*smActive+
+			effectiveSMOccupancyWeight*smOccupancy+
+			effectiveDRAMActiveWeight*dramActive, 1), true
+	}
+	if utilization, ok := valueOf(m.GPUUtilization); ok {
+		return min(utilization/100, 1), true
+	}
+	return 0, m.SMActive != nil || m.SMOccupancy != nil || m.DRAMActive != nil
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// derivedGPU collects the DCGM metrics of a GPU in Map to compute its derived metrics.
+type derivedGPU struct {
+	metric   GPUMetric
+	reported map[MetricName]struct{}
+	labels   []*pb.Metric_Label
+}
+
+// derivedGPUs groups the measurements of a batch by GPU in the order the GPUs were seen.
+type derivedGPUs struct {
+	gpus  map[derivedGPUKey]*derivedGPU
+	order []derivedGPUKey
+}
+
+type derivedGPUKey struct {
+	node string
+	gpuMetricKey
+}
+
+// gpuIdentityLabels are the labels of the DCGM measurements which are kept on the derived ones.
+var gpuIdentityLabels = map[string]struct{}{
+	nodeNameLabel:  {},
+	modelNameLabel: {},
+	deviceLabel:    {},
+	gpuIDLabel:     {},
+	gpuUUIDLabel:   {},
+	gpuMIGProfile:  {},
+	gpuInstanceID:  {},
+	podLabel:       {},
+	containerLabel: {},
+	namespaceLabel: {},
+}
+
+func newDerivedGPUs() *derivedGPUs {
+	return &derivedGPUs{gpus: make(map[derivedGPUKey]*derivedGPU)}
+}
+
+// add records a measurement, measurements which can't be told apart by GPU are ignored.
+func (d *derivedGPUs) add(name MetricName, value float64, labelPairs []*client_model.LabelPair, nodeName string, targetLabels map[string]string) {
+	key := derivedGPUKey{
+		node: nodeName,
+		gpuMetricKey: gpuMetricKey{
+			device:        getLabelValue(labelPairs, deviceLabel),
+			pod:           getLabelValue(labelPairs, podLabel),
+			namespace:     getLabelValue(labelPairs, namespaceLabel),
+			container:     getLabelValue(labelPairs, containerLabel),
+			deviceID:      getLabelValue(labelPairs, gpuIDLabel),
+			deviceUUID:    getLabelValue(labelPairs, gpuUUIDLabel),
+			MIGProfile:    getLabelValue(labelPairs, gpuMIGProfile),
+			MIGInstanceID: getLabelValue(labelPairs, gpuInstanceID),
+		},
+	}
+	if key.deviceUUID == "" && key.deviceID == "" {
+		return
+	}
+
+	gpu, found := d.gpus[key]
+	if !found {
+		identity := make([]*client_model.LabelPair, 0, len(labelPairs))
+		for _, label := range labelPairs {
+			if _, found := gpuIdentityLabels[label.GetName()]; found {
+				identity = append(identity, label)
+			}
+		}
+		gpu = &derivedGPU{
+			reported: make(map[MetricName]struct{}),
+			labels:   mapLabels(identity, nodeName, targetLabels),
+		}
+		d.gpus[key] = gpu
+		d.order = append(d.order, key)
+	}
+
+	gpu.metric.set(name, value)
+	gpu.reported[name] = struct{}{}
+}
+
+// metrics returns the derived metrics of all GPUs, metrics which couldn't be computed for any GPU are left out.
+func (d *derivedGPUs) metrics() []*pb.Metric {
+	for _, key := range d.order {
+		d.gpus[key].metric.derive()
+	}
+
+	var metrics []*pb.Metric
+	for _, derived := range derivedMetrics {
+		metric := &pb.Metric{Name: derived.name}
+		for _, key := range d.order {
+			gpu := d.gpus[key]
+			if !gpu.reportedAny(derived.inputs) {
+				continue
+			}
+			value, ok := derived.value(&gpu.metric)
+			if !ok {
+				continue
+			}
+			metric.Measurements = append(metric.Measurements, &pb.Metric_Measurement{
+				Value:  value,
+				Labels: gpu.labels,
+			})
+		}
+		if len(metric.Measurements) > 0 {
+			metrics = append(metrics, metric)
+		}
+	}
+	return metrics
+}
+
+func (g *derivedGPU) reportedAny(names []MetricName) bool {
+	for _, name := range names {
+		if _, found := g.reported[name]; found {
+			return true
+		}
+	}
+	return false
+}
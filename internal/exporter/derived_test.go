@@ -0,0 +1,189 @@
+package exporter_test
+
+import (
+	"context"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	workload_mock "github.com/castai/gpu-metrics-exporter/mock/workload"
+	"github.com/castai/gpu-metrics-exporter/pb"
+	"github.com/castai/logging"
+)
+
+func gpuFamilies(uuid string, values map[exporter.MetricName]float64) exporter.MetricFamilyMap {
+	families := exporter.MetricFamilyMap{}
+	for name, value := range values {
+		families[name] = &dto.MetricFamily{
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{
+						newLabelPair("UUID", uuid),
+						newLabelPair("gpu", "0"),
+						newLabelPair("modelName", "NVIDIA A100-SXM4-40GB"),
+						newLabelPair("DCGM_FI_DRIVER_VERSION", "550.54.15"),
+					},
+					Gauge: newGauge(value),
+				},
+			},
+		}
+	}
+	return families
+}
+
+func TestMetricMapper_DerivedMetrics(t *testing.T) {
+	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
+	resolver := workload_mock.NewMockResolver(t)
+	mapper := exporter.NewMapper(exporter.MapperConfig{NodeName: "gpu-node-1"}, resolver, log)
+
+	tests := []struct {
+		name     string
+		values   map[exporter.MetricName]float64
+		expected exporter.GPUMetric
+	}{
+		{
+			name: "framebuffer utilization relates used to total framebuffer",
+			values: map[exporter.MetricName]float64{
+				exporter.MetricFrameBufferTotal: 40960,
+				exporter.MetricFrameBufferUsed:  10240,
+				exporter.MetricFrameBufferFree:  30000,
+			},
+			expected: exporter.GPUMetric{FramebufferUtilization: ptr(25.0)},
+		},
+		{
+			name: "framebuffer total falls back to used and free framebuffer",
+			values: map[exporter.MetricName]float64{
+				exporter.MetricFrameBufferUsed: 3000,
+				exporter.MetricFrameBufferFree: 1000,
+			},
+			expected: exporter.GPUMetric{FramebufferUtilization: ptr(75.0)},
+		},
+		{
+			name: "power utilization relates usage to the power limit",
+			values: map[exporter.MetricName]float64{
+				exporter.MetricPowerUsage: 200,
+				exporter.MetricPowerLimit: 400,
+			},
+			expected: exporter.GPUMetric{PowerUtilization: ptr(50.0)},
+		},
+		{
+			name: "tensor share is relative to active SM cycles and capped at 1",
+			values: map[exporter.MetricName]float64{
+				exporter.MetricStreamingMultiProcessorActive:       0.5,
+				exporter.MetricStreamingMultiProcessorTensorActive: 0.6,
+			},
+			expected: exporter.GPUMetric{TensorActiveShare: ptr(1.0), EffectiveUtilization: ptr(0.3), Idle: ptr(false)},
+		},
+		{
+			name: "effective utilization weighs profiling metrics",
+			values: map[exporter.MetricName]float64{
+				exporter.MetricStreamingMultiProcessorActive:       0.8,
+				exporter.MetricStreamingMultiProcessorOccupancy:    0.5,
+				exporter.MetricStreamingMultiProcessorTensorActive: 0.4,
+				exporter.MetricDRAMActive:                          0.25,
+				exporter.MetricGPUUtilization:                      100,
+			},
+			expected: exporter.GPUMetric{TensorActiveShare: ptr(0.5), EffectiveUtilization: ptr(0.6*0.8 + 0.2*0.5 + 0.2*0.25), Idle: ptr(false)},
+		},
+		{
+			name: "effective utilization falls back to GPU utilization",
+			values: map[exporter.MetricName]float64{
+				exporter.MetricGPUUtilization: 40,
+			},
+			expected: exporter.GPUMetric{EffectiveUtilization: ptr(0.4), Idle: ptr(false)},
+		},
+		{
+			name:     "GPU without activity is idle",
+			values:   map[exporter.MetricName]float64{exporter.MetricGPUUtilization: 0},
+			expected: exporter.GPUMetric{EffectiveUtilization: ptr(0.0), Idle: ptr(true)},
+		},
+		{
+			name: "power utilization needs the power usage",
+			values: map[exporter.MetricName]float64{
+				exporter.MetricPowerLimit: 400,
+			},
+			expected: exporter.GPUMetric{},
+		},
+		{
+			name:     "idle GPUs are told apart from GPUs without activity metrics",
+			values:   map[exporter.MetricName]float64{exporter.MetricStreamingMultiProcessorActive: 0},
+			expected: exporter.GPUMetric{EffectiveUtilization: ptr(0.0), Idle: ptr(true)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := require.New(t)
+
+			got := mapper.MapToAvro(context.Background(), []exporter.ScrapeResult{{Families: gpuFamilies("GPU-1", tt.values)}})
+			r.Len(got, 1)
+			inDelta := func(expected, actual *float64) {
+				if expected == nil {
+					r.Nil(actual)
+					return
+				}
+				r.NotNil(actual)
+				r.InDelta(*expected, *actual, 1e-9)
+			}
+			inDelta(tt.expected.FramebufferUtilization, got[0].FramebufferUtilization)
+			inDelta(tt.expected.PowerUtilization, got[0].PowerUtilization)
+			inDelta(tt.expected.TensorActiveShare, got[0].TensorActiveShare)
+			inDelta(tt.expected.EffectiveUtilization, got[0].EffectiveUtilization)
+			r.Equal(tt.expected.Idle, got[0].Idle)
+		})
+	}
+
+	t.Run("derived metrics are added to the batch with the labels identifying the GPU", func(t *testing.T) {
+		r := require.New(t)
+
+		got := mapper.Map([]exporter.ScrapeResult{{
+			Target: exporter.Target{Labels: map[string]string{"cluster": "prod"}},
+			Families: gpuFamilies("GPU-1", map[exporter.MetricName]float64{
+				exporter.MetricPowerUsage:     100,
+				exporter.MetricPowerLimit:     400,
+				exporter.MetricGPUUtilization: 30,
+			}),
+		}})
+
+		labels := []*pb.Metric_Label{
+			{Name: "UUID", Value: "GPU-1"},
+			{Name: "gpu", Value: "0"},
+			{Name: "modelName", Value: "NVIDIA A100-SXM4-40GB"},
+			{Name: "Hostname", Value: "gpu-node-1"},
+			{Name: "cluster", Value: "prod"},
+		}
+		derived := make(map[string]*pb.Metric_Measurement)
+		for _, metric := range got.Metrics {
+			if metric.Name == exporter.MetricPowerUtilization ||
+				metric.Name == exporter.MetricEffectiveUtilization ||
+				metric.Name == exporter.MetricIdle {
+				r.Len(metric.Measurements, 1)
+				derived[metric.Name] = metric.Measurements[0]
+			}
+			// no framebuffer or profiling metrics to derive from
+			r.NotEqual(exporter.MetricFramebufferUtilization, metric.Name)
+			r.NotEqual(exporter.MetricTensorActiveShare, metric.Name)
+		}
+		r.Len(derived, 3)
+		r.Equal(&pb.Metric_Measurement{Value: 25, Labels: labels}, derived[exporter.MetricPowerUtilization])
+		r.Equal(&pb.Metric_Measurement{Value: 0.3, Labels: labels}, derived[exporter.MetricEffectiveUtilization])
+		r.Equal(&pb.Metric_Measurement{Value: 0, Labels: labels}, derived[exporter.MetricIdle])
+	})
+
+	t.Run("measurements which don't identify a GPU aren't derived from", func(t *testing.T) {
+		r := require.New(t)
+
+		got := mapper.Map([]exporter.ScrapeResult{{Families: exporter.MetricFamilyMap{
+			exporter.MetricGPUUtilization: {
+				Type:   dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{{Gauge: newGauge(50)}},
+			},
+		}}})
+
+		r.Len(got.Metrics, 1)
+		r.Equal(exporter.MetricGPUUtilization, got.Metrics[0].Name)
+	})
+}
@@ -0,0 +1,371 @@
+package exporter
+
+import (
+	"sort"
+	"time"
+
+	"github.com/castai/gpu-metrics-exporter/pb"
+)
+
+// Energy metrics are cumulative since the exporter started, like counters they restart from 0 when it restarts.
+const (
+	// MetricEnergy is the energy consumed by a GPU in joules.
+	MetricEnergy = MetricName("gpu_energy_joules")
+	// MetricPodEnergy is the energy consumed by a GPU while it was assigned to a pod in joules.
+	MetricPodEnergy = MetricName("gpu_pod_energy_joules")
+	// MetricCarbon is the estimated emissions of the energy consumed by a GPU in grams of CO2 equivalent.
+	MetricCarbon = MetricName("gpu_carbon_grams")
+	// MetricPodCarbon is the estimated emissions of the energy consumed by a GPU for a pod in grams of CO2 equivalent.
+	MetricPodCarbon = MetricName("gpu_pod_carbon_grams")
+)
+
+const (
+	joulesPerKilowattHour = 3.6e6
+	// seriesRetention is how long the state of series which are no longer reported is kept, e.g. of completed
+	// pods.
+	seriesRetention = time.Hour
+)
+
+type EnergyConfig struct {
+	// MaxGap is the longest interval between two power samples which is integrated, longer intervals, e.g. while
+	// a dcgm-exporter was unavailable, are skipped since the power in between is unknown. The total energy
+	// consumption counter of the GPU is accurate across gaps and used instead when it's exposed.
+	MaxGap time.Duration
+	// CarbonIntensity is the grid intensity in gCO2e/kWh, carbon estimates are added when it's set.
+	CarbonIntensity float64
+	// CarbonIntensityZones overrides CarbonIntensity for the GPUs whose ZoneLabel has the zone as value.
+	CarbonIntensityZones map[string]float64
+	ZoneLabel            string
+}
+
+type energySeriesKey struct {
+	node          string
+	uuid          string
+	migProfile    string
+	migInstanceID string
+	namespace     string
+	pod           string
+	container     string
+}
+
+type energySeries struct {
+	labels []*pb.Metric_Label
+	zone   string
+	joules float64
+
+	// the previous sample, hasPower and hasCounter tell whether it had the power and the energy counter
+	at         time.Time
+	power      float64
+	hasPower   bool
+	counter    float64
+	hasCounter bool
+}
+
+type energySample struct {
+	power      float64
+	hasPower   bool
+	counter    float64
+	hasCounter bool
+}
+
+// energyMeter integrates the power of every GPU, and of every pod a GPU is assigned to, over the scrapes.
+type energyMeter struct {
+	cfg    EnergyConfig
+	series map[energySeriesKey]*energySeries
+}
+
+func newEnergyMeter(cfg EnergyConfig) *energyMeter {
+	return &energyMeter{
+		cfg:    cfg,
+		series: make(map[energySeriesKey]*energySeries),
+	}
+}
+
+// update adds the energy consumed since the previous batch to the series of the GPUs in the batch and returns
+// their energy, and carbon, metrics. Samples are taken at the time their node was scraped. The energy of a GPU is
+// split evenly between the pods it's assigned to, e.g. with time-slicing or MPS, so that the pods of a GPU don't
+// add up to more than its energy.
+func (e *energyMeter) update(batch *pb.MetricsBatch, results []ScrapeResult) []*pb.Metric {
+	scrapedAt, latest := scrapeTimes(results)
+
+	samples := make(map[energySeriesKey]*energySample)
+	labels := make(map[energySeriesKey][]*pb.Metric_Label)
+	pods := make(map[energySeriesKey]map[energySeriesKey]struct{})
+	for _, metric := range batch.Metrics {
+		if metric.Name != MetricPowerUsage && metric.Name != MetricTotalEnergyConsumption {
+			continue
+		}
+		for _, measurement := range metric.Measurements {
+			gpuKey, podKey, found := energySeriesKeys(measurement.Labels)
+			if !found {
+				continue
+			}
+			sample, found := samples[gpuKey]
+			if !found {
+				sample = &energySample{}
+				samples[gpuKey] = sample
+				labels[gpuKey] = e.seriesLabels(gpuKey, measurement.Labels)
+			}
+			switch metric.Name {
+			case MetricPowerUsage:
+				sample.power, sample.hasPower = measurement.Value, true
+			case MetricTotalEnergyConsumption:
+				sample.counter, sample.hasCounter = measurement.Value, true
+			}
+
+			if podKey == gpuKey {
+				continue
+			}
+			if _, found := pods[gpuKey]; !found {
+				pods[gpuKey] = make(map[energySeriesKey]struct{})
+			}
+			if _, found := labels[podKey]; !found {
+				labels[podKey] = e.seriesLabels(podKey, measurement.Labels)
+			}
+			pods[gpuKey][podKey] = struct{}{}
+		}
+	}
+
+	keys := make([]energySeriesKey, 0, len(labels))
+	for gpuKey, sample := range samples {
+		at, found := scrapedAt[gpuKey.node]
+		if !found {
+			at = latest
+		}
+		joules := e.seriesOf(gpuKey, labels[gpuKey]).add(at, sample, e.cfg.MaxGap)
+		keys = append(keys, gpuKey)
+
+		// pods which just appeared start counting from their first sample, the energy since the previous one is
+		// split between the pods which were already assigned to the GPU
+		var assigned []*energySeries
+		for podKey := range pods[gpuKey] {
+			if series, found := e.series[podKey]; found {
+				assigned = append(assigned, series)
+			} else {
+				e.seriesOf(podKey, labels[podKey]).at = at
+			}
+			keys = append(keys, podKey)
+		}
+		for _, series := range assigned {
+			series.joules += joules / float64(len(assigned))
+			series.at = at
+		}
+	}
+
+	for key, series := range e.series {
+		if latest.Sub(series.at) > seriesRetention {
+			delete(e.series, key)
+		}
+	}
+
+	return e.metrics(keys)
+}
+
+// seriesOf returns the series of the key, creating it with the labels if it doesn't exist yet.
+func (e *energyMeter) seriesOf(key energySeriesKey, labels []*pb.Metric_Label) *energySeries {
+	series, found := e.series[key]
+	if !found {
+		series = &energySeries{labels: labels, zone: labelValue(labels, e.cfg.ZoneLabel)}
+		e.series[key] = series
+	}
+	return series
+}
+
+// forget drops the series of the node, e.g. when another replica took over the node.
+func (e *energyMeter) forget(node string) {
+	for key := range e.series {
+		if key.node == node {
+			delete(e.series, key)
+		}
+	}
+}
+
+// annotate sets the energy, and carbon, of the GPU metric rows to the ones of the pod a row belongs to, or of its
+// GPU if it isn't assigned to a pod. Rows of GPUs which were never metered, e.g. without power samples, are left
+// without them.
+func (e *energyMeter) annotate(gpuMetrics []GPUMetric) {
+	for i := range gpuMetrics {
+		m := &gpuMetrics[i]
+		series, found := e.series[energySeriesKey{
+			node:          m.NodeName,
+			uuid:          m.DeviceUUID,
+			migProfile:    m.MIGProfile,
+			migInstanceID: m.MIGInstanceID,
+			namespace:     m.Namespace,
+			pod:           m.Pod,
+			container:     m.Container,
+		}]
+		if !found {
+			continue
+		}
+		joules := series.joules
+		m.EnergyJoules = &joules
+		if intensity, found := e.carbonIntensity(series.zone); found {
+			grams := carbonGrams(series.joules, intensity)
+			m.CarbonGrams = &grams
+		}
+	}
+}
+
+func (e *energyMeter) metrics(keys []energySeriesKey) []*pb.Metric {
+	sort.Slice(keys, func(a, b int) bool { return keys[a].less(keys[b]) })
+
+	energy := &pb.Metric{Name: MetricEnergy}
+	podEnergy := &pb.Metric{Name: MetricPodEnergy}
+	carbon := &pb.Metric{Name: MetricCarbon}
+	podCarbon := &pb.Metric{Name: MetricPodCarbon}
+	for _, key := range keys {
+		series := e.series[key]
+		energyMetric, carbonMetric := energy, carbon
+		if key.pod != "" {
+			energyMetric, carbonMetric = podEnergy, podCarbon
+		}
+		energyMetric.Measurements = append(energyMetric.Measurements, &pb.Metric_Measurement{
+			Value:  series.joules,
+			Labels: series.labels,
+		})
+		if intensity, found := e.carbonIntensity(series.zone); found {
+			carbonMetric.Measurements = append(carbonMetric.Measurements, &pb.Metric_Measurement{
+				Value:  carbonGrams(series.joules, intensity),
+				Labels: series.labels,
+			})
+		}
+	}
+
+	var metrics []*pb.Metric
+	for _, metric := range []*pb.Metric{energy, podEnergy, carbon, podCarbon} {
+		if len(metric.Measurements) > 0 {
+			metrics = append(metrics, metric)
+		}
+	}
+	return metrics
+}
+
+func (e *energyMeter) carbonIntensity(zone string) (float64, bool) {
+	if intensity, found := e.cfg.CarbonIntensityZones[zone]; found && zone != "" {
+		return intensity, true
+	}
+	return e.cfg.CarbonIntensity, e.cfg.CarbonIntensity > 0
+}
+
+func (e *energyMeter) seriesLabels(key energySeriesKey, measurementLabels []*pb.Metric_Label) []*pb.Metric_Label {
+	labels := []*pb.Metric_Label{
+		{Name: nodeNameLabel, Value: key.node},
+		{Name: gpuUUIDLabel, Value: key.uuid},
+		{Name: gpuIDLabel, Value: labelValue(measurementLabels, gpuIDLabel)},
+		{Name: modelNameLabel, Value: labelValue(measurementLabels, modelNameLabel)},
+	}
+	if key.migProfile != "" || key.migInstanceID != "" {
+		labels = append(labels,
+			&pb.Metric_Label{Name: gpuMIGProfile, Value: key.migProfile},
+			&pb.Metric_Label{Name: gpuInstanceID, Value: key.migInstanceID},
+		)
+	}
+	if key.pod != "" {
+		labels = append(labels,
+			&pb.Metric_Label{Name: namespaceLabel, Value: key.namespace},
+			&pb.Metric_Label{Name: podLabel, Value: key.pod},
+			&pb.Metric_Label{Name: containerLabel, Value: key.container},
+		)
+	}
+	if e.cfg.ZoneLabel != "" {
+		if zone := labelValue(measurementLabels, e.cfg.ZoneLabel); zone != "" {
+			labels = append(labels, &pb.Metric_Label{Name: e.cfg.ZoneLabel, Value: zone})
+		}
+	}
+	return labels
+}
+
+// add integrates the energy since the previous sample and returns it. The energy counter, in mJ, is preferred as it's exact,
+// a counter which went backwards was reset, e.g. by a driver reload, and counts from 0. Otherwise the power is
+// integrated with the trapezoidal rule, as long as the samples aren't further apart than maxGap.
+func (s *energySeries) add(at time.Time, sample *energySample, maxGap time.Duration) float64 {
+	var joules float64
+	if !s.at.IsZero() && at.After(s.at) {
+		switch {
+		case sample.hasCounter && s.hasCounter:
+			delta := sample.counter - s.counter
+			if delta < 0 {
+				delta = sample.counter
+			}
+			joules = delta / 1000
+		case sample.hasPower && s.hasPower:
+			elapsed := at.Sub(s.at)
+			if maxGap <= 0 || elapsed <= maxGap {
+				joules = (s.power + sample.power) / 2 * elapsed.Seconds()
+			}
+		}
+	}
+	s.joules += joules
+
+	if !at.Before(s.at) {
+		s.at = at
+		s.power, s.hasPower = sample.power, sample.hasPower
+		s.counter, s.hasCounter = sample.counter, sample.hasCounter
+	}
+	return joules
+}
+
+func (k energySeriesKey) less(o energySeriesKey) bool {
+	a := []string{k.node, k.uuid, k.migProfile, k.migInstanceID, k.namespace, k.pod, k.container}
+	b := []string{o.node, o.uuid, o.migProfile, o.migInstanceID, o.namespace, o.pod, o.container}
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// energySeriesKeys returns the series of the GPU of a measurement and of the pod it's assigned to, both are the
+// GPU's series when it isn't assigned to a pod. Measurements without a GPU UUID aren't metered.
+func energySeriesKeys(labels []*pb.Metric_Label) (energySeriesKey, energySeriesKey, bool) {
+	gpu := energySeriesKey{
+		node:          labelValue(labels, nodeNameLabel),
+		uuid:          labelValue(labels, gpuUUIDLabel),
+		migProfile:    labelValue(labels, gpuMIGProfile),
+		migInstanceID: labelValue(labels, gpuInstanceID),
+	}
+	if gpu.uuid == "" {
+		return energySeriesKey{}, energySeriesKey{}, false
+	}
+	pod := gpu
+	pod.pod = labelValue(labels, podLabel)
+	if pod.pod != "" {
+		pod.namespace = labelValue(labels, namespaceLabel)
+		pod.container = labelValue(labels, containerLabel)
+	}
+	return gpu, pod, true
+}
+
+// scrapeTimes returns when the targets of every node were scraped, along with the latest scrape for
+// measurements whose node isn't known from their target.
+func scrapeTimes(results []ScrapeResult) (map[string]time.Time, time.Time) {
+	scrapedAt := make(map[string]time.Time)
+	var latest time.Time
+	for _, result := range results {
+		if result.Err != nil {
+			continue
+		}
+		if result.Timestamp.After(latest) {
+			latest = result.Timestamp
+		}
+		if node := result.Target.NodeName; node != "" && result.Timestamp.After(scrapedAt[node]) {
+			scrapedAt[node] = result.Timestamp
+		}
+	}
+	return scrapedAt, latest
+}
+
+func carbonGrams(joules, intensity float64) float64 {
+	return joules / joulesPerKilowattHour * intensity
+}
+
+func labelValue(labels []*pb.Metric_Label, name string) string {
+	for _, label := range labels {
+		if label.Name == name {
+			return label.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,300 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/castai/gpu-metrics-exporter/pb"
+)
+
+type energyReading struct {
+	node    string
+	uuid    string
+	pod     string
+	power   *float64
+	counter *float64
+}
+
+type energyStep struct {
+	at       time.Duration
+	readings []energyReading
+	// energy and carbon are keyed by node/uuid/pod, pod is empty for the series of GPUs.
+	energy map[string]float64
+	carbon map[string]float64
+}
+
+func TestEnergyMeter_Update(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	watts := func(v float64) *float64 { return &v }
+	millijoules := watts
+
+	tests := []struct {
+		name  string
+		cfg   EnergyConfig
+		steps []energyStep
+	}{
+		{
+			name: "integrates the power between scrapes",
+			cfg:  EnergyConfig{MaxGap: time.Minute},
+			steps: []energyStep{
+				{
+					readings: []energyReading{{node: "node-a", uuid: "GPU-1", power: watts(100)}},
+					energy:   map[string]float64{"node-a/GPU-1/": 0},
+				},
+				{
+					at:       10 * time.Second,
+					readings: []energyReading{{node: "node-a", uuid: "GPU-1", power: watts(200)}},
+					energy:   map[string]float64{"node-a/GPU-1/": 1500},
+				},
+				// the dcgm-exporter was unavailable for longer than the max gap
+				{
+					at:       10 * time.Minute,
+					readings: []energyReading{{node: "node-a", uuid: "GPU-1", power: watts(300)}},
+					energy:   map[string]float64{"node-a/GPU-1/": 1500},
+				},
+				{
+					at:       10*time.Minute + 10*time.Second,
+					readings: []energyReading{{node: "node-a", uuid: "GPU-1", power: watts(300)}},
+					energy:   map[string]float64{"node-a/GPU-1/": 4500},
+				},
+			},
+		},
+		{
+			name: "prefers the energy counter and restarts it after a reset",
+			cfg:  EnergyConfig{MaxGap: time.Minute},
+			steps: []energyStep{
+				{
+					readings: []energyReading{{node: "node-a", uuid: "GPU-1", power: watts(50), counter: millijoules(1_000_000)}},
+					energy:   map[string]float64{"node-a/GPU-1/": 0},
+				},
+				{
+					at:       10 * time.Second,
+					readings: []energyReading{{node: "node-a", uuid: "GPU-1", power: watts(50), counter: millijoules(1_500_000)}},
+					energy:   map[string]float64{"node-a/GPU-1/": 500},
+				},
+				// the counter is exact, so it's counted across gaps, and the driver was reloaded meanwhile
+				{
+					at:       10 * time.Minute,
+					readings: []energyReading{{node: "node-a", uuid: "GPU-1", power: watts(50), counter: millijoules(400_000)}},
+					energy:   map[string]float64{"node-a/GPU-1/": 900},
+				},
+			},
+		},
+		{
+			name: "meters the pods of a GPU separately",
+			steps: []energyStep{
+				{
+					readings: []energyReading{{node: "node-a", uuid: "GPU-1", pod: "trainer", power: watts(100)}},
+					energy:   map[string]float64{"node-a/GPU-1/": 0, "node-a/GPU-1/trainer": 0},
+				},
+				{
+					at:       10 * time.Second,
+					readings: []energyReading{{node: "node-a", uuid: "GPU-1", pod: "trainer", power: watts(100)}},
+					energy:   map[string]float64{"node-a/GPU-1/": 1000, "node-a/GPU-1/trainer": 1000},
+				},
+				// a new pod starts counting from its first sample
+				{
+					at:       20 * time.Second,
+					readings: []energyReading{{node: "node-a", uuid: "GPU-1", pod: "evaluator", power: watts(100)}},
+					energy:   map[string]float64{"node-a/GPU-1/": 2000, "node-a/GPU-1/evaluator": 0},
+				},
+			},
+		},
+		{
+			name: "splits the energy of a shared GPU between its pods",
+			steps: []energyStep{
+				{
+					readings: []energyReading{
+						{node: "node-a", uuid: "GPU-1", pod: "trainer", power: watts(100)},
+						{node: "node-a", uuid: "GPU-1", pod: "evaluator", power: watts(100)},
+					},
+					energy: map[string]float64{"node-a/GPU-1/": 0, "node-a/GPU-1/trainer": 0, "node-a/GPU-1/evaluator": 0},
+				},
+				{
+					at: 10 * time.Second,
+					readings: []energyReading{
+						{node: "node-a", uuid: "GPU-1", pod: "trainer", power: watts(100)},
+						{node: "node-a", uuid: "GPU-1", pod: "evaluator", power: watts(100)},
+					},
+					energy: map[string]float64{"node-a/GPU-1/": 1000, "node-a/GPU-1/trainer": 500, "node-a/GPU-1/evaluator": 500},
+				},
+				// a pod joining the GPU only gets a share from its first sample on
+				{
+					at: 20 * time.Second,
+					readings: []energyReading{
+						{node: "node-a", uuid: "GPU-1", pod: "trainer", power: watts(100)},
+						{node: "node-a", uuid: "GPU-1", pod: "evaluator", power: watts(100)},
+						{node: "node-a", uuid: "GPU-1", pod: "notebook", power: watts(100)},
+					},
+					energy: map[string]float64{
+						"node-a/GPU-1/": 2000, "node-a/GPU-1/trainer": 1000, "node-a/GPU-1/evaluator": 1000, "node-a/GPU-1/notebook": 0,
+					},
+				},
+				{
+					at: 30 * time.Second,
+					readings: []energyReading{
+						{node: "node-a", uuid: "GPU-1", pod: "trainer", power: watts(100)},
+						{node: "node-a", uuid: "GPU-1", pod: "evaluator", power: watts(100)},
+						{node: "node-a", uuid: "GPU-1", pod: "notebook", power: watts(100)},
+					},
+					energy: map[string]float64{
+						"node-a/GPU-1/": 3000, "node-a/GPU-1/trainer": 1000 + 1000.0/3, "node-a/GPU-1/evaluator": 1000 + 1000.0/3,
+						"node-a/GPU-1/notebook": 1000.0 / 3,
+					},
+				},
+			},
+		},
+		{
+			name: "converts the energy to carbon with the intensity of the zone",
+			cfg: EnergyConfig{
+				CarbonIntensity:      400,
+				CarbonIntensityZones: map[string]float64{"eu-north-1a": 36},
+				ZoneLabel:            "zone",
+			},
+			steps: []energyStep{
+				{
+					readings: []energyReading{
+						{node: "node-a", uuid: "GPU-1", power: watts(3600)},
+						{node: "node-b", uuid: "GPU-2", power: watts(3600)},
+					},
+					energy: map[string]float64{"node-a/GPU-1/": 0, "node-b/GPU-2/": 0},
+					carbon: map[string]float64{"node-a/GPU-1/": 0, "node-b/GPU-2/": 0},
+				},
+				{
+					at: 1000 * time.Second,
+					readings: []energyReading{
+						{node: "node-a", uuid: "GPU-1", power: watts(3600)},
+						{node: "node-b", uuid: "GPU-2", power: watts(3600)},
+					},
+					energy: map[string]float64{"node-a/GPU-1/": 3.6e6, "node-b/GPU-2/": 3.6e6},
+					// node-a is in eu-north-1a, node-b's zone isn't known
+					carbon: map[string]float64{"node-a/GPU-1/": 36, "node-b/GPU-2/": 400},
+				},
+			},
+		},
+		{
+			name: "forgets GPUs which haven't been scraped for the retention",
+			cfg:  EnergyConfig{MaxGap: time.Minute},
+			steps: []energyStep{
+				{
+					readings: []energyReading{
+						{node: "node-a", uuid: "GPU-1", power: watts(100)},
+						{node: "node-b", uuid: "GPU-2", power: watts(100)},
+					},
+					energy: map[string]float64{"node-a/GPU-1/": 0, "node-b/GPU-2/": 0},
+				},
+				{
+					at: 10 * time.Second,
+					readings: []energyReading{
+						{node: "node-a", uuid: "GPU-1", power: watts(100)},
+						{node: "node-b", uuid: "GPU-2", power: watts(100)},
+					},
+					energy: map[string]float64{"node-a/GPU-1/": 1000, "node-b/GPU-2/": 1000},
+				},
+				{
+					at:       10*time.Second + seriesRetention + time.Second,
+					readings: []energyReading{{node: "node-a", uuid: "GPU-1", power: watts(100)}},
+					energy:   map[string]float64{"node-a/GPU-1/": 1000},
+				},
+				{
+					at: 20*time.Second + seriesRetention,
+					readings: []energyReading{
+						{node: "node-a", uuid: "GPU-1", power: watts(100)},
+						{node: "node-b", uuid: "GPU-2", power: watts(100)},
+					},
+					energy: map[string]float64{"node-a/GPU-1/": 1900, "node-b/GPU-2/": 0},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := require.New(t)
+			meter := newEnergyMeter(tt.cfg)
+
+			for i, step := range tt.steps {
+				metrics := meter.update(energyBatch(start.Add(step.at), step.readings))
+				r.Equal(step.energy, energyValues(metrics, MetricEnergy, MetricPodEnergy), "step %d", i)
+				if step.carbon != nil {
+					carbon := energyValues(metrics, MetricCarbon, MetricPodCarbon)
+					r.Len(carbon, len(step.carbon), "step %d", i)
+					for key, grams := range step.carbon {
+						r.InDelta(grams, carbon[key], 1e-9, "step %d %s", i, key)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEnergyMeter_Annotate(t *testing.T) {
+	r := require.New(t)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	power := 3600.0
+
+	meter := newEnergyMeter(EnergyConfig{CarbonIntensity: 400})
+	readings := []energyReading{{node: "node-a", uuid: "GPU-1", pod: "trainer", power: &power}, {node: "node-a", uuid: "GPU-2", power: &power}}
+	meter.update(energyBatch(start, readings))
+	meter.update(energyBatch(start.Add(1000*time.Second), readings))
+
+	rows := []GPUMetric{
+		{NodeName: "node-a", DeviceUUID: "GPU-1", Namespace: "ml", Pod: "trainer"},
+		{NodeName: "node-a", DeviceUUID: "GPU-2"},
+		{NodeName: "node-a", DeviceUUID: "GPU-3"},
+	}
+	meter.annotate(rows)
+	r.Equal(3.6e6, *rows[0].EnergyJoules)
+	r.InDelta(400, *rows[0].CarbonGrams, 1e-9)
+	r.Equal(3.6e6, *rows[1].EnergyJoules)
+	// GPUs without power samples have no energy
+	r.Nil(rows[2].EnergyJoules)
+	r.Nil(rows[2].CarbonGrams)
+}
+
+func energyBatch(at time.Time, readings []energyReading) (*pb.MetricsBatch, []ScrapeResult) {
+	power := &pb.Metric{Name: MetricPowerUsage}
+	counter := &pb.Metric{Name: MetricTotalEnergyConsumption}
+	scraped := make(map[string]struct{})
+	var results []ScrapeResult
+	for _, reading := range readings {
+		labels := []*pb.Metric_Label{
+			{Name: nodeNameLabel, Value: reading.node},
+			{Name: gpuUUIDLabel, Value: reading.uuid},
+		}
+		if reading.pod != "" {
+			labels = append(labels, &pb.Metric_Label{Name: namespaceLabel, Value: "ml"}, &pb.Metric_Label{Name: podLabel, Value: reading.pod})
+		}
+		if reading.node == "node-a" {
+			labels = append(labels, &pb.Metric_Label{Name: "zone", Value: "eu-north-1a"})
+		}
+		if reading.power != nil {
+			power.Measurements = append(power.Measurements, &pb.Metric_Measurement{Value: *reading.power, Labels: labels})
+		}
+		if reading.counter != nil {
+			counter.Measurements = append(counter.Measurements, &pb.Metric_Measurement{Value: *reading.counter, Labels: labels})
+		}
+
+		if _, found := scraped[reading.node]; !found {
+			scraped[reading.node] = struct{}{}
+			results = append(results, ScrapeResult{Target: Target{NodeName: reading.node}, Timestamp: at})
+		}
+	}
+	return &pb.MetricsBatch{Metrics: []*pb.Metric{power, counter}}, results
+}
+
+func energyValues(metrics []*pb.Metric, names ...MetricName) map[string]float64 {
+	values := make(map[string]float64)
+	for _, metric := range metrics {
+		for _, name := range names {
+			if metric.Name != name {
+				continue
+			}
+			for _, m := range metric.Measurements {
+				values[labelValue(m.Labels, nodeNameLabel)+"/"+labelValue(m.Labels, gpuUUIDLabel)+"/"+labelValue(m.Labels, podLabel)] = m.Value
+			}
+		}
+	}
+	return values
+}
@@ -2,10 +2,15 @@ package exporter
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"regexp"
+	"strconv"
 	"sync/atomic"
 	"time"
 
+	"golang.org/x/sync/errgroup"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -13,10 +18,23 @@ import (
 	"k8s.io/client-go/dynamic"
 
 	"github.com/castai/gpu-metrics-exporter/internal/castai"
+	"github.com/castai/gpu-metrics-exporter/internal/workload"
+	"github.com/castai/gpu-metrics-exporter/pb"
 	"github.com/castai/logging"
 	"github.com/castai/metrics"
 )
 
+const (
+	schemeAnnotation = "prometheus.io/scheme"
+	portAnnotation   = "prometheus.io/port"
+	pathAnnotation   = "prometheus.io/path"
+	metricsPortName  = "metrics"
+)
+
+// scrapeDeadlineRatio is the share of the export interval scraping may take, the rest is left for
+// mapping and writing the metrics.
+const scrapeDeadlineRatio = 0.8
+
 type Exporter interface {
 	Start(ctx context.Context) error
 	Enable()
@@ -24,14 +42,66 @@ type Exporter interface {
 	Enabled() bool
 }
 
+// Discoverer provides the dcgm-exporters to scrape when they aren't discovered from Kubernetes.
+type Discoverer interface {
+	Targets(ctx context.Context) ([]Target, error)
+}
+
+// Shard tells whether a target is scraped by this replica when several replicas split the targets between them.
+type Shard interface {
+	Owns(target Target) bool
+}
+
+// BatchObserver is handed every mapped batch, after the exporter added its own metrics and before it's uploaded.
+// Observers must not modify the batch.
+type BatchObserver interface {
+	Observe(ctx context.Context, batch *pb.MetricsBatch)
+}
+
+// Sink receives the GPU metrics of every export alongside the CAST AI backend. Sinks are written concurrently, with
+// the same rows, so they must not modify them, and have to return by the deadline of the context.
+type Sink interface {
+	Name() string
+	Write(ctx context.Context, metrics []GPUMetric) error
+}
+
+// EmptyBatchSink is a Sink which is also written, with no rows, by exports which collected none, e.g. because every
+// scrape failed, so that it can tell the metrics are missing. Other sinks are only written rows.
+type EmptyBatchSink interface {
+	Sink
+	WritesEmptyBatches()
+}
+
 type Config struct {
-	ExportInterval   time.Duration
-	DCGMExporterPort int
-	DCGMExporterPath string
-	DCGMExporterHost string
-	Selector         string
-	Enabled          bool
-	NodeName         string
+	ExportInterval     time.Duration
+	DCGMExporterScheme string
+	DCGMExporterPort   int
+	DCGMExporterPath   string
+	DCGMExporterHost   string
+	// DCGMExporterSocket is the unix socket dcgm-exporter is listening on, it takes precedence over the host.
+	DCGMExporterSocket string
+	Selector           string
+	Enabled            bool
+	NodeName           string
+	// Discoverer takes precedence over the socket, host and pod discovery when set.
+	Discoverer Discoverer
+	// Shard limits the targets to the ones owned by this replica when set.
+	Shard       Shard
+	Energy      EnergyConfig
+	ClockEvents ClockEventsConfig
+	// XIDRecorder publishes the XID errors of GPUs when set, they are logged either way.
+	XIDRecorder XIDRecorder
+	Observers   []BatchObserver
+	// Idle follows the idle time of pods and workloads when set, and annotates workloads with it when
+	// IdleAnnotator is set as well.
+	Idle          *IdleDetector
+	IdleAnnotator workload.Annotator
+	// Relabeler rewrites the labels of the scraped series before they're mapped when set.
+	Relabeler Relabeler
+	// InvalidValuePolicy is applied to NaN, infinite and DCGM blank values, they're dropped when it's empty.
+	InvalidValuePolicy InvalidValuePolicy
+	// ExtraMetrics matches the families exported in addition to EnabledMetrics, the same as the mapper's.
+	ExtraMetrics *regexp.Regexp
 }
 
 type exporter struct {
@@ -44,6 +114,13 @@ type exporter struct {
 	client       castai.Client
 	metricClient metrics.MetricClient
 	metricWriter metrics.Metric[GPUMetric]
+	sinks        []Sink
+	// lastScraped holds the time of the last successful scrape of every target, it's only accessed by export
+	lastScraped map[string]time.Time
+	inventory   *inventory
+	energy      *energyMeter
+	clockEvents *clocksEventTimer
+	xids        *xidTracker
 }
 
 func NewExporter(
@@ -54,6 +131,7 @@ func NewExporter(
 	mapper MetricMapper,
 	castaiClient castai.Client,
 	metricClient metrics.MetricClient,
+	sinks ...Sink,
 ) Exporter {
 	enabled := atomic.Bool{}
 	enabled.Store(cfg.Enabled)
@@ -82,6 +160,12 @@ func NewExporter(
 		client:       castaiClient,
 		metricClient: metricClient,
 		metricWriter: m,
+		sinks:        sinks,
+		lastScraped:  make(map[string]time.Time),
+		inventory:    newInventory(),
+		energy:       newEnergyMeter(cfg.Energy),
+		clockEvents:  newClocksEventTimer(cfg.ClockEvents),
+		xids:         newXIDTracker(),
 	}
 }
 
@@ -118,11 +202,27 @@ func (e *exporter) Enabled() bool {
 
 var podGVR = schema.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
 
-func (e *exporter) getDCGMUrls(ctx context.Context) ([]string, error) {
+func (e *exporter) getDCGMTargets(ctx context.Context) ([]Target, error) {
+	if e.cfg.Discoverer != nil {
+		return e.cfg.Discoverer.Targets(ctx)
+	}
+
+	if e.cfg.DCGMExporterSocket != "" {
+		return []Target{
+			{
+				URL:      UnixSocketURL(e.cfg.DCGMExporterSocket, e.cfg.DCGMExporterPath),
+				NodeName: e.cfg.NodeName,
+			},
+		}, nil
+	}
+
 	if e.cfg.DCGMExporterHost != "" {
 		// we are scraping a single host, no need to check for other pods
-		return []string{
-			fmt.Sprintf("http://%s:%d%s", e.cfg.DCGMExporterHost, e.cfg.DCGMExporterPort, e.cfg.DCGMExporterPath),
+		return []Target{
+			{
+				URL:      fmt.Sprintf("%s://%s:%d%s", e.scheme(), e.cfg.DCGMExporterHost, e.cfg.DCGMExporterPort, e.cfg.DCGMExporterPath),
+				NodeName: e.cfg.NodeName,
+			},
 		}, nil
 	}
 
@@ -138,49 +238,196 @@ func (e *exporter) getDCGMUrls(ctx context.Context) ([]string, error) {
 		FieldSelector: fieldSelector,
 	})
 	if err != nil {
-		return []string{}, fmt.Errorf("error getting DCGM exporter pods %w", err)
+		return nil, fmt.Errorf("error getting DCGM exporter pods %w", err)
 	}
 
-	urls := make([]string, len(dcgmExporterList.Items))
+	targets := make([]Target, 0, len(dcgmExporterList.Items))
 	for i := range dcgmExporterList.Items {
 		var pod corev1.Pod
 		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(dcgmExporterList.Items[i].Object, &pod); err != nil {
 			return nil, fmt.Errorf("converting unstructured to pod: %w", err)
 		}
-		urls[i] = fmt.Sprintf("http://%s:%d%s", pod.Status.PodIP, e.cfg.DCGMExporterPort, e.cfg.DCGMExporterPath)
+		target, ok := e.podTarget(&pod)
+		if !ok {
+			continue
+		}
+		targets = append(targets, target)
 	}
 
-	return urls, nil
+	return targets, nil
+}
+
+// podTarget builds the target of a dcgm-exporter pod. The prometheus.io/scheme, prometheus.io/port and
+// prometheus.io/path annotations take precedence over a container port named metrics and the configuration.
+// Pods which aren't ready yet, or have no IP, are skipped.
+func (e *exporter) podTarget(pod *corev1.Pod) (Target, bool) {
+	if !podReady(pod) {
+		return Target{}, false
+	}
+
+	ip := pod.Status.PodIP
+	if ip == "" {
+		ip = pod.Status.HostIP
+	}
+	if ip == "" {
+		return Target{}, false
+	}
+
+	scheme := e.scheme()
+	if value := pod.Annotations[schemeAnnotation]; value != "" {
+		scheme = value
+	}
+	path := e.cfg.DCGMExporterPath
+	if value := pod.Annotations[pathAnnotation]; value != "" {
+		path = value
+	}
+	port, ok := podPort(pod, e.cfg.DCGMExporterPort)
+	if !ok {
+		e.log.With("pod", pod.Name, "namespace", pod.Namespace).Warnf("unknown port %q of dcgm-exporter", pod.Annotations[portAnnotation])
+		return Target{}, false
+	}
+
+	return Target{
+		URL:       fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(ip, strconv.Itoa(port)), path),
+		NodeName:  pod.Spec.NodeName,
+		Pod:       pod.Name,
+		Namespace: pod.Namespace,
+	}, true
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// podPort returns the port of the prometheus.io/port annotation, which may be a number or the name of a
+// container port, or the container port named metrics, or the default port.
+func podPort(pod *corev1.Pod, defaultPort int) (int, bool) {
+	name := metricsPortName
+	if value := pod.Annotations[portAnnotation]; value != "" {
+		if port, err := strconv.Atoi(value); err == nil {
+			return port, true
+		}
+		name = value
+		defaultPort = 0
+	}
+
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.Name == name {
+				return int(port.ContainerPort), true
+			}
+		}
+	}
+
+	return defaultPort, defaultPort != 0
+}
+
+func (e *exporter) scheme() string {
+	if e.cfg.DCGMExporterScheme == "" {
+		return "http"
+	}
+	return e.cfg.DCGMExporterScheme
 }
 
 func (e *exporter) export(ctx context.Context) error {
-	urls, err := e.getDCGMUrls(ctx)
+	targets, err := e.getDCGMTargets(ctx)
 	if err != nil {
 		return err
 	}
 
-	if len(urls) == 0 {
+	if e.cfg.Shard != nil {
+		targets = e.ownedTargets(targets)
+	}
+
+	if len(targets) == 0 {
 		e.log.Info("no dcgm-exporter instances to scrape")
+		sinkCtx, cancel := context.WithTimeout(ctx, e.cfg.ExportInterval)
+		defer cancel()
+		e.writeSinks(sinkCtx, nil)
 		return nil
 	}
 
-	metricFamilies, err := e.scraper.Scrape(ctx, urls)
-	if err != nil {
-		return fmt.Errorf("couldn't scrape DCGM exporters %w", err)
+	// scraping must not run into the next export, targets which don't respond in time are skipped
+	scrapeDeadline := time.Duration(float64(e.cfg.ExportInterval) * scrapeDeadlineRatio)
+	scrapeCtx, cancel := context.WithTimeout(ctx, scrapeDeadline)
+	results := e.scraper.Scrape(scrapeCtx, targets)
+	if errors.Is(scrapeCtx.Err(), context.DeadlineExceeded) {
+		e.log.Warnf("scraping %d dcgm-exporters exceeded the deadline of %s", len(targets), scrapeDeadline)
 	}
-	if len(metricFamilies) == 0 {
-		e.log.Warnf("no metrics collected from %d dcgm-exporters", len(urls))
-		return nil
+	cancel()
+
+	// handling the batch must not hold back the following exports, e.g. because of a sink which doesn't respond
+	batchCtx, cancelBatch := context.WithTimeout(ctx, e.cfg.ExportInterval)
+	defer cancelBatch()
+
+	if e.reportScrapeFailures(results) == len(results) {
+		e.log.Warnf("no metrics collected from %d dcgm-exporters", len(targets))
+		return e.exportInventory(ctx, batchCtx, &pb.MetricsBatch{}, results)
+	}
+	if e.cfg.Relabeler != nil {
+		relabelResults(results, e.cfg.Relabeler)
 	}
-	now := time.Now()
 
-	batch := e.mapper.Map(metricFamilies)
-	if len(batch.Metrics) == 0 {
-		e.log.Warnf("no metrics to export from activated metrics, scraped %d metrics from dcgm-exporter", len(urls))
-		return nil
+	invalidValues := sanitizeResults(results, e.cfg.InvalidValuePolicy, e.cfg.ExtraMetrics)
+
+	batch := e.mapper.Map(results)
+	mapped := len(batch.Metrics)
+	// invalid values are counted even when none of the values were valid
+	if invalidValues != nil {
+		batch.Metrics = append(batch.Metrics, invalidValues)
+	}
+	if mapped == 0 {
+		e.log.Warnf("no metrics to export from activated metrics, scraped %d metrics from dcgm-exporter", len(targets))
+		return e.exportInventory(ctx, batchCtx, batch, results)
 	}
 
-	if err := e.client.UploadBatch(ctx, batch); err != nil {
+	e.updateInventory(batch, results)
+	batch.Metrics = append(batch.Metrics, e.energy.update(batch, results)...)
+	if clockEvents := e.clockEvents.update(batch, results); clockEvents != nil {
+		batch.Metrics = append(batch.Metrics, clockEvents)
+	}
+	xids, xidCount := e.xids.update(batch, results)
+	if xidCount != nil {
+		batch.Metrics = append(batch.Metrics, xidCount)
+	}
+
+	var gpuMetrics []GPUMetric
+	if e.metricWriter != nil || len(e.sinks) > 0 || e.cfg.Idle != nil {
+		gpuMetrics = e.mapper.MapToAvro(ctx, results)
+		e.energy.annotate(gpuMetrics)
+	}
+	if e.cfg.Idle != nil {
+		batch.Metrics = append(batch.Metrics, e.cfg.Idle.update(gpuMetrics)...)
+		if e.cfg.IdleAnnotator != nil {
+			for _, err := range e.cfg.Idle.annotate(batchCtx, e.cfg.IdleAnnotator) {
+				e.log.WithField("error", err.Error()).Warn("failed to annotate idle workload")
+			}
+		}
+	}
+
+	for _, observer := range e.cfg.Observers {
+		observer.Observe(ctx, batch)
+	}
+
+	// Sinks are written, and XIDs recorded, alongside the upload so that neither a CAST AI outage nor a slow sink or
+	// a storm of XIDs holds back the other
+	var g errgroup.Group
+	g.Go(func() error {
+		e.reportXIDs(batchCtx, xids)
+		return nil
+	})
+	g.Go(func() error {
+		e.writeSinks(batchCtx, gpuMetrics)
+		return nil
+	})
+	err = e.client.UploadBatch(ctx, batch)
+	_ = g.Wait()
+	if err != nil {
 		return fmt.Errorf("error while sending %d metrics to backend %w", len(batch.Metrics), err)
 	}
 
@@ -189,9 +436,7 @@ func (e *exporter) export(ctx context.Context) error {
 	// Export metrics to Custom Metrics API
 	// Right now optionally, so any errors are logged and ignored
 	if e.metricWriter != nil {
-		gpuMetrics := e.mapper.MapToAvro(ctx, metricFamilies)
 		for _, metric := range gpuMetrics {
-			metric.Timestamp = now
 			err = e.metricWriter.Write(metric)
 			if err != nil {
 				e.log.WithField("error", err.Error()).Warn("error while writing metrics to custom metrics api")
@@ -202,3 +447,152 @@ func (e *exporter) export(ctx context.Context) error {
 
 	return nil
 }
+
+// ownedTargets returns the targets of this replica's shard. The inventory of nodes owned by other replicas is
+// forgotten, their GPUs didn't disappear, and so are their energy, clocks event times, XID errors and idle pods
+// which the other replicas follow from now on.
+func (e *exporter) ownedTargets(targets []Target) []Target {
+	owned := make([]Target, 0, len(targets))
+	for _, target := range targets {
+		if e.cfg.Shard.Owns(target) {
+			owned = append(owned, target)
+			continue
+		}
+		if target.NodeName != "" {
+			e.inventory.forget(target.NodeName)
+			e.energy.forget(target.NodeName)
+			e.clockEvents.forget(target.NodeName)
+			e.xids.forget(target.NodeName)
+			if e.cfg.Idle != nil {
+				e.cfg.Idle.forget(target.NodeName)
+			}
+		}
+	}
+	return owned
+}
+
+// reportScrapeFailures logs the targets which couldn't be scraped, along with how long ago they were last
+// scraped successfully, and returns their number.
+func (e *exporter) reportScrapeFailures(results []ScrapeResult) int {
+	seen := make(map[string]struct{}, len(results))
+	var failed int
+	for _, result := range results {
+		url := result.Target.URL
+		seen[url] = struct{}{}
+
+		if result.Err == nil {
+			e.lastScraped[url] = result.Timestamp
+			continue
+		}
+
+		failed++
+		log := e.log.With(
+			"target", url,
+			"node", result.Target.NodeName,
+			"pod", result.Target.Pod,
+			"error", result.Err.Error(),
+		)
+		if last, found := e.lastScraped[url]; found {
+			log = log.With("stale_for", result.Timestamp.Sub(last).Round(time.Second).String())
+		}
+		log.Error("failed to scrape metrics")
+	}
+
+	// forget targets which are gone, e.g. pods replaced by a rollout
+	for url := range e.lastScraped {
+		if _, found := seen[url]; !found {
+			delete(e.lastScraped, url)
+		}
+	}
+
+	if failed > 0 && failed < len(results) {
+		e.log.Warnf("scraped %d of %d dcgm-exporters", len(results)-failed, len(results))
+	}
+
+	return failed
+}
+
+// updateInventory adds the inventory of the nodes and the presence of their GPUs to the batch.
+func (e *exporter) updateInventory(batch *pb.MetricsBatch, results []ScrapeResult) {
+	batch.Inventory = e.inventory.update(batch, results)
+	e.reportInventory(batch.Inventory)
+	if presence := gpuPresence(batch.Inventory); presence != nil {
+		batch.Metrics = append(batch.Metrics, presence)
+	}
+}
+
+// exportInventory uploads a batch without mapped metrics which carries the inventory, and the count of invalid
+// values, so that the GPUs of nodes which couldn't be scraped are still reported stale and GPUs which vanished are
+// reported absent.
+func (e *exporter) exportInventory(ctx, batchCtx context.Context, batch *pb.MetricsBatch, results []ScrapeResult) error {
+	// the sinks which follow missing metrics are told there are none
+	var g errgroup.Group
+	g.Go(func() error {
+		e.writeSinks(batchCtx, nil)
+		return nil
+	})
+	defer func() { _ = g.Wait() }()
+
+	e.updateInventory(batch, results)
+	if len(batch.Inventory) == 0 && len(batch.Metrics) == 0 {
+		return nil
+	}
+	if err := e.client.UploadBatch(ctx, batch); err != nil {
+		return fmt.Errorf("error while sending inventory of %d nodes to backend %w", len(batch.Inventory), err)
+	}
+	return nil
+}
+
+// reportInventory logs the GPUs which appeared on or disappeared from nodes since the previous export.
+func (e *exporter) reportInventory(inventories []*pb.NodeInventory) {
+	for _, inv := range inventories {
+		log := e.log.With("node", inv.NodeName)
+		switch {
+		case inv.Stale:
+			log.With("gpus", gpuUUIDs(inv.Gpus)).Warn("gpu inventory of node is stale, its dcgm-exporter couldn't be scraped")
+		case len(inv.Gpus) == 0:
+			log.With("removed", gpuUUIDs(inv.Removed)).Warn("node is gone along with its gpus")
+		case len(inv.Removed) > 0:
+			log.With("added", gpuUUIDs(inv.Added), "removed", gpuUUIDs(inv.Removed)).Warn("gpus disappeared from node")
+		case len(inv.Added) > 0:
+			log.With("added", gpuUUIDs(inv.Added)).Info("gpus appeared on node")
+		}
+	}
+}
+
+// reportXIDs logs the XID errors raised since the previous export and passes them to the recorder.
+func (e *exporter) reportXIDs(ctx context.Context, xids []XIDError) {
+	for _, xid := range xids {
+		log := e.log.With(
+			"node", xid.NodeName,
+			"gpu", xid.DeviceUUID,
+			"xid", xid.Code,
+			"severity", string(xid.Severity),
+		)
+		if xid.Severity == XIDSeverityHardware {
+			log.Errorf("gpu reported XID %d: %s", xid.Code, xid.Description)
+		} else {
+			log.Warnf("gpu reported XID %d: %s", xid.Code, xid.Description)
+		}
+
+		if e.cfg.XIDRecorder != nil {
+			e.cfg.XIDRecorder.RecordXID(ctx, xid)
+		}
+	}
+}
+
+func (e *exporter) writeSinks(ctx context.Context, gpuMetrics []GPUMetric) {
+	var g errgroup.Group
+	for _, sink := range e.sinks {
+		if _, writesEmpty := sink.(EmptyBatchSink); len(gpuMetrics) == 0 && !writesEmpty {
+			continue
+		}
+		g.Go(func() error {
+			if err := sink.Write(ctx, gpuMetrics); err != nil {
+				e.log.With("sink", sink.Name(), "error", err.Error()).Warn("error while writing metrics to sink")
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+}
@@ -1,8 +1,11 @@
 package exporter_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"math"
+	"sync"
 	"testing"
 	"time"
 
@@ -15,12 +18,17 @@ import (
 	fakedynamic "k8s.io/client-go/dynamic/fake"
 
 	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/gpu-metrics-exporter/internal/relabel"
+	"github.com/castai/gpu-metrics-exporter/internal/workload"
 	castai_mock "github.com/castai/gpu-metrics-exporter/mock/castai"
 	mocks "github.com/castai/gpu-metrics-exporter/mock/exporter"
+	workload_mock "github.com/castai/gpu-metrics-exporter/mock/workload"
 	"github.com/castai/gpu-metrics-exporter/pb"
 	"github.com/castai/logging"
 )
 
+var readyConditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+
 func TestExporter_Running(t *testing.T) {
 	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
 
@@ -36,9 +44,13 @@ func TestExporter_Running(t *testing.T) {
 				Namespace: "default",
 				Labels:    map[string]string{"app": "dcgm-exporter"},
 			},
+			Spec: corev1.PodSpec{
+				NodeName: "node-1",
+			},
 			Status: corev1.PodStatus{
-				PodIP: "192.168.1.1",
-				Phase: corev1.PodRunning,
+				PodIP:      "192.168.1.1",
+				Phase:      corev1.PodRunning,
+				Conditions: readyConditions,
 			},
 		})
 
@@ -57,28 +69,26 @@ func TestExporter_Running(t *testing.T) {
 		ex := exporter.NewExporter(config, dynClient, log, scraper, mapper, client, nil)
 		ex.Enable()
 
-		metricFamilies := []exporter.MetricFamilyMap{
-			{
-				"test_gauge": {
-					Type: dto.MetricType_GAUGE.Enum(),
-					Metric: []*dto.Metric{
-						{
-							Label: []*dto.LabelPair{
-								newLabelPair("label1", "value1"),
-							},
-							Gauge: newGauge(1.0),
+		metricFamilies := exporter.MetricFamilyMap{
+			"test_gauge": {
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{
+							newLabelPair("label1", "value1"),
 						},
+						Gauge: newGauge(1.0),
 					},
 				},
-				exporter.MetricGraphicsEngineActive: {
-					Type: dto.MetricType_GAUGE.Enum(),
-					Metric: []*dto.Metric{
-						{
-							Label: []*dto.LabelPair{
-								newLabelPair("label1", "value1"),
-							},
-							Gauge: newGauge(1.0),
+			},
+			exporter.MetricGraphicsEngineActive: {
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{
+							newLabelPair("label1", "value1"),
 						},
+						Gauge: newGauge(1.0),
 					},
 				},
 			},
@@ -92,8 +102,16 @@ func TestExporter_Running(t *testing.T) {
 			},
 		}
 
-		scraper.EXPECT().Scrape(ctx, []string{"http://192.168.1.1:9400/metrics"}).Times(1).Return(metricFamilies, nil)
-		mapper.EXPECT().Map(metricFamilies).Times(1).Return(batch, nil)
+		target := exporter.Target{
+			URL:       "http://192.168.1.1:9400/metrics",
+			NodeName:  "node-1",
+			Pod:       "dcgm-exporter",
+			Namespace: "default",
+		}
+		results := []exporter.ScrapeResult{{Target: target, Families: metricFamilies}}
+
+		scraper.EXPECT().Scrape(mock.Anything, []exporter.Target{target}).Times(1).Return(results)
+		mapper.EXPECT().Map(results).Times(1).Return(batch, nil)
 		client.EXPECT().UploadBatch(mock.Anything, batch).Times(1).Return(nil, nil)
 
 		go func() {
@@ -132,28 +150,26 @@ func TestExporter_Running(t *testing.T) {
 		ex := exporter.NewExporter(config, dynClient, log, scraper, mapper, client, nil)
 		ex.Enable()
 
-		metricFamilies := []exporter.MetricFamilyMap{
-			{
-				"test_gauge": {
-					Type: dto.MetricType_GAUGE.Enum(),
-					Metric: []*dto.Metric{
-						{
-							Label: []*dto.LabelPair{
-								newLabelPair("label1", "value1"),
-							},
-							Gauge: newGauge(1.0),
+		metricFamilies := exporter.MetricFamilyMap{
+			"test_gauge": {
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{
+							newLabelPair("label1", "value1"),
 						},
+						Gauge: newGauge(1.0),
 					},
 				},
-				exporter.MetricGraphicsEngineActive: {
-					Type: dto.MetricType_GAUGE.Enum(),
-					Metric: []*dto.Metric{
-						{
-							Label: []*dto.LabelPair{
-								newLabelPair("label1", "value1"),
-							},
-							Gauge: newGauge(1.0),
+			},
+			exporter.MetricGraphicsEngineActive: {
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{
+							newLabelPair("label1", "value1"),
 						},
+						Gauge: newGauge(1.0),
 					},
 				},
 			},
@@ -167,8 +183,11 @@ func TestExporter_Running(t *testing.T) {
 			},
 		}
 
-		scraper.EXPECT().Scrape(ctx, []string{"http://localhost:9400/metrics"}).Times(1).Return(metricFamilies, nil)
-		mapper.EXPECT().Map(metricFamilies).Times(1).Return(batch, nil)
+		target := exporter.Target{URL: "http://localhost:9400/metrics"}
+		results := []exporter.ScrapeResult{{Target: target, Families: metricFamilies}}
+
+		scraper.EXPECT().Scrape(mock.Anything, []exporter.Target{target}).Times(1).Return(results)
+		mapper.EXPECT().Map(results).Times(1).Return(batch, nil)
 		client.EXPECT().UploadBatch(mock.Anything, batch).Times(1).Return(nil, nil)
 
 		go func() {
@@ -207,28 +226,26 @@ func TestExporter_Running(t *testing.T) {
 		ex := exporter.NewExporter(config, dynClient, log, scraper, mapper, client, nil)
 		ex.Enable()
 
-		metricFamilies := []exporter.MetricFamilyMap{
-			{
-				"test_gauge": {
-					Type: dto.MetricType_GAUGE.Enum(),
-					Metric: []*dto.Metric{
-						{
-							Label: []*dto.LabelPair{
-								newLabelPair("label1", "value1"),
-							},
-							Gauge: newGauge(1.0),
+		metricFamilies := exporter.MetricFamilyMap{
+			"test_gauge": {
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{
+							newLabelPair("label1", "value1"),
 						},
+						Gauge: newGauge(1.0),
 					},
 				},
-				exporter.MetricGraphicsEngineActive: {
-					Type: dto.MetricType_GAUGE.Enum(),
-					Metric: []*dto.Metric{
-						{
-							Label: []*dto.LabelPair{
-								newLabelPair("label1", "value1"),
-							},
-							Gauge: newGauge(1.0),
+			},
+			exporter.MetricGraphicsEngineActive: {
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{
+							newLabelPair("label1", "value1"),
 						},
+						Gauge: newGauge(1.0),
 					},
 				},
 			},
@@ -236,8 +253,11 @@ func TestExporter_Running(t *testing.T) {
 
 		batch := &pb.MetricsBatch{}
 
-		scraper.EXPECT().Scrape(ctx, []string{"http://localhost:9400/metrics"}).Times(1).Return(metricFamilies, nil)
-		mapper.EXPECT().Map(metricFamilies).Times(1).Return(batch, nil)
+		target := exporter.Target{URL: "http://localhost:9400/metrics"}
+		results := []exporter.ScrapeResult{{Target: target, Families: metricFamilies}}
+
+		scraper.EXPECT().Scrape(mock.Anything, []exporter.Target{target}).Times(1).Return(results)
+		mapper.EXPECT().Map(results).Times(1).Return(batch, nil)
 
 		go func() {
 			err := ex.Start(ctx)
@@ -251,4 +271,726 @@ func TestExporter_Running(t *testing.T) {
 		r := require.New(t)
 		r.True(ex.Enabled())
 	})
+
+	t.Run("writes gpu metrics to sinks", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		scheme := runtime.NewScheme()
+		_ = corev1.AddToScheme(scheme)
+		dynClient := fakedynamic.NewSimpleDynamicClient(scheme)
+
+		config := exporter.Config{
+			ExportInterval:   2 * time.Second,
+			DCGMExporterPort: 9400,
+			DCGMExporterPath: "/metrics",
+			DCGMExporterHost: "localhost",
+			Enabled:          true,
+		}
+
+		scraper := mocks.NewMockScraper(t)
+		mapper := mocks.NewMockMetricMapper(t)
+		client := castai_mock.NewMockClient(t)
+		sink := mocks.NewMockSink(t)
+
+		ex := exporter.NewExporter(config, dynClient, log, scraper, mapper, client, nil, sink)
+
+		metricFamilies := exporter.MetricFamilyMap{
+			exporter.MetricGraphicsEngineActive: {
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{
+							newLabelPair("label1", "value1"),
+						},
+						Gauge: newGauge(1.0),
+					},
+				},
+			},
+		}
+
+		batch := &pb.MetricsBatch{
+			Metrics: []*pb.Metric{
+				{
+					Name: exporter.MetricGraphicsEngineActive,
+				},
+			},
+		}
+
+		gpuMetrics := []exporter.GPUMetric{{NodeName: "node-1", GraphicsEngineActive: ptr(1.0), Timestamp: time.Now()}}
+
+		target := exporter.Target{URL: "http://localhost:9400/metrics"}
+		results := []exporter.ScrapeResult{{Target: target, Families: metricFamilies}}
+
+		scraper.EXPECT().Scrape(mock.Anything, []exporter.Target{target}).Times(1).Return(results)
+		mapper.EXPECT().Map(results).Times(1).Return(batch, nil)
+		mapper.EXPECT().MapToAvro(mock.Anything, results).Times(1).Return(gpuMetrics)
+		// a failing sink must not prevent the upload to CAST AI
+		sink.EXPECT().Write(mock.Anything, mock.MatchedBy(func(metrics []exporter.GPUMetric) bool {
+			return len(metrics) == 1 && metrics[0].NodeName == "node-1" && !metrics[0].Timestamp.IsZero()
+		})).Times(1).Return(errors.New("sink unavailable"))
+		sink.EXPECT().Name().Return("test")
+		client.EXPECT().UploadBatch(mock.Anything, batch).Times(1).Return(nil, nil)
+
+		go func() {
+			err := ex.Start(ctx)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+
+		time.Sleep(2400 * time.Millisecond)
+	})
+
+	t.Run("writes sinks alongside the upload within the export interval", func(t *testing.T) {
+		r := require.New(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		config := exporter.Config{
+			ExportInterval:   200 * time.Millisecond,
+			DCGMExporterPort: 9400,
+			DCGMExporterPath: "/metrics",
+			DCGMExporterHost: "localhost",
+			Enabled:          true,
+		}
+
+		scraper := mocks.NewMockScraper(t)
+		mapper := mocks.NewMockMetricMapper(t)
+		client := castai_mock.NewMockClient(t)
+		slow := mocks.NewMockSink(t)
+		fast := mocks.NewMockSink(t)
+
+		ex := exporter.NewExporter(config, nil, log, scraper, mapper, client, nil, slow, fast)
+
+		target := exporter.Target{URL: "http://localhost:9400/metrics"}
+		results := []exporter.ScrapeResult{{Target: target, Families: exporter.MetricFamilyMap{}}}
+		batch := &pb.MetricsBatch{Metrics: []*pb.Metric{{Name: exporter.MetricGraphicsEngineActive}}}
+		gpuMetrics := []exporter.GPUMetric{{NodeName: "node-1", GraphicsEngineActive: ptr(1.0), Timestamp: time.Now()}}
+
+		scraper.EXPECT().Scrape(mock.Anything, []exporter.Target{target}).Return(results)
+		mapper.EXPECT().Map(results).Return(batch)
+		mapper.EXPECT().MapToAvro(mock.Anything, results).Return(gpuMetrics)
+		written := make(chan error, 10)
+		slow.EXPECT().Write(mock.Anything, gpuMetrics).RunAndReturn(func(ctx context.Context, _ []exporter.GPUMetric) error {
+			// the sink doesn't respond until the deadline of the batch
+			<-ctx.Done()
+			written <- ctx.Err()
+			return ctx.Err()
+		})
+		slow.EXPECT().Name().Return("slow")
+		fast.EXPECT().Write(mock.Anything, gpuMetrics).Return(nil)
+		uploaded := make(chan struct{}, 10)
+		client.EXPECT().UploadBatch(mock.Anything, batch).RunAndReturn(func(context.Context, *pb.MetricsBatch) error {
+			uploaded <- struct{}{}
+			return nil
+		})
+
+		started := time.Now()
+		go func() {
+			err := ex.Start(ctx)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+
+		<-uploaded
+		r.Empty(written)
+		r.ErrorIs(<-written, context.DeadlineExceeded)
+		r.Less(time.Since(started), time.Second)
+		cancel()
+	})
+
+	t.Run("writes empty batch sinks when every scrape failed", func(t *testing.T) {
+		r := require.New(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		config := exporter.Config{
+			ExportInterval:   100 * time.Millisecond,
+			DCGMExporterPort: 9400,
+			DCGMExporterPath: "/metrics",
+			DCGMExporterHost: "localhost",
+			Enabled:          true,
+		}
+
+		scraper := mocks.NewMockScraper(t)
+		// sinks which don't follow missing metrics aren't written
+		sink := mocks.NewMockSink(t)
+		empty := &emptyBatchSink{written: make(chan []exporter.GPUMetric, 10)}
+
+		ex := exporter.NewExporter(config, nil, log, scraper, mocks.NewMockMetricMapper(t), castai_mock.NewMockClient(t), nil, sink, empty)
+
+		target := exporter.Target{URL: "http://localhost:9400/metrics"}
+		scraper.EXPECT().Scrape(mock.Anything, []exporter.Target{target}).
+			Return([]exporter.ScrapeResult{{Target: target, Err: errors.New("connection refused")}})
+
+		go func() {
+			err := ex.Start(ctx)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+
+		r.Empty(<-empty.written)
+		r.Empty(<-empty.written)
+		cancel()
+	})
+
+	t.Run("reports targets which failed to be scraped", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var logs safeBuffer
+		log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{Output: &logs}))
+
+		scheme := runtime.NewScheme()
+		_ = corev1.AddToScheme(scheme)
+		pod := func(name, ip string) *corev1.Pod {
+			return &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: "default",
+					Labels:    map[string]string{"app": "dcgm-exporter"},
+				},
+				Spec:   corev1.PodSpec{NodeName: "node-" + name},
+				Status: corev1.PodStatus{PodIP: ip, Phase: corev1.PodRunning, Conditions: readyConditions},
+			}
+		}
+		dynClient := fakedynamic.NewSimpleDynamicClient(scheme, pod("a", "192.168.1.1"), pod("b", "192.168.1.2"))
+
+		config := exporter.Config{
+			ExportInterval:   1 * time.Second,
+			DCGMExporterPort: 9400,
+			DCGMExporterPath: "/metrics",
+			Selector:         "app=dcgm-exporter",
+			Enabled:          true,
+		}
+
+		scraper := mocks.NewMockScraper(t)
+		mapper := mocks.NewMockMetricMapper(t)
+		client := castai_mock.NewMockClient(t)
+
+		ex := exporter.NewExporter(config, dynClient, log, scraper, mapper, client, nil)
+
+		batch := &pb.MetricsBatch{Metrics: []*pb.Metric{{Name: exporter.MetricGraphicsEngineActive}}}
+		scrapes := 0
+		scraper.EXPECT().Scrape(mock.Anything, mock.Anything).RunAndReturn(func(_ context.Context, targets []exporter.Target) []exporter.ScrapeResult {
+			scrapes++
+			results := make([]exporter.ScrapeResult, len(targets))
+			for i, target := range targets {
+				results[i] = exporter.ScrapeResult{Target: target, Timestamp: time.Now(), Families: exporter.MetricFamilyMap{}}
+				// the second pod stops responding after the first export
+				if target.Pod == "b" && scrapes > 1 {
+					results[i].Families = nil
+					results[i].Err = errors.New("connection refused")
+				}
+			}
+			return results
+		})
+		mapper.EXPECT().Map(mock.Anything).Return(batch)
+		client.EXPECT().UploadBatch(mock.Anything, batch).Return(nil)
+
+		go func() {
+			err := ex.Start(ctx)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+
+		time.Sleep(2400 * time.Millisecond)
+		cancel()
+
+		r := require.New(t)
+		output := logs.String()
+		r.Contains(output, "scraped 1 of 2 dcgm-exporters")
+		r.Contains(output, "target=http://192.168.1.2:9400/metrics")
+		r.Contains(output, "node=node-b")
+		r.Contains(output, "stale_for=")
+	})
+}
+
+// safeBuffer is a bytes.Buffer which can be written by the exporter and read by the test concurrently.
+type safeBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *safeBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *safeBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestExporter_GPUInventory(t *testing.T) {
+	r := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var logs safeBuffer
+	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{Output: &logs}))
+
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	dynClient := fakedynamic.NewSimpleDynamicClient(scheme)
+
+	config := exporter.Config{
+		ExportInterval:   300 * time.Millisecond,
+		DCGMExporterPort: 9400,
+		DCGMExporterPath: "/metrics",
+		DCGMExporterHost: "localhost",
+		Enabled:          true,
+	}
+
+	gpus := func(uuids ...string) exporter.MetricFamilyMap {
+		family := &dto.MetricFamily{Type: dto.MetricType_GAUGE.Enum()}
+		for _, uuid := range uuids {
+			family.Metric = append(family.Metric, &dto.Metric{
+				Label: []*dto.LabelPair{
+					newLabelPair("Hostname", "dcgm-exporter"),
+					newLabelPair("UUID", uuid),
+					newLabelPair("modelName", "NVIDIA A100"),
+				},
+				Gauge: newGauge(40),
+			})
+		}
+		return exporter.MetricFamilyMap{exporter.MetricGPUTemperature: family}
+	}
+	nodeA := exporter.Target{URL: "http://192.168.1.1:9400/metrics", NodeName: "node-a"}
+	nodeB := exporter.Target{URL: "http://192.168.1.2:9400/metrics", NodeName: "node-b"}
+	scrapes := [][]exporter.ScrapeResult{
+		{{Target: nodeA, Families: gpus("GPU-1", "GPU-2")}, {Target: nodeB, Families: gpus("GPU-3")}},
+		// GPU-2 fell off the bus and node-b's dcgm-exporter stopped responding
+		{{Target: nodeA, Families: gpus("GPU-1")}, {Target: nodeB, Err: errors.New("connection refused")}},
+		// node-b is gone
+		{{Target: nodeA, Families: gpus("GPU-1")}},
+		// node-a's dcgm-exporter, the only one left, stopped responding
+		{{Target: nodeA, Err: errors.New("connection refused")}},
+		// node-a's dcgm-exporter is back without any GPUs
+		{{Target: nodeA, Families: exporter.MetricFamilyMap{}}},
+	}
+
+	scraper := mocks.NewMockScraper(t)
+	client := castai_mock.NewMockClient(t)
+	mapper := exporter.NewMapper(exporter.MapperConfig{}, nil, log)
+
+	var scraped int
+	scraper.EXPECT().Scrape(mock.Anything, mock.Anything).RunAndReturn(func(context.Context, []exporter.Target) []exporter.ScrapeResult {
+		results := scrapes[min(scraped, len(scrapes)-1)]
+		scraped++
+		return results
+	})
+	batches := make(chan *pb.MetricsBatch, 10)
+	client.EXPECT().UploadBatch(mock.Anything, mock.Anything).RunAndReturn(func(_ context.Context, batch *pb.MetricsBatch) error {
+		batches <- batch
+		return nil
+	})
+
+	ex := exporter.NewExporter(config, dynClient, log, scraper, mapper, client, nil)
+	go func() {
+		err := ex.Start(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}()
+
+	type presence map[string]float64
+	gpuPresent := func(batch *pb.MetricsBatch) presence {
+		got := presence{}
+		for _, metric := range batch.Metrics {
+			if metric.Name != exporter.MetricGPUPresent {
+				continue
+			}
+			for _, m := range metric.Measurements {
+				var node, uuid string
+				for _, l := range m.Labels {
+					switch l.Name {
+					case "Hostname":
+						node = l.Value
+					case "UUID":
+						uuid = l.Value
+					}
+				}
+				got[node+"/"+uuid] = m.Value
+			}
+		}
+		return got
+	}
+	uuids := func(gpus []*pb.NodeInventory_GPU) []string {
+		var got []string
+		for _, gpu := range gpus {
+			got = append(got, gpu.Uuid)
+		}
+		return got
+	}
+
+	batch := <-batches
+	r.Equal(presence{"node-a/GPU-1": 1, "node-a/GPU-2": 1, "node-b/GPU-3": 1}, gpuPresent(batch))
+	r.Len(batch.Inventory, 2)
+	r.Equal([]string{"GPU-1", "GPU-2"}, uuids(batch.Inventory[0].Gpus))
+	r.Empty(batch.Inventory[0].Added)
+
+	batch = <-batches
+	r.Equal(presence{"node-a/GPU-1": 1, "node-a/GPU-2": 0}, gpuPresent(batch))
+	r.Equal("node-a", batch.Inventory[0].NodeName)
+	r.Equal([]string{"GPU-2"}, uuids(batch.Inventory[0].Removed))
+	r.Equal("node-b", batch.Inventory[1].NodeName)
+	r.True(batch.Inventory[1].Stale)
+	r.Equal([]string{"GPU-3"}, uuids(batch.Inventory[1].Gpus))
+
+	batch = <-batches
+	r.Equal(presence{"node-a/GPU-1": 1, "node-b/GPU-3": 0}, gpuPresent(batch))
+	r.False(batch.Inventory[1].Stale)
+	r.Empty(batch.Inventory[1].Gpus)
+	r.Equal([]string{"GPU-3"}, uuids(batch.Inventory[1].Removed))
+
+	// batches without metrics still carry the inventory
+	batch = <-batches
+	r.Empty(gpuPresent(batch))
+	r.Len(batch.Inventory, 1)
+	r.True(batch.Inventory[0].Stale)
+	r.Equal([]string{"GPU-1"}, uuids(batch.Inventory[0].Gpus))
+
+	batch = <-batches
+	r.Equal(presence{"node-a/GPU-1": 0}, gpuPresent(batch))
+	r.Len(batch.Inventory, 1)
+	r.Equal([]string{"GPU-1"}, uuids(batch.Inventory[0].Removed))
+
+	// there is nothing left to report
+	time.Sleep(3 * config.ExportInterval)
+	r.Empty(batches)
+	cancel()
+
+	output := logs.String()
+	r.Contains(output, "gpus disappeared from node")
+	r.Contains(output, "removed=[GPU-2]")
+	r.Contains(output, "gpu inventory of node is stale")
+	r.Contains(output, "node is gone along with its gpus")
+}
+
+// TestExporter_Tracking checks that the exporter wires the scraped series through relabeling, sanitizing and the
+// trackers into the batches, sinks and recorders, the trackers themselves are tested on their own.
+func TestExporter_Tracking(t *testing.T) {
+	r := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var logs safeBuffer
+	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{Output: &logs}))
+
+	training := workload.Workload{Namespace: "ml", Kind: workload.KindJob, Name: "training"}
+	resolver := workload_mock.NewMockResolver(t)
+	resolver.EXPECT().FindWorkloadForPod(mock.Anything, mock.Anything, "ml").Return(&training, nil)
+	annotator := workload_mock.NewMockAnnotator(t)
+	annotations := make(chan map[string]*string, 10)
+	annotator.EXPECT().Annotate(mock.Anything, training, mock.Anything).
+		RunAndReturn(func(_ context.Context, _ workload.Workload, a map[string]*string) error {
+			annotations <- a
+			return nil
+		})
+	recorder := mocks.NewMockXIDRecorder(t)
+	recorded := make(chan exporter.XIDError, 10)
+	recorder.EXPECT().RecordXID(mock.Anything, mock.Anything).Run(func(ctx context.Context, xid exporter.XIDError) {
+		// XIDs are recorded within the deadline of the batch
+		if _, found := ctx.Deadline(); !found {
+			t.Error("XID recorded without a deadline")
+		}
+		recorded <- xid
+	})
+	relabeler, err := relabel.New([]relabel.Config{{Action: relabel.LabelDrop, Regex: ptr("pci_bus_id")}})
+	r.NoError(err)
+
+	config := exporter.Config{
+		ExportInterval:     100 * time.Millisecond,
+		Enabled:            true,
+		Discoverer:         staticDiscoverer{{URL: "http://10.0.0.1:9400/metrics", NodeName: "node-a"}},
+		Energy:             exporter.EnergyConfig{MaxGap: time.Hour, CarbonIntensity: 400},
+		ClockEvents:        exporter.ClockEventsConfig{MaxGap: time.Hour},
+		XIDRecorder:        recorder,
+		Idle:               exporter.NewIdleDetector(exporter.IdleConfig{MaxUtilization: 1, MinDuration: 30 * time.Minute}),
+		IdleAnnotator:      annotator,
+		Relabeler:          relabeler,
+		InvalidValuePolicy: exporter.InvalidValuePolicyDrop,
+	}
+
+	gauge := func(value float64) *dto.MetricFamily {
+		return &dto.MetricFamily{
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{
+					newLabelPair("UUID", "GPU-1"),
+					newLabelPair("gpu", "0"),
+					newLabelPair("pci_bus_id", "00000000:00:1E.0"),
+					newLabelPair("namespace", "ml"),
+					newLabelPair("pod", "trainer-0"),
+				},
+				Gauge: newGauge(value),
+			}},
+		}
+	}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	scrape := func(at time.Time, xid float64) []exporter.ScrapeResult {
+		return []exporter.ScrapeResult{{
+			Target:    exporter.Target{URL: "http://10.0.0.1:9400/metrics", NodeName: "node-a"},
+			Timestamp: at,
+			Families: exporter.MetricFamilyMap{
+				exporter.MetricPowerUsage:         gauge(100),
+				exporter.MetricGPUUtilization:     gauge(0),
+				exporter.MetricClocksEventReasons: gauge(0x1),
+				exporter.MetricXIDErrors:          gauge(xid),
+				exporter.MetricGPUTemperature:     gauge(math.NaN()),
+			},
+		}}
+	}
+	scrapes := [][]exporter.ScrapeResult{
+		scrape(start, 0),
+		scrape(start.Add(30*time.Minute), 79),
+	}
+
+	scraper := mocks.NewMockScraper(t)
+	var scraped int
+	scraper.EXPECT().Scrape(mock.Anything, mock.Anything).RunAndReturn(func(context.Context, []exporter.Target) []exporter.ScrapeResult {
+		results := scrapes[min(scraped, len(scrapes)-1)]
+		scraped++
+		return results
+	})
+	client := castai_mock.NewMockClient(t)
+	batches := make(chan *pb.MetricsBatch, 10)
+	client.EXPECT().UploadBatch(mock.Anything, mock.Anything).RunAndReturn(func(_ context.Context, batch *pb.MetricsBatch) error {
+		batches <- batch
+		return nil
+	})
+	sink := mocks.NewMockSink(t)
+	rows := make(chan []exporter.GPUMetric, 10)
+	sink.EXPECT().Name().Return("test").Maybe()
+	sink.EXPECT().Write(mock.Anything, mock.Anything).RunAndReturn(func(_ context.Context, metrics []exporter.GPUMetric) error {
+		rows <- metrics
+		return nil
+	})
+	mapper := exporter.NewMapper(exporter.MapperConfig{}, resolver, log)
+
+	ex := exporter.NewExporter(config, nil, log, scraper, mapper, client, nil, sink)
+	go func() {
+		err := ex.Start(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}()
+
+	<-batches
+	<-rows
+	batch := <-batches
+	row := (<-rows)[0]
+	cancel()
+
+	values := make(map[string]float64)
+	for _, metric := range batch.Metrics {
+		for _, m := range metric.Measurements {
+			for _, l := range m.Labels {
+				r.NotEqual("pci_bus_id", l.Name)
+			}
+		}
+		if len(metric.Measurements) > 0 {
+			values[metric.Name] = metric.Measurements[0].Value
+		}
+	}
+	r.NotContains(values, exporter.MetricGPUTemperature)
+	r.Equal(1.0, values[exporter.MetricInvalidValues])
+	r.Equal(180000.0, values[exporter.MetricEnergy])
+	r.Equal(1800.0, values[exporter.MetricClocksEventSeconds])
+	r.Equal(1.0, values[exporter.MetricXIDErrorCount])
+	r.Equal(1800.0, values[exporter.MetricIdleSeconds])
+
+	r.Equal(ptr(180000.0), row.EnergyJoules)
+	r.Nil(row.Temperature)
+
+	r.Equal(79, (<-recorded).Code)
+	r.Contains(logs.String(), "gpu reported XID 79: GPU has fallen off the bus")
+	r.Equal("30m0s", *(<-annotations)[exporter.IdleDurationAnnotation])
+}
+
+func TestExporter_PodDiscovery(t *testing.T) {
+	r := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
+
+	pod := func(name string, mutate func(*corev1.Pod)) *corev1.Pod {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Labels:    map[string]string{"app": "dcgm-exporter"},
+			},
+			Spec: corev1.PodSpec{
+				NodeName:   "node-" + name,
+				Containers: []corev1.Container{{Name: "dcgm-exporter"}},
+			},
+			Status: corev1.PodStatus{
+				PodIP:      "192.168.1.1",
+				HostIP:     "10.0.0.1",
+				Phase:      corev1.PodRunning,
+				Conditions: readyConditions,
+			},
+		}
+		mutate(pod)
+		return pod
+	}
+
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	dynClient := fakedynamic.NewSimpleDynamicClient(scheme,
+		pod("defaults", func(*corev1.Pod) {}),
+		pod("annotations", func(p *corev1.Pod) {
+			p.Status.PodIP = "192.168.1.2"
+			p.Annotations = map[string]string{
+				"prometheus.io/scheme": "https",
+				"prometheus.io/port":   "9500",
+				"prometheus.io/path":   "/dcgm/metrics",
+			}
+		}),
+		pod("named-port", func(p *corev1.Pod) {
+			p.Status.PodIP = "192.168.1.3"
+			p.Spec.Containers[0].Ports = []corev1.ContainerPort{{Name: "metrics", ContainerPort: 9600}}
+		}),
+		pod("annotated-port-name", func(p *corev1.Pod) {
+			p.Status.PodIP = "fd00::4"
+			p.Annotations = map[string]string{"prometheus.io/port": "dcgm"}
+			p.Spec.Containers[0].Ports = []corev1.ContainerPort{
+				{Name: "metrics", ContainerPort: 9600},
+				{Name: "dcgm", ContainerPort: 9700},
+			}
+		}),
+		pod("host-network", func(p *corev1.Pod) {
+			p.Spec.HostNetwork = true
+			p.Status.PodIP = ""
+		}),
+		pod("unknown-port-name", func(p *corev1.Pod) {
+			p.Annotations = map[string]string{"prometheus.io/port": "missing"}
+		}),
+		pod("not-ready", func(p *corev1.Pod) {
+			p.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionFalse}}
+		}),
+		pod("no-conditions", func(p *corev1.Pod) {
+			p.Status.Conditions = nil
+		}),
+	)
+
+	config := exporter.Config{
+		ExportInterval:   100 * time.Millisecond,
+		DCGMExporterPort: 9400,
+		DCGMExporterPath: "/metrics",
+		Selector:         "app=dcgm-exporter",
+		Enabled:          true,
+	}
+
+	scraper := mocks.NewMockScraper(t)
+	discovered := make(chan []exporter.Target, 10)
+	scraper.EXPECT().Scrape(mock.Anything, mock.Anything).RunAndReturn(func(_ context.Context, targets []exporter.Target) []exporter.ScrapeResult {
+		discovered <- targets
+		results := make([]exporter.ScrapeResult, len(targets))
+		for i, target := range targets {
+			results[i] = exporter.ScrapeResult{Target: target, Err: errors.New("connection refused")}
+		}
+		return results
+	})
+
+	ex := exporter.NewExporter(config, dynClient, log, scraper, mocks.NewMockMetricMapper(t), castai_mock.NewMockClient(t), nil)
+	go func() {
+		err := ex.Start(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}()
+
+	targets := <-discovered
+	cancel()
+
+	urls := make(map[string]string, len(targets))
+	for _, target := range targets {
+		urls[target.Pod] = target.URL
+	}
+	r.Equal(map[string]string{
+		"defaults":            "http://192.168.1.1:9400/metrics",
+		"annotations":         "https://192.168.1.2:9500/dcgm/metrics",
+		"named-port":          "http://192.168.1.3:9600/metrics",
+		"annotated-port-name": "http://[fd00::4]:9700/metrics",
+		"host-network":        "http://10.0.0.1:9400/metrics",
+	}, urls)
+}
+
+// shardFunc owns the targets for which the function returns true.
+type shardFunc func(exporter.Target) bool
+
+func (f shardFunc) Owns(target exporter.Target) bool {
+	return f(target)
+}
+
+func TestExporter_Shard(t *testing.T) {
+	r := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
+	config := exporter.Config{
+		ExportInterval: 100 * time.Millisecond,
+		Enabled:        true,
+		Discoverer: staticDiscoverer{
+			{URL: "http://10.0.0.1:9400/metrics", NodeName: "node-a"},
+			{URL: "http://10.0.0.2:9400/metrics", NodeName: "node-b"},
+		},
+		Shard: shardFunc(func(target exporter.Target) bool { return target.NodeName == "node-b" }),
+	}
+
+	scraper := mocks.NewMockScraper(t)
+	scraped := make(chan []exporter.Target, 10)
+	scraper.EXPECT().Scrape(mock.Anything, mock.Anything).RunAndReturn(func(_ context.Context, targets []exporter.Target) []exporter.ScrapeResult {
+		scraped <- targets
+		return []exporter.ScrapeResult{{Target: targets[0], Err: errors.New("connection refused")}}
+	})
+
+	ex := exporter.NewExporter(config, nil, log, scraper, mocks.NewMockMetricMapper(t), castai_mock.NewMockClient(t), nil)
+	go func() {
+		err := ex.Start(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}()
+
+	targets := <-scraped
+	cancel()
+	r.Equal([]exporter.Target{{URL: "http://10.0.0.2:9400/metrics", NodeName: "node-b"}}, targets)
+}
+
+// emptyBatchSink sends the rows it's written to the channel.
+type emptyBatchSink struct {
+	written chan []exporter.GPUMetric
+}
+
+func (s *emptyBatchSink) Name() string {
+	return "empty"
+}
+
+func (s *emptyBatchSink) Write(_ context.Context, metrics []exporter.GPUMetric) error {
+	s.written <- metrics
+	return nil
+}
+
+func (s *emptyBatchSink) WritesEmptyBatches() {}
+
+type staticDiscoverer []exporter.Target
+
+func (d staticDiscoverer) Targets(context.Context) ([]exporter.Target, error) {
+	return d, nil
+}
+
+func ptr[T any](v T) *T {
+	return &v
 }
@@ -3,46 +3,218 @@ package exporter
 import "time"
 
 type GPUMetric struct {
-	NodeName      string `avro:"node_name"`
-	ModelName     string `avro:"model_name"`
-	Device        string `avro:"device"`
-	DeviceID      string `avro:"device_id"`
-	DeviceUUID    string `avro:"device_uuid"`
-	MIGProfile    string `avro:"mig_profile"`
-	MIGInstanceID string `avro:"mig_instance_id"`
-
-	Pod          string `avro:"pod"`
-	Container    string `avro:"container"`
-	Namespace    string `avro:"namespace"`
-	WorkloadName string `avro:"workload_name"`
-	WorkloadKind string `avro:"workload_kind"`
-
-	SMActive             float64 `avro:"sm_active"`
-	SMOccupancy          float64 `avro:"sm_occupancy"`
-	TensorActive         float64 `avro:"tensor_active"`
-	DRAMActive           float64 `avro:"dram_active"`
-	PCIeTXBytes          float64 `avro:"pcie_tx_bytes"`
-	PCIeRXBytes          float64 `avro:"pcie_rx_bytes"`
-	NVLinkTXBytes        float64 `avro:"nvlink_tx_bytes"`
-	NVLinkRXBytes        float64 `avro:"nvlink_rx_bytes"`
-	GraphicsEngineActive float64 `avro:"graphics_engine_active"`
-	FramebufferTotal     float64 `avro:"framebuffer_total"`
-	FramebufferUsed      float64 `avro:"framebuffer_used"`
-	FramebufferFree      float64 `avro:"framebuffer_free"`
-	PCIeLinkGen          float64 `avro:"pcie_link_gen"`
-	PCIeLinkWidth        float64 `avro:"pcie_link_width"`
-	Temperature          float64 `avro:"temperature"`
-	MemoryTemperature    float64 `avro:"memory_temperature"`
-	PowerUsage           float64 `avro:"power_usage"`
-	GPUUtilization       float64 `avro:"gpu_utilization"`
-	IntPipeActive        float64 `avro:"int_pipe_active"`
-	FP16PipeActive       float64 `avro:"fp16_pipe_active"`
-	FP32PipeActive       float64 `avro:"fp32_pipe_active"`
-	FP64PipeActive       float64 `avro:"fp64_pipe_active"`
-	ClocksEventReasons   float64 `avro:"clocks_event_reasons"`
-	XIDErrors            float64 `avro:"xid_errors"`
-	PowerViolation       float64 `avro:"power_violation"`
-	ThermalViolation     float64 `avro:"thermal_violation"`
-
-	Timestamp time.Time `avro:"ts"`
+	NodeName      string `avro:"node_name" json:"node_name"`
+	ModelName     string `avro:"model_name" json:"model_name"`
+	Device        string `avro:"device" json:"device"`
+	DeviceID      string `avro:"device_id" json:"device_id"`
+	DeviceUUID    string `avro:"device_uuid" json:"device_uuid"`
+	MIGProfile    string `avro:"mig_profile" json:"mig_profile"`
+	MIGInstanceID string `avro:"mig_instance_id" json:"mig_instance_id"`
+
+	Pod          string `avro:"pod" json:"pod"`
+	Container    string `avro:"container" json:"container"`
+	Namespace    string `avro:"namespace" json:"namespace"`
+	WorkloadName string `avro:"workload_name" json:"workload_name"`
+	WorkloadKind string `avro:"workload_kind" json:"workload_kind"`
+
+	// Measured values, nil when the GPU didn't report them.
+	SMActive             *float64 `avro:"sm_active" json:"sm_active"`
+	SMOccupancy          *float64 `avro:"sm_occupancy" json:"sm_occupancy"`
+	TensorActive         *float64 `avro:"tensor_active" json:"tensor_active"`
+	DRAMActive           *float64 `avro:"dram_active" json:"dram_active"`
+	PCIeTXBytes          *float64 `avro:"pcie_tx_bytes" json:"pcie_tx_bytes"`
+	PCIeRXBytes          *float64 `avro:"pcie_rx_bytes" json:"pcie_rx_bytes"`
+	NVLinkTXBytes        *float64 `avro:"nvlink_tx_bytes" json:"nvlink_tx_bytes"`
+	NVLinkRXBytes        *float64 `avro:"nvlink_rx_bytes" json:"nvlink_rx_bytes"`
+	GraphicsEngineActive *float64 `avro:"graphics_engine_active" json:"graphics_engine_active"`
+	FramebufferTotal     *float64 `avro:"framebuffer_total" json:"framebuffer_total"`
+	FramebufferUsed      *float64 `avro:"framebuffer_used" json:"framebuffer_used"`
+	FramebufferFree      *float64 `avro:"framebuffer_free" json:"framebuffer_free"`
+	PCIeLinkGen          *float64 `avro:"pcie_link_gen" json:"pcie_link_gen"`
+	PCIeLinkWidth        *float64 `avro:"pcie_link_width" json:"pcie_link_width"`
+	Temperature          *float64 `avro:"temperature" json:"temperature"`
+	MemoryTemperature    *float64 `avro:"memory_temperature" json:"memory_temperature"`
+	PowerUsage           *float64 `avro:"power_usage" json:"power_usage"`
+	PowerLimit           *float64 `avro:"power_limit" json:"power_limit"`
+	GPUUtilization       *float64 `avro:"gpu_utilization" json:"gpu_utilization"`
+	IntPipeActive        *float64 `avro:"int_pipe_active" json:"int_pipe_active"`
+	FP16PipeActive       *float64 `avro:"fp16_pipe_active" json:"fp16_pipe_active"`
+	FP32PipeActive       *float64 `avro:"fp32_pipe_active" json:"fp32_pipe_active"`
+	FP64PipeActive       *float64 `avro:"fp64_pipe_active" json:"fp64_pipe_active"`
+	ClocksEventReasons   *float64 `avro:"clocks_event_reasons" json:"clocks_event_reasons"`
+	XIDErrors            *float64 `avro:"xid_errors" json:"xid_errors"`
+	PowerViolation       *float64 `avro:"power_violation" json:"power_violation"`
+	ThermalViolation     *float64 `avro:"thermal_violation" json:"thermal_violation"`
+
+	// Derived values, see derive. Nil when the values they're derived from weren't reported.
+	FramebufferUtilization *float64 `avro:"framebuffer_utilization" json:"framebuffer_utilization"`
+	PowerUtilization       *float64 `avro:"power_utilization" json:"power_utilization"`
+	TensorActiveShare      *float64 `avro:"tensor_active_share" json:"tensor_active_share"`
+	EffectiveUtilization   *float64 `avro:"effective_utilization" json:"effective_utilization"`
+	Idle                   *bool    `avro:"idle" json:"idle"`
+
+	// Decoded from ClocksEventReasons.
+	ClocksEventGPUIdle            bool `avro:"clocks_event_gpu_idle" json:"clocks_event_gpu_idle"`
+	ClocksEventApplicationsClocks bool `avro:"clocks_event_applications_clocks_setting" json:"clocks_event_applications_clocks_setting"`
+	ClocksEventSWPowerCap         bool `avro:"clocks_event_sw_power_cap" json:"clocks_event_sw_power_cap"`
+	ClocksEventHWSlowdown         bool `avro:"clocks_event_hw_slowdown" json:"clocks_event_hw_slowdown"`
+	ClocksEventSyncBoost          bool `avro:"clocks_event_sync_boost" json:"clocks_event_sync_boost"`
+	ClocksEventSWThermal          bool `avro:"clocks_event_sw_thermal_slowdown" json:"clocks_event_sw_thermal_slowdown"`
+	ClocksEventHWThermal          bool `avro:"clocks_event_hw_thermal_slowdown" json:"clocks_event_hw_thermal_slowdown"`
+	ClocksEventHWPowerBrake       bool `avro:"clocks_event_hw_power_brake_slowdown" json:"clocks_event_hw_power_brake_slowdown"`
+	ClocksEventDisplayClock       bool `avro:"clocks_event_display_clock_setting" json:"clocks_event_display_clock_setting"`
+
+	// Cumulative since the exporter started, see EnergyConfig.
+	EnergyJoules *float64 `avro:"energy_joules" json:"energy_joules"`
+	CarbonGrams  *float64 `avro:"carbon_grams" json:"carbon_grams"`
+
+	Timestamp time.Time `avro:"ts" json:"ts"`
+}
+
+// GPUMetricField binds a DCGM metric to the GPUMetric field it is mapped into.
+type GPUMetricField struct {
+	Name MetricName
+	// Value returns false when the GPU didn't report the metric.
+	Value func(m *GPUMetric) (float64, bool)
+	// Cumulative is set for monotonically increasing totals since the exporter started, which restart from 0
+	// with it, the other values are gauges.
+	Cumulative bool
+}
+
+// GPUMetricFields lists the measured values of GPUMetric in a stable order. Sinks which
+// re-expose GPUMetric rows as individual series should use it instead of reflecting on the struct.
+var GPUMetricFields = []GPUMetricField{
+	{Name: MetricStreamingMultiProcessorActive, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.SMActive) }},
+	{Name: MetricStreamingMultiProcessorOccupancy, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.SMOccupancy) }},
+	{Name: MetricStreamingMultiProcessorTensorActive, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.TensorActive) }},
+	{Name: MetricDRAMActive, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.DRAMActive) }},
+	{Name: MetricPCIeTXBytes, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.PCIeTXBytes) }},
+	{Name: MetricPCIeRXBytes, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.PCIeRXBytes) }},
+	{Name: MetricNVLinkTXBytes, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.NVLinkTXBytes) }},
+	{Name: MetricNVLinkRXBytes, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.NVLinkRXBytes) }},
+	{Name: MetricGraphicsEngineActive, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.GraphicsEngineActive) }},
+	{Name: MetricFrameBufferTotal, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.FramebufferTotal) }},
+	{Name: MetricFrameBufferUsed, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.FramebufferUsed) }},
+	{Name: MetricFrameBufferFree, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.FramebufferFree) }},
+	{Name: MetricPCIeLinkGen, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.PCIeLinkGen) }},
+	{Name: MetricPCIeLinkWidth, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.PCIeLinkWidth) }},
+	{Name: MetricGPUTemperature, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.Temperature) }},
+	{Name: MetricMemoryTemperature, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.MemoryTemperature) }},
+	{Name: MetricPowerUsage, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.PowerUsage) }},
+	{Name: MetricPowerLimit, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.PowerLimit) }},
+	{Name: MetricGPUUtilization, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.GPUUtilization) }},
+	{Name: MetricIntPipeActive, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.IntPipeActive) }},
+	{Name: MetricFloat16PipeActive, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.FP16PipeActive) }},
+	{Name: MetricFloat32PipeActive, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.FP32PipeActive) }},
+	{Name: MetricFloat64PipeActive, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.FP64PipeActive) }},
+	{Name: MetricClocksEventReasons, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.ClocksEventReasons) }},
+	{Name: MetricClocksEventReason + "_gpu_idle", Value: func(m *GPUMetric) (float64, bool) { return decodedReason(m, m.ClocksEventGPUIdle) }},
+	{Name: MetricClocksEventReason + "_applications_clocks_setting", Value: func(m *GPUMetric) (float64, bool) { return decodedReason(m, m.ClocksEventApplicationsClocks) }},
+	{Name: MetricClocksEventReason + "_sw_power_cap", Value: func(m *GPUMetric) (float64, bool) { return decodedReason(m, m.ClocksEventSWPowerCap) }},
+	{Name: MetricClocksEventReason + "_hw_slowdown", Value: func(m *GPUMetric) (float64, bool) { return decodedReason(m, m.ClocksEventHWSlowdown) }},
+	{Name: MetricClocksEventReason + "_sync_boost", Value: func(m *GPUMetric) (float64, bool) { return decodedReason(m, m.ClocksEventSyncBoost) }},
+	{Name: MetricClocksEventReason + "_sw_thermal_slowdown", Value: func(m *GPUMetric) (float64, bool) { return decodedReason(m, m.ClocksEventSWThermal) }},
+	{Name: MetricClocksEventReason + "_hw_thermal_slowdown", Value: func(m *GPUMetric) (float64, bool) { return decodedReason(m, m.ClocksEventHWThermal) }},
+	{Name: MetricClocksEventReason + "_hw_power_brake_slowdown", Value: func(m *GPUMetric) (float64, bool) { return decodedReason(m, m.ClocksEventHWPowerBrake) }},
+	{Name: MetricClocksEventReason + "_display_clock_setting", Value: func(m *GPUMetric) (float64, bool) { return decodedReason(m, m.ClocksEventDisplayClock) }},
+	{Name: MetricXIDErrors, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.XIDErrors) }},
+	{Name: MetricPowerViolation, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.PowerViolation) }},
+	{Name: MetricThermalViolation, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.ThermalViolation) }},
+	{Name: MetricFramebufferUtilization, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.FramebufferUtilization) }},
+	{Name: MetricPowerUtilization, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.PowerUtilization) }},
+	{Name: MetricTensorActiveShare, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.TensorActiveShare) }},
+	{Name: MetricEffectiveUtilization, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.EffectiveUtilization) }},
+	{Name: MetricIdle, Value: func(m *GPUMetric) (float64, bool) { return boolValueOf(m.Idle) }},
+	{Name: MetricEnergy, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.EnergyJoules) }, Cumulative: true},
+	{Name: MetricCarbon, Value: func(m *GPUMetric) (float64, bool) { return valueOf(m.CarbonGrams) }, Cumulative: true},
+}
+
+// set stores the value of a DCGM metric in its field, values of other metrics are ignored.
+func (m *GPUMetric) set(name MetricName, value float64) {
+	switch name {
+	case MetricStreamingMultiProcessorActive:
+		m.SMActive = &value
+	case MetricStreamingMultiProcessorOccupancy:
+		m.SMOccupancy = &value
+	case MetricStreamingMultiProcessorTensorActive:
+		m.TensorActive = &value
+	case MetricDRAMActive:
+		m.DRAMActive = &value
+	case MetricPCIeTXBytes:
+		m.PCIeTXBytes = &value
+	case MetricPCIeRXBytes:
+		m.PCIeRXBytes = &value
+	case MetricNVLinkTXBytes:
+		m.NVLinkTXBytes = &value
+	case MetricNVLinkRXBytes:
+		m.NVLinkRXBytes = &value
+	case MetricGraphicsEngineActive:
+		m.GraphicsEngineActive = &value
+	case MetricFrameBufferTotal:
+		m.FramebufferTotal = &value
+	case MetricFrameBufferFree:
+		m.FramebufferFree = &value
+	case MetricFrameBufferUsed:
+		m.FramebufferUsed = &value
+	case MetricPCIeLinkGen:
+		m.PCIeLinkGen = &value
+	case MetricPCIeLinkWidth:
+		m.PCIeLinkWidth = &value
+	case MetricGPUTemperature:
+		m.Temperature = &value
+	case MetricMemoryTemperature:
+		m.MemoryTemperature = &value
+	case MetricPowerUsage:
+		m.PowerUsage = &value
+	case MetricPowerLimit:
+		m.PowerLimit = &value
+	case MetricGPUUtilization:
+		m.GPUUtilization = &value
+	case MetricIntPipeActive:
+		m.IntPipeActive = &value
+	case MetricFloat16PipeActive:
+		m.FP16PipeActive = &value
+	case MetricFloat32PipeActive:
+		m.FP32PipeActive = &value
+	case MetricFloat64PipeActive:
+		m.FP64PipeActive = &value
+	case MetricClocksEventReasons:
+		m.ClocksEventReasons = &value
+		m.setClocksEventReasons(value)
+	case MetricXIDErrors:
+		m.XIDErrors = &value
+	case MetricPowerViolation:
+		m.PowerViolation = &value
+	case MetricThermalViolation:
+		m.ThermalViolation = &value
+	}
+}
+
+// valueOf returns the value of a measured field, false when it wasn't reported.
+func valueOf(v *float64) (float64, bool) {
+	if v == nil {
+		return 0, false
+	}
+	return *v, true
+}
+
+// boolValueOf returns a derived flag as 0 or 1, false when it couldn't be derived.
+func boolValueOf(v *bool) (float64, bool) {
+	if v == nil {
+		return 0, false
+	}
+	return boolToFloat(*v), true
+}
+
+// decodedReason returns a reason decoded from ClocksEventReasons, false when those weren't reported.
+func decodedReason(m *GPUMetric, set bool) (float64, bool) {
+	return boolToFloat(set), m.ClocksEventReasons != nil
+}
+
+// orZero returns the value of a measured field, 0 when it wasn't reported.
+func orZero(v *float64) float64 {
+	if v == nil {
+		return 0
+	}
+	return *v
 }
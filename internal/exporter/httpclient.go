@@ -0,0 +1,159 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	promconfig "github.com/prometheus/common/config"
+)
+
+const (
+	scrapeClientName = "dcgm-exporter"
+	userAgent        = "castai-gpu-metrics-exporter/"
+)
+
+// ScrapeClientConfig configures how the connections to dcgm-exporters are secured and authenticated.
+type ScrapeClientConfig struct {
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+	// BearerTokenFile and the basic auth credentials are mutually exclusive.
+	BearerTokenFile       string
+	BasicAuthUsername     string
+	BasicAuthPasswordFile string
+}
+
+// NewScrapeHTTPClient creates the client used to scrape dcgm-exporters. Certificates, the bearer token and
+// the basic auth password are read from their files again once they change, so rotated credentials are picked
+// up without a restart.
+//
+// Besides http and https the client accepts unix URLs in the form unix:///path/to/socket:/metrics, which are
+// requested over plain HTTP on the socket.
+func NewScrapeHTTPClient(cfg ScrapeClientConfig, version string) (*http.Client, error) {
+	clientConfig := promconfig.HTTPClientConfig{
+		TLSConfig: promconfig.TLSConfig{
+			CAFile:             cfg.CAFile,
+			CertFile:           cfg.CertFile,
+			KeyFile:            cfg.KeyFile,
+			ServerName:         cfg.ServerName,
+			InsecureSkipVerify: cfg.InsecureSkipVerify,
+		},
+		ProxyConfig: promconfig.ProxyConfig{
+			ProxyFromEnvironment: true,
+		},
+		FollowRedirects: true,
+		EnableHTTP2:     true,
+	}
+	if cfg.BearerTokenFile != "" {
+		clientConfig.Authorization = &promconfig.Authorization{CredentialsFile: cfg.BearerTokenFile}
+	}
+	if cfg.BasicAuthUsername != "" || cfg.BasicAuthPasswordFile != "" {
+		clientConfig.BasicAuth = &promconfig.BasicAuth{
+			Username:     cfg.BasicAuthUsername,
+			PasswordFile: cfg.BasicAuthPasswordFile,
+		}
+	}
+
+	if err := clientConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid dcgm-exporter client configuration: %w", err)
+	}
+
+	client, err := promconfig.NewClientFromConfig(clientConfig, scrapeClientName, promconfig.WithUserAgent(userAgent+version))
+	if err != nil {
+		return nil, err
+	}
+
+	// unix sockets are local, so they aren't proxied and don't need TLS, but they're authenticated the same way
+	unixConfig := promconfig.HTTPClientConfig{
+		Authorization: clientConfig.Authorization,
+		BasicAuth:     clientConfig.BasicAuth,
+	}
+	client.Transport = &unixRoundTripper{
+		next: client.Transport,
+		newTransport: func(socket string) (http.RoundTripper, error) {
+			return promconfig.NewRoundTripperFromConfig(
+				unixConfig,
+				scrapeClientName,
+				promconfig.WithUserAgent(userAgent+version),
+				promconfig.WithDialContextFunc(func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socket)
+				}),
+			)
+		},
+		transports: make(map[string]http.RoundTripper),
+	}
+
+	return client, nil
+}
+
+// UnixSocketURL returns the URL scraping path over the unix socket.
+func UnixSocketURL(socket, path string) string {
+	return fmt.Sprintf("unix://%s:%s", socket, path)
+}
+
+// unixRoundTripper sends the requests of unix URLs through a transport dialing their socket, one per socket so
+// that their connections are pooled separately, and the other requests through next.
+type unixRoundTripper struct {
+	next         http.RoundTripper
+	newTransport func(socket string) (http.RoundTripper, error)
+
+	mu         sync.Mutex
+	transports map[string]http.RoundTripper
+}
+
+func (u *unixRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "unix" {
+		return u.next.RoundTrip(req)
+	}
+
+	// the path requested starts with the first ":/", so socket paths may contain colons
+	socket, path, found := strings.Cut(req.URL.Path, ":/")
+	if socket == "" {
+		return nil, fmt.Errorf("missing socket path in %q", req.URL.String())
+	}
+	path = "/" + path
+	if !found {
+		socket = strings.TrimSuffix(socket, ":")
+	}
+
+	transport, err := u.transport(socket)
+	if err != nil {
+		return nil, fmt.Errorf("creating transport of socket %s: %w", socket, err)
+	}
+
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	req.URL.Host = "localhost"
+	req.URL.Path = path
+	req.URL.RawPath = ""
+	req.Host = "localhost"
+
+	return transport.RoundTrip(req)
+}
+
+func (u *unixRoundTripper) transport(socket string) (http.RoundTripper, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if transport, found := u.transports[socket]; found {
+		return transport, nil
+	}
+	transport, err := u.newTransport(socket)
+	if err != nil {
+		return nil, err
+	}
+	u.transports[socket] = transport
+	return transport, nil
+}
+
+var dialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
@@ -0,0 +1,252 @@
+package exporter_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/logging"
+)
+
+func writePEM(t *testing.T, path, blockType string, der []byte) string {
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+	return path
+}
+
+// newClientCertificate creates a CA and a client certificate signed by it, returning the CA pool and the
+// paths of the client certificate and key.
+func newClientCertificate(t *testing.T, dir string) (*x509.CertPool, string, string) {
+	r := require.New(t)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	r.NoError(err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	r.NoError(err)
+	ca, err := x509.ParseCertificate(caDER)
+	r.NoError(err)
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	r.NoError(err)
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "gpu-metrics-exporter"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTemplate, ca, &clientKey.PublicKey, caKey)
+	r.NoError(err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(clientKey)
+	r.NoError(err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	return pool,
+		writePEM(t, filepath.Join(dir, "client.crt"), "CERTIFICATE", clientDER),
+		writePEM(t, filepath.Join(dir, "client.key"), "PRIVATE KEY", keyDER)
+}
+
+func scrape(client *http.Client, url string) exporter.ScrapeResult {
+	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
+	return exporter.NewScraper(exporter.ScraperConfig{}, client, log).Scrape(context.Background(), []exporter.Target{{URL: url}})[0]
+}
+
+func TestNewScrapeHTTPClient(t *testing.T) {
+	metricsHandler := func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(metricsString))
+	}
+
+	t.Run("verifies the server with the CA bundle and server name", func(t *testing.T) {
+		r := require.New(t)
+		srv := httptest.NewTLSServer(http.HandlerFunc(metricsHandler))
+		defer srv.Close()
+
+		caFile := writePEM(t, filepath.Join(t.TempDir(), "ca.crt"), "CERTIFICATE", srv.Certificate().Raw)
+
+		client, err := exporter.NewScrapeHTTPClient(exporter.ScrapeClientConfig{CAFile: caFile}, "test")
+		r.NoError(err)
+		r.NoError(scrape(client, srv.URL+"/metrics").Err)
+
+		// the test certificate is valid for example.com
+		client, err = exporter.NewScrapeHTTPClient(exporter.ScrapeClientConfig{CAFile: caFile, ServerName: "example.com"}, "test")
+		r.NoError(err)
+		r.NoError(scrape(client, srv.URL+"/metrics").Err)
+
+		client, err = exporter.NewScrapeHTTPClient(exporter.ScrapeClientConfig{CAFile: caFile, ServerName: "dcgm-exporter.local"}, "test")
+		r.NoError(err)
+		r.Error(scrape(client, srv.URL+"/metrics").Err)
+	})
+
+	t.Run("rejects servers signed by an unknown CA", func(t *testing.T) {
+		r := require.New(t)
+		srv := httptest.NewTLSServer(http.HandlerFunc(metricsHandler))
+		defer srv.Close()
+
+		client, err := exporter.NewScrapeHTTPClient(exporter.ScrapeClientConfig{}, "test")
+		r.NoError(err)
+		r.Error(scrape(client, srv.URL+"/metrics").Err)
+
+		client, err = exporter.NewScrapeHTTPClient(exporter.ScrapeClientConfig{InsecureSkipVerify: true}, "test")
+		r.NoError(err)
+		r.NoError(scrape(client, srv.URL+"/metrics").Err)
+	})
+
+	t.Run("authenticates with a client certificate", func(t *testing.T) {
+		r := require.New(t)
+		dir := t.TempDir()
+		clientCAs, certFile, keyFile := newClientCertificate(t, dir)
+
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(metricsHandler))
+		srv.TLS = &tls.Config{
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientCAs:  clientCAs,
+			MinVersion: tls.VersionTLS12,
+		}
+		srv.StartTLS()
+		defer srv.Close()
+
+		caFile := writePEM(t, filepath.Join(dir, "ca.crt"), "CERTIFICATE", srv.Certificate().Raw)
+
+		client, err := exporter.NewScrapeHTTPClient(exporter.ScrapeClientConfig{CAFile: caFile}, "test")
+		r.NoError(err)
+		r.Error(scrape(client, srv.URL+"/metrics").Err)
+
+		client, err = exporter.NewScrapeHTTPClient(exporter.ScrapeClientConfig{
+			CAFile:   caFile,
+			CertFile: certFile,
+			KeyFile:  keyFile,
+		}, "test")
+		r.NoError(err)
+		r.NoError(scrape(client, srv.URL+"/metrics").Err)
+	})
+
+	t.Run("sends the bearer token read from file on every request", func(t *testing.T) {
+		r := require.New(t)
+		tokens := make(chan string, 10)
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			tokens <- req.Header.Get("Authorization")
+			r.Equal("castai-gpu-metrics-exporter/test", req.Header.Get("User-Agent"))
+			metricsHandler(w, req)
+		}))
+		defer srv.Close()
+
+		dir := t.TempDir()
+		caFile := writePEM(t, filepath.Join(dir, "ca.crt"), "CERTIFICATE", srv.Certificate().Raw)
+		tokenFile := filepath.Join(dir, "token")
+		r.NoError(os.WriteFile(tokenFile, []byte("token-1\n"), 0o600))
+
+		client, err := exporter.NewScrapeHTTPClient(exporter.ScrapeClientConfig{CAFile: caFile, BearerTokenFile: tokenFile}, "test")
+		r.NoError(err)
+
+		r.NoError(scrape(client, srv.URL+"/metrics").Err)
+		r.Equal("Bearer token-1", <-tokens)
+
+		r.NoError(os.WriteFile(tokenFile, []byte("token-2\n"), 0o600))
+		r.NoError(scrape(client, srv.URL+"/metrics").Err)
+		r.Equal("Bearer token-2", <-tokens)
+	})
+
+	t.Run("sends basic auth with the password read from file", func(t *testing.T) {
+		r := require.New(t)
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			username, password, ok := req.BasicAuth()
+			if !ok || username != "scraper" || password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			metricsHandler(w, req)
+		}))
+		defer srv.Close()
+
+		dir := t.TempDir()
+		caFile := writePEM(t, filepath.Join(dir, "ca.crt"), "CERTIFICATE", srv.Certificate().Raw)
+		passwordFile := filepath.Join(dir, "password")
+		r.NoError(os.WriteFile(passwordFile, []byte("secret"), 0o600))
+
+		client, err := exporter.NewScrapeHTTPClient(exporter.ScrapeClientConfig{
+			CAFile:                caFile,
+			BasicAuthUsername:     "scraper",
+			BasicAuthPasswordFile: passwordFile,
+		}, "test")
+		r.NoError(err)
+		r.NoError(scrape(client, srv.URL+"/metrics").Err)
+
+		r.NoError(os.WriteFile(passwordFile, []byte("rotated"), 0o600))
+		r.Error(scrape(client, srv.URL+"/metrics").Err)
+	})
+
+	t.Run("rejects bearer token together with basic auth", func(t *testing.T) {
+		r := require.New(t)
+
+		_, err := exporter.NewScrapeHTTPClient(exporter.ScrapeClientConfig{
+			BearerTokenFile:       "/var/run/secrets/token",
+			BasicAuthUsername:     "scraper",
+			BasicAuthPasswordFile: "/var/run/secrets/password",
+		}, "test")
+		r.Error(err)
+	})
+
+	t.Run("scrapes over a unix socket", func(t *testing.T) {
+		r := require.New(t)
+
+		// socket paths are limited to ~100 characters, t.TempDir is too long on some systems
+		dir, err := os.MkdirTemp("", "dcgm")
+		r.NoError(err)
+		defer os.RemoveAll(dir)
+		// longer than a host name label and with colons in its path
+		r.NoError(os.Mkdir(filepath.Join(dir, "dcgm:exporter"), 0o700))
+		socket := filepath.Join(dir, "dcgm:exporter", "nvidia-dcgm-exporter-metrics.sock")
+
+		listener, err := net.Listen("unix", socket)
+		r.NoError(err)
+		paths := make(chan string, 10)
+		srv := &httptest.Server{
+			Listener: listener,
+			Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				paths <- req.URL.Path
+				metricsHandler(w, req)
+			})},
+		}
+		srv.Start()
+		defer srv.Close()
+
+		// sockets aren't dialed through the proxy
+		t.Setenv("HTTP_PROXY", "http://127.0.0.1:1")
+		client, err := exporter.NewScrapeHTTPClient(exporter.ScrapeClientConfig{}, "test")
+		r.NoError(err)
+
+		result := scrape(client, exporter.UnixSocketURL(socket, "/metrics"))
+		r.NoError(result.Err)
+		r.NotEmpty(result.Families)
+		r.Equal("/metrics", <-paths)
+
+		r.Error(scrape(client, exporter.UnixSocketURL(filepath.Join(dir, "missing.sock"), "/metrics")).Err)
+	})
+}
@@ -0,0 +1,477 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/castai/gpu-metrics-exporter/internal/workload"
+	"github.com/castai/gpu-metrics-exporter/pb"
+)
+
+const (
+	// MetricIdleSeconds is how long all GPUs of a pod have been idle without interruption, 0 while it uses them.
+	MetricIdleSeconds = MetricName("gpu_idle_seconds")
+	// MetricWorkloadIdleSeconds is how long all GPUs of all pods of a workload have been idle without interruption.
+	MetricWorkloadIdleSeconds = MetricName("gpu_workload_idle_seconds")
+
+	// IdleSinceAnnotation and IdleDurationAnnotation are set on workloads which have been idle for MinDuration.
+	IdleSinceAnnotation    = "gpu-metrics-exporter.cast.ai/idle-since"
+	IdleDurationAnnotation = "gpu-metrics-exporter.cast.ai/idle-duration"
+
+	workloadKindLabel = "workload_kind"
+	workloadNameLabel = "workload_name"
+)
+
+type IdleConfig struct {
+	// A GPU is idle while its utilization, in percent, is at most MaxUtilization and its SM activity, a ratio, is
+	// at most MaxSMActive.
+	MaxUtilization float64
+	MaxSMActive    float64
+	// MinDuration is how long a pod, or workload, has to be idle before it's reported and annotated.
+	MinDuration time.Duration
+	// AnnotateInterval is how often the idle duration annotation of a workload is refreshed.
+	AnnotateInterval time.Duration
+}
+
+// IdlePod is a pod whose GPUs have all been idle for at least MinDuration.
+type IdlePod struct {
+	Namespace    string    `json:"namespace"`
+	Pod          string    `json:"pod"`
+	WorkloadKind string    `json:"workload_kind,omitempty"`
+	WorkloadName string    `json:"workload_name,omitempty"`
+	Nodes        []string  `json:"nodes"`
+	GPUs         []string  `json:"gpus"`
+	IdleSince    time.Time `json:"idle_since"`
+	IdleSeconds  float64   `json:"idle_seconds"`
+}
+
+// IdleWorkload is a workload whose pods have all been idle for at least MinDuration.
+type IdleWorkload struct {
+	Namespace   string    `json:"namespace"`
+	Kind        string    `json:"kind"`
+	Name        string    `json:"name"`
+	Pods        []string  `json:"pods"`
+	IdleSince   time.Time `json:"idle_since"`
+	IdleSeconds float64   `json:"idle_seconds"`
+}
+
+// IdleReport lists the pods and workloads holding idle GPUs, ordered by how long they have been idle.
+type IdleReport struct {
+	GeneratedAt time.Time      `json:"generated_at"`
+	MinDuration string         `json:"min_duration"`
+	Pods        []IdlePod      `json:"pods"`
+	Workloads   []IdleWorkload `json:"workloads"`
+}
+
+type idlePodKey struct {
+	namespace string
+	pod       string
+}
+
+type idlePod struct {
+	workload workload.Workload
+	nodes    []string
+	gpus     []string
+	// idleSince is zero while the pod uses its GPUs
+	idleSince time.Time
+	seenAt    time.Time
+	// current tells whether the pod was part of the last update
+	current bool
+}
+
+type idleWorkload struct {
+	workload  workload.Workload
+	pods      []string
+	idleSince time.Time
+	seenAt    time.Time
+}
+
+// IdleDetector follows how long the GPUs allocated to every pod, and workload, have been idle. A pod is idle while
+// all of its GPUs are, and a workload while all of its pods are. It's updated by the exporter and read by the
+// /api/v1/idle endpoint.
+type IdleDetector struct {
+	cfg IdleConfig
+
+	mu        sync.Mutex
+	pods      map[idlePodKey]*idlePod
+	workloads map[workload.Workload]*idleWorkload
+	// annotated holds when the annotations of a workload were last set
+	annotated map[workload.Workload]time.Time
+}
+
+func NewIdleDetector(cfg IdleConfig) *IdleDetector {
+	return &IdleDetector{
+		cfg:       cfg,
+		pods:      make(map[idlePodKey]*idlePod),
+		workloads: make(map[workload.Workload]*idleWorkload),
+		annotated: make(map[workload.Workload]time.Time),
+	}
+}
+
+// update follows the pods of the rows and returns their gpu_idle_seconds, and gpu_workload_idle_seconds, metrics.
+func (d *IdleDetector) update(rows []GPUMetric) []*pb.Metric {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	type podRows struct {
+		workload workload.Workload
+		nodes    map[string]struct{}
+		gpus     map[string]struct{}
+		idle     bool
+		at       time.Time
+	}
+	current := make(map[idlePodKey]*podRows)
+	var latest time.Time
+	for i := range rows {
+		m := &rows[i]
+		if m.Pod == "" {
+			continue
+		}
+		key := idlePodKey{namespace: m.Namespace, pod: m.Pod}
+		p, found := current[key]
+		if !found {
+			p = &podRows{
+				workload: workload.Workload{Namespace: m.Namespace, Kind: m.WorkloadKind, Name: m.WorkloadName},
+				nodes:    make(map[string]struct{}),
+				gpus:     make(map[string]struct{}),
+				idle:     true,
+			}
+			current[key] = p
+		}
+		p.nodes[m.NodeName] = struct{}{}
+		p.gpus[m.DeviceUUID] = struct{}{}
+		p.idle = p.idle && d.idle(m)
+		if m.Timestamp.After(p.at) {
+			p.at = m.Timestamp
+		}
+		if m.Timestamp.After(latest) {
+			latest = m.Timestamp
+		}
+	}
+
+	for _, pod := range d.pods {
+		pod.current = false
+	}
+	for key, p := range current {
+		pod, found := d.pods[key]
+		if !found {
+			pod = &idlePod{}
+			d.pods[key] = pod
+		}
+		pod.workload = p.workload
+		pod.nodes = sortedKeys(p.nodes)
+		pod.gpus = sortedKeys(p.gpus)
+		pod.seenAt = p.at
+		pod.current = true
+		switch {
+		case !p.idle:
+			pod.idleSince = time.Time{}
+		case pod.idleSince.IsZero():
+			pod.idleSince = p.at
+		}
+	}
+
+	// workloads are idle since the last of their pods became idle
+	workloads := make(map[workload.Workload]*idleWorkload)
+	for key := range current {
+		pod := d.pods[key]
+		if pod.workload.Name == "" {
+			continue
+		}
+		w, found := workloads[pod.workload]
+		if !found {
+			w = &idleWorkload{workload: pod.workload, idleSince: pod.idleSince}
+			workloads[pod.workload] = w
+		}
+		w.pods = append(w.pods, key.pod)
+		if pod.seenAt.After(w.seenAt) {
+			w.seenAt = pod.seenAt
+		}
+		if pod.idleSince.IsZero() || w.idleSince.IsZero() {
+			w.idleSince = time.Time{}
+		} else if pod.idleSince.After(w.idleSince) {
+			w.idleSince = pod.idleSince
+		}
+	}
+	for _, w := range workloads {
+		sort.Strings(w.pods)
+	}
+	d.workloads = workloads
+
+	for key, pod := range d.pods {
+		if latest.Sub(pod.seenAt) > seriesRetention {
+			delete(d.pods, key)
+		}
+	}
+
+	return d.metrics()
+}
+
+// forget drops the pods of the node, e.g. when another replica took over the node.
+func (d *IdleDetector) forget(node string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key, pod := range d.pods {
+		for _, n := range pod.nodes {
+			if n == node {
+				delete(d.pods, key)
+				break
+			}
+		}
+	}
+}
+
+// Report returns the pods and workloads which have been idle for at least MinDuration.
+func (d *IdleDetector) Report() IdleReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	report := IdleReport{
+		GeneratedAt: time.Now().UTC(),
+		MinDuration: d.cfg.MinDuration.String(),
+		Pods:        []IdlePod{},
+		Workloads:   []IdleWorkload{},
+	}
+	for key, pod := range d.pods {
+		seconds := pod.idleSeconds()
+		if !pod.current || pod.idleSince.IsZero() || seconds < d.cfg.MinDuration.Seconds() {
+			continue
+		}
+		report.Pods = append(report.Pods, IdlePod{
+			Namespace:    key.namespace,
+			Pod:          key.pod,
+			WorkloadKind: pod.workload.Kind,
+			WorkloadName: pod.workload.Name,
+			Nodes:        pod.nodes,
+			GPUs:         pod.gpus,
+			IdleSince:    pod.idleSince,
+			IdleSeconds:  seconds,
+		})
+	}
+	for _, w := range d.idleWorkloads() {
+		report.Workloads = append(report.Workloads, IdleWorkload{
+			Namespace:   w.workload.Namespace,
+			Kind:        w.workload.Kind,
+			Name:        w.workload.Name,
+			Pods:        w.pods,
+			IdleSince:   w.idleSince,
+			IdleSeconds: w.idleSeconds(),
+		})
+	}
+
+	sort.Slice(report.Pods, func(a, b int) bool {
+		if report.Pods[a].IdleSeconds != report.Pods[b].IdleSeconds {
+			return report.Pods[a].IdleSeconds > report.Pods[b].IdleSeconds
+		}
+		if report.Pods[a].Namespace != report.Pods[b].Namespace {
+			return report.Pods[a].Namespace < report.Pods[b].Namespace
+		}
+		return report.Pods[a].Pod < report.Pods[b].Pod
+	})
+	sort.Slice(report.Workloads, func(a, b int) bool {
+		if report.Workloads[a].IdleSeconds != report.Workloads[b].IdleSeconds {
+			return report.Workloads[a].IdleSeconds > report.Workloads[b].IdleSeconds
+		}
+		return workloadLess(
+			workload.Workload{Namespace: report.Workloads[a].Namespace, Kind: report.Workloads[a].Kind, Name: report.Workloads[a].Name},
+			workload.Workload{Namespace: report.Workloads[b].Namespace, Kind: report.Workloads[b].Kind, Name: report.Workloads[b].Name},
+		)
+	})
+	return report
+}
+
+// annotate sets the idle annotations of the workloads which have been idle for MinDuration, refreshing them every
+// AnnotateInterval, and removes them from the workloads which are no longer idle. The annotator is called without
+// holding the lock, so that updates and reports don't wait for the API server.
+func (d *IdleDetector) annotate(ctx context.Context, annotator workload.Annotator) []error {
+	type annotation struct {
+		workload    workload.Workload
+		annotations map[string]*string
+		seenAt      time.Time
+	}
+
+	d.mu.Lock()
+	var set []annotation
+	var remove []workload.Workload
+	idle := make(map[workload.Workload]struct{})
+	for _, w := range d.idleWorkloads() {
+		idle[w.workload] = struct{}{}
+		if last, found := d.annotated[w.workload]; found && w.seenAt.Sub(last) < d.cfg.AnnotateInterval {
+			continue
+		}
+		since := w.idleSince.UTC().Format(time.RFC3339)
+		duration := (time.Duration(w.idleSeconds()) * time.Second).Round(time.Minute).String()
+		set = append(set, annotation{
+			workload: w.workload,
+			annotations: map[string]*string{
+				IdleSinceAnnotation:    &since,
+				IdleDurationAnnotation: &duration,
+			},
+			seenAt: w.seenAt,
+		})
+	}
+	for w := range d.annotated {
+		if _, found := idle[w]; !found {
+			remove = append(remove, w)
+		}
+	}
+	d.mu.Unlock()
+
+	var errs []error
+	annotated := make(map[workload.Workload]time.Time, len(set))
+	for _, a := range set {
+		// only successfully annotated workloads are recorded, so that failures are retried at the next refresh
+		if err := annotator.Annotate(ctx, a.workload, a.annotations); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		annotated[a.workload] = a.seenAt
+	}
+
+	var removed []workload.Workload
+	for _, w := range remove {
+		// workloads are only forgotten once their annotations are removed, or they can't have any, so that
+		// failures are retried and e.g. jobs without pods left don't keep them
+		err := annotator.Annotate(ctx, w, map[string]*string{
+			IdleSinceAnnotation:    nil,
+			IdleDurationAnnotation: nil,
+		})
+		if err != nil && !apierrors.IsNotFound(err) && !errors.Is(err, workload.ErrUnsupportedKind) {
+			errs = append(errs, err)
+			continue
+		}
+		removed = append(removed, w)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for w, seenAt := range annotated {
+		d.annotated[w] = seenAt
+	}
+	for _, w := range removed {
+		delete(d.annotated, w)
+	}
+	return errs
+}
+
+// idle tells whether the reported utilization of the GPU is below the thresholds, GPUs which reported neither
+// aren't known to be idle.
+func (d *IdleDetector) idle(m *GPUMetric) bool {
+	utilization, hasUtilization := valueOf(m.GPUUtilization)
+	smActive, hasSMActive := valueOf(m.SMActive)
+	return (hasUtilization || hasSMActive) &&
+		(!hasUtilization || utilization <= d.cfg.MaxUtilization) &&
+		(!hasSMActive || smActive <= d.cfg.MaxSMActive)
+}
+
+func (d *IdleDetector) idleWorkloads() []*idleWorkload {
+	var idle []*idleWorkload
+	for _, w := range d.workloads {
+		if !w.idleSince.IsZero() && w.idleSeconds() >= d.cfg.MinDuration.Seconds() {
+			idle = append(idle, w)
+		}
+	}
+	sort.Slice(idle, func(a, b int) bool { return workloadLess(idle[a].workload, idle[b].workload) })
+	return idle
+}
+
+func (d *IdleDetector) metrics() []*pb.Metric {
+	keys := make([]idlePodKey, 0, len(d.pods))
+	for key, pod := range d.pods {
+		if pod.current {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		if keys[a].namespace != keys[b].namespace {
+			return keys[a].namespace < keys[b].namespace
+		}
+		return keys[a].pod < keys[b].pod
+	})
+
+	podIdle := &pb.Metric{Name: MetricIdleSeconds}
+	for _, key := range keys {
+		pod := d.pods[key]
+		labels := []*pb.Metric_Label{
+			{Name: namespaceLabel, Value: key.namespace},
+			{Name: podLabel, Value: key.pod},
+		}
+		if len(pod.nodes) > 0 {
+			labels = append(labels, &pb.Metric_Label{Name: nodeNameLabel, Value: pod.nodes[0]})
+		}
+		podIdle.Measurements = append(podIdle.Measurements, &pb.Metric_Measurement{
+			Value:  pod.idleSeconds(),
+			Labels: append(labels, workloadLabels(pod.workload)...),
+		})
+	}
+	metrics := []*pb.Metric{podIdle}
+
+	workloads := make([]*idleWorkload, 0, len(d.workloads))
+	for _, w := range d.workloads {
+		workloads = append(workloads, w)
+	}
+	sort.Slice(workloads, func(a, b int) bool { return workloadLess(workloads[a].workload, workloads[b].workload) })
+	workloadIdle := &pb.Metric{Name: MetricWorkloadIdleSeconds}
+	for _, w := range workloads {
+		workloadIdle.Measurements = append(workloadIdle.Measurements, &pb.Metric_Measurement{
+			Value:  w.idleSeconds(),
+			Labels: append([]*pb.Metric_Label{{Name: namespaceLabel, Value: w.workload.Namespace}}, workloadLabels(w.workload)...),
+		})
+	}
+	if len(workloadIdle.Measurements) > 0 {
+		metrics = append(metrics, workloadIdle)
+	}
+	return metrics
+}
+
+func workloadLabels(w workload.Workload) []*pb.Metric_Label {
+	if w.Name == "" {
+		return nil
+	}
+	return []*pb.Metric_Label{
+		{Name: workloadKindLabel, Value: w.Kind},
+		{Name: workloadNameLabel, Value: w.Name},
+	}
+}
+
+func (p *idlePod) idleSeconds() float64 {
+	if p.idleSince.IsZero() {
+		return 0
+	}
+	return p.seenAt.Sub(p.idleSince).Seconds()
+}
+
+func (w *idleWorkload) idleSeconds() float64 {
+	if w.idleSince.IsZero() {
+		return 0
+	}
+	return w.seenAt.Sub(w.idleSince).Seconds()
+}
+
+func workloadLess(a, b workload.Workload) bool {
+	if a.Namespace != b.Namespace {
+		return a.Namespace < b.Namespace
+	}
+	if a.Kind != b.Kind {
+		return a.Kind < b.Kind
+	}
+	return a.Name < b.Name
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,276 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/castai/gpu-metrics-exporter/internal/workload"
+	workload_mock "github.com/castai/gpu-metrics-exporter/mock/workload"
+)
+
+type idleStep struct {
+	at time.Duration
+	// utilization of the GPUs of the pods, keyed by pod, nil when the GPU reported no utilization
+	utilization map[string]*float64
+	// seconds are keyed by pod, and kind/name of workloads.
+	seconds map[string]float64
+}
+
+func TestIdleDetector_Update(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	percent := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		name  string
+		steps []idleStep
+	}{
+		{
+			name: "pods are idle while all of their GPUs are and workloads while all of their pods are",
+			steps: []idleStep{
+				{
+					utilization: map[string]*float64{"trainer-0": percent(0), "trainer-1": percent(80)},
+					seconds:     map[string]float64{"trainer-0": 0, "trainer-1": 0, "Job/training": 0},
+				},
+				{
+					at:          10 * time.Minute,
+					utilization: map[string]*float64{"trainer-0": percent(0), "trainer-1": percent(0)},
+					seconds:     map[string]float64{"trainer-0": 600, "trainer-1": 0, "Job/training": 0},
+				},
+				// the workload is idle since trainer-1 became idle
+				{
+					at:          40 * time.Minute,
+					utilization: map[string]*float64{"trainer-0": percent(1), "trainer-1": percent(0)},
+					seconds:     map[string]float64{"trainer-0": 2400, "trainer-1": 1800, "Job/training": 1800},
+				},
+				{
+					at:          41 * time.Minute,
+					utilization: map[string]*float64{"trainer-0": percent(50), "trainer-1": percent(0)},
+					seconds:     map[string]float64{"trainer-0": 0, "trainer-1": 1860, "Job/training": 0},
+				},
+			},
+		},
+		{
+			name: "GPUs without utilization aren't known to be idle",
+			steps: []idleStep{
+				{
+					utilization: map[string]*float64{"trainer-0": nil},
+					seconds:     map[string]float64{"trainer-0": 0, "Job/training": 0},
+				},
+				{
+					at:          10 * time.Minute,
+					utilization: map[string]*float64{"trainer-0": nil},
+					seconds:     map[string]float64{"trainer-0": 0, "Job/training": 0},
+				},
+			},
+		},
+		{
+			name: "only reports the pods of the rows",
+			steps: []idleStep{
+				{
+					utilization: map[string]*float64{"trainer-0": percent(0), "trainer-1": percent(0)},
+					seconds:     map[string]float64{"trainer-0": 0, "trainer-1": 0, "Job/training": 0},
+				},
+				{
+					at:          10 * time.Minute,
+					utilization: map[string]*float64{"trainer-0": percent(0)},
+					seconds:     map[string]float64{"trainer-0": 600, "Job/training": 600},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := require.New(t)
+			d := NewIdleDetector(IdleConfig{MaxUtilization: 1, MaxSMActive: 0.01, MinDuration: 30 * time.Minute})
+
+			for i, step := range tt.steps {
+				rows := []GPUMetric{
+					// GPUs which aren't allocated aren't followed
+					{NodeName: "node-a", DeviceUUID: "GPU-0", GPUUtilization: percent(0), Timestamp: start.Add(step.at)},
+				}
+				for pod, utilization := range step.utilization {
+					rows = append(rows, GPUMetric{
+						NodeName:       "node-a",
+						DeviceUUID:     "GPU-" + pod,
+						Namespace:      "ml",
+						Pod:            pod,
+						WorkloadKind:   workload.KindJob,
+						WorkloadName:   "training",
+						GPUUtilization: utilization,
+						Timestamp:      start.Add(step.at),
+					})
+				}
+
+				seconds := make(map[string]float64)
+				for _, metric := range d.update(rows) {
+					for _, m := range metric.Measurements {
+						switch metric.Name {
+						case MetricIdleSeconds:
+							seconds[labelValue(m.Labels, podLabel)] = m.Value
+						case MetricWorkloadIdleSeconds:
+							seconds[labelValue(m.Labels, workloadKindLabel)+"/"+labelValue(m.Labels, workloadNameLabel)] = m.Value
+						}
+					}
+				}
+				r.Equal(step.seconds, seconds, "step %d", i)
+			}
+		})
+	}
+}
+
+func TestIdleDetector_Report(t *testing.T) {
+	r := require.New(t)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	idle := 0.0
+
+	d := NewIdleDetector(IdleConfig{MaxUtilization: 1, MinDuration: 30 * time.Minute})
+	for _, at := range []time.Time{start, start.Add(40 * time.Minute)} {
+		d.update([]GPUMetric{
+			{NodeName: "node-a", DeviceUUID: "GPU-1", Namespace: "ml", Pod: "trainer-0", WorkloadKind: workload.KindJob, WorkloadName: "training", GPUUtilization: &idle, Timestamp: at},
+			{NodeName: "node-a", DeviceUUID: "GPU-2", Namespace: "ml", Pod: "trainer-0", WorkloadKind: workload.KindJob, WorkloadName: "training", GPUUtilization: &idle, Timestamp: at},
+		})
+	}
+
+	report := d.Report()
+	r.Equal("30m0s", report.MinDuration)
+	r.Equal([]IdlePod{{
+		Namespace:    "ml",
+		Pod:          "trainer-0",
+		WorkloadKind: workload.KindJob,
+		WorkloadName: "training",
+		Nodes:        []string{"node-a"},
+		GPUs:         []string{"GPU-1", "GPU-2"},
+		IdleSince:    start,
+		IdleSeconds:  2400,
+	}}, report.Pods)
+	r.Equal([]IdleWorkload{{
+		Namespace:   "ml",
+		Kind:        workload.KindJob,
+		Name:        "training",
+		Pods:        []string{"trainer-0"},
+		IdleSince:   start,
+		IdleSeconds: 2400,
+	}}, report.Workloads)
+}
+
+func TestIdleDetector_Annotate(t *testing.T) {
+	r := require.New(t)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	training := workload.Workload{Namespace: "ml", Kind: workload.KindJob, Name: "training"}
+	row := func(at time.Duration, utilization float64) []GPUMetric {
+		return []GPUMetric{{
+			NodeName: "node-a", DeviceUUID: "GPU-1", Namespace: "ml", Pod: "trainer-0",
+			WorkloadKind: training.Kind, WorkloadName: training.Name, GPUUtilization: &utilization, Timestamp: start.Add(at),
+		}}
+	}
+	annotation := func(v string) *string { return &v }
+
+	d := NewIdleDetector(IdleConfig{MaxUtilization: 1, MinDuration: 30 * time.Minute, AnnotateInterval: 5 * time.Minute})
+	annotator := workload_mock.NewMockAnnotator(t)
+
+	// workloads which haven't been idle for MinDuration aren't annotated
+	d.update(row(0, 0))
+	r.Empty(d.annotate(context.Background(), annotator))
+
+	annotator.EXPECT().Annotate(mock.Anything, training, map[string]*string{
+		IdleSinceAnnotation:    annotation("2024-05-01T12:00:00Z"),
+		IdleDurationAnnotation: annotation("30m0s"),
+	}).Return(nil).Once()
+	d.update(row(30*time.Minute, 0))
+	r.Empty(d.annotate(context.Background(), annotator))
+
+	// the annotations are refreshed every AnnotateInterval
+	d.update(row(34*time.Minute, 0))
+	r.Empty(d.annotate(context.Background(), annotator))
+	annotator.EXPECT().Annotate(mock.Anything, training, map[string]*string{
+		IdleSinceAnnotation:    annotation("2024-05-01T12:00:00Z"),
+		IdleDurationAnnotation: annotation("35m0s"),
+	}).Return(nil).Once()
+	d.update(row(35*time.Minute, 0))
+	r.Empty(d.annotate(context.Background(), annotator))
+
+	annotator.EXPECT().Annotate(mock.Anything, training, map[string]*string{
+		IdleSinceAnnotation:    nil,
+		IdleDurationAnnotation: nil,
+	}).Return(nil).Once()
+	d.update(row(36*time.Minute, 50))
+	r.Empty(d.annotate(context.Background(), annotator))
+	r.Empty(d.annotated)
+}
+
+func TestIdleDetector_AnnotateRemoval(t *testing.T) {
+	removal := map[string]*string{IdleSinceAnnotation: nil, IdleDurationAnnotation: nil}
+	jobs := schema.GroupResource{Group: "batch", Resource: "jobs"}
+
+	tests := []struct {
+		name      string
+		err       error
+		forgotten bool
+	}{
+		{name: "removed", forgotten: true},
+		{name: "workload is gone", err: fmt.Errorf("annotating: %w", apierrors.NewNotFound(jobs, "training")), forgotten: true},
+		{name: "kind can't be annotated", err: fmt.Errorf("can't annotate: %w", workload.ErrUnsupportedKind), forgotten: true},
+		{name: "removal failed", err: errors.New("connection refused")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := require.New(t)
+			training := workload.Workload{Namespace: "ml", Kind: workload.KindJob, Name: "training"}
+
+			// the workload has no pods left, so it's no longer followed
+			d := NewIdleDetector(IdleConfig{MinDuration: time.Minute, AnnotateInterval: time.Minute})
+			d.annotated[training] = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+			annotator := workload_mock.NewMockAnnotator(t)
+			annotator.EXPECT().Annotate(mock.Anything, training, removal).Return(tt.err).Once()
+
+			errs := d.annotate(context.Background(), annotator)
+			_, annotated := d.annotated[training]
+			r.Equal(!tt.forgotten, annotated)
+			if tt.forgotten {
+				r.Empty(errs)
+			} else {
+				r.Len(errs, 1)
+			}
+		})
+	}
+}
+
+func TestIdleDetector_AnnotateFailure(t *testing.T) {
+	r := require.New(t)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	training := workload.Workload{Namespace: "ml", Kind: workload.KindJob, Name: "training"}
+	utilization := 0.0
+	row := func(at time.Duration) []GPUMetric {
+		return []GPUMetric{{
+			NodeName: "node-a", DeviceUUID: "GPU-1", Namespace: "ml", Pod: "trainer-0",
+			WorkloadKind: training.Kind, WorkloadName: training.Name, GPUUtilization: &utilization, Timestamp: start.Add(at),
+		}}
+	}
+
+	d := NewIdleDetector(IdleConfig{MaxUtilization: 1, MinDuration: 30 * time.Minute, AnnotateInterval: 5 * time.Minute})
+	annotator := workload_mock.NewMockAnnotator(t)
+
+	// reports don't wait for the annotations to be written
+	annotator.EXPECT().Annotate(mock.Anything, training, mock.Anything).
+		Run(func(context.Context, workload.Workload, map[string]*string) { d.Report() }).
+		Return(errors.New("connection refused")).Once()
+	d.update(row(0))
+	d.update(row(30 * time.Minute))
+	r.Len(d.annotate(context.Background(), annotator), 1)
+	r.Empty(d.annotated)
+
+	// failures are retried at the next refresh instead of after AnnotateInterval
+	annotator.EXPECT().Annotate(mock.Anything, training, mock.Anything).Return(nil).Once()
+	d.update(row(31 * time.Minute))
+	r.Empty(d.annotate(context.Background(), annotator))
+	r.Equal(start.Add(31*time.Minute), d.annotated[training])
+}
@@ -0,0 +1,152 @@
+package exporter
+
+import (
+	"math"
+	"regexp"
+	"sort"
+
+	client_model "github.com/prometheus/client_model/go"
+
+	"github.com/castai/gpu-metrics-exporter/pb"
+)
+
+// InvalidValuePolicy is what happens with values which aren't measurements: NaN, infinite values and the blank
+// sentinels DCGM reports for fields it has no value for.
+type InvalidValuePolicy string
+
+const (
+	// InvalidValuePolicyDrop leaves invalid values out, their series aren't exported and the fields of the GPU
+	// metric rows are null.
+	InvalidValuePolicyDrop = InvalidValuePolicy("drop")
+	// InvalidValuePolicyZero replaces invalid values with 0.
+	InvalidValuePolicyZero = InvalidValuePolicy("zero")
+)
+
+// MetricInvalidValues counts the invalid values of a scrape per node, metric and reason.
+const MetricInvalidValues = MetricName("gpu_invalid_values")
+
+const (
+	invalidMetricLabel = "metric"
+	invalidReasonLabel = "reason"
+
+	invalidReasonNaN   = "nan"
+	invalidReasonInf   = "inf"
+	invalidReasonBlank = "blank"
+)
+
+// Blank sentinels of DCGM, see DCGM_INT32_BLANK, DCGM_INT64_BLANK and DCGM_FP64_BLANK in dcgm_structs.h. Each is
+// followed by the sentinels of fields which weren't found, aren't supported or aren't permitted.
+const (
+	dcgmInt32Blank = float64(0x7ffffff0)
+	dcgmInt64Blank = float64(0x7ffffffffffffff0)
+	dcgmFP64Blank  = 140737488355328.0
+	// dcgmBlankRange is the number of sentinels following each blank value.
+	dcgmBlankRange = 15
+)
+
+// invalidReason returns why a value isn't a measurement, or an empty string for valid values. Blank sentinels are
+// matched exactly, so only values of 64-bit fields which equal a 32-bit sentinel are mistaken for one.
+func invalidReason(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return invalidReasonNaN
+	case math.IsInf(v, 0):
+		return invalidReasonInf
+	case v >= dcgmInt32Blank && v <= dcgmInt32Blank+dcgmBlankRange,
+		v >= dcgmFP64Blank && v <= dcgmFP64Blank+dcgmBlankRange,
+		// float64 can't tell the 64-bit sentinels apart, they all round to 2^63
+		v >= dcgmInt64Blank:
+		return invalidReasonBlank
+	}
+	return ""
+}
+
+type invalidValueKey struct {
+	node   string
+	metric MetricName
+	reason string
+}
+
+// sanitizeResults drops or zeroes the invalid values of the enabled and extra counters, gauges and untyped metrics
+// according to the policy and returns how many there were, nil when all values are valid.
+func sanitizeResults(results []ScrapeResult, policy InvalidValuePolicy, extraMetrics *regexp.Regexp) *pb.Metric {
+	counts := make(map[invalidValueKey]int)
+	for _, result := range results {
+		for name, family := range result.Families {
+			if !metricEnabled(name, extraMetrics) {
+				continue
+			}
+			kept := family.Metric[:0]
+			for _, m := range family.Metric {
+				value, ok := scalarValue(family.GetType(), m)
+				reason := ""
+				if ok {
+					reason = invalidReason(value)
+				}
+				if reason == "" {
+					kept = append(kept, m)
+					continue
+				}
+
+				node := result.Target.NodeName
+				if node == "" {
+					node = getLabelValue(m.Label, nodeNameLabel)
+				}
+				counts[invalidValueKey{node: node, metric: name, reason: reason}]++
+				if policy == InvalidValuePolicyZero {
+					setScalarValue(family.GetType(), m, 0)
+					kept = append(kept, m)
+				}
+			}
+			if len(kept) == 0 {
+				delete(result.Families, name)
+				continue
+			}
+			family.Metric = kept
+		}
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+
+	keys := make([]invalidValueKey, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].node != keys[j].node {
+			return keys[i].node < keys[j].node
+		}
+		if keys[i].metric != keys[j].metric {
+			return keys[i].metric < keys[j].metric
+		}
+		return keys[i].reason < keys[j].reason
+	})
+
+	metric := &pb.Metric{Name: MetricInvalidValues}
+	for _, key := range keys {
+		labels := []*pb.Metric_Label{
+			{Name: invalidMetricLabel, Value: key.metric},
+			{Name: invalidReasonLabel, Value: key.reason},
+		}
+		if key.node != "" {
+			labels = append(labels, &pb.Metric_Label{Name: nodeNameLabel, Value: key.node})
+		}
+		metric.Measurements = append(metric.Measurements, &pb.Metric_Measurement{
+			Value:  float64(counts[key]),
+			Labels: labels,
+		})
+	}
+	return metric
+}
+
+func setScalarValue(t client_model.MetricType, m *client_model.Metric, value float64) {
+	switch t {
+	case client_model.MetricType_COUNTER:
+		m.Counter.Value = &value
+	case client_model.MetricType_GAUGE:
+		m.Gauge.Value = &value
+	case client_model.MetricType_UNTYPED:
+		m.Untyped.Value = &value
+	}
+}
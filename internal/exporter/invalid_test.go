@@ -0,0 +1,136 @@
+package exporter
+
+import (
+	"math"
+	"regexp"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitizeResults(t *testing.T) {
+	gpu := func(uuid string, value float64) *dto.Metric {
+		name, v := gpuUUIDLabel, uuid
+		return &dto.Metric{Label: []*dto.LabelPair{{Name: &name, Value: &v}}, Gauge: &dto.Gauge{Value: &value}}
+	}
+	results := func(node string) []ScrapeResult {
+		return []ScrapeResult{{
+			Target: Target{NodeName: node},
+			Families: MetricFamilyMap{
+				MetricStreamingMultiProcessorActive: {
+					Type:   dto.MetricType_GAUGE.Enum(),
+					Metric: []*dto.Metric{gpu("GPU-1", 0.5), gpu("GPU-2", math.NaN())},
+				},
+				MetricPowerUsage: {
+					Type: dto.MetricType_GAUGE.Enum(),
+					// DCGM_FP64_BLANK and DCGM_INT32_NOT_SUPPORTED
+					Metric: []*dto.Metric{gpu("GPU-1", 140737488355328), gpu("GPU-2", 2147483634)},
+				},
+				MetricGPUTemperature: {
+					Type:   dto.MetricType_GAUGE.Enum(),
+					Metric: []*dto.Metric{gpu("GPU-1", 60), gpu("GPU-2", math.Inf(1))},
+				},
+				"vllm:num_requests_running": {
+					Type:   dto.MetricType_GAUGE.Enum(),
+					Metric: []*dto.Metric{gpu("GPU-1", math.NaN())},
+				},
+			},
+		}}
+	}
+	invalid := map[string]float64{
+		MetricStreamingMultiProcessorActive + "/nan": 1,
+		MetricPowerUsage + "/blank":                  2,
+		MetricGPUTemperature + "/inf":                1,
+	}
+
+	tests := []struct {
+		name         string
+		policy       InvalidValuePolicy
+		extraMetrics *regexp.Regexp
+		// values are keyed by metric/uuid
+		values  map[string]float64
+		invalid map[string]float64
+	}{
+		{
+			name:   "drops invalid values",
+			policy: InvalidValuePolicyDrop,
+			values: map[string]float64{
+				MetricStreamingMultiProcessorActive + "/GPU-1": 0.5,
+				MetricGPUTemperature + "/GPU-1":                60,
+				"vllm:num_requests_running/GPU-1":              math.NaN(),
+			},
+			invalid: invalid,
+		},
+		{
+			name:   "replaces invalid values with zero",
+			policy: InvalidValuePolicyZero,
+			values: map[string]float64{
+				MetricStreamingMultiProcessorActive + "/GPU-1": 0.5,
+				MetricStreamingMultiProcessorActive + "/GPU-2": 0,
+				MetricPowerUsage + "/GPU-1":                    0,
+				MetricPowerUsage + "/GPU-2":                    0,
+				MetricGPUTemperature + "/GPU-1":                60,
+				MetricGPUTemperature + "/GPU-2":                0,
+				"vllm:num_requests_running/GPU-1":              math.NaN(),
+			},
+			invalid: invalid,
+		},
+		{
+			name:         "sanitizes extra metrics",
+			policy:       InvalidValuePolicyDrop,
+			extraMetrics: regexp.MustCompile("^(?:vllm:.*)$"),
+			values: map[string]float64{
+				MetricStreamingMultiProcessorActive + "/GPU-1": 0.5,
+				MetricGPUTemperature + "/GPU-1":                60,
+			},
+			invalid: map[string]float64{
+				MetricStreamingMultiProcessorActive + "/nan": 1,
+				MetricPowerUsage + "/blank":                  2,
+				MetricGPUTemperature + "/inf":                1,
+				"vllm:num_requests_running/nan":              1,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := require.New(t)
+			scraped := results("node-a")
+
+			metric := sanitizeResults(scraped, tt.policy, tt.extraMetrics)
+			r.NotNil(metric)
+			r.Equal(MetricInvalidValues, metric.Name)
+			got := make(map[string]float64)
+			for _, m := range metric.Measurements {
+				r.Equal("node-a", labelValue(m.Labels, nodeNameLabel))
+				got[labelValue(m.Labels, invalidMetricLabel)+"/"+labelValue(m.Labels, invalidReasonLabel)] = m.Value
+			}
+			r.Equal(tt.invalid, got)
+
+			values := make(map[string]float64)
+			for name, family := range scraped[0].Families {
+				for _, m := range family.Metric {
+					values[name+"/"+m.Label[0].GetValue()] = m.Gauge.GetValue()
+				}
+			}
+			r.Len(values, len(tt.values))
+			for key, want := range tt.values {
+				r.Contains(values, key)
+				if math.IsNaN(want) {
+					r.True(math.IsNaN(values[key]), key)
+				} else {
+					r.Equal(want, values[key], key)
+				}
+			}
+		})
+	}
+
+	t.Run("returns nil when all values are valid", func(t *testing.T) {
+		r := require.New(t)
+		scraped := []ScrapeResult{{Families: MetricFamilyMap{
+			MetricGPUTemperature: {Type: dto.MetricType_GAUGE.Enum(), Metric: []*dto.Metric{gpu("GPU-1", 60)}},
+		}}}
+		r.Nil(sanitizeResults(scraped, InvalidValuePolicyDrop, nil))
+		r.Len(scraped[0].Families[MetricGPUTemperature].Metric, 1)
+	})
+}
@@ -0,0 +1,201 @@
+package exporter
+
+import (
+	"sort"
+
+	"github.com/castai/gpu-metrics-exporter/pb"
+)
+
+// MetricGPUPresent is added to every batch for each known GPU, it's 1 while the GPU is reported by its node's
+// dcgm-exporter and 0 in the batch in which it disappears, e.g. after falling off the bus. GPUs of nodes which
+// couldn't be scraped are stale rather than gone and get no measurement.
+const MetricGPUPresent = MetricName("gpu_present")
+
+type gpuIdentity struct {
+	uuid          string
+	migProfile    string
+	migInstanceID string
+}
+
+// inventory keeps the GPUs last seen on every node, so that GPUs which vanish from a scrape can be told apart
+// from nodes which couldn't be scraped.
+type inventory struct {
+	nodes map[string]map[gpuIdentity]*pb.NodeInventory_GPU
+}
+
+func newInventory() *inventory {
+	return &inventory{nodes: make(map[string]map[gpuIdentity]*pb.NodeInventory_GPU)}
+}
+
+// update compares the GPUs in the batch with the ones seen previously and returns the inventory of every node,
+// sorted by node name. Nodes are stale when a target on them, or a target of an unknown node, failed to be
+// scraped. Nodes which are neither in the batch nor stale are gone along with their GPUs.
+func (i *inventory) update(batch *pb.MetricsBatch, results []ScrapeResult) []*pb.NodeInventory {
+	current := gpusByNode(batch)
+
+	failedNodes := make(map[string]struct{})
+	var failedUnknownNode bool
+	for _, result := range results {
+		if result.Err == nil {
+			continue
+		}
+		if result.Target.NodeName == "" {
+			failedUnknownNode = true
+			continue
+		}
+		failedNodes[result.Target.NodeName] = struct{}{}
+	}
+
+	var inventories []*pb.NodeInventory
+	for node, gpus := range current {
+		inv := &pb.NodeInventory{NodeName: node}
+		previous, known := i.nodes[node]
+		for id, gpu := range gpus {
+			inv.Gpus = append(inv.Gpus, gpu)
+			if _, found := previous[id]; known && !found {
+				inv.Added = append(inv.Added, gpu)
+			}
+		}
+		for id, gpu := range previous {
+			if _, found := gpus[id]; !found {
+				inv.Removed = append(inv.Removed, gpu)
+			}
+		}
+		i.nodes[node] = gpus
+		inventories = append(inventories, inv)
+	}
+
+	for node, previous := range i.nodes {
+		if _, found := current[node]; found {
+			continue
+		}
+		inv := &pb.NodeInventory{NodeName: node}
+		_, failed := failedNodes[node]
+		if failed || failedUnknownNode {
+			inv.Stale = true
+			for _, gpu := range previous {
+				inv.Gpus = append(inv.Gpus, gpu)
+			}
+		} else {
+			for _, gpu := range previous {
+				inv.Removed = append(inv.Removed, gpu)
+			}
+			delete(i.nodes, node)
+		}
+		inventories = append(inventories, inv)
+	}
+
+	sort.Slice(inventories, func(a, b int) bool {
+		return inventories[a].NodeName < inventories[b].NodeName
+	})
+	for _, inv := range inventories {
+		sortGPUs(inv.Gpus)
+		sortGPUs(inv.Added)
+		sortGPUs(inv.Removed)
+	}
+
+	return inventories
+}
+
+// forget drops the GPUs of the node without reporting them as removed, e.g. when another replica took over the node.
+func (i *inventory) forget(node string) {
+	delete(i.nodes, node)
+}
+
+// gpuPresence builds the gpu_present metric out of the inventories, nil if there are no measurements.
+func gpuPresence(inventories []*pb.NodeInventory) *pb.Metric {
+	metric := &pb.Metric{Name: MetricGPUPresent}
+	for _, inv := range inventories {
+		if inv.Stale {
+			continue
+		}
+		for _, gpu := range inv.Gpus {
+			metric.Measurements = append(metric.Measurements, gpuPresenceMeasurement(inv.NodeName, gpu, 1))
+		}
+		for _, gpu := range inv.Removed {
+			metric.Measurements = append(metric.Measurements, gpuPresenceMeasurement(inv.NodeName, gpu, 0))
+		}
+	}
+	if len(metric.Measurements) == 0 {
+		return nil
+	}
+	return metric
+}
+
+func gpuPresenceMeasurement(node string, gpu *pb.NodeInventory_GPU, value float64) *pb.Metric_Measurement {
+	labels := []*pb.Metric_Label{
+		{Name: nodeNameLabel, Value: node},
+		{Name: gpuUUIDLabel, Value: gpu.Uuid},
+		{Name: gpuIDLabel, Value: gpu.DeviceId},
+		{Name: modelNameLabel, Value: gpu.ModelName},
+	}
+	if gpu.MigProfile != "" || gpu.MigInstanceId != "" {
+		labels = append(labels,
+			&pb.Metric_Label{Name: gpuMIGProfile, Value: gpu.MigProfile},
+			&pb.Metric_Label{Name: gpuInstanceID, Value: gpu.MigInstanceId},
+		)
+	}
+	return &pb.Metric_Measurement{Value: value, Labels: labels}
+}
+
+// gpusByNode collects the GPUs, and MIG instances, in the measurements of the batch. Measurements without a
+// GPU UUID, e.g. node level metrics, are ignored.
+func gpusByNode(batch *pb.MetricsBatch) map[string]map[gpuIdentity]*pb.NodeInventory_GPU {
+	nodes := make(map[string]map[gpuIdentity]*pb.NodeInventory_GPU)
+	for _, metric := range batch.Metrics {
+		for _, measurement := range metric.Measurements {
+			var node string
+			gpu := &pb.NodeInventory_GPU{}
+			for _, label := range measurement.Labels {
+				switch label.Name {
+				case nodeNameLabel:
+					node = label.Value
+				case gpuUUIDLabel:
+					gpu.Uuid = label.Value
+				case gpuIDLabel:
+					gpu.DeviceId = label.Value
+				case modelNameLabel:
+					gpu.ModelName = label.Value
+				case gpuMIGProfile:
+					gpu.MigProfile = label.Value
+				case gpuInstanceID:
+					gpu.MigInstanceId = label.Value
+				}
+			}
+			if gpu.Uuid == "" {
+				continue
+			}
+
+			gpus, found := nodes[node]
+			if !found {
+				gpus = make(map[gpuIdentity]*pb.NodeInventory_GPU)
+				nodes[node] = gpus
+			}
+			id := gpuIdentity{uuid: gpu.Uuid, migProfile: gpu.MigProfile, migInstanceID: gpu.MigInstanceId}
+			if _, found := gpus[id]; !found {
+				gpus[id] = gpu
+			}
+		}
+	}
+	return nodes
+}
+
+func sortGPUs(gpus []*pb.NodeInventory_GPU) {
+	sort.Slice(gpus, func(a, b int) bool {
+		if gpus[a].Uuid != gpus[b].Uuid {
+			return gpus[a].Uuid < gpus[b].Uuid
+		}
+		return gpus[a].MigInstanceId < gpus[b].MigInstanceId
+	})
+}
+
+func gpuUUIDs(gpus []*pb.NodeInventory_GPU) []string {
+	uuids := make([]string, len(gpus))
+	for i, gpu := range gpus {
+		uuids[i] = gpu.Uuid
+		if gpu.MigInstanceId != "" {
+			uuids[i] += "/" + gpu.MigInstanceId
+		}
+	}
+	return uuids
+}
@@ -2,6 +2,8 @@ package exporter
 
 import (
 	"context"
+	"regexp"
+	"sort"
 	"strings"
 
 	client_model "github.com/prometheus/client_model/go"
@@ -24,13 +26,41 @@ const (
 	gpuInstanceID  = "GPU_I_ID"
 )
 
+// NodeNameSource is where the node of a measurement is taken from.
+type NodeNameSource string
+
+const (
+	// NodeNameSourceTarget is the node of the discovered dcgm-exporter pod or endpoint.
+	NodeNameSourceTarget = NodeNameSource("target")
+	// NodeNameSourceConfig is the node name the exporter is configured with.
+	NodeNameSourceConfig = NodeNameSource("config")
+	// NodeNameSourceLabel is the Hostname label set by dcgm-exporter, which is its pod name unless it runs in
+	// the host network.
+	NodeNameSourceLabel = NodeNameSource("label")
+)
+
+// DefaultNodeNameSources prefers what's known about the target over the configuration and dcgm-exporter.
+var DefaultNodeNameSources = []NodeNameSource{NodeNameSourceTarget, NodeNameSourceConfig, NodeNameSourceLabel}
+
+type MapperConfig struct {
+	NodeName string
+	// NodeNameSources are tried in order until one of them knows the node, DefaultNodeNameSources when empty.
+	NodeNameSources []NodeNameSource
+	// ExtraMetrics matches the names of families which are exported in addition to EnabledMetrics, e.g. the
+	// metrics of other exporters on the same endpoint. They're mapped as they are, without GPU metric rows.
+	ExtraMetrics *regexp.Regexp
+}
+
 type MetricMapper interface {
-	Map(metrics []MetricFamilyMap) *pb.MetricsBatch
-	MapToAvro(ctx context.Context, metrics []MetricFamilyMap) []GPUMetric
+	// Map and MapToAvro skip results of failed scrapes.
+	Map(results []ScrapeResult) *pb.MetricsBatch
+	MapToAvro(ctx context.Context, results []ScrapeResult) []GPUMetric
 }
 
 type metricMapper struct {
 	nodeName         string
+	nodeNameSources  []NodeNameSource
+	extraMetrics     *regexp.Regexp
 	workloadResolver workload.Resolver
 	log              *logging.Logger
 }
@@ -46,56 +76,89 @@ type gpuMetricKey struct {
 	MIGInstanceID string
 }
 
-func NewMapper(nodeName string, resolver workload.Resolver, log *logging.Logger) MetricMapper {
+func NewMapper(cfg MapperConfig, resolver workload.Resolver, log *logging.Logger) MetricMapper {
+	sources := cfg.NodeNameSources
+	if len(sources) == 0 {
+		sources = DefaultNodeNameSources
+	}
+
 	return &metricMapper{
-		nodeName:         nodeName,
+		nodeName:         cfg.NodeName,
+		nodeNameSources:  sources,
+		extraMetrics:     cfg.ExtraMetrics,
 		workloadResolver: resolver,
 		log:              log,
 	}
 }
 
-func (p metricMapper) Map(metricFamilyMaps []MetricFamilyMap) *pb.MetricsBatch {
+func (p metricMapper) Map(results []ScrapeResult) *pb.MetricsBatch {
 	metrics := &pb.MetricsBatch{}
 	metricsMap := make(map[string]*pb.Metric)
+	gpus := newDerivedGPUs()
+	clocksEventReason := &pb.Metric{Name: MetricClocksEventReason}
+	metric := func(name string) *pb.Metric {
+		m, found := metricsMap[name]
+		if !found {
+			m = &pb.Metric{Name: name}
+			metricsMap[name] = m
+			metrics.Metrics = append(metrics.Metrics, m)
+		}
+		return m
+	}
 
-	for _, familyMap := range metricFamilyMaps {
-		for name, family := range familyMap {
-			if _, found := EnabledMetrics[name]; !found {
+	for _, result := range results {
+		if result.Err != nil {
+			continue
+		}
+		for name, family := range result.Families {
+			if !metricEnabled(name, p.extraMetrics) {
 				continue
 			}
 
-			metric, found := metricsMap[name]
-			if !found {
-				metric = &pb.Metric{
-					Name: name,
-				}
-				metricsMap[name] = metric
-				metrics.Metrics = append(metrics.Metrics, metric)
-			}
-
-			t := family.Type.String()
-
 			for _, m := range family.Metric {
-				labels := p.mapLabels(m.Label)
-				var newValue float64
-				switch t {
-				case "COUNTER":
-					newValue = *m.GetCounter().Value
-				case "GAUGE":
-					newValue = *m.GetGauge().Value
+				nodeName := p.measurementNodeName(result.Target, m.Label)
+				labels := mapLabels(m.Label, nodeName, result.Target.Labels)
+
+				value, ok := scalarValue(family.GetType(), m)
+				if !ok {
+					for _, s := range distributionSamples(name, family.GetType(), m) {
+						distribution := metric(s.name)
+						distribution.Measurements = append(distribution.Measurements, &pb.Metric_Measurement{
+							Value:  s.value,
+							Labels: append(labels[:len(labels):len(labels)], s.labels...),
+						})
+					}
+					continue
 				}
 
-				metric.Measurements = append(metric.Measurements, &pb.Metric_Measurement{
-					Value:  newValue,
+				scalar := metric(name)
+				scalar.Measurements = append(scalar.Measurements, &pb.Metric_Measurement{
+					Value:  value,
 					Labels: labels,
 				})
+				gpus.add(name, value, m.Label, nodeName, result.Target.Labels)
+				if name == MetricClocksEventReasons {
+					clocksEventReason.Measurements = append(clocksEventReason.Measurements, clocksEventReasonMeasurements(value, labels)...)
+				}
 			}
 		}
 	}
+	metrics.Metrics = append(metrics.Metrics, gpus.metrics()...)
+	if len(clocksEventReason.Measurements) > 0 {
+		metrics.Metrics = append(metrics.Metrics, clocksEventReason)
+	}
 
 	return metrics
 }
 
+// metricEnabled tells whether the family is one of EnabledMetrics or matches the extra metrics.
+func metricEnabled(name string, extraMetrics *regexp.Regexp) bool {
+	if _, found := EnabledMetrics[name]; found {
+		return true
+	}
+	return extraMetrics != nil && extraMetrics.MatchString(name)
+}
+
 func getLabelValue(labels []*client_model.LabelPair, name string) string {
 	for _, lp := range labels {
 		if lp.GetName() == name {
@@ -105,16 +168,25 @@ func getLabelValue(labels []*client_model.LabelPair, name string) string {
 	return ""
 }
 
-func (p metricMapper) MapToAvro(ctx context.Context, metricFamilyMaps []MetricFamilyMap) []GPUMetric {
+func (p metricMapper) MapToAvro(ctx context.Context, results []ScrapeResult) []GPUMetric {
 	gpuMetrics := make(map[gpuMetricKey]*GPUMetric)
 
-	for _, familyMap := range metricFamilyMaps {
-		for name, family := range familyMap {
+	for _, result := range results {
+		if result.Err != nil {
+			continue
+		}
+		for name, family := range result.Families {
 			if _, found := EnabledMetrics[name]; !found {
 				continue
 			}
 
 			for _, m := range family.Metric {
+				// rows only have fields for single values, histograms and summaries aren't part of them
+				value, ok := scalarValue(family.GetType(), m)
+				if !ok {
+					continue
+				}
+
 				key := gpuMetricKey{
 					device:        getLabelValue(m.Label, deviceLabel),
 					pod:           getLabelValue(m.Label, podLabel),
@@ -128,13 +200,8 @@ func (p metricMapper) MapToAvro(ctx context.Context, metricFamilyMaps []MetricFa
 
 				gm, exists := gpuMetrics[key]
 				if !exists {
-					nodeName := getLabelValue(m.Label, nodeNameLabel)
-					if p.nodeName != "" {
-						nodeName = p.nodeName
-					}
-
 					gm = &GPUMetric{
-						NodeName:      nodeName,
+						NodeName:      p.measurementNodeName(result.Target, m.Label),
 						ModelName:     getLabelValue(m.Label, modelNameLabel),
 						Device:        key.device,
 						DeviceID:      key.deviceID,
@@ -144,6 +211,7 @@ func (p metricMapper) MapToAvro(ctx context.Context, metricFamilyMaps []MetricFa
 						Pod:           key.pod,
 						Container:     key.container,
 						Namespace:     key.namespace,
+						Timestamp:     result.Timestamp,
 					}
 
 					if key.pod != "" {
@@ -163,91 +231,89 @@ func (p metricMapper) MapToAvro(ctx context.Context, metricFamilyMaps []MetricFa
 					gpuMetrics[key] = gm
 				}
 
-				var value float64
-				switch family.Type.String() {
-				case "COUNTER":
-					value = *m.GetCounter().Value
-				case "GAUGE":
-					value = *m.GetGauge().Value
-				}
-
-				switch name {
-				case MetricStreamingMultiProcessorActive:
-					gm.SMActive = value
-				case MetricStreamingMultiProcessorOccupancy:
-					gm.SMOccupancy = value
-				case MetricStreamingMultiProcessorTensorActive:
-					gm.TensorActive = value
-				case MetricDRAMActive:
-					gm.DRAMActive = value
-				case MetricPCIeTXBytes:
-					gm.PCIeTXBytes = value
-				case MetricPCIeRXBytes:
-					gm.PCIeRXBytes = value
-				case MetricNVLinkTXBytes:
-					gm.NVLinkTXBytes = value
-				case MetricNVLinkRXBytes:
-					gm.NVLinkRXBytes = value
-				case MetricGraphicsEngineActive:
-					gm.GraphicsEngineActive = value
-				case MetricFrameBufferTotal:
-					gm.FramebufferTotal = value
-				case MetricFrameBufferFree:
-					gm.FramebufferFree = value
-				case MetricFrameBufferUsed:
-					gm.FramebufferUsed = value
-				case MetricPCIeLinkGen:
-					gm.PCIeLinkGen = value
-				case MetricPCIeLinkWidth:
-					gm.PCIeLinkWidth = value
-				case MetricGPUTemperature:
-					gm.Temperature = value
-				case MetricMemoryTemperature:
-					gm.MemoryTemperature = value
-				case MetricPowerUsage:
-					gm.PowerUsage = value
-				case MetricGPUUtilization:
-					gm.GPUUtilization = value
-				case MetricIntPipeActive:
-					gm.IntPipeActive = value
-				case MetricFloat16PipeActive:
-					gm.FP16PipeActive = value
-				case MetricFloat32PipeActive:
-					gm.FP32PipeActive = value
-				case MetricFloat64PipeActive:
-					gm.FP64PipeActive = value
-				case MetricClocksEventReasons:
-					gm.ClocksEventReasons = value
-				case MetricXIDErrors:
-					gm.XIDErrors = value
-				case MetricPowerViolation:
-					gm.PowerViolation = value
-				case MetricThermalViolation:
-					gm.ThermalViolation = value
-				}
+				gm.set(name, value)
 			}
 		}
 	}
 
 	metrics := make([]GPUMetric, 0, len(gpuMetrics))
 	for _, gm := range gpuMetrics {
+		gm.derive()
 		metrics = append(metrics, *gm)
 	}
 
 	return metrics
 }
 
-func (p metricMapper) mapLabels(labelPairs []*client_model.LabelPair) []*pb.Metric_Label {
-	labels := make([]*pb.Metric_Label, len(labelPairs))
-	for i, label := range labelPairs {
+// measurementNodeName returns the node of a measurement from the first of the configured sources which knows it.
+// A Hostname label of the target replaces the one of the measurement, like the other target labels.
+func (p metricMapper) measurementNodeName(target Target, labels []*client_model.LabelPair) string {
+	label, found := target.Labels[nodeNameLabel]
+	if !found {
+		label = getLabelValue(labels, nodeNameLabel)
+	}
+	return ResolveNodeName(p.nodeNameSources, target.NodeName, p.nodeName, label)
+}
+
+// ResolveNodeName returns the node from the first of the sources which knows it, out of the node of the target,
+// the configured node name and the Hostname label.
+func ResolveNodeName(sources []NodeNameSource, target, config, label string) string {
+	for _, source := range sources {
+		var nodeName string
+		switch source {
+		case NodeNameSourceTarget:
+			nodeName = target
+		case NodeNameSourceConfig:
+			nodeName = config
+		case NodeNameSourceLabel:
+			nodeName = label
+		}
+		if nodeName != "" {
+			return nodeName
+		}
+	}
+	return ""
+}
+
+func mapLabels(labelPairs []*client_model.LabelPair, nodeName string, targetLabels map[string]string) []*pb.Metric_Label {
+	labels := make([]*pb.Metric_Label, 0, len(labelPairs)+len(targetLabels)+1)
+	var hasNodeName bool
+	for _, label := range labelPairs {
+		if _, found := targetLabels[*label.Name]; found {
+			continue
+		}
 		value := *label.Value
-		if p.nodeName != "" && strings.EqualFold(*label.Name, nodeNameLabel) {
-			value = p.nodeName
+		if nodeName != "" && strings.EqualFold(*label.Name, nodeNameLabel) {
+			value = nodeName
+			hasNodeName = true
 		}
-		labels[i] = &pb.Metric_Label{
+		labels = append(labels, &pb.Metric_Label{
 			Name:  *label.Name,
 			Value: value,
+		})
+	}
+	// the node is known even when dcgm-exporter doesn't set the Hostname label
+	if nodeName != "" && !hasNodeName {
+		if _, found := targetLabels[nodeNameLabel]; !found {
+			labels = append(labels, &pb.Metric_Label{Name: nodeNameLabel, Value: nodeName})
+		}
+	}
+
+	names := make([]string, 0, len(targetLabels))
+	for name := range targetLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := targetLabels[name]
+		// the Hostname label of a target is one of the node name sources, so it doesn't bypass their order
+		if nodeName != "" && name == nodeNameLabel {
+			value = nodeName
 		}
+		labels = append(labels, &pb.Metric_Label{
+			Name:  name,
+			Value: value,
+		})
 	}
 
 	return labels
@@ -1,7 +1,11 @@
 package exporter_test
 
 import (
+	"context"
+	"errors"
+	"regexp"
 	"testing"
+	"time"
 
 	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
@@ -28,12 +32,10 @@ func newLabelPair(name, value string) *dto.LabelPair {
 func TestMetricMapper_Map(t *testing.T) {
 	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
 	resolver := workload_mock.NewMockResolver(t)
-	mapper := exporter.NewMapper("test-node-name", resolver, log)
+	mapper := exporter.NewMapper(exporter.MapperConfig{NodeName: "test-node-name"}, resolver, log)
 
 	t.Run("empty input yields empty MetricsBatch", func(t *testing.T) {
-		metricFamilyMaps := []exporter.MetricFamilyMap{}
-
-		got := mapper.Map(metricFamilyMaps)
+		got := mapper.Map([]exporter.ScrapeResult{})
 		expected := &pb.MetricsBatch{}
 
 		r := require.New(t)
@@ -41,23 +43,21 @@ func TestMetricMapper_Map(t *testing.T) {
 	})
 
 	t.Run("metric familiy which is not enabled is skipped", func(t *testing.T) {
-		metricFamilyMaps := []exporter.MetricFamilyMap{
-			{
-				"test_gauge": {
-					Type: dto.MetricType_GAUGE.Enum(),
-					Metric: []*dto.Metric{
-						{
-							Label: []*dto.LabelPair{
-								newLabelPair("label1", "value1"),
-							},
-							Gauge: newGauge(1.0),
+		families := exporter.MetricFamilyMap{
+			"test_gauge": {
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{
+							newLabelPair("label1", "value1"),
 						},
+						Gauge: newGauge(1.0),
 					},
 				},
 			},
 		}
 
-		got := mapper.Map(metricFamilyMaps)
+		got := mapper.Map([]exporter.ScrapeResult{{Families: families}})
 		expected := &pb.MetricsBatch{}
 
 		r := require.New(t)
@@ -65,34 +65,32 @@ func TestMetricMapper_Map(t *testing.T) {
 	})
 
 	t.Run("enabled metric family is included", func(t *testing.T) {
-		metricFamilyMaps := []exporter.MetricFamilyMap{
-			{
-				"test_gauge": {
-					Type: dto.MetricType_GAUGE.Enum(),
-					Metric: []*dto.Metric{
-						{
-							Label: []*dto.LabelPair{
-								newLabelPair("label1", "value1"),
-							},
-							Gauge: newGauge(1.0),
+		families := exporter.MetricFamilyMap{
+			"test_gauge": {
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{
+							newLabelPair("label1", "value1"),
 						},
+						Gauge: newGauge(1.0),
 					},
 				},
-				exporter.MetricGraphicsEngineActive: {
-					Type: dto.MetricType_GAUGE.Enum(),
-					Metric: []*dto.Metric{
-						{
-							Label: []*dto.LabelPair{
-								newLabelPair("label1", "value1"),
-							},
-							Gauge: newGauge(1.0),
+			},
+			exporter.MetricGraphicsEngineActive: {
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{
+							newLabelPair("label1", "value1"),
 						},
+						Gauge: newGauge(1.0),
 					},
 				},
 			},
 		}
 
-		got := mapper.Map(metricFamilyMaps)
+		got := mapper.Map([]exporter.ScrapeResult{{Families: families}})
 		expected := &pb.MetricsBatch{
 			Metrics: []*pb.Metric{
 				{
@@ -102,6 +100,7 @@ func TestMetricMapper_Map(t *testing.T) {
 							Value: 1.0,
 							Labels: []*pb.Metric_Label{
 								{Name: "label1", Value: "value1"},
+								{Name: "Hostname", Value: "test-node-name"},
 							},
 						},
 					},
@@ -112,4 +111,313 @@ func TestMetricMapper_Map(t *testing.T) {
 		r := require.New(t)
 		r.Equal(expected, got)
 	})
+
+	t.Run("results of failed scrapes are skipped", func(t *testing.T) {
+		families := exporter.MetricFamilyMap{
+			exporter.MetricGraphicsEngineActive: {
+				Type:   dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{{Gauge: newGauge(1.0)}},
+			},
+		}
+
+		got := mapper.Map([]exporter.ScrapeResult{{Families: families, Err: errors.New("connection refused")}})
+
+		r := require.New(t)
+		r.Equal(&pb.MetricsBatch{}, got)
+	})
+
+	t.Run("node name of the target replaces the Hostname label", func(t *testing.T) {
+		families := exporter.MetricFamilyMap{
+			exporter.MetricGraphicsEngineActive: {
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{newLabelPair("Hostname", "dcgm-exporter-x7k2p")},
+						Gauge: newGauge(1.0),
+					},
+				},
+			},
+		}
+
+		got := mapper.Map([]exporter.ScrapeResult{{Target: exporter.Target{NodeName: "gpu-node-1"}, Families: families}})
+
+		r := require.New(t)
+		r.Equal([]*pb.Metric_Label{{Name: "Hostname", Value: "gpu-node-1"}}, got.Metrics[0].Measurements[0].Labels)
+	})
+
+	t.Run("node name is taken from the sources in the configured order", func(t *testing.T) {
+		families := exporter.MetricFamilyMap{
+			exporter.MetricGraphicsEngineActive: {
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{newLabelPair("Hostname", "dcgm-exporter-x7k2p")},
+						Gauge: newGauge(1.0),
+					},
+				},
+			},
+		}
+		nodeName := func(cfg exporter.MapperConfig, target exporter.Target) string {
+			got := exporter.NewMapper(cfg, resolver, log).Map([]exporter.ScrapeResult{{Target: target, Families: families}})
+			return got.Metrics[0].Measurements[0].Labels[0].Value
+		}
+
+		r := require.New(t)
+		target := exporter.Target{NodeName: "gpu-node-1"}
+		r.Equal("gpu-node-1", nodeName(exporter.MapperConfig{NodeName: "test-node-name"}, target))
+		r.Equal("test-node-name", nodeName(exporter.MapperConfig{NodeName: "test-node-name"}, exporter.Target{}))
+		r.Equal("dcgm-exporter-x7k2p", nodeName(exporter.MapperConfig{}, exporter.Target{}))
+		r.Equal("test-node-name", nodeName(exporter.MapperConfig{
+			NodeName:        "test-node-name",
+			NodeNameSources: []exporter.NodeNameSource{exporter.NodeNameSourceConfig, exporter.NodeNameSourceTarget},
+		}, target))
+		r.Equal("dcgm-exporter-x7k2p", nodeName(exporter.MapperConfig{
+			NodeName:        "test-node-name",
+			NodeNameSources: []exporter.NodeNameSource{exporter.NodeNameSourceLabel, exporter.NodeNameSourceTarget},
+		}, target))
+
+		// a Hostname label of the target takes the place of the scraped one as the label source
+		labeled := exporter.Target{NodeName: "gpu-node-1", Labels: map[string]string{"Hostname": "gpu-host-9"}}
+		r.Equal("gpu-node-1", nodeName(exporter.MapperConfig{NodeName: "test-node-name"}, labeled))
+		r.Equal("test-node-name", nodeName(exporter.MapperConfig{
+			NodeName:        "test-node-name",
+			NodeNameSources: []exporter.NodeNameSource{exporter.NodeNameSourceConfig, exporter.NodeNameSourceLabel},
+		}, labeled))
+		r.Equal("gpu-host-9", nodeName(exporter.MapperConfig{
+			NodeName:        "test-node-name",
+			NodeNameSources: []exporter.NodeNameSource{exporter.NodeNameSourceLabel, exporter.NodeNameSourceTarget},
+		}, labeled))
+	})
+
+	t.Run("labels of the target are merged into the measurements", func(t *testing.T) {
+		families := exporter.MetricFamilyMap{
+			exporter.MetricGraphicsEngineActive: {
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{
+							newLabelPair("Hostname", "gpu-host-1"),
+							newLabelPair("rack", "scraped"),
+						},
+						Gauge: newGauge(1.0),
+					},
+				},
+			},
+		}
+
+		got := exporter.NewMapper(exporter.MapperConfig{}, resolver, log).Map([]exporter.ScrapeResult{{
+			Target:   exporter.Target{Labels: map[string]string{"rack": "r1", "datacenter": "dc1"}},
+			Families: families,
+		}})
+
+		r := require.New(t)
+		r.Equal([]*pb.Metric_Label{
+			{Name: "Hostname", Value: "gpu-host-1"},
+			{Name: "datacenter", Value: "dc1"},
+			{Name: "rack", Value: "r1"},
+		}, got.Metrics[0].Measurements[0].Labels)
+	})
+}
+
+func TestMetricMapper_MapTypes(t *testing.T) {
+	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
+	mapper := exporter.NewMapper(exporter.MapperConfig{
+		ExtraMetrics: regexp.MustCompile("^(?:vllm:.+|go_gc_duration_seconds)$"),
+	}, workload_mock.NewMockResolver(t), log)
+	value := func(v float64) *float64 { return &v }
+	count := func(v uint64) *uint64 { return &v }
+	gpuLabels := []*dto.LabelPair{newLabelPair("gpu", "0")}
+	const (
+		latencyHistogram = "vllm:e2e_request_latency_seconds"
+		gcSummary        = "go_gc_duration_seconds"
+	)
+
+	t.Run("maps counters, gauges and untyped values", func(t *testing.T) {
+		r := require.New(t)
+		got := mapper.Map([]exporter.ScrapeResult{{Families: exporter.MetricFamilyMap{
+			exporter.MetricXIDErrors: {
+				Type:   dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{{Label: gpuLabels, Counter: &dto.Counter{Value: value(2)}}},
+			},
+			exporter.MetricGPUTemperature: {
+				Type:   dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{{Label: gpuLabels, Gauge: newGauge(60)}},
+			},
+			exporter.MetricGPUUtilization: {
+				Type:   dto.MetricType_UNTYPED.Enum(),
+				Metric: []*dto.Metric{{Label: gpuLabels, Untyped: &dto.Untyped{Value: value(42)}}},
+			},
+		}}})
+
+		values := make(map[string]float64)
+		for _, metric := range got.Metrics {
+			for _, m := range metric.Measurements {
+				values[metric.Name] = m.Value
+			}
+		}
+		r.Equal(2.0, values[exporter.MetricXIDErrors])
+		r.Equal(60.0, values[exporter.MetricGPUTemperature])
+		r.Equal(42.0, values[exporter.MetricGPUUtilization])
+	})
+
+	t.Run("expands histograms into buckets, sum and count", func(t *testing.T) {
+		r := require.New(t)
+		got := mapper.Map([]exporter.ScrapeResult{{Families: exporter.MetricFamilyMap{
+			latencyHistogram: {
+				Type: dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{{Label: gpuLabels, Histogram: &dto.Histogram{
+					SampleCount: count(5),
+					SampleSum:   value(12),
+					Bucket: []*dto.Bucket{
+						{UpperBound: value(1), CumulativeCount: count(1)},
+						{UpperBound: value(2.5), CumulativeCount: count(4)},
+					},
+				}}},
+			},
+		}}})
+
+		label := func(name, value string) []*pb.Metric_Label {
+			return []*pb.Metric_Label{{Name: "gpu", Value: "0"}, {Name: name, Value: value}}
+		}
+		r.ElementsMatch([]*pb.Metric{
+			{Name: latencyHistogram + "_bucket", Measurements: []*pb.Metric_Measurement{
+				{Value: 1, Labels: label("le", "1")},
+				{Value: 4, Labels: label("le", "2.5")},
+				{Value: 5, Labels: label("le", "+Inf")},
+			}},
+			{Name: latencyHistogram + "_sum", Measurements: []*pb.Metric_Measurement{
+				{Value: 12, Labels: []*pb.Metric_Label{{Name: "gpu", Value: "0"}}},
+			}},
+			{Name: latencyHistogram + "_count", Measurements: []*pb.Metric_Measurement{
+				{Value: 5, Labels: []*pb.Metric_Label{{Name: "gpu", Value: "0"}}},
+			}},
+		}, got.Metrics)
+	})
+
+	t.Run("expands summaries into quantiles, sum and count", func(t *testing.T) {
+		r := require.New(t)
+		got := mapper.Map([]exporter.ScrapeResult{{Families: exporter.MetricFamilyMap{
+			gcSummary: {
+				Type: dto.MetricType_SUMMARY.Enum(),
+				Metric: []*dto.Metric{{Summary: &dto.Summary{
+					SampleCount: count(10),
+					SampleSum:   value(0.025),
+					Quantile: []*dto.Quantile{
+						{Quantile: value(0.5), Value: value(0.002)},
+						{Quantile: value(1), Value: value(0.004)},
+					},
+				}}},
+			},
+		}}})
+
+		r.ElementsMatch([]*pb.Metric{
+			{Name: gcSummary, Measurements: []*pb.Metric_Measurement{
+				{Value: 0.002, Labels: []*pb.Metric_Label{{Name: "quantile", Value: "0.5"}}},
+				{Value: 0.004, Labels: []*pb.Metric_Label{{Name: "quantile", Value: "1"}}},
+			}},
+			{Name: gcSummary + "_sum", Measurements: []*pb.Metric_Measurement{
+				{Value: 0.025, Labels: []*pb.Metric_Label{}},
+			}},
+			{Name: gcSummary + "_count", Measurements: []*pb.Metric_Measurement{
+				{Value: 10, Labels: []*pb.Metric_Label{}},
+			}},
+		}, got.Metrics)
+	})
+
+	t.Run("ignores families which are neither enabled nor extra metrics", func(t *testing.T) {
+		r := require.New(t)
+		got := mapper.Map([]exporter.ScrapeResult{{Families: exporter.MetricFamilyMap{
+			"process_cpu_seconds_total": {
+				Type:   dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{{Counter: &dto.Counter{Value: value(3)}}},
+			},
+			// extra metrics match the whole name
+			"go_gc_duration_seconds_total": {
+				Type:   dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{{Counter: &dto.Counter{Value: value(3)}}},
+			},
+		}}})
+		r.Empty(got.Metrics)
+	})
+
+	t.Run("metrics without a value of their type aren't mapped to zero", func(t *testing.T) {
+		r := require.New(t)
+		results := []exporter.ScrapeResult{{Families: exporter.MetricFamilyMap{
+			exporter.MetricGPUTemperature: {
+				Type:   dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{{Label: gpuLabels, Untyped: &dto.Untyped{Value: value(60)}}},
+			},
+		}}}
+		r.Equal(&pb.MetricsBatch{}, mapper.Map(results))
+		r.Empty(mapper.MapToAvro(context.Background(), results))
+	})
+
+	t.Run("rows get untyped values and skip extra metrics", func(t *testing.T) {
+		r := require.New(t)
+		got := mapper.MapToAvro(context.Background(), []exporter.ScrapeResult{{Families: exporter.MetricFamilyMap{
+			exporter.MetricGPUUtilization: {
+				Type:   dto.MetricType_UNTYPED.Enum(),
+				Metric: []*dto.Metric{{Label: gpuLabels, Untyped: &dto.Untyped{Value: value(42)}}},
+			},
+			latencyHistogram: {
+				Type: dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{{Label: gpuLabels, Histogram: &dto.Histogram{
+					SampleCount: count(1),
+					SampleSum:   value(0.5),
+				}}},
+			},
+		}}})
+
+		r.Len(got, 1)
+		r.Equal(42.0, *got[0].GPUUtilization)
+	})
+}
+
+func TestMetricMapper_MapToAvro(t *testing.T) {
+	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
+	resolver := workload_mock.NewMockResolver(t)
+
+	families := exporter.MetricFamilyMap{
+		exporter.MetricPowerUsage: {
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{
+						newLabelPair("Hostname", "dcgm-exporter-x7k2p"),
+						newLabelPair("UUID", "GPU-1"),
+					},
+					Gauge: newGauge(250.0),
+				},
+			},
+		},
+	}
+
+	t.Run("attributes rows to the node and time of the scrape", func(t *testing.T) {
+		mapper := exporter.NewMapper(exporter.MapperConfig{}, resolver, log)
+		ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+		got := mapper.MapToAvro(context.Background(), []exporter.ScrapeResult{
+			{Target: exporter.Target{NodeName: "gpu-node-1"}, Timestamp: ts, Families: families},
+			{Target: exporter.Target{NodeName: "gpu-node-2"}, Err: errors.New("timeout")},
+		})
+
+		r := require.New(t)
+		r.Len(got, 1)
+		r.Equal("gpu-node-1", got[0].NodeName)
+		r.Equal("GPU-1", got[0].DeviceUUID)
+		r.Equal(250.0, *got[0].PowerUsage)
+		r.Equal(ts, got[0].Timestamp)
+	})
+
+	t.Run("falls back to the configured node name and the Hostname label", func(t *testing.T) {
+		r := require.New(t)
+
+		got := exporter.NewMapper(exporter.MapperConfig{NodeName: "test-node-name"}, resolver, log).
+			MapToAvro(context.Background(), []exporter.ScrapeResult{{Families: families}})
+		r.Equal("test-node-name", got[0].NodeName)
+
+		got = exporter.NewMapper(exporter.MapperConfig{}, resolver, log).
+			MapToAvro(context.Background(), []exporter.ScrapeResult{{Families: families}})
+		r.Equal("dcgm-exporter-x7k2p", got[0].NodeName)
+	})
 }
@@ -0,0 +1,189 @@
+package exporter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// openMetricsToText rewrites an OpenMetrics exposition into the Prometheus text format, so it can be
+// parsed by expfmt.TextParser. Exemplars, units, _created samples and the # EOF marker are dropped,
+// the _total suffix of counter samples is stripped, so that families keep their declared names like in
+// the text format, and timestamps are converted from seconds to milliseconds.
+func openMetricsToText(r io.Reader, w io.Writer) error {
+	c := &openMetricsConverter{w: bufio.NewWriter(w)}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if err := c.line(scanner.Text()); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	c.flushMetadata()
+
+	return c.w.Flush()
+}
+
+type openMetricsConverter struct {
+	w *bufio.Writer
+
+	// metadata of the family whose samples follow, it's written once the family type is known
+	family     string
+	familyType string
+	help       string
+	hasHelp    bool
+	pending    bool
+}
+
+func (c *openMetricsConverter) line(line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(line, "#") {
+		c.metadata(line)
+		return nil
+	}
+
+	return c.sample(line)
+}
+
+func (c *openMetricsConverter) metadata(line string) {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 3 {
+		// # EOF and other comments
+		return
+	}
+
+	keyword, name := fields[1], fields[2]
+	if name != c.family {
+		c.flushMetadata()
+		c.family = name
+		c.familyType = ""
+		c.help = ""
+		c.hasHelp = false
+	}
+	c.pending = true
+
+	switch keyword {
+	case "HELP":
+		c.hasHelp = true
+		if len(fields) == 4 {
+			c.help = fields[3]
+		}
+	case "TYPE":
+		if len(fields) == 4 {
+			c.familyType = fields[3]
+		}
+	}
+}
+
+func (c *openMetricsConverter) flushMetadata() {
+	if !c.pending {
+		return
+	}
+	c.pending = false
+
+	name, textType := c.family, ""
+	switch c.familyType {
+	case "counter", "gauge", "histogram", "summary":
+		textType = c.familyType
+	case "info":
+		name += "_info"
+		textType = "gauge"
+	case "stateset":
+		textType = "gauge"
+	}
+
+	if c.hasHelp {
+		_, _ = fmt.Fprintf(c.w, "# HELP %s %s\n", name, c.help)
+	}
+	if textType != "" {
+		_, _ = fmt.Fprintf(c.w, "# TYPE %s %s\n", name, textType)
+	}
+}
+
+func (c *openMetricsConverter) sample(line string) error {
+	c.flushMetadata()
+
+	series, rest, err := splitSeries(line)
+	if err != nil {
+		return err
+	}
+
+	if c.isCreated(series) {
+		return nil
+	}
+	if name := seriesName(series); c.familyType == "counter" && name == c.family+"_total" {
+		series = c.family + series[len(name):]
+	}
+
+	// everything after # is an exemplar
+	if i := strings.IndexByte(rest, '#'); i >= 0 {
+		rest = rest[:i]
+	}
+	values := strings.Fields(rest)
+	switch len(values) {
+	case 1:
+		_, _ = fmt.Fprintf(c.w, "%s %s\n", series, values[0])
+	case 2:
+		seconds, err := strconv.ParseFloat(values[1], 64)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp in line %q: %w", line, err)
+		}
+		_, _ = fmt.Fprintf(c.w, "%s %s %d\n", series, values[0], int64(seconds*1000))
+	default:
+		return fmt.Errorf("invalid sample line %q", line)
+	}
+
+	return nil
+}
+
+func (c *openMetricsConverter) isCreated(series string) bool {
+	switch c.familyType {
+	case "counter", "histogram", "summary", "gaugehistogram":
+	default:
+		return false
+	}
+
+	return seriesName(series) == c.family+"_created"
+}
+
+func seriesName(series string) string {
+	if i := strings.IndexByte(series, '{'); i >= 0 {
+		return series[:i]
+	}
+	return series
+}
+
+// splitSeries splits a sample line into the metric name with its labels and the rest of the line.
+func splitSeries(line string) (string, string, error) {
+	end := strings.IndexAny(line, "{ ")
+	if end < 0 {
+		return "", "", fmt.Errorf("invalid sample line %q", line)
+	}
+	if line[end] == ' ' {
+		return line[:end], line[end:], nil
+	}
+
+	inQuotes := false
+	for i := end + 1; i < len(line); i++ {
+		switch {
+		case inQuotes && line[i] == '\\':
+			i++
+		case line[i] == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && line[i] == '}':
+			return line[:i+1], line[i+1:], nil
+		}
+	}
+
+	return "", "", fmt.Errorf("unterminated labels in line %q", line)
+}
@@ -0,0 +1,62 @@
+package exporter
+
+import (
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metricNameLabel holds the metric name of a series while it's relabeled.
+const metricNameLabel = "__name__"
+
+// Relabeler rewrites the labels of scraped series before they're mapped, e.g. to drop high-cardinality labels.
+type Relabeler interface {
+	// Process modifies the labels, which hold the metric name as __name__, and returns false when the series is
+	// dropped.
+	Process(labels map[string]string) bool
+}
+
+// relabelResults relabels every series of the results. Labels prefixed with __ are only available while relabeling,
+// the labels of the series which are kept are sorted by name afterwards.
+func relabelResults(results []ScrapeResult, relabeler Relabeler) {
+	for _, result := range results {
+		for name, family := range result.Families {
+			kept := family.Metric[:0]
+			for _, m := range family.Metric {
+				labels := make(map[string]string, len(m.Label)+1)
+				for _, label := range m.Label {
+					labels[label.GetName()] = label.GetValue()
+				}
+				labels[metricNameLabel] = name
+				if !relabeler.Process(labels) {
+					continue
+				}
+				m.Label = labelPairs(labels)
+				kept = append(kept, m)
+			}
+			if len(kept) == 0 {
+				delete(result.Families, name)
+				continue
+			}
+			family.Metric = kept
+		}
+	}
+}
+
+func labelPairs(labels map[string]string) []*dto.LabelPair {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if !strings.HasPrefix(name, "__") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	pairs := make([]*dto.LabelPair, 0, len(names))
+	for _, name := range names {
+		value := labels[name]
+		pairs = append(pairs, &dto.LabelPair{Name: &name, Value: &value})
+	}
+	return pairs
+}
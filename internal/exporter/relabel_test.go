@@ -0,0 +1,63 @@
+package exporter
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/castai/gpu-metrics-exporter/internal/relabel"
+)
+
+func TestRelabelResults(t *testing.T) {
+	r := require.New(t)
+	ptr := func(s string) *string { return &s }
+	relabeler, err := relabel.New([]relabel.Config{
+		{Action: relabel.LabelDrop, Regex: ptr("pci_bus_id|DCGM_FI_DRIVER_VERSION")},
+		{Action: relabel.Drop, SourceLabels: []string{"__name__", "gpu"}, Regex: ptr(MetricGPUTemperature + ";1")},
+		{SourceLabels: []string{"modelName"}, Regex: ptr("NVIDIA (.*)"), TargetLabel: "model"},
+		{Action: relabel.Drop, SourceLabels: []string{"__name__"}, Regex: ptr(MetricPowerUsage)},
+	})
+	r.NoError(err)
+
+	gpu := func(id string, value float64) *dto.Metric {
+		return &dto.Metric{
+			Label: []*dto.LabelPair{
+				{Name: ptr("gpu"), Value: ptr(id)},
+				{Name: ptr("pci_bus_id"), Value: ptr("00000000:00:1E." + id)},
+				{Name: ptr("modelName"), Value: ptr("NVIDIA A100")},
+			},
+			Gauge: &dto.Gauge{Value: &value},
+		}
+	}
+	results := []ScrapeResult{{
+		Families: MetricFamilyMap{
+			MetricGPUTemperature: {Type: dto.MetricType_GAUGE.Enum(), Metric: []*dto.Metric{gpu("0", 60), gpu("1", 70)}},
+			MetricGPUUtilization: {Type: dto.MetricType_GAUGE.Enum(), Metric: []*dto.Metric{gpu("1", 50)}},
+			MetricPowerUsage:     {Type: dto.MetricType_GAUGE.Enum(), Metric: []*dto.Metric{gpu("0", 250)}},
+		},
+	}}
+
+	relabelResults(results, relabeler)
+
+	labels := func(m *dto.Metric) map[string]string {
+		got := make(map[string]string)
+		for _, l := range m.Label {
+			got[l.GetName()] = l.GetValue()
+		}
+		return got
+	}
+	families := results[0].Families
+	// families without series left are removed
+	r.Len(families, 2)
+	temperature := families[MetricGPUTemperature].Metric
+	r.Len(temperature, 1)
+	r.Equal(map[string]string{"gpu": "0", "modelName": "NVIDIA A100", "model": "A100"}, labels(temperature[0]))
+	r.Equal(60.0, temperature[0].Gauge.GetValue())
+	utilization := families[MetricGPUUtilization].Metric
+	r.Len(utilization, 1)
+	r.Equal(map[string]string{"gpu": "1", "modelName": "NVIDIA A100", "model": "A100"}, labels(utilization[0]))
+	// labels are sorted by name
+	r.Equal("gpu", utilization[0].Label[0].GetName())
+	r.Equal("model", utilization[0].Label[1].GetName())
+}
@@ -0,0 +1,119 @@
+package exporter
+
+import (
+	"math"
+	"strconv"
+
+	client_model "github.com/prometheus/client_model/go"
+
+	"github.com/castai/gpu-metrics-exporter/pb"
+)
+
+const (
+	bucketLabel   = "le"
+	quantileLabel = "quantile"
+
+	bucketSuffix = "_bucket"
+	sumSuffix    = "_sum"
+	countSuffix  = "_count"
+)
+
+// scalarValue returns the value of counters, gauges and untyped metrics. It returns false for histograms and
+// summaries, and when the metric doesn't hold a value of its family's type.
+func scalarValue(t client_model.MetricType, m *client_model.Metric) (float64, bool) {
+	switch t {
+	case client_model.MetricType_COUNTER:
+		if m.Counter != nil {
+			return m.Counter.GetValue(), true
+		}
+	case client_model.MetricType_GAUGE:
+		if m.Gauge != nil {
+			return m.Gauge.GetValue(), true
+		}
+	case client_model.MetricType_UNTYPED:
+		if m.Untyped != nil {
+			return m.Untyped.GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+// sample is a single value of a histogram or summary, labels are added to the ones of the metric.
+type sample struct {
+	name   string
+	value  float64
+	labels []*pb.Metric_Label
+}
+
+// distributionSamples expands histograms and summaries into the series of the Prometheus text format: a _bucket
+// series per bucket with an le label, or a series per quantile with a quantile label, and _sum and _count series.
+// Other types have no samples.
+func distributionSamples(name string, t client_model.MetricType, m *client_model.Metric) []sample {
+	switch t {
+	case client_model.MetricType_HISTOGRAM, client_model.MetricType_GAUGE_HISTOGRAM:
+		h := m.Histogram
+		if h == nil {
+			return nil
+		}
+		count := float64(h.GetSampleCount())
+		if h.SampleCountFloat != nil {
+			count = h.GetSampleCountFloat()
+		}
+
+		samples := make([]sample, 0, len(h.Bucket)+3)
+		var hasInf bool
+		for _, b := range h.Bucket {
+			value := float64(b.GetCumulativeCount())
+			if b.CumulativeCountFloat != nil {
+				value = b.GetCumulativeCountFloat()
+			}
+			hasInf = hasInf || math.IsInf(b.GetUpperBound(), 1)
+			samples = append(samples, sample{
+				name:   name + bucketSuffix,
+				value:  value,
+				labels: []*pb.Metric_Label{{Name: bucketLabel, Value: formatFloat(b.GetUpperBound())}},
+			})
+		}
+		// the +Inf bucket is implied by the count when it isn't listed
+		if !hasInf {
+			samples = append(samples, sample{
+				name:   name + bucketSuffix,
+				value:  count,
+				labels: []*pb.Metric_Label{{Name: bucketLabel, Value: formatFloat(math.Inf(1))}},
+			})
+		}
+		return append(samples,
+			sample{name: name + sumSuffix, value: h.GetSampleSum()},
+			sample{name: name + countSuffix, value: count},
+		)
+	case client_model.MetricType_SUMMARY:
+		s := m.Summary
+		if s == nil {
+			return nil
+		}
+		samples := make([]sample, 0, len(s.Quantile)+2)
+		for _, q := range s.Quantile {
+			samples = append(samples, sample{
+				name:   name,
+				value:  q.GetValue(),
+				labels: []*pb.Metric_Label{{Name: quantileLabel, Value: formatFloat(q.GetQuantile())}},
+			})
+		}
+		return append(samples,
+			sample{name: name + sumSuffix, value: s.GetSampleSum()},
+			sample{name: name + countSuffix, value: float64(s.GetSampleCount())},
+		)
+	}
+	return nil
+}
+
+// formatFloat formats bucket bounds and quantiles like Prometheus, e.g. 0.5 and +Inf.
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
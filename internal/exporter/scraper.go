@@ -1,9 +1,14 @@
 package exporter
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"time"
 
@@ -15,106 +20,240 @@ import (
 )
 
 const (
-	maxConcurrentScrapes = 15
+	defaultScrapeConcurrency = 15
+	defaultScrapeTimeout     = 10 * time.Second
+
+	// acceptHeader prefers the protobuf exposition as it's the cheapest to parse, followed by
+	// OpenMetrics and the text format, the same order Prometheus negotiates.
+	acceptHeader = expfmt.ProtoType + ";proto=" + expfmt.ProtoProtocol + ";encoding=delimited;q=0.6," +
+		expfmt.OpenMetricsType + ";version=" + expfmt.OpenMetricsVersion_1_0_0 + ";q=0.5," +
+		expfmt.OpenMetricsType + ";version=" + expfmt.OpenMetricsVersion_0_0_1 + ";q=0.4," +
+		"text/plain;version=" + expfmt.TextVersion + ";q=0.3," +
+		"*/*;q=0.2"
+	acceptEncodingHeader = "gzip"
 )
 
 type MetricFamilyMap map[string]*dto.MetricFamily
 
+// Target is a dcgm-exporter instance to scrape, together with the identity of the pod and node it runs on
+// when known.
+type Target struct {
+	URL       string
+	NodeName  string
+	Pod       string
+	Namespace string
+	// Labels are added to every measurement scraped from the target, replacing scraped labels of the same name.
+	Labels map[string]string
+}
+
+// ScrapeResult is the outcome of scraping a single target. Families is nil when Err is set.
+type ScrapeResult struct {
+	Target    Target
+	Timestamp time.Time
+	Duration  time.Duration
+	// Bytes is the size of the response body as received, before decompression.
+	Bytes    int64
+	Families MetricFamilyMap
+	Err      error
+}
+
 type Scraper interface {
-	Scrape(ctx context.Context, urls []string) ([]MetricFamilyMap, error)
+	// Scrape returns a result for every target, in the order of targets.
+	Scrape(ctx context.Context, targets []Target) []ScrapeResult
 }
 
 type HTTPClient interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
-type result struct {
-	metricFamilyMap MetricFamilyMap
-	err             error
-	ts              time.Time
+var errBodyTooLarge = errors.New("response body too large")
+
+type ScraperConfig struct {
+	// Concurrency is the number of targets scraped at the same time, 15 when not set.
+	Concurrency int
+	// Timeout of a single target, 10s when not set.
+	Timeout time.Duration
+	// MaxBodyBytes fails scrapes of responses larger than the limit after decompression, 0 disables the limit.
+	MaxBodyBytes int64
 }
 
 type scraper struct {
+	cfg        ScraperConfig
 	httpClient HTTPClient
-	parser     expfmt.TextParser
 	log        *logging.Logger
 }
 
-func NewScraper(httpClient HTTPClient, log *logging.Logger) Scraper {
+func NewScraper(cfg ScraperConfig, httpClient HTTPClient, log *logging.Logger) Scraper {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = defaultScrapeConcurrency
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultScrapeTimeout
+	}
+
 	return &scraper{
+		cfg:        cfg,
 		httpClient: httpClient,
 		log:        log,
 	}
 }
 
-func (s scraper) Scrape(ctx context.Context, urls []string) ([]MetricFamilyMap, error) {
+// Scrape stops scraping when ctx is done, the targets which weren't scraped by then get ctx's error as their
+// result while the results which already arrived are kept.
+func (s scraper) Scrape(ctx context.Context, targets []Target) []ScrapeResult {
 	var g errgroup.Group
-	g.SetLimit(maxConcurrentScrapes)
-
-	resultsChan := make(chan result, maxConcurrentScrapes)
+	g.SetLimit(s.cfg.Concurrency)
 
-	now := time.Now().UTC()
-
-	for i := range urls {
-		url := urls[i]
+	results := make([]ScrapeResult, len(targets))
+	for i := range targets {
+		results[i].Target = targets[i]
 		g.Go(func() error {
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			default:
-				metrics, err := s.scrapeURL(ctx, url)
-				if err != nil {
-					err = fmt.Errorf("error while fetching metrics from '%s' %w", url, err)
-				}
-				resultsChan <- result{metricFamilyMap: metrics, err: err, ts: now}
-			}
+			results[i] = s.scrapeTarget(ctx, targets[i])
 			return nil
 		})
 	}
+	_ = g.Wait()
 
-	go func() {
-		if err := g.Wait(); err != nil && !errors.Is(err, context.Canceled) {
-			s.log.Errorf("error while scraping metrics %v", err)
-		}
-		close(resultsChan)
-	}()
-
-	metrics := make([]MetricFamilyMap, 0, len(urls))
-	for result := range resultsChan {
-		if result.err != nil {
-			s.log.WithField("error", result.err.Error()).Error("failed to scrape metrics")
-			continue
-		}
-		metrics = append(metrics, result.metricFamilyMap)
+	return results
+}
+
+func (s scraper) scrapeTarget(ctx context.Context, target Target) ScrapeResult {
+	result := ScrapeResult{
+		Target:    target,
+		Timestamp: time.Now().UTC(),
+	}
+	if err := ctx.Err(); err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.Families, result.Bytes, result.Err = s.scrapeURL(ctx, target.URL)
+	result.Duration = time.Since(result.Timestamp)
+	if result.Err != nil {
+		result.Err = fmt.Errorf("error while fetching metrics from '%s' %w", target.URL, result.Err)
+		return result
 	}
 
-	return metrics, nil
+	s.log.With(
+		"target", target.URL,
+		"duration", result.Duration.String(),
+		"bytes", result.Bytes,
+	).Debug("scraped dcgm-exporter")
+
+	return result
 }
 
-func (s scraper) scrapeURL(ctx context.Context, url string) (map[string]*dto.MetricFamily, error) {
-	ctxWithTimeout, cancel := context.WithTimeout(ctx, time.Second*10)
+func (s scraper) scrapeURL(ctx context.Context, url string) (MetricFamilyMap, int64, error) {
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctxWithTimeout, "GET", url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("cannot create request %w", err)
+		return nil, 0, fmt.Errorf("cannot create request %w", err)
 	}
+	req.Header.Set("Accept", acceptHeader)
+	// setting Accept-Encoding disables the transparent decompression of the transport, the body is
+	// decompressed in parseMetrics instead
+	req.Header.Set("Accept-Encoding", acceptEncodingHeader)
 
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error while making http request %w", err)
+		return nil, 0, fmt.Errorf("error while making http request %w", err)
 	}
 
+	defer resp.Body.Close()
+
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("request failed with status code: %d", resp.StatusCode)
+		return nil, 0, fmt.Errorf("request failed with status code: %d", resp.StatusCode)
 	}
 
-	defer resp.Body.Close()
-
-	metrics, err := s.parser.TextToMetricFamilies(resp.Body)
+	body := &countingReader{r: resp.Body}
+	metrics, err := parseMetrics(resp.Header, body, s.cfg.MaxBodyBytes)
 	if err != nil {
-		return nil, fmt.Errorf("cannot parse metrics %w", err)
+		return nil, body.n, fmt.Errorf("cannot parse metrics %w", err)
+	}
+
+	return metrics, body.n, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// limitedReader fails with errBodyTooLarge once more than the limit is read, unlike io.LimitReader
+// which ends the stream silently and would let a truncated body be parsed.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
 	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
 
-	return metrics, nil
+// parseMetrics decodes a response body in the format given by its Content-Type, responses
+// without a known type are parsed as the text format.
+func parseMetrics(header http.Header, body io.Reader, maxBytes int64) (MetricFamilyMap, error) {
+	if header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decompress body %w", err)
+		}
+		defer reader.Close()
+		body = reader
+	}
+	if maxBytes > 0 {
+		body = &limitedReader{r: body, remaining: maxBytes}
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	switch {
+	case mediaType == expfmt.ProtoType && params["encoding"] == "delimited":
+		return parseProtoDelimited(body)
+	case mediaType == expfmt.OpenMetricsType:
+		var text bytes.Buffer
+		if err := openMetricsToText(body, &text); err != nil {
+			return nil, err
+		}
+		body = &text
+	}
+
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(body)
+}
+
+func parseProtoDelimited(body io.Reader) (MetricFamilyMap, error) {
+	// the decoder wraps the reader in a bufio.Reader on every call, which must be the same one to not
+	// lose buffered data between families
+	decoder := expfmt.NewDecoder(bufio.NewReader(body), expfmt.NewFormat(expfmt.TypeProtoDelim))
+
+	metrics := make(MetricFamilyMap)
+	for {
+		family := &dto.MetricFamily{}
+		if err := decoder.Decode(family); err != nil {
+			if errors.Is(err, io.EOF) {
+				return metrics, nil
+			}
+			return nil, err
+		}
+		metrics[family.GetName()] = family
+	}
 }
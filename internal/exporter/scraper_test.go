@@ -1,18 +1,28 @@
 package exporter_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/castai/gpu-metrics-exporter/internal/exporter"
 	mocks "github.com/castai/gpu-metrics-exporter/mock/exporter"
+	workload_mock "github.com/castai/gpu-metrics-exporter/mock/workload"
 	"github.com/castai/logging"
 )
 
@@ -22,14 +32,77 @@ var (
 	# TYPE DCGM_FI_DEV_GPU_TEMP gauge
 	DCGM_FI_DEV_GPU_TEMP{gpu="0",UUID="GPU-93461651-6be6-8fb7-a69a-c9eedc6984db",device="nvidia0",modelName="Tesla T4",Hostname="gke-gpu-default-pool",container="",namespace="",pod=""} 40
 	`
+
+	openMetricsString = `# HELP DCGM_FI_DEV_GPU_TEMP Current temperature readings for the device in degrees C.
+# TYPE DCGM_FI_DEV_GPU_TEMP gauge
+# UNIT DCGM_FI_DEV_GPU_TEMP celsius
+DCGM_FI_DEV_GPU_TEMP{gpu="0",UUID="GPU-1",device="nvidia0",modelName="Tesla T4",Hostname="node-1"} 40 1700000000.5
+# HELP DCGM_FI_PROF_PIPE_TENSOR_ACTIVE Ratio of cycles the tensor (HMMA) pipe is active.
+# TYPE DCGM_FI_PROF_PIPE_TENSOR_ACTIVE gauge
+DCGM_FI_PROF_PIPE_TENSOR_ACTIVE{gpu="0",UUID="GPU-1",modelName="label with } and \" # inside"} 0.25
+# HELP DCGM_FI_DEV_XID_ERRORS_COUNT Number of XID errors.
+# TYPE DCGM_FI_DEV_XID_ERRORS_COUNT counter
+DCGM_FI_DEV_XID_ERRORS_COUNT_total{gpu="0",UUID="GPU-1"} 3 # {trace_id="abc"} 1.0 1700000000.0
+DCGM_FI_DEV_XID_ERRORS_COUNT_created{gpu="0",UUID="GPU-1"} 1700000000.0
+# HELP DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION Total energy consumption since boot (in mJ).
+# TYPE DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION counter
+DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION_total{gpu="0",UUID="GPU-1"} 123456
+# EOF
+`
 )
 
+type httpClientFunc func(req *http.Request) (*http.Response, error)
+
+func (f httpClientFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func encodeMetrics(t testing.TB, text string, format expfmt.Format) []byte {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(strings.NewReader(text))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	encoder := expfmt.NewEncoder(&buf, format)
+	for _, family := range families {
+		require.NoError(t, encoder.Encode(family))
+	}
+	return buf.Bytes()
+}
+
+func gzipBytes(t testing.TB, data []byte) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err := writer.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return buf.Bytes()
+}
+
+func scrapeSingle(t *testing.T, log *logging.Logger, header http.Header, body []byte) (exporter.MetricFamilyMap, *http.Request) {
+	var request *http.Request
+	scraper := exporter.NewScraper(exporter.ScraperConfig{}, httpClientFunc(func(req *http.Request) (*http.Response, error) {
+		request = req
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     header,
+			Body:       io.NopCloser(bytes.NewReader(body)),
+		}, nil
+	}), log)
+
+	results := scraper.Scrape(context.Background(), []exporter.Target{{URL: "http://localhost:9400/metrics"}})
+	require.Len(t, results, 1)
+	require.NoError(t, results[0].Err)
+
+	return results[0].Families, request
+}
+
 func TestScraper_Scrape(t *testing.T) {
 	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
 
 	t.Run("scrapes metrics without error", func(t *testing.T) {
 		httpClient := mocks.NewMockHTTPClient(t)
-		scraper := exporter.NewScraper(httpClient, log)
+		scraper := exporter.NewScraper(exporter.ScraperConfig{}, httpClient, log)
 
 		response1 := &http.Response{
 			StatusCode: http.StatusOK,
@@ -58,26 +131,28 @@ func TestScraper_Scrape(t *testing.T) {
 			return req.URL.Host == "localhost:9420" && req.URL.Path == "/metrics"
 		})).Times(1).Return(response3, nil)
 
-		metricsFamily, err := scraper.Scrape(
+		results := scraper.Scrape(
 			context.Background(),
-			[]string{
-				"http://localhost:9400/metrics",
-				"http://localhost:9410/metrics",
-				"http://localhost:9420/metrics",
+			[]exporter.Target{
+				{URL: "http://localhost:9400/metrics", NodeName: "node-1"},
+				{URL: "http://localhost:9410/metrics", NodeName: "node-2"},
+				{URL: "http://localhost:9420/metrics", NodeName: "node-3"},
 			})
 
 		r := require.New(t)
-		r.NoError(err)
-		r.NotNil(metricsFamily)
-		r.Len(metricsFamily, 3)
-		r.NotEmpty(metricsFamily[0])
-		r.NotEmpty(metricsFamily[1])
-		r.NotEmpty(metricsFamily[2])
+		r.Len(results, 3)
+		for i, result := range results {
+			r.NoError(result.Err)
+			r.NotEmpty(result.Families)
+			r.Equal(fmt.Sprintf("node-%d", i+1), result.Target.NodeName)
+			r.False(result.Timestamp.IsZero())
+			r.Equal(int64(len(metricsString)), result.Bytes)
+		}
 	})
 
 	t.Run("partially scrapes metrics when some exporter returns non-200 code", func(t *testing.T) {
 		httpClient := mocks.NewMockHTTPClient(t)
-		scraper := exporter.NewScraper(httpClient, log)
+		scraper := exporter.NewScraper(exporter.ScraperConfig{}, httpClient, log)
 
 		response := &http.Response{
 			StatusCode: http.StatusOK,
@@ -106,25 +181,28 @@ func TestScraper_Scrape(t *testing.T) {
 			return req.URL.Host == "localhost:9420" && req.URL.Path == "/metrics"
 		})).Times(1).Return(response2, nil)
 
-		metricsFamily, err := scraper.Scrape(
+		results := scraper.Scrape(
 			context.Background(),
-			[]string{
-				"http://localhost:9400/metrics",
-				"http://localhost:9410/metrics",
-				"http://localhost:9420/metrics",
+			[]exporter.Target{
+				{URL: "http://localhost:9400/metrics", NodeName: "node-1"},
+				{URL: "http://localhost:9410/metrics", NodeName: "node-2"},
+				{URL: "http://localhost:9420/metrics", NodeName: "node-3"},
 			})
 
 		r := require.New(t)
-		r.NoError(err)
-		r.NotNil(metricsFamily)
-		r.Len(metricsFamily, 2)
-		r.NotEmpty(metricsFamily[0])
-		r.NotEmpty(metricsFamily[1])
+		r.Len(results, 3)
+		r.NoError(results[0].Err)
+		r.NotEmpty(results[0].Families)
+		r.Error(results[1].Err)
+		r.Nil(results[1].Families)
+		r.Equal("http://localhost:9410/metrics", results[1].Target.URL)
+		r.NoError(results[2].Err)
+		r.NotEmpty(results[2].Families)
 	})
 
 	t.Run("partially scrapes metrics when some exporter cannot be scraped", func(t *testing.T) {
 		httpClient := mocks.NewMockHTTPClient(t)
-		scraper := exporter.NewScraper(httpClient, log)
+		scraper := exporter.NewScraper(exporter.ScraperConfig{}, httpClient, log)
 
 		response := &http.Response{
 			StatusCode: http.StatusOK,
@@ -148,19 +226,310 @@ func TestScraper_Scrape(t *testing.T) {
 			return req.URL.Host == "localhost:9420" && req.URL.Path == "/metrics"
 		})).Times(1).Return(response1, nil)
 
-		metricsFamily, err := scraper.Scrape(
+		results := scraper.Scrape(
 			context.Background(),
-			[]string{
-				"http://localhost:9400/metrics",
-				"http://localhost:9410/metrics",
-				"http://localhost:9420/metrics",
+			[]exporter.Target{
+				{URL: "http://localhost:9400/metrics", NodeName: "node-1"},
+				{URL: "http://localhost:9410/metrics", NodeName: "node-2"},
+				{URL: "http://localhost:9420/metrics", NodeName: "node-3"},
 			})
 
 		r := require.New(t)
-		r.NoError(err)
-		r.NotNil(metricsFamily)
-		r.Len(metricsFamily, 2)
-		r.NotEmpty(metricsFamily[0])
-		r.NotEmpty(metricsFamily[1])
+		r.Len(results, 3)
+		r.NoError(results[0].Err)
+		r.NotEmpty(results[0].Families)
+		r.Error(results[1].Err)
+		r.Nil(results[1].Families)
+		r.Equal("http://localhost:9410/metrics", results[1].Target.URL)
+		r.NoError(results[2].Err)
+		r.NotEmpty(results[2].Families)
+	})
+
+	t.Run("negotiates the exposition format and compression", func(t *testing.T) {
+		r := require.New(t)
+
+		_, req := scrapeSingle(t, log, http.Header{}, []byte(metricsString))
+
+		accept := req.Header.Get("Accept")
+		r.True(strings.HasPrefix(accept, "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited"))
+		r.Contains(accept, "application/openmetrics-text;version=1.0.0")
+		r.Contains(accept, "text/plain;version=0.0.4")
+		r.Equal("gzip", req.Header.Get("Accept-Encoding"))
 	})
+
+	t.Run("parses delimited protobuf", func(t *testing.T) {
+		r := require.New(t)
+
+		body := encodeMetrics(t, metricsString+openMetricsTextEquivalent, expfmt.NewFormat(expfmt.TypeProtoDelim))
+		header := http.Header{"Content-Type": []string{string(expfmt.NewFormat(expfmt.TypeProtoDelim))}}
+
+		families, _ := scrapeSingle(t, log, header, body)
+
+		r.Len(families, 2)
+		r.Equal(40.0, families["DCGM_FI_DEV_GPU_TEMP"].Metric[0].GetGauge().GetValue())
+		r.Equal(dto.MetricType_COUNTER, families["DCGM_FI_DEV_XID_ERRORS_COUNT"].GetType())
+	})
+
+	t.Run("parses OpenMetrics", func(t *testing.T) {
+		r := require.New(t)
+
+		header := http.Header{"Content-Type": []string{"application/openmetrics-text; version=1.0.0; charset=utf-8"}}
+		families, _ := scrapeSingle(t, log, header, []byte(openMetricsString))
+
+		r.Len(families, 4)
+
+		temp := families["DCGM_FI_DEV_GPU_TEMP"]
+		r.Equal(dto.MetricType_GAUGE, temp.GetType())
+		r.Equal(40.0, temp.Metric[0].GetGauge().GetValue())
+		r.Equal(int64(1700000000500), temp.Metric[0].GetTimestampMs())
+
+		tensor := families["DCGM_FI_PROF_PIPE_TENSOR_ACTIVE"]
+		r.Equal(0.25, tensor.Metric[0].GetGauge().GetValue())
+
+		xid := families["DCGM_FI_DEV_XID_ERRORS_COUNT"]
+		r.Equal(dto.MetricType_COUNTER, xid.GetType())
+		r.Equal("Number of XID errors.", xid.GetHelp())
+		r.Len(xid.Metric, 1)
+		r.Equal(3.0, xid.Metric[0].GetCounter().GetValue())
+
+		// counters keep their declared name, so they're still mapped
+		energy := families[exporter.MetricTotalEnergyConsumption]
+		r.Equal(dto.MetricType_COUNTER, energy.GetType())
+		batch := exporter.NewMapper(exporter.MapperConfig{}, workload_mock.NewMockResolver(t), log).
+			Map([]exporter.ScrapeResult{{Families: families}})
+		var mapped []float64
+		for _, metric := range batch.Metrics {
+			if metric.Name == exporter.MetricTotalEnergyConsumption {
+				for _, m := range metric.Measurements {
+					mapped = append(mapped, m.Value)
+				}
+			}
+		}
+		r.Equal([]float64{123456}, mapped)
+	})
+
+	t.Run("parses OpenMetrics into the same families as the text format", func(t *testing.T) {
+		r := require.New(t)
+
+		text := dcgmOutput(2)
+		textFamilies, _ := scrapeSingle(t, log, http.Header{"Content-Type": []string{"text/plain; version=0.0.4"}}, []byte(text))
+		header := http.Header{"Content-Type": []string{"application/openmetrics-text; version=1.0.0; charset=utf-8"}}
+		openMetricsFamilies, _ := scrapeSingle(t, log, header, toOpenMetrics(t, text))
+
+		r.Len(openMetricsFamilies, len(textFamilies))
+		for name, family := range textFamilies {
+			r.Contains(openMetricsFamilies, name)
+			r.Equal(family.GetType(), openMetricsFamilies[name].GetType(), name)
+		}
+		r.Equal(dto.MetricType_COUNTER, openMetricsFamilies[exporter.MetricTotalEnergyConsumption].GetType())
+	})
+
+	t.Run("decompresses gzip responses", func(t *testing.T) {
+		r := require.New(t)
+
+		header := http.Header{
+			"Content-Type":     []string{"text/plain; version=0.0.4"},
+			"Content-Encoding": []string{"gzip"},
+		}
+		families, _ := scrapeSingle(t, log, header, gzipBytes(t, []byte(metricsString)))
+
+		r.Equal(40.0, families["DCGM_FI_DEV_GPU_TEMP"].Metric[0].GetGauge().GetValue())
+	})
+
+	t.Run("limits the number of concurrent scrapes", func(t *testing.T) {
+		r := require.New(t)
+
+		var inFlight, maxInFlight atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for {
+				current := maxInFlight.Load()
+				if n <= current || maxInFlight.CompareAndSwap(current, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			_, _ = w.Write([]byte(metricsString))
+		}))
+		defer srv.Close()
+
+		targets := make([]exporter.Target, 10)
+		for i := range targets {
+			targets[i] = exporter.Target{URL: srv.URL + "/metrics"}
+		}
+
+		scraper := exporter.NewScraper(exporter.ScraperConfig{Concurrency: 2}, srv.Client(), log)
+		for _, result := range scraper.Scrape(context.Background(), targets) {
+			r.NoError(result.Err)
+		}
+		r.LessOrEqual(maxInFlight.Load(), int32(2))
+	})
+
+	t.Run("times out slow targets", func(t *testing.T) {
+		r := require.New(t)
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/slow" {
+				<-req.Context().Done()
+				return
+			}
+			_, _ = w.Write([]byte(metricsString))
+		}))
+		defer srv.Close()
+
+		scraper := exporter.NewScraper(exporter.ScraperConfig{Timeout: 100 * time.Millisecond}, srv.Client(), log)
+		results := scraper.Scrape(context.Background(), []exporter.Target{
+			{URL: srv.URL + "/metrics"},
+			{URL: srv.URL + "/slow"},
+		})
+
+		r.NoError(results[0].Err)
+		r.ErrorIs(results[1].Err, context.DeadlineExceeded)
+	})
+
+	t.Run("keeps the results which arrived before the context is done", func(t *testing.T) {
+		r := require.New(t)
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/slow" {
+				<-req.Context().Done()
+				return
+			}
+			_, _ = w.Write([]byte(metricsString))
+		}))
+		defer srv.Close()
+
+		targets := []exporter.Target{{URL: srv.URL + "/slow"}, {URL: srv.URL + "/metrics"}, {URL: srv.URL + "/metrics"}}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+
+		// a single worker is stuck on the slow target, the remaining targets are skipped once the deadline passes
+		scraper := exporter.NewScraper(exporter.ScraperConfig{Concurrency: 1}, srv.Client(), log)
+		start := time.Now()
+		results := scraper.Scrape(ctx, targets)
+		r.Less(time.Since(start), 2*time.Second)
+		r.Len(results, 3)
+		for _, result := range results {
+			r.ErrorIs(result.Err, context.DeadlineExceeded)
+		}
+
+		ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+
+		scraper = exporter.NewScraper(exporter.ScraperConfig{Concurrency: 3}, srv.Client(), log)
+		results = scraper.Scrape(ctx, targets)
+		r.ErrorIs(results[0].Err, context.DeadlineExceeded)
+		r.NoError(results[1].Err)
+		r.NoError(results[2].Err)
+	})
+
+	t.Run("fails responses larger than the limit", func(t *testing.T) {
+		r := require.New(t)
+		body := []byte(metricsString)
+
+		scrape := func(maxBytes int64, header http.Header, body []byte) exporter.ScrapeResult {
+			scraper := exporter.NewScraper(exporter.ScraperConfig{MaxBodyBytes: maxBytes}, httpClientFunc(func(*http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     header,
+					Body:       io.NopCloser(bytes.NewReader(body)),
+				}, nil
+			}), log)
+			return scraper.Scrape(context.Background(), []exporter.Target{{URL: "http://localhost:9400/metrics"}})[0]
+		}
+
+		r.NoError(scrape(int64(len(body)), http.Header{}, body).Err)
+		r.ErrorContains(scrape(int64(len(body))-1, http.Header{}, body).Err, "too large")
+
+		// the limit applies to the decompressed body
+		gzipHeader := http.Header{"Content-Encoding": []string{"gzip"}}
+		compressed := gzipBytes(t, body)
+		r.Less(len(compressed), len(body))
+		r.ErrorContains(scrape(int64(len(body))-1, gzipHeader, compressed).Err, "too large")
+		r.NoError(scrape(int64(len(body)), gzipHeader, compressed).Err)
+	})
+}
+
+// openMetricsTextEquivalent is the XID counter of openMetricsString in the text format.
+const openMetricsTextEquivalent = `
+# HELP DCGM_FI_DEV_XID_ERRORS_COUNT Number of XID errors.
+# TYPE DCGM_FI_DEV_XID_ERRORS_COUNT counter
+DCGM_FI_DEV_XID_ERRORS_COUNT{gpu="0",UUID="GPU-1"} 3
+`
+
+// dcgmOutput generates an exposition of the given number of GPUs with all the fields the exporter reads, the
+// energy and XID fields are counters like in dcgm-exporter's default configuration.
+func dcgmOutput(gpus int) string {
+	var sb strings.Builder
+	for _, field := range exporter.GPUMetricFields {
+		metricType := "gauge"
+		if field.Name == exporter.MetricTotalEnergyConsumption || field.Name == exporter.MetricXIDErrors {
+			metricType = "counter"
+		}
+		fmt.Fprintf(&sb, "# HELP %s %s.\n# TYPE %s %s\n", field.Name, field.Name, field.Name, metricType)
+		for gpu := 0; gpu < gpus; gpu++ {
+			fmt.Fprintf(&sb, "%s{gpu=\"%d\",UUID=\"GPU-%08d-6be6-8fb7-a69a-c9eedc6984db\",device=\"nvidia%d\",modelName=\"NVIDIA H100 80GB HBM3\",Hostname=\"node-1\",container=\"trainer\",namespace=\"ml\",pod=\"trainer-%d\"} %d\n",
+				field.Name, gpu, gpu, gpu, gpu, gpu*7)
+		}
+	}
+	return sb.String()
+}
+
+// toOpenMetrics converts a text exposition to OpenMetrics, counter samples get the _total suffix.
+func toOpenMetrics(t testing.TB, text string) []byte {
+	var openMetrics bytes.Buffer
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(strings.NewReader(text))
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetType() == dto.MetricType_COUNTER {
+			// expfmt only writes counters whose names end with _total, the suffix is stripped from the family
+			family.Name = proto.String(family.GetName() + "_total")
+		}
+		_, err := expfmt.MetricFamilyToOpenMetrics(&openMetrics, family)
+		require.NoError(t, err)
+	}
+	_, err = expfmt.FinalizeOpenMetrics(&openMetrics)
+	require.NoError(t, err)
+	return openMetrics.Bytes()
+}
+
+func BenchmarkScraper_Scrape(b *testing.B) {
+	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
+	text := dcgmOutput(64)
+
+	protoFormat := expfmt.NewFormat(expfmt.TypeProtoDelim)
+	formats := []struct {
+		name        string
+		contentType string
+		body        []byte
+	}{
+		{"text", "text/plain; version=0.0.4; charset=utf-8", []byte(text)},
+		{"openmetrics", "application/openmetrics-text; version=1.0.0; charset=utf-8", toOpenMetrics(b, text)},
+		{"protobuf", string(protoFormat), encodeMetrics(b, text, protoFormat)},
+	}
+
+	for _, format := range formats {
+		b.Run(format.name, func(b *testing.B) {
+			scraper := exporter.NewScraper(exporter.ScraperConfig{}, httpClientFunc(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Type": []string{format.contentType}},
+					Body:       io.NopCloser(bytes.NewReader(format.body)),
+				}, nil
+			}), log)
+
+			b.SetBytes(int64(len(format.body)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				results := scraper.Scrape(context.Background(), []exporter.Target{{URL: "http://localhost:9400/metrics"}})
+				if results[0].Err != nil {
+					b.Fatalf("scrape failed: %v", results[0].Err)
+				}
+			}
+		})
+	}
 }
@@ -20,6 +20,8 @@ const (
 	MetricGPUTemperature                      = MetricName("DCGM_FI_DEV_GPU_TEMP")
 	MetricMemoryTemperature                   = MetricName("DCGM_FI_DEV_MEMORY_TEMP")
 	MetricPowerUsage                          = MetricName("DCGM_FI_DEV_POWER_USAGE")
+	MetricPowerLimit                          = MetricName("DCGM_FI_DEV_POWER_MGMT_LIMIT")
+	MetricTotalEnergyConsumption              = MetricName("DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION")
 	MetricGPUUtilization                      = MetricName("DCGM_FI_DEV_GPU_UTIL")
 	MetricIntPipeActive                       = MetricName("DCGM_FI_PROF_PIPE_INT_ACTIVE")
 	MetricFloat16PipeActive                   = MetricName("DCGM_FI_PROF_PIPE_FP16_ACTIVE")
@@ -50,6 +52,8 @@ var (
 		MetricGPUTemperature:                      {},
 		MetricMemoryTemperature:                   {},
 		MetricPowerUsage:                          {},
+		MetricPowerLimit:                          {},
+		MetricTotalEnergyConsumption:              {},
 		MetricGPUUtilization:                      {},
 		MetricIntPipeActive:                       {},
 		MetricFloat16PipeActive:                   {},
@@ -0,0 +1,244 @@
+package exporter
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/castai/gpu-metrics-exporter/pb"
+)
+
+// MetricXIDErrorCount is the number of times a GPU reported an XID error since the exporter started, per XID code.
+const MetricXIDErrorCount = MetricName("gpu_xid_errors")
+
+const (
+	xidLabel         = "xid"
+	xidSeverityLabel = "severity"
+)
+
+// XIDSeverity tells who has to act on an XID error.
+type XIDSeverity string
+
+const (
+	// XIDSeverityApplication errors are caused by the application running on the GPU, e.g. an illegal memory access.
+	XIDSeverityApplication = XIDSeverity("application")
+	// XIDSeverityHardware errors point at a failing GPU, which usually needs a reset or to be replaced.
+	XIDSeverityHardware = XIDSeverity("hardware")
+	// XIDSeverityDriver errors are raised by the driver or the GPU firmware.
+	XIDSeverityDriver = XIDSeverity("driver")
+	// XIDSeverityUnknown is the severity of codes missing from the table.
+	XIDSeverityUnknown = XIDSeverity("unknown")
+)
+
+type xidCode struct {
+	severity    XIDSeverity
+	description string
+}
+
+// xidCodes classifies the common XID codes, see https://docs.nvidia.com/deploy/xid-errors/.
+var xidCodes = map[int]xidCode{
+	13:  {XIDSeverityApplication, "graphics engine exception"},
+	31:  {XIDSeverityApplication, "GPU memory page fault"},
+	43:  {XIDSeverityApplication, "GPU stopped processing"},
+	45:  {XIDSeverityApplication, "preemptive cleanup, due to previous errors"},
+	68:  {XIDSeverityApplication, "video processor exception"},
+	32:  {XIDSeverityDriver, "invalid or corrupted push buffer stream"},
+	61:  {XIDSeverityDriver, "internal micro-controller breakpoint or warning"},
+	62:  {XIDSeverityDriver, "internal micro-controller halt"},
+	69:  {XIDSeverityDriver, "graphics engine class error"},
+	119: {XIDSeverityDriver, "GSP RPC timeout"},
+	120: {XIDSeverityDriver, "GSP error"},
+	48:  {XIDSeverityHardware, "double bit ECC error"},
+	63:  {XIDSeverityHardware, "ECC page retirement or row remapping recording event"},
+	64:  {XIDSeverityHardware, "ECC page retirement or row remapper recording failure"},
+	74:  {XIDSeverityHardware, "NVLink error"},
+	79:  {XIDSeverityHardware, "GPU has fallen off the bus"},
+	92:  {XIDSeverityHardware, "high single-bit ECC error rate"},
+	94:  {XIDSeverityHardware, "contained ECC error"},
+	95:  {XIDSeverityHardware, "uncontained ECC error"},
+}
+
+// ClassifyXID returns the severity and a description of an XID code.
+func ClassifyXID(code int) (XIDSeverity, string) {
+	if c, found := xidCodes[code]; found {
+		return c.severity, c.description
+	}
+	return XIDSeverityUnknown, "unknown XID error"
+}
+
+// XIDError is an XID error which a GPU reported since the previous scrape.
+type XIDError struct {
+	NodeName    string
+	DeviceUUID  string
+	DeviceID    string
+	ModelName   string
+	Code        int
+	Severity    XIDSeverity
+	Description string
+	// Pods the GPU is assigned to.
+	Pods []PodRef
+}
+
+type PodRef struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// XIDRecorder publishes XID errors, e.g. as Kubernetes Events.
+type XIDRecorder interface {
+	RecordXID(ctx context.Context, xid XIDError)
+}
+
+type xidSeries struct {
+	labels []*pb.Metric_Label
+	last   int
+	counts map[int]int
+	// at is when the GPU was last scraped.
+	at time.Time
+}
+
+// xidTracker follows DCGM_FI_DEV_XID_ERRORS, the last XID error of a GPU, and counts the changes of its value
+// as errors. The first value seen for a GPU is the baseline, it may have been raised long before the exporter
+// started. GPUs which haven't been scraped for seriesRetention are forgotten.
+type xidTracker struct {
+	series map[gpuSeriesKey]*xidSeries
+}
+
+func newXIDTracker() *xidTracker {
+	return &xidTracker{series: make(map[gpuSeriesKey]*xidSeries)}
+}
+
+// update returns the XID errors raised since the previous batch along with the gpu_xid_errors metric of the GPUs in
+// the batch, nil when none of them reported an error yet.
+func (x *xidTracker) update(batch *pb.MetricsBatch, results []ScrapeResult) ([]XIDError, *pb.Metric) {
+	scrapedAt, latest := scrapeTimes(results)
+
+	var xids []XIDError
+	var keys []gpuSeriesKey
+	raised := make(map[gpuSeriesKey]int)
+	seen := make(map[gpuSeriesKey]struct{})
+	for _, metric := range batch.Metrics {
+		if metric.Name != MetricXIDErrors {
+			continue
+		}
+		for _, measurement := range metric.Measurements {
+			key := gpuSeriesKey{
+				node:          labelValue(measurement.Labels, nodeNameLabel),
+				uuid:          labelValue(measurement.Labels, gpuUUIDLabel),
+				migProfile:    labelValue(measurement.Labels, gpuMIGProfile),
+				migInstanceID: labelValue(measurement.Labels, gpuInstanceID),
+			}
+			if key.uuid == "" {
+				continue
+			}
+
+			// measurements of pods sharing a GPU repeat its XID, the pods are added to its error
+			if _, found := seen[key]; found {
+				if i, found := raised[key]; found {
+					xids[i].Pods = appendPod(xids[i].Pods, measurement.Labels)
+				}
+				continue
+			}
+			seen[key] = struct{}{}
+			keys = append(keys, key)
+
+			at, found := scrapedAt[key.node]
+			if !found {
+				at = latest
+			}
+
+			code := xidValue(measurement.Value)
+			series, found := x.series[key]
+			if !found {
+				x.series[key] = &xidSeries{labels: gpuLabels(measurement.Labels), last: code, counts: make(map[int]int), at: at}
+				continue
+			}
+			series.at = at
+			if code == series.last {
+				continue
+			}
+			series.last = code
+			if code == 0 {
+				continue
+			}
+
+			series.counts[code]++
+			severity, description := ClassifyXID(code)
+			raised[key] = len(xids)
+			xids = append(xids, XIDError{
+				NodeName:    key.node,
+				DeviceUUID:  key.uuid,
+				DeviceID:    labelValue(measurement.Labels, gpuIDLabel),
+				ModelName:   labelValue(measurement.Labels, modelNameLabel),
+				Code:        code,
+				Severity:    severity,
+				Description: description,
+				Pods:        appendPod(nil, measurement.Labels),
+			})
+		}
+	}
+
+	for key, series := range x.series {
+		if latest.Sub(series.at) > seriesRetention {
+			delete(x.series, key)
+		}
+	}
+
+	return xids, x.metric(keys)
+}
+
+// forget drops the GPUs of the node, e.g. when another replica took over the node.
+func (x *xidTracker) forget(node string) {
+	for key := range x.series {
+		if key.node == node {
+			delete(x.series, key)
+		}
+	}
+}
+
+// metric returns the gpu_xid_errors metric of the GPUs with errors among keys.
+func (x *xidTracker) metric(keys []gpuSeriesKey) *pb.Metric {
+	sort.Slice(keys, func(a, b int) bool { return keys[a].less(keys[b]) })
+
+	var metric *pb.Metric
+	for _, key := range keys {
+		series, found := x.series[key]
+		if !found || len(series.counts) == 0 {
+			continue
+		}
+		if metric == nil {
+			metric = &pb.Metric{Name: MetricXIDErrorCount}
+		}
+		codes := make([]int, 0, len(series.counts))
+		for code := range series.counts {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			severity, _ := ClassifyXID(code)
+			labels := withLabel(series.labels, xidLabel, strconv.Itoa(code))
+			metric.Measurements = append(metric.Measurements, &pb.Metric_Measurement{
+				Value:  float64(series.counts[code]),
+				Labels: append(labels, &pb.Metric_Label{Name: xidSeverityLabel, Value: string(severity)}),
+			})
+		}
+	}
+	return metric
+}
+
+func xidValue(value float64) int {
+	if math.IsNaN(value) || value < 0 || value > math.MaxInt32 {
+		return 0
+	}
+	return int(value)
+}
+
+func appendPod(pods []PodRef, labels []*pb.Metric_Label) []PodRef {
+	pod := PodRef{Namespace: labelValue(labels, namespaceLabel), Name: labelValue(labels, podLabel)}
+	if pod.Name == "" {
+		return pods
+	}
+	return append(pods, pod)
+}
@@ -0,0 +1,184 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/castai/gpu-metrics-exporter/pb"
+)
+
+type xidSample struct {
+	node string
+	uuid string
+	pod  string
+	code float64
+}
+
+type xidStep struct {
+	at      time.Duration
+	samples []xidSample
+	// raised are the codes of the XID errors returned, in order.
+	raised []int
+	// counts are keyed by node/uuid/xid/severity.
+	counts map[string]float64
+}
+
+func TestXIDTracker_Update(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		steps []xidStep
+	}{
+		{
+			name: "counts changes of the last XID after the baseline",
+			steps: []xidStep{
+				// XIDs raised before the exporter started are the baseline
+				{samples: []xidSample{{"node-a", "GPU-1", "", 0}, {"node-a", "GPU-2", "", 31}}},
+				{
+					at:      time.Minute,
+					samples: []xidSample{{"node-a", "GPU-1", "", 79}, {"node-a", "GPU-2", "", 31}},
+					raised:  []int{79},
+					counts:  map[string]float64{"node-a/GPU-1/79/hardware": 1},
+				},
+				{
+					at:      2 * time.Minute,
+					samples: []xidSample{{"node-a", "GPU-1", "", 79}, {"node-a", "GPU-2", "", 13}},
+					raised:  []int{13},
+					counts:  map[string]float64{"node-a/GPU-1/79/hardware": 1, "node-a/GPU-2/13/application": 1},
+				},
+				{
+					at:      3 * time.Minute,
+					samples: []xidSample{{"node-a", "GPU-1", "", 0}, {"node-a", "GPU-2", "", 31}},
+					raised:  []int{31},
+					counts: map[string]float64{
+						"node-a/GPU-1/79/hardware": 1, "node-a/GPU-2/13/application": 1, "node-a/GPU-2/31/application": 1,
+					},
+				},
+				{
+					at:      4 * time.Minute,
+					samples: []xidSample{{"node-a", "GPU-1", "", 79}, {"node-a", "GPU-2", "", 31}},
+					raised:  []int{79},
+					counts: map[string]float64{
+						"node-a/GPU-1/79/hardware": 2, "node-a/GPU-2/13/application": 1, "node-a/GPU-2/31/application": 1,
+					},
+				},
+			},
+		},
+		{
+			name: "only reports the GPUs of the batch",
+			steps: []xidStep{
+				{samples: []xidSample{{"node-a", "GPU-1", "", 0}, {"node-b", "GPU-2", "", 0}}},
+				{
+					at:      time.Minute,
+					samples: []xidSample{{"node-a", "GPU-1", "", 48}, {"node-b", "GPU-2", "", 79}},
+					raised:  []int{48, 79},
+					counts:  map[string]float64{"node-a/GPU-1/48/hardware": 1, "node-b/GPU-2/79/hardware": 1},
+				},
+				// node-b couldn't be scraped
+				{
+					at:      2 * time.Minute,
+					samples: []xidSample{{"node-a", "GPU-1", "", 48}},
+					counts:  map[string]float64{"node-a/GPU-1/48/hardware": 1},
+				},
+				{
+					at:      3 * time.Minute,
+					samples: []xidSample{{"node-a", "GPU-1", "", 48}, {"node-b", "GPU-2", "", 79}},
+					counts:  map[string]float64{"node-a/GPU-1/48/hardware": 1, "node-b/GPU-2/79/hardware": 1},
+				},
+			},
+		},
+		{
+			name: "forgets GPUs which haven't been scraped for the retention",
+			steps: []xidStep{
+				{samples: []xidSample{{"node-a", "GPU-1", "", 0}, {"node-b", "GPU-2", "", 0}}},
+				{
+					at:      time.Minute,
+					samples: []xidSample{{"node-a", "GPU-1", "", 0}, {"node-b", "GPU-2", "", 79}},
+					raised:  []int{79},
+					counts:  map[string]float64{"node-b/GPU-2/79/hardware": 1},
+				},
+				{at: time.Minute + seriesRetention, samples: []xidSample{{"node-a", "GPU-1", "", 0}}},
+				// the XID of the GPU is its baseline again
+				{at: 2*time.Minute + seriesRetention, samples: []xidSample{{"node-a", "GPU-1", "", 0}}},
+				{at: 3*time.Minute + seriesRetention, samples: []xidSample{{"node-a", "GPU-1", "", 0}, {"node-b", "GPU-2", "", 79}}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := require.New(t)
+			tracker := newXIDTracker()
+
+			for i, step := range tt.steps {
+				batch, results := xidBatch(start.Add(step.at), step.samples)
+				xids, metric := tracker.update(batch, results)
+
+				var raised []int
+				for _, xid := range xids {
+					raised = append(raised, xid.Code)
+				}
+				r.Equal(step.raised, raised, "step %d", i)
+				r.Equal(step.counts, xidCounts(metric), "step %d", i)
+			}
+		})
+	}
+
+	t.Run("describes the errors", func(t *testing.T) {
+		r := require.New(t)
+		tracker := newXIDTracker()
+
+		tracker.update(xidBatch(start, []xidSample{{"node-a", "GPU-1", "trainer-0", 0}, {"node-a", "GPU-1", "trainer-1", 0}}))
+		xids, _ := tracker.update(xidBatch(start.Add(time.Minute), []xidSample{
+			{"node-a", "GPU-1", "trainer-0", 79}, {"node-a", "GPU-1", "trainer-1", 79},
+		}))
+		r.Equal([]XIDError{{
+			NodeName:    "node-a",
+			DeviceUUID:  "GPU-1",
+			DeviceID:    "0",
+			ModelName:   "A100",
+			Code:        79,
+			Severity:    XIDSeverityHardware,
+			Description: "GPU has fallen off the bus",
+			Pods:        []PodRef{{Namespace: "ml", Name: "trainer-0"}, {Namespace: "ml", Name: "trainer-1"}},
+		}}, xids)
+	})
+}
+
+func xidBatch(at time.Time, samples []xidSample) (*pb.MetricsBatch, []ScrapeResult) {
+	metric := &pb.Metric{Name: MetricXIDErrors}
+	scraped := make(map[string]struct{})
+	var results []ScrapeResult
+	for _, sample := range samples {
+		labels := []*pb.Metric_Label{
+			{Name: nodeNameLabel, Value: sample.node},
+			{Name: gpuUUIDLabel, Value: sample.uuid},
+			{Name: gpuIDLabel, Value: "0"},
+			{Name: modelNameLabel, Value: "A100"},
+		}
+		if sample.pod != "" {
+			labels = append(labels, &pb.Metric_Label{Name: namespaceLabel, Value: "ml"}, &pb.Metric_Label{Name: podLabel, Value: sample.pod})
+		}
+		metric.Measurements = append(metric.Measurements, &pb.Metric_Measurement{Value: sample.code, Labels: labels})
+
+		if _, found := scraped[sample.node]; !found {
+			scraped[sample.node] = struct{}{}
+			results = append(results, ScrapeResult{Target: Target{NodeName: sample.node}, Timestamp: at})
+		}
+	}
+	return &pb.MetricsBatch{Metrics: []*pb.Metric{metric}}, results
+}
+
+func xidCounts(metric *pb.Metric) map[string]float64 {
+	if metric == nil {
+		return nil
+	}
+	counts := make(map[string]float64)
+	for _, m := range metric.Measurements {
+		counts[labelValue(m.Labels, nodeNameLabel)+"/"+labelValue(m.Labels, gpuUUIDLabel)+"/"+
+			labelValue(m.Labels, xidLabel)+"/"+labelValue(m.Labels, xidSeverityLabel)] = m.Value
+	}
+	return counts
+}
@@ -0,0 +1,77 @@
+package ha
+
+import (
+	"context"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/logging"
+)
+
+type LeaderElectionConfig struct {
+	Namespace     string
+	LeaseName     string
+	Identity      string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// RunLeaderElection keeps the exporter enabled while this replica holds the lease and disabled otherwise, so
+// that only one of several replicas exports. It campaigns again whenever the lease is lost and returns once the
+// context is done, releasing the lease.
+func RunLeaderElection(
+	ctx context.Context,
+	client kubernetes.Interface,
+	cfg LeaderElectionConfig,
+	ex exporter.Exporter,
+	log *logging.Logger,
+) error {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Namespace: cfg.Namespace,
+			Name:      cfg.LeaseName,
+		},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: cfg.Identity},
+	}
+
+	log = log.With("lease", cfg.Namespace+"/"+cfg.LeaseName, "identity", cfg.Identity)
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   cfg.LeaseDuration,
+		RenewDeadline:   cfg.RenewDeadline,
+		RetryPeriod:     cfg.RetryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				log.Info("became the leader, exporting metrics")
+				ex.Enable()
+			},
+			OnStoppedLeading: func() {
+				log.Info("lost the leadership, no longer exporting metrics")
+				ex.Disable()
+			},
+			OnNewLeader: func(identity string) {
+				if identity != cfg.Identity {
+					log.Infof("%s is the leader", identity)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		elector.Run(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package ha_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/castai/gpu-metrics-exporter/internal/ha"
+	mocks "github.com/castai/gpu-metrics-exporter/mock/exporter"
+	"github.com/castai/logging"
+)
+
+func TestRunLeaderElection(t *testing.T) {
+	r := require.New(t)
+	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
+	client := fake.NewSimpleClientset()
+
+	config := func(identity string) ha.LeaderElectionConfig {
+		return ha.LeaderElectionConfig{
+			Namespace:     "castai-agent",
+			LeaseName:     "gpu-metrics-exporter",
+			Identity:      identity,
+			LeaseDuration: time.Second,
+			RenewDeadline: 500 * time.Millisecond,
+			RetryPeriod:   100 * time.Millisecond,
+		}
+	}
+
+	// replica keeps track of whether its exporter is enabled
+	type replica struct {
+		enabled atomic.Bool
+		cancel  context.CancelFunc
+		done    chan error
+	}
+	start := func(identity string) *replica {
+		rep := &replica{done: make(chan error, 1)}
+		ex := mocks.NewMockExporter(t)
+		ex.EXPECT().Enable().Run(func() { rep.enabled.Store(true) }).Maybe()
+		ex.EXPECT().Disable().Run(func() { rep.enabled.Store(false) }).Maybe()
+
+		var ctx context.Context
+		ctx, rep.cancel = context.WithCancel(context.Background())
+		go func() { rep.done <- ha.RunLeaderElection(ctx, client, config(identity), ex, log) }()
+		return rep
+	}
+
+	a := start("replica-a")
+	r.Eventually(a.enabled.Load, 5*time.Second, 10*time.Millisecond)
+
+	b := start("replica-b")
+	r.Never(b.enabled.Load, 500*time.Millisecond, 10*time.Millisecond)
+
+	// the lease is released on shutdown and the standby takes over
+	a.cancel()
+	r.True(errors.Is(<-a.done, context.Canceled))
+	r.False(a.enabled.Load())
+	r.Eventually(b.enabled.Load, 5*time.Second, 10*time.Millisecond)
+
+	b.cancel()
+	r.True(errors.Is(<-b.done, context.Canceled))
+}
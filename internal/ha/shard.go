@@ -0,0 +1,213 @@
+package ha
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/logging"
+)
+
+// shardGroupLabel marks the leases of the replicas splitting the targets between them.
+const shardGroupLabel = "gpu-metrics-exporter.cast.ai/shard-group"
+
+type ShardingConfig struct {
+	Namespace string
+	// Group identifies the replicas splitting the targets, each of them holds a lease labeled with it.
+	Group    string
+	Identity string
+	// Replicas which didn't renew their lease within LeaseDuration are considered gone.
+	LeaseDuration time.Duration
+	RenewInterval time.Duration
+}
+
+// Sharder splits the targets between the replicas of a group by node name with rendezvous hashing, so that only
+// the nodes of a replica which joins or leaves move to another replica. Replicas announce themselves by renewing
+// their own lease.
+type Sharder struct {
+	cfg    ShardingConfig
+	client kubernetes.Interface
+	log    *logging.Logger
+
+	mu      sync.RWMutex
+	members []string
+}
+
+func NewSharder(cfg ShardingConfig, client kubernetes.Interface, log *logging.Logger) *Sharder {
+	return &Sharder{
+		cfg:     cfg,
+		client:  client,
+		log:     log.With("shard_group", cfg.Group, "identity", cfg.Identity),
+		members: []string{cfg.Identity},
+	}
+}
+
+// Run renews the lease of this replica and refreshes the members of the group until the context is done, the
+// lease is then deleted so that the other replicas take over right away.
+func (s *Sharder) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.cfg.RenewInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.renew(ctx); err != nil {
+			s.log.WithField("error", err.Error()).Warn("failed to renew shard lease")
+		}
+		if err := s.refresh(ctx); err != nil {
+			s.log.WithField("error", err.Error()).Warn("failed to list replicas of the shard group")
+		}
+
+		select {
+		case <-ctx.Done():
+			s.release()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Owns tells whether the target belongs to this replica's shard. Targets without a node name are sharded by URL.
+func (s *Sharder) Owns(target exporter.Target) bool {
+	key := target.NodeName
+	if key == "" {
+		key = target.URL
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return owner(s.members, key) == s.cfg.Identity
+}
+
+func (s *Sharder) leaseName() string {
+	return s.cfg.Group + "-" + s.cfg.Identity
+}
+
+func (s *Sharder) renew(ctx context.Context) error {
+	leases := s.client.CoordinationV1().Leases(s.cfg.Namespace)
+	now := metav1.NewMicroTime(time.Now())
+	duration := int32(s.cfg.LeaseDuration.Seconds())
+
+	lease, err := leases.Get(ctx, s.leaseName(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      s.leaseName(),
+				Namespace: s.cfg.Namespace,
+				Labels:    map[string]string{shardGroupLabel: s.cfg.Group},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &s.cfg.Identity,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	lease.Spec.HolderIdentity = &s.cfg.Identity
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+func (s *Sharder) refresh(ctx context.Context) error {
+	list, err := s.client.CoordinationV1().Leases(s.cfg.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", shardGroupLabel, s.cfg.Group),
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	// this replica always owns a shard, even before its lease is visible to the others
+	members := []string{s.cfg.Identity}
+	for i := range list.Items {
+		lease := &list.Items[i]
+		spec := lease.Spec
+		if spec.HolderIdentity == nil || *spec.HolderIdentity == s.cfg.Identity || spec.RenewTime == nil {
+			continue
+		}
+		duration := s.cfg.LeaseDuration
+		if spec.LeaseDurationSeconds != nil {
+			duration = time.Duration(*spec.LeaseDurationSeconds) * time.Second
+		}
+		if spec.RenewTime.Add(duration).Before(now) {
+			s.deleteExpired(ctx, lease)
+			continue
+		}
+		members = append(members, *spec.HolderIdentity)
+	}
+	sort.Strings(members)
+
+	s.mu.Lock()
+	changed := !slices.Equal(s.members, members)
+	s.members = members
+	s.mu.Unlock()
+
+	if changed {
+		s.log.With("replicas", members).Info("shard group changed, rebalancing targets")
+	}
+	return nil
+}
+
+// deleteExpired deletes the lease of a replica which went away without releasing it, e.g. because it was killed,
+// unless the replica renewed it in the meantime.
+func (s *Sharder) deleteExpired(ctx context.Context, lease *coordinationv1.Lease) {
+	err := s.client.CoordinationV1().Leases(s.cfg.Namespace).Delete(ctx, lease.Name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &lease.UID, ResourceVersion: &lease.ResourceVersion},
+	})
+	if err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+		s.log.With("lease", lease.Name).WithField("error", err.Error()).Warn("failed to delete expired shard lease")
+	}
+}
+
+func (s *Sharder) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := s.client.CoordinationV1().Leases(s.cfg.Namespace).Delete(ctx, s.leaseName(), metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		s.log.WithField("error", err.Error()).Warn("failed to release shard lease")
+	}
+}
+
+// owner picks the member with the highest hash of member and key.
+func owner(members []string, key string) string {
+	var best string
+	var bestScore uint64
+	for _, member := range members {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(member))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(key))
+		score := mix(h.Sum64())
+		if best == "" || score > bestScore {
+			best, bestScore = member, score
+		}
+	}
+	return best
+}
+
+// mix is the splitmix64 finalizer, FNV alone spreads keys which differ only in their last bytes poorly.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,168 @@
+package ha_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/gpu-metrics-exporter/internal/ha"
+	"github.com/castai/logging"
+)
+
+func TestSharder(t *testing.T) {
+	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
+
+	targets := make([]exporter.Target, 300)
+	for i := range targets {
+		targets[i] = exporter.Target{URL: fmt.Sprintf("http://10.0.%d.%d:9400/metrics", i/256, i%256), NodeName: fmt.Sprintf("gpu-node-%d", i)}
+	}
+
+	config := func(identity string) ha.ShardingConfig {
+		return ha.ShardingConfig{
+			Namespace:     "castai-agent",
+			Group:         "gpu-metrics-exporter",
+			Identity:      identity,
+			LeaseDuration: 15 * time.Second,
+			RenewInterval: 50 * time.Millisecond,
+		}
+	}
+
+	// owners returns the identity of the sharder owning every target, failing when it isn't exactly one
+	owners := func(r *require.Assertions, sharders map[string]*ha.Sharder) map[string]string {
+		owned := make(map[string]string, len(targets))
+		for _, target := range targets {
+			for identity, sharder := range sharders {
+				if sharder.Owns(target) {
+					r.NotContains(owned, target.NodeName, "target owned by several replicas")
+					owned[target.NodeName] = identity
+				}
+			}
+			r.Contains(owned, target.NodeName, "target not owned by any replica")
+		}
+		return owned
+	}
+
+	t.Run("a single replica owns every target", func(t *testing.T) {
+		r := require.New(t)
+
+		sharder := ha.NewSharder(config("replica-a"), fake.NewSimpleClientset(), log)
+		for _, target := range targets {
+			r.True(sharder.Owns(target))
+		}
+	})
+
+	t.Run("deletes the expired leases of the group", func(t *testing.T) {
+		r := require.New(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		expired := metav1.NewMicroTime(time.Now().Add(-time.Minute))
+		duration := int32(15)
+		lease := func(name, group string) *coordinationv1.Lease {
+			return &coordinationv1.Lease{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: "castai-agent",
+					Labels:    map[string]string{"gpu-metrics-exporter.cast.ai/shard-group": group},
+				},
+				Spec: coordinationv1.LeaseSpec{HolderIdentity: &name, LeaseDurationSeconds: &duration, RenewTime: &expired},
+			}
+		}
+		client := fake.NewSimpleClientset(
+			lease("gpu-metrics-exporter-killed", "gpu-metrics-exporter"),
+			lease("other-killed", "other"),
+		)
+
+		errs := make(chan error, 1)
+		go func() { errs <- ha.NewSharder(config("replica-a"), client, log).Run(ctx) }()
+
+		r.Eventually(func() bool {
+			_, err := client.CoordinationV1().Leases("castai-agent").Get(ctx, "gpu-metrics-exporter-killed", metav1.GetOptions{})
+			return apierrors.IsNotFound(err)
+		}, 5*time.Second, 20*time.Millisecond)
+		_, err := client.CoordinationV1().Leases("castai-agent").Get(ctx, "other-killed", metav1.GetOptions{})
+		r.NoError(err)
+
+		cancel()
+		<-errs
+	})
+
+	t.Run("replicas split the targets and rebalance when they join or leave", func(t *testing.T) {
+		r := require.New(t)
+		client := fake.NewSimpleClientset()
+
+		sharders := make(map[string]*ha.Sharder)
+		cancels := make(map[string]context.CancelFunc)
+		done := make(map[string]chan error)
+		start := func(identity string) {
+			ctx, cancel := context.WithCancel(context.Background())
+			sharder := ha.NewSharder(config(identity), client, log)
+			errs := make(chan error, 1)
+			sharders[identity], cancels[identity], done[identity] = sharder, cancel, errs
+			go func() { errs <- sharder.Run(ctx) }()
+		}
+		stop := func(identity string) {
+			cancels[identity]()
+			<-done[identity]
+			delete(sharders, identity)
+		}
+		defer func() {
+			for identity := range sharders {
+				stop(identity)
+			}
+		}()
+
+		start("replica-a")
+		start("replica-b")
+		start("replica-c")
+
+		r.Eventually(func() bool {
+			owned := make(map[string]int)
+			for _, target := range targets {
+				for identity, sharder := range sharders {
+					if sharder.Owns(target) {
+						owned[identity]++
+					}
+				}
+			}
+			return owned["replica-a"]+owned["replica-b"]+owned["replica-c"] == len(targets) && len(owned) == 3
+		}, 5*time.Second, 20*time.Millisecond)
+		before := owners(r, sharders)
+		counts := make(map[string]int)
+		for _, identity := range before {
+			counts[identity]++
+		}
+		for identity, count := range counts {
+			r.Greater(count, len(targets)/6, "replica %s owns too few targets", identity)
+		}
+
+		// leases of stopped replicas are deleted, only the targets of replica-c move
+		stop("replica-c")
+		leases, err := client.CoordinationV1().Leases("castai-agent").List(context.Background(), metav1.ListOptions{})
+		r.NoError(err)
+		r.Len(leases.Items, 2)
+
+		r.Eventually(func() bool {
+			for _, target := range targets {
+				if !sharders["replica-a"].Owns(target) && !sharders["replica-b"].Owns(target) {
+					return false
+				}
+			}
+			return true
+		}, 5*time.Second, 20*time.Millisecond)
+		after := owners(r, sharders)
+		for node, identity := range before {
+			if identity != "replica-c" {
+				r.Equal(identity, after[node], "target of a remaining replica moved")
+			}
+		}
+	})
+}
@@ -0,0 +1,411 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/utils/clock"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/gpu-metrics-exporter/pb"
+	"github.com/castai/logging"
+)
+
+// ConditionGPUHealthy is the type of the NodeCondition reflecting the health of the GPUs of a node.
+const ConditionGPUHealthy = corev1.NodeConditionType("GPUHealthy")
+
+const (
+	reasonHealthy   = "GPUsHealthy"
+	reasonUnhealthy = "GPUsUnhealthy"
+)
+
+var nodeGVR = schema.GroupVersionResource{Group: "", Version: "v1", Resource: "nodes"}
+
+// nodeRetention is how long the state of nodes which are no longer in the batches is kept, e.g. of nodes which were
+// removed from the cluster or are exported by another replica.
+const nodeRetention = time.Hour
+
+type Config struct {
+	// XIDSeverities are the severities of XID errors which make a GPU unhealthy for XIDHold.
+	XIDSeverities []exporter.XIDSeverity
+	XIDHold       time.Duration
+	// MaxThermalViolationRatio and MaxPowerViolationRatio are the largest share of the time since the previous batch
+	// a GPU may have been slowed down for thermal or power reasons, 0 disables the rule.
+	MaxThermalViolationRatio float64
+	MaxPowerViolationRatio   float64
+	// MaxGPUTemperature and MaxMemoryTemperature are in °C, 0 disables the rule.
+	MaxGPUTemperature    float64
+	MaxMemoryTemperature float64
+	// A node becomes unhealthy after UnhealthyThreshold consecutive unhealthy batches and healthy again after
+	// HealthyThreshold consecutive healthy batches.
+	UnhealthyThreshold int
+	HealthyThreshold   int
+	// Taint is added to unhealthy nodes and removed once they are healthy again when its key is set.
+	Taint corev1.Taint
+	// DryRun logs the changes instead of applying them.
+	DryRun bool
+}
+
+type nodeHealth struct {
+	// decided tells whether either threshold was reached since the node was first seen, until then the health of
+	// the node is unknown and its condition and taint are left as they are
+	decided         bool
+	healthy         bool
+	applied         bool
+	unhealthyStreak int
+	healthyStreak   int
+	problems        []string
+	seenAt          time.Time
+}
+
+// seriesKey identifies the series of a GPU, e.g. the count of an XID or a violation counter.
+type seriesKey struct {
+	node   string
+	gpu    string
+	series string
+}
+
+type violationSample struct {
+	value float64
+	at    time.Time
+}
+
+// Controller evaluates health rules over the GPUs in every batch and reflects the result in the GPUHealthy
+// condition of their nodes, and optionally a taint, so that schedulers can avoid failing GPUs.
+type Controller struct {
+	cfg     Config
+	dynamic dynamic.Interface
+	log     *logging.Logger
+	clock   clock.PassiveClock
+
+	nodes map[string]*nodeHealth
+	// xidCounts holds the last gpu_xid_errors of every node, GPU and code, lastXID when a node last raised one
+	xidCounts map[seriesKey]float64
+	lastXID   map[string]xidProblem
+	// violations holds the last thermal and power violation time of every GPU
+	violations map[seriesKey]violationSample
+}
+
+type xidProblem struct {
+	at      time.Time
+	problem string
+}
+
+func NewController(cfg Config, dynClient dynamic.Interface, log *logging.Logger, clk clock.PassiveClock) *Controller {
+	return &Controller{
+		cfg:        cfg,
+		dynamic:    dynClient,
+		log:        log.With("component", "gpu-health"),
+		clock:      clk,
+		nodes:      make(map[string]*nodeHealth),
+		xidCounts:  make(map[seriesKey]float64),
+		lastXID:    make(map[string]xidProblem),
+		violations: make(map[seriesKey]violationSample),
+	}
+}
+
+func (c *Controller) Observe(ctx context.Context, batch *pb.MetricsBatch) {
+	now := c.clock.Now()
+	problems := c.evaluate(batch, now)
+
+	for node, nodeProblems := range problems {
+		state, found := c.nodes[node]
+		if !found {
+			state = &nodeHealth{}
+			c.nodes[node] = state
+		}
+		state.seenAt = now
+
+		wasHealthy := state.healthy
+		if len(nodeProblems) > 0 {
+			state.unhealthyStreak++
+			state.healthyStreak = 0
+			if state.unhealthyStreak >= c.cfg.UnhealthyThreshold {
+				state.decided = true
+				state.healthy = false
+				state.problems = nodeProblems
+			}
+		} else {
+			state.healthyStreak++
+			state.unhealthyStreak = 0
+			if state.healthyStreak >= c.cfg.HealthyThreshold {
+				state.decided = true
+				state.healthy = true
+				state.problems = nil
+			}
+		}
+
+		if !state.decided || state.applied && state.healthy == wasHealthy {
+			continue
+		}
+		if err := c.apply(ctx, node, state); err != nil {
+			c.log.With("node", node, "error", err.Error()).Warn("failed to update gpu health of node")
+			state.applied = false
+			continue
+		}
+		state.applied = true
+	}
+
+	c.prune(now)
+}
+
+// prune forgets the nodes which haven't been in a batch for nodeRetention along with the state of their GPUs.
+func (c *Controller) prune(now time.Time) {
+	for node, state := range c.nodes {
+		if now.Sub(state.seenAt) <= nodeRetention {
+			continue
+		}
+		delete(c.nodes, node)
+		delete(c.lastXID, node)
+		for key := range c.xidCounts {
+			if key.node == node {
+				delete(c.xidCounts, key)
+			}
+		}
+		for key := range c.violations {
+			if key.node == node {
+				delete(c.violations, key)
+			}
+		}
+	}
+}
+
+// evaluate returns the problems of the GPUs of every node in the batch, nodes without problems have an empty list.
+func (c *Controller) evaluate(batch *pb.MetricsBatch, now time.Time) map[string][]string {
+	problems := make(map[string][]string)
+	for _, metric := range batch.Metrics {
+		for _, m := range metric.Measurements {
+			node := labelValue(m.Labels, "Hostname")
+			gpu := labelValue(m.Labels, "UUID")
+			if node == "" || gpu == "" {
+				continue
+			}
+			if _, found := problems[node]; !found {
+				problems[node] = nil
+			}
+			if problem := c.evaluateMeasurement(metric.Name, node, gpu, m, now); problem != "" {
+				problems[node] = append(problems[node], fmt.Sprintf("%s: %s", gpu, problem))
+			}
+		}
+	}
+
+	for node := range problems {
+		if xid, found := c.lastXID[node]; found {
+			if now.Sub(xid.at) <= c.cfg.XIDHold {
+				problems[node] = append(problems[node], xid.problem)
+			} else {
+				delete(c.lastXID, node)
+			}
+		}
+		slices.Sort(problems[node])
+		problems[node] = slices.Compact(problems[node])
+	}
+	return problems
+}
+
+func (c *Controller) evaluateMeasurement(name, node, gpu string, m *pb.Metric_Measurement, now time.Time) string {
+	switch name {
+	case exporter.MetricGPUTemperature:
+		if c.cfg.MaxGPUTemperature > 0 && m.Value > c.cfg.MaxGPUTemperature {
+			return fmt.Sprintf("temperature %.0f°C above %.0f°C", m.Value, c.cfg.MaxGPUTemperature)
+		}
+	case exporter.MetricMemoryTemperature:
+		if c.cfg.MaxMemoryTemperature > 0 && m.Value > c.cfg.MaxMemoryTemperature {
+			return fmt.Sprintf("memory temperature %.0f°C above %.0f°C", m.Value, c.cfg.MaxMemoryTemperature)
+		}
+	case exporter.MetricThermalViolation:
+		if ratio, found := c.violationRatio(name, node, gpu, m.Value, now); found && c.cfg.MaxThermalViolationRatio > 0 &&
+			ratio > c.cfg.MaxThermalViolationRatio {
+			return fmt.Sprintf("thermally throttled %.0f%% of the time", ratio*100)
+		}
+	case exporter.MetricPowerViolation:
+		if ratio, found := c.violationRatio(name, node, gpu, m.Value, now); found && c.cfg.MaxPowerViolationRatio > 0 &&
+			ratio > c.cfg.MaxPowerViolationRatio {
+			return fmt.Sprintf("power throttled %.0f%% of the time", ratio*100)
+		}
+	case exporter.MetricXIDErrorCount:
+		xid := labelValue(m.Labels, "xid")
+		severity := exporter.XIDSeverity(labelValue(m.Labels, "severity"))
+		key := seriesKey{node: node, gpu: gpu, series: xid}
+		previous, found := c.xidCounts[key]
+		c.xidCounts[key] = m.Value
+		// the counts start at 0 with the exporter, the first count is new as well
+		if (!found || m.Value > previous) && slices.Contains(c.cfg.XIDSeverities, severity) {
+			c.lastXID[node] = xidProblem{at: now, problem: fmt.Sprintf("%s: XID %s (%s)", gpu, xid, severity)}
+		}
+	}
+	return ""
+}
+
+// violationRatio returns the share of the time since the previous batch which the violation counter, in ns, grew.
+func (c *Controller) violationRatio(name, node, gpu string, value float64, now time.Time) (float64, bool) {
+	key := seriesKey{node: node, gpu: gpu, series: name}
+	previous, found := c.violations[key]
+	c.violations[key] = violationSample{value: value, at: now}
+	elapsed := now.Sub(previous.at)
+	if !found || elapsed <= 0 || value < previous.value {
+		return 0, false
+	}
+	return (value - previous.value) / float64(elapsed.Nanoseconds()), true
+}
+
+func (c *Controller) apply(ctx context.Context, nodeName string, state *nodeHealth) error {
+	status, reason, message := corev1.ConditionTrue, reasonHealthy, "all GPUs are healthy"
+	if !state.healthy {
+		status, reason, message = corev1.ConditionFalse, reasonUnhealthy, strings.Join(state.problems, "; ")
+	}
+
+	log := c.log.With("node", nodeName, "healthy", state.healthy)
+	if !state.healthy {
+		log = log.With("problems", message)
+	}
+	if c.cfg.DryRun {
+		log.Info("dry run, not updating gpu health of node")
+		return nil
+	}
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := c.getNode(ctx, nodeName)
+		if err != nil {
+			return err
+		}
+		if !setCondition(node, status, reason, message) {
+			return nil
+		}
+		return c.updateNode(ctx, node, true)
+	})
+	if err != nil {
+		return fmt.Errorf("updating condition: %w", err)
+	}
+
+	if c.cfg.Taint.Key != "" {
+		err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			node, err := c.getNode(ctx, nodeName)
+			if err != nil {
+				return err
+			}
+			if !setTaint(node, c.cfg.Taint, !state.healthy) {
+				return nil
+			}
+			return c.updateNode(ctx, node, false)
+		})
+		if err != nil {
+			return fmt.Errorf("updating taint: %w", err)
+		}
+	}
+
+	log.Info("updated gpu health of node")
+	return nil
+}
+
+func (c *Controller) getNode(ctx context.Context, name string) (*corev1.Node, error) {
+	obj, err := c.dynamic.Resource(nodeGVR).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var node corev1.Node
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &node); err != nil {
+		return nil, fmt.Errorf("converting unstructured to node: %w", err)
+	}
+	return &node, nil
+}
+
+func (c *Controller) updateNode(ctx context.Context, node *corev1.Node, status bool) error {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(node)
+	if err != nil {
+		return fmt.Errorf("converting node to unstructured: %w", err)
+	}
+	u := &unstructured.Unstructured{Object: obj}
+	if status {
+		_, err = c.dynamic.Resource(nodeGVR).UpdateStatus(ctx, u, metav1.UpdateOptions{})
+	} else {
+		_, err = c.dynamic.Resource(nodeGVR).Update(ctx, u, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+// setCondition sets the GPUHealthy condition of the node and tells whether it changed.
+func setCondition(node *corev1.Node, status corev1.ConditionStatus, reason, message string) bool {
+	now := metav1.Now()
+	for i := range node.Status.Conditions {
+		condition := &node.Status.Conditions[i]
+		if condition.Type != ConditionGPUHealthy {
+			continue
+		}
+		if condition.Status == status && condition.Reason == reason && condition.Message == message {
+			return false
+		}
+		if condition.Status != status {
+			condition.LastTransitionTime = now
+		}
+		condition.Status = status
+		condition.Reason = reason
+		condition.Message = message
+		condition.LastHeartbeatTime = now
+		return true
+	}
+
+	node.Status.Conditions = append(node.Status.Conditions, corev1.NodeCondition{
+		Type:               ConditionGPUHealthy,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		LastHeartbeatTime:  now,
+		LastTransitionTime: now,
+	})
+	return true
+}
+
+// setTaint adds or removes the taint and tells whether the taints of the node changed.
+func setTaint(node *corev1.Node, taint corev1.Taint, present bool) bool {
+	i := slices.IndexFunc(node.Spec.Taints, func(t corev1.Taint) bool {
+		return t.Key == taint.Key && t.Effect == taint.Effect
+	})
+	switch {
+	case present && i < 0:
+		node.Spec.Taints = append(node.Spec.Taints, taint)
+		return true
+	case !present && i >= 0:
+		node.Spec.Taints = slices.Delete(node.Spec.Taints, i, i+1)
+		return true
+	}
+	return false
+}
+
+func labelValue(labels []*pb.Metric_Label, name string) string {
+	for _, label := range labels {
+		if label.Name == name {
+			return label.Value
+		}
+	}
+	return ""
+}
+
+// ParseTaint parses a taint formatted as key=value:effect, the value is optional.
+func ParseTaint(spec string) (corev1.Taint, error) {
+	keyValue, effect, found := strings.Cut(spec, ":")
+	if !found {
+		return corev1.Taint{}, fmt.Errorf("invalid taint %q, expected key=value:effect", spec)
+	}
+	key, value, _ := strings.Cut(keyValue, "=")
+	taint := corev1.Taint{Key: key, Value: value, Effect: corev1.TaintEffect(effect)}
+	switch taint.Effect {
+	case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+	default:
+		return corev1.Taint{}, fmt.Errorf("invalid taint effect %q, expected NoSchedule, PreferNoSchedule or NoExecute", effect)
+	}
+	if key == "" {
+		return corev1.Taint{}, fmt.Errorf("invalid taint %q, the key is empty", spec)
+	}
+	return taint, nil
+}
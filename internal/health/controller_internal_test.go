@@ -0,0 +1,73 @@
+package health
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/gpu-metrics-exporter/pb"
+	"github.com/castai/logging"
+)
+
+func TestController_Prune(t *testing.T) {
+	r := require.New(t)
+	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clk := clocktesting.NewFakePassiveClock(start)
+	controller := NewController(Config{
+		XIDSeverities:            []exporter.XIDSeverity{exporter.XIDSeverityHardware},
+		XIDHold:                  3 * time.Hour,
+		MaxThermalViolationRatio: 0.5,
+		UnhealthyThreshold:       2,
+		HealthyThreshold:         2,
+		DryRun:                   true,
+	}, fakedynamic.NewSimpleDynamicClient(runtime.NewScheme()), log, clk)
+
+	batch := func(nodes ...string) *pb.MetricsBatch {
+		xids := &pb.Metric{Name: exporter.MetricXIDErrorCount}
+		violations := &pb.Metric{Name: exporter.MetricThermalViolation}
+		for _, node := range nodes {
+			labels := []*pb.Metric_Label{{Name: "Hostname", Value: node}, {Name: "UUID", Value: "GPU-1"}}
+			xids.Measurements = append(xids.Measurements, &pb.Metric_Measurement{Value: 1, Labels: append(labels,
+				&pb.Metric_Label{Name: "xid", Value: "48"},
+				&pb.Metric_Label{Name: "severity", Value: string(exporter.XIDSeverityHardware)},
+			)})
+			violations.Measurements = append(violations.Measurements, &pb.Metric_Measurement{Value: 0, Labels: labels})
+		}
+		return &pb.MetricsBatch{Metrics: []*pb.Metric{xids, violations}}
+	}
+
+	controller.Observe(context.Background(), batch("gpu-node-1", "gpu-node-2"))
+	r.Len(controller.nodes, 2)
+	r.Len(controller.lastXID, 2)
+	r.Len(controller.xidCounts, 2)
+	r.Len(controller.violations, 2)
+
+	// gpu-node-1 is kept for an hour after it was last seen
+	clk.SetTime(start.Add(nodeRetention))
+	controller.Observe(context.Background(), batch("gpu-node-2"))
+	r.Len(controller.nodes, 2)
+
+	clk.SetTime(start.Add(nodeRetention + time.Minute))
+	controller.Observe(context.Background(), batch("gpu-node-2"))
+	r.Equal([]string{"gpu-node-2"}, nodeNames(controller.nodes))
+	r.Contains(controller.lastXID, "gpu-node-2")
+	r.NotContains(controller.lastXID, "gpu-node-1")
+	r.Equal(map[seriesKey]float64{{node: "gpu-node-2", gpu: "GPU-1", series: "48"}: 1}, controller.xidCounts)
+	r.Len(controller.violations, 1)
+	r.Contains(controller.violations, seriesKey{node: "gpu-node-2", gpu: "GPU-1", series: exporter.MetricThermalViolation})
+}
+
+func nodeNames(nodes map[string]*nodeHealth) []string {
+	names := make([]string, 0, len(nodes))
+	for name := range nodes {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,231 @@
+package health_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/gpu-metrics-exporter/internal/health"
+	"github.com/castai/gpu-metrics-exporter/pb"
+	"github.com/castai/logging"
+)
+
+func measurement(node, gpu string, value float64, labels ...*pb.Metric_Label) *pb.Metric_Measurement {
+	return &pb.Metric_Measurement{
+		Value: value,
+		Labels: append([]*pb.Metric_Label{
+			{Name: "Hostname", Value: node},
+			{Name: "UUID", Value: gpu},
+		}, labels...),
+	}
+}
+
+func temperatures(values map[string]float64) *pb.MetricsBatch {
+	metric := &pb.Metric{Name: exporter.MetricGPUTemperature}
+	for gpu, value := range values {
+		metric.Measurements = append(metric.Measurements, measurement("gpu-node-1", gpu, value))
+	}
+	return &pb.MetricsBatch{Metrics: []*pb.Metric{metric}}
+}
+
+func TestController_Observe(t *testing.T) {
+	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
+	taint := corev1.Taint{Key: "gpu.cast.ai/unhealthy", Value: "true", Effect: corev1.TaintEffectNoSchedule}
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	newNode := func() *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "gpu-node-1"},
+			Spec:       corev1.NodeSpec{Taints: []corev1.Taint{{Key: "nvidia.com/gpu", Effect: corev1.TaintEffectNoSchedule}}},
+			Status:     corev1.NodeStatus{Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}}},
+		}
+	}
+	newClientWithNode := func(node *corev1.Node) *fakedynamic.FakeDynamicClient {
+		scheme := runtime.NewScheme()
+		_ = corev1.AddToScheme(scheme)
+		return fakedynamic.NewSimpleDynamicClient(scheme, node)
+	}
+	newClient := func() *fakedynamic.FakeDynamicClient {
+		return newClientWithNode(newNode())
+	}
+	getNode := func(t *testing.T, client *fakedynamic.FakeDynamicClient) *corev1.Node {
+		obj, err := client.Resource(schema.GroupVersionResource{Version: "v1", Resource: "nodes"}).
+			Get(context.Background(), "gpu-node-1", metav1.GetOptions{})
+		require.NoError(t, err)
+		var node corev1.Node
+		require.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &node))
+		return &node
+	}
+	condition := func(node *corev1.Node) *corev1.NodeCondition {
+		for i := range node.Status.Conditions {
+			if node.Status.Conditions[i].Type == health.ConditionGPUHealthy {
+				return &node.Status.Conditions[i]
+			}
+		}
+		return nil
+	}
+
+	t.Run("applies the condition and taint with hysteresis", func(t *testing.T) {
+		r := require.New(t)
+		client := newClient()
+		controller := health.NewController(health.Config{
+			MaxGPUTemperature:  85,
+			UnhealthyThreshold: 2,
+			HealthyThreshold:   3,
+			Taint:              taint,
+		}, client, log, clocktesting.NewFakePassiveClock(start))
+
+		hot := temperatures(map[string]float64{"GPU-1": 70, "GPU-2": 91})
+		cool := temperatures(map[string]float64{"GPU-1": 70, "GPU-2": 60})
+
+		// the health of the node is unknown until a threshold is reached
+		controller.Observe(context.Background(), cool)
+		controller.Observe(context.Background(), hot)
+		r.Nil(condition(getNode(t, client)))
+
+		controller.Observe(context.Background(), hot)
+		node := getNode(t, client)
+		r.Equal(corev1.ConditionFalse, condition(node).Status)
+		r.Equal("GPUsUnhealthy", condition(node).Reason)
+		r.Equal("GPU-2: temperature 91°C above 85°C", condition(node).Message)
+		r.Equal([]corev1.Taint{{Key: "nvidia.com/gpu", Effect: corev1.TaintEffectNoSchedule}, taint}, node.Spec.Taints)
+
+		controller.Observe(context.Background(), cool)
+		controller.Observe(context.Background(), cool)
+		r.Equal(corev1.ConditionFalse, condition(getNode(t, client)).Status)
+
+		controller.Observe(context.Background(), cool)
+		node = getNode(t, client)
+		r.Equal(corev1.ConditionTrue, condition(node).Status)
+		r.Equal("GPUsHealthy", condition(node).Reason)
+		r.Len(node.Status.Conditions, 2)
+		r.Equal([]corev1.Taint{{Key: "nvidia.com/gpu", Effect: corev1.TaintEffectNoSchedule}}, node.Spec.Taints)
+	})
+
+	t.Run("keeps the condition and taint of a restart until a threshold is reached", func(t *testing.T) {
+		r := require.New(t)
+		unhealthy := newNode()
+		unhealthy.Spec.Taints = append(unhealthy.Spec.Taints, taint)
+		unhealthy.Status.Conditions = append(unhealthy.Status.Conditions, corev1.NodeCondition{
+			Type:    health.ConditionGPUHealthy,
+			Status:  corev1.ConditionFalse,
+			Reason:  "GPUsUnhealthy",
+			Message: "GPU-2: temperature 91°C above 85°C",
+		})
+		client := newClientWithNode(unhealthy)
+		controller := health.NewController(health.Config{
+			MaxGPUTemperature:  85,
+			UnhealthyThreshold: 2,
+			HealthyThreshold:   3,
+			Taint:              taint,
+		}, client, log, clocktesting.NewFakePassiveClock(start))
+
+		cool := temperatures(map[string]float64{"GPU-1": 70, "GPU-2": 60})
+		controller.Observe(context.Background(), cool)
+		controller.Observe(context.Background(), cool)
+		node := getNode(t, client)
+		r.Equal(corev1.ConditionFalse, condition(node).Status)
+		r.Contains(node.Spec.Taints, taint)
+
+		controller.Observe(context.Background(), cool)
+		node = getNode(t, client)
+		r.Equal(corev1.ConditionTrue, condition(node).Status)
+		r.NotContains(node.Spec.Taints, taint)
+	})
+
+	t.Run("XID errors of the configured severities make GPUs unhealthy for a while", func(t *testing.T) {
+		r := require.New(t)
+		client := newClient()
+		clk := clocktesting.NewFakePassiveClock(start)
+		controller := health.NewController(health.Config{
+			XIDSeverities:      []exporter.XIDSeverity{exporter.XIDSeverityHardware},
+			XIDHold:            15 * time.Minute,
+			UnhealthyThreshold: 1,
+			HealthyThreshold:   1,
+		}, client, log, clk)
+
+		xids := func(counts map[string]float64) *pb.MetricsBatch {
+			metric := &pb.Metric{Name: exporter.MetricXIDErrorCount}
+			for xid, count := range counts {
+				severity, _ := exporter.ClassifyXID(map[string]int{"13": 13, "48": 48}[xid])
+				metric.Measurements = append(metric.Measurements, measurement("gpu-node-1", "GPU-1", count,
+					&pb.Metric_Label{Name: "xid", Value: xid},
+					&pb.Metric_Label{Name: "severity", Value: string(severity)},
+				))
+			}
+			return &pb.MetricsBatch{Metrics: []*pb.Metric{metric}}
+		}
+
+		controller.Observe(context.Background(), xids(map[string]float64{"13": 1}))
+		r.Equal(corev1.ConditionTrue, condition(getNode(t, client)).Status)
+
+		controller.Observe(context.Background(), xids(map[string]float64{"13": 1, "48": 1}))
+		node := getNode(t, client)
+		r.Equal(corev1.ConditionFalse, condition(node).Status)
+		r.Equal("GPU-1: XID 48 (hardware)", condition(node).Message)
+		r.Empty(node.Spec.Taints[1:])
+
+		controller.Observe(context.Background(), xids(map[string]float64{"13": 1, "48": 1}))
+		r.Equal(corev1.ConditionFalse, condition(getNode(t, client)).Status)
+
+		clk.SetTime(start.Add(16 * time.Minute))
+		controller.Observe(context.Background(), xids(map[string]float64{"13": 1, "48": 1}))
+		r.Equal(corev1.ConditionTrue, condition(getNode(t, client)).Status)
+	})
+
+	t.Run("growth of the thermal violation time makes GPUs unhealthy", func(t *testing.T) {
+		r := require.New(t)
+		client := newClient()
+		clk := clocktesting.NewFakePassiveClock(start)
+		controller := health.NewController(health.Config{
+			MaxThermalViolationRatio: 0.5,
+			UnhealthyThreshold:       1,
+			HealthyThreshold:         1,
+		}, client, log, clk)
+
+		violation := func(ns float64) *pb.MetricsBatch {
+			return &pb.MetricsBatch{Metrics: []*pb.Metric{{
+				Name:         exporter.MetricThermalViolation,
+				Measurements: []*pb.Metric_Measurement{measurement("gpu-node-1", "GPU-1", ns)},
+			}}}
+		}
+
+		controller.Observe(context.Background(), violation(1e9))
+		clk.SetTime(start.Add(15 * time.Second))
+		controller.Observe(context.Background(), violation(2e9))
+		r.Equal(corev1.ConditionTrue, condition(getNode(t, client)).Status)
+
+		// throttled for 12 of the 15 seconds
+		clk.SetTime(start.Add(30 * time.Second))
+		controller.Observe(context.Background(), violation(14e9))
+		node := getNode(t, client)
+		r.Equal(corev1.ConditionFalse, condition(node).Status)
+		r.Contains(condition(node).Message, "GPU-1: thermally throttled")
+	})
+
+	t.Run("dry run leaves the node alone", func(t *testing.T) {
+		r := require.New(t)
+		client := newClient()
+		controller := health.NewController(health.Config{
+			MaxGPUTemperature:  85,
+			UnhealthyThreshold: 1,
+			HealthyThreshold:   1,
+			Taint:              taint,
+			DryRun:             true,
+		}, client, log, clocktesting.NewFakePassiveClock(start))
+
+		controller.Observe(context.Background(), temperatures(map[string]float64{"GPU-1": 95}))
+		node := getNode(t, client)
+		r.Nil(condition(node))
+		r.Len(node.Spec.Taints, 1)
+	})
+}
@@ -0,0 +1,277 @@
+package otlp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+)
+
+const (
+	sinkName = "otlp"
+
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http/protobuf"
+
+	serviceName = "castai-gpu-metrics-exporter"
+	scopeName   = "github.com/castai/gpu-metrics-exporter"
+)
+
+// Resource and data point attribute keys, following the OpenTelemetry semantic conventions where one exists.
+const (
+	attrServiceName    = "service.name"
+	attrServiceVersion = "service.version"
+	attrClusterUID     = "k8s.cluster.uid"
+	attrNodeName       = "k8s.node.name"
+	attrPodName        = "k8s.pod.name"
+	attrNamespaceName  = "k8s.namespace.name"
+	attrContainerName  = "k8s.container.name"
+	attrWorkloadName   = "k8s.workload.name"
+	attrWorkloadKind   = "k8s.workload.kind"
+	attrGPUUUID        = "gpu.uuid"
+	attrGPUID          = "gpu.id"
+	attrGPUDevice      = "gpu.device"
+	attrGPUModel       = "gpu.model"
+	attrMIGProfile     = "gpu.mig.profile"
+	attrMIGInstanceID  = "gpu.mig.instance_id"
+)
+
+type Config struct {
+	// Endpoint is the URL of the collector, e.g. https://otel-collector:4317 for gRPC or
+	// https://otel-collector:4318/v1/metrics for HTTP. http:// endpoints disable TLS.
+	Endpoint  string
+	Protocol  string
+	Headers   map[string]string
+	CAFile    string
+	CertFile  string
+	KeyFile   string
+	Timeout   time.Duration
+	ClusterID string
+}
+
+// Sink exports the GPU metrics to an OpenTelemetry collector. Shutdown has to be called on exit, it flushes and
+// closes the connection to the collector.
+type Sink interface {
+	exporter.Sink
+	Shutdown(ctx context.Context) error
+}
+
+type sink struct {
+	exporter  sdkmetric.Exporter
+	timeout   time.Duration
+	clusterID string
+	version   string
+	scope     instrumentation.Scope
+	// startedAt is the start time of cumulative sums, which restart with the exporter.
+	startedAt time.Time
+}
+
+func NewSink(ctx context.Context, cfg Config, version string) (Sink, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q, expected an http:// or https:// URL", cfg.Endpoint)
+	}
+
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var exp sdkmetric.Exporter
+	switch cfg.Protocol {
+	case ProtocolGRPC:
+		opts := []otlpmetricgrpc.Option{
+			otlpmetricgrpc.WithEndpointURL(cfg.Endpoint),
+			otlpmetricgrpc.WithHeaders(cfg.Headers),
+			otlpmetricgrpc.WithTimeout(cfg.Timeout),
+		}
+		if tlsConfig != nil {
+			opts = append(opts, otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(tlsConfig)))
+		}
+		exp, err = otlpmetricgrpc.New(ctx, opts...)
+	case ProtocolHTTP:
+		opts := []otlpmetrichttp.Option{
+			otlpmetrichttp.WithEndpointURL(cfg.Endpoint),
+			otlpmetrichttp.WithHeaders(cfg.Headers),
+			otlpmetrichttp.WithTimeout(cfg.Timeout),
+		}
+		if tlsConfig != nil {
+			opts = append(opts, otlpmetrichttp.WithTLSClientConfig(tlsConfig))
+		}
+		exp, err = otlpmetrichttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q, expected %q or %q", cfg.Protocol, ProtocolGRPC, ProtocolHTTP)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP exporter: %w", err)
+	}
+
+	return &sink{
+		exporter:  exp,
+		timeout:   cfg.Timeout,
+		clusterID: cfg.ClusterID,
+		version:   version,
+		scope:     instrumentation.Scope{Name: scopeName, Version: version},
+		startedAt: time.Now(),
+	}, nil
+}
+
+func newTLSConfig(cfg Config) (*tls.Config, error) {
+	if cfg.CAFile == "" && cfg.CertFile == "" && cfg.KeyFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.CAFile != "" {
+		ca, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading OTLP CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in OTLP CA file %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, errors.New("both OTLP client certificate and key files are required")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading OTLP client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func (s *sink) Name() string {
+	return sinkName
+}
+
+// Write exports the metrics of a batch in a single request, the node of every GPU is a data point attribute so
+// that a single exporter discovering dcgm-exporters across the cluster still attributes each GPU to its node.
+func (s *sink) Write(ctx context.Context, metrics []exporter.GPUMetric) error {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	if err := s.exporter.Export(ctx, s.toResourceMetrics(metrics)); err != nil {
+		return fmt.Errorf("exporting metrics: %w", err)
+	}
+	return nil
+}
+
+func (s *sink) Shutdown(ctx context.Context) error {
+	return s.exporter.Shutdown(ctx)
+}
+
+func (s *sink) toResourceMetrics(metrics []exporter.GPUMetric) *metricdata.ResourceMetrics {
+	resourceAttrs := []attribute.KeyValue{
+		attribute.String(attrServiceName, serviceName),
+		attribute.String(attrServiceVersion, s.version),
+	}
+	if s.clusterID != "" {
+		resourceAttrs = append(resourceAttrs, attribute.String(attrClusterUID, s.clusterID))
+	}
+
+	attrs := make([]attribute.Set, len(metrics))
+	for i := range metrics {
+		attrs[i] = dataPointAttributes(&metrics[i])
+	}
+
+	otelMetrics := make([]metricdata.Metrics, 0, len(exporter.GPUMetricFields))
+	for _, field := range exporter.GPUMetricFields {
+		dataPoints := make([]metricdata.DataPoint[float64], 0, len(metrics))
+		for i := range metrics {
+			value, ok := field.Value(&metrics[i])
+			if !ok {
+				continue
+			}
+			dataPoint := metricdata.DataPoint[float64]{
+				Attributes: attrs[i],
+				Time:       metrics[i].Timestamp,
+				Value:      value,
+			}
+			if field.Cumulative {
+				dataPoint.StartTime = s.startedAt
+			}
+			dataPoints = append(dataPoints, dataPoint)
+		}
+		if len(dataPoints) == 0 {
+			continue
+		}
+
+		// totals are sums, so that backends can compute their rates
+		var data metricdata.Aggregation = metricdata.Gauge[float64]{DataPoints: dataPoints}
+		if field.Cumulative {
+			data = metricdata.Sum[float64]{
+				DataPoints:  dataPoints,
+				Temporality: metricdata.CumulativeTemporality,
+				IsMonotonic: true,
+			}
+		}
+		otelMetrics = append(otelMetrics, metricdata.Metrics{
+			Name: field.Name,
+			Data: data,
+		})
+	}
+
+	return &metricdata.ResourceMetrics{
+		Resource: resource.NewWithAttributes("", resourceAttrs...),
+		ScopeMetrics: []metricdata.ScopeMetrics{
+			{Scope: s.scope, Metrics: otelMetrics},
+		},
+	}
+}
+
+func dataPointAttributes(m *exporter.GPUMetric) attribute.Set {
+	values := []struct {
+		key   string
+		value string
+	}{
+		{attrNodeName, m.NodeName},
+		{attrGPUUUID, m.DeviceUUID},
+		{attrGPUID, m.DeviceID},
+		{attrGPUDevice, m.Device},
+		{attrGPUModel, m.ModelName},
+		{attrMIGProfile, m.MIGProfile},
+		{attrMIGInstanceID, m.MIGInstanceID},
+		{attrPodName, m.Pod},
+		{attrNamespaceName, m.Namespace},
+		{attrContainerName, m.Container},
+		{attrWorkloadName, m.WorkloadName},
+		{attrWorkloadKind, m.WorkloadKind},
+	}
+
+	kvs := make([]attribute.KeyValue, 0, len(values))
+	for _, v := range values {
+		if v.value == "" {
+			continue
+		}
+		kvs = append(kvs, attribute.String(v.key, v.value))
+	}
+
+	return attribute.NewSet(kvs...)
+}
@@ -0,0 +1,217 @@
+package otlp_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/gpu-metrics-exporter/internal/otlp"
+)
+
+type metricsService struct {
+	collectorpb.UnimplementedMetricsServiceServer
+	requests chan *collectorpb.ExportMetricsServiceRequest
+	headers  chan metadata.MD
+}
+
+func (s *metricsService) Export(ctx context.Context, req *collectorpb.ExportMetricsServiceRequest) (*collectorpb.ExportMetricsServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.headers <- md
+	s.requests <- req
+	return &collectorpb.ExportMetricsServiceResponse{}, nil
+}
+
+func newTestMetrics(ts time.Time) []exporter.GPUMetric {
+	return []exporter.GPUMetric{
+		{
+			NodeName:     "node-1",
+			ModelName:    "NVIDIA A100",
+			DeviceID:     "0",
+			DeviceUUID:   "GPU-1",
+			MIGProfile:   "1g.5gb",
+			Pod:          "trainer-0",
+			Namespace:    "ml",
+			WorkloadName: "trainer",
+			WorkloadKind: "StatefulSet",
+			PowerUsage:   ptr(250.0),
+			EnergyJoules: ptr(1800.0),
+			Timestamp:    ts,
+		},
+		{
+			NodeName:   "node-2",
+			DeviceID:   "0",
+			DeviceUUID: "GPU-2",
+			PowerUsage: ptr(70.0),
+			Timestamp:  ts,
+		},
+	}
+}
+
+func attributesToMap(attrs []*commonpb.KeyValue) map[string]string {
+	m := make(map[string]string, len(attrs))
+	for _, kv := range attrs {
+		m[kv.Key] = kv.Value.GetStringValue()
+	}
+	return m
+}
+
+func findMetric(rm *metricspb.ResourceMetrics, name string) *metricspb.Metric {
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == name {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+func TestSink(t *testing.T) {
+	t.Run("exports a batch in a single request over gRPC", func(t *testing.T) {
+		r := require.New(t)
+		ctx := context.Background()
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		r.NoError(err)
+		service := &metricsService{
+			requests: make(chan *collectorpb.ExportMetricsServiceRequest, 10),
+			headers:  make(chan metadata.MD, 10),
+		}
+		srv := grpc.NewServer()
+		collectorpb.RegisterMetricsServiceServer(srv, service)
+		go func() { _ = srv.Serve(listener) }()
+		defer srv.Stop()
+
+		sink, err := otlp.NewSink(ctx, otlp.Config{
+			Endpoint:  "http://" + listener.Addr().String(),
+			Protocol:  otlp.ProtocolGRPC,
+			Headers:   map[string]string{"x-tenant": "team-a"},
+			Timeout:   5 * time.Second,
+			ClusterID: "cluster-1",
+		}, "test")
+		r.NoError(err)
+
+		now := time.Now()
+		r.NoError(sink.Write(ctx, newTestMetrics(now)))
+
+		r.Equal([]string{"team-a"}, (<-service.headers).Get("x-tenant"))
+
+		req := <-service.requests
+		r.Len(req.ResourceMetrics, 1)
+		rm := req.ResourceMetrics[0]
+		r.Equal(map[string]string{
+			"service.name":    "castai-gpu-metrics-exporter",
+			"service.version": "test",
+			"k8s.cluster.uid": "cluster-1",
+		}, attributesToMap(rm.Resource.Attributes))
+		r.Equal("github.com/castai/gpu-metrics-exporter", rm.ScopeMetrics[0].Scope.Name)
+		// fields which weren't reported, like the temperature, aren't exported
+		r.Nil(findMetric(rm, exporter.MetricGPUTemperature))
+		reported := make(map[string]struct{})
+		for _, row := range newTestMetrics(now) {
+			for _, field := range exporter.GPUMetricFields {
+				if _, ok := field.Value(&row); ok {
+					reported[field.Name] = struct{}{}
+				}
+			}
+		}
+		r.Len(rm.ScopeMetrics[0].Metrics, len(reported))
+
+		power := findMetric(rm, exporter.MetricPowerUsage)
+		r.NotNil(power)
+		r.Len(power.GetGauge().DataPoints, 2)
+		dp := power.GetGauge().DataPoints[0]
+		r.Equal(250.0, dp.GetAsDouble())
+		r.Equal(uint64(now.UnixNano()), dp.TimeUnixNano)
+		r.Equal(map[string]string{
+			"k8s.node.name":      "node-1",
+			"gpu.id":             "0",
+			"gpu.uuid":           "GPU-1",
+			"gpu.model":          "NVIDIA A100",
+			"gpu.mig.profile":    "1g.5gb",
+			"k8s.pod.name":       "trainer-0",
+			"k8s.namespace.name": "ml",
+			"k8s.workload.name":  "trainer",
+			"k8s.workload.kind":  "StatefulSet",
+		}, attributesToMap(dp.Attributes))
+
+		r.Equal("node-2", attributesToMap(power.GetGauge().DataPoints[1].Attributes)["k8s.node.name"])
+
+		// the cumulative energy is a monotonic sum since the sink started
+		energy := findMetric(rm, exporter.MetricEnergy).GetSum()
+		r.NotNil(energy)
+		r.True(energy.IsMonotonic)
+		r.Equal(metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, energy.AggregationTemporality)
+		r.Len(energy.DataPoints, 1)
+		r.Equal(1800.0, energy.DataPoints[0].GetAsDouble())
+		r.NotZero(energy.DataPoints[0].StartTimeUnixNano)
+		r.LessOrEqual(energy.DataPoints[0].StartTimeUnixNano, uint64(now.UnixNano()))
+		r.Empty(service.requests)
+
+		r.NoError(sink.Shutdown(ctx))
+		r.Error(sink.Write(ctx, newTestMetrics(now)))
+	})
+
+	t.Run("exports over HTTP", func(t *testing.T) {
+		r := require.New(t)
+		ctx := context.Background()
+
+		requests := make(chan *collectorpb.ExportMetricsServiceRequest, 10)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			r.Equal("/v1/metrics", req.URL.Path)
+			r.Equal("application/x-protobuf", req.Header.Get("Content-Type"))
+
+			body, err := io.ReadAll(req.Body)
+			r.NoError(err)
+			exportRequest := &collectorpb.ExportMetricsServiceRequest{}
+			r.NoError(proto.Unmarshal(body, exportRequest))
+			requests <- exportRequest
+
+			w.Header().Set("Content-Type", "application/x-protobuf")
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer srv.Close()
+
+		sink, err := otlp.NewSink(ctx, otlp.Config{
+			Endpoint: srv.URL + "/v1/metrics",
+			Protocol: otlp.ProtocolHTTP,
+			Timeout:  5 * time.Second,
+		}, "test")
+		r.NoError(err)
+
+		r.NoError(sink.Write(ctx, newTestMetrics(time.Now())[:1]))
+
+		req := <-requests
+		power := findMetric(req.ResourceMetrics[0], exporter.MetricPowerUsage)
+		r.NotNil(power)
+		r.Equal(250.0, power.GetGauge().DataPoints[0].GetAsDouble())
+	})
+
+	t.Run("rejects invalid configuration", func(t *testing.T) {
+		r := require.New(t)
+		ctx := context.Background()
+
+		_, err := otlp.NewSink(ctx, otlp.Config{Endpoint: "collector:4317", Protocol: otlp.ProtocolGRPC}, "test")
+		r.Error(err)
+
+		_, err = otlp.NewSink(ctx, otlp.Config{Endpoint: "http://collector:4317", Protocol: "thrift"}, "test")
+		r.Error(err)
+	})
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
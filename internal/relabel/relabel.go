@@ -0,0 +1,229 @@
+package relabel
+
+import (
+	"crypto/md5" // nolint:gosec // G501: hashmod has to match Prometheus, it isn't used for security
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Action is what a relabel config does with a series, the actions behave like the ones of Prometheus'
+// metric_relabel_configs.
+type Action string
+
+const (
+	// Replace sets TargetLabel to Replacement, expanded with the groups of Regex matching the source labels. The
+	// label is removed when the replacement is empty, and left alone when Regex doesn't match.
+	Replace = Action("replace")
+	// Keep drops series whose source labels don't match Regex.
+	Keep = Action("keep")
+	// Drop drops series whose source labels match Regex.
+	Drop = Action("drop")
+	// HashMod sets TargetLabel to the hash of the source labels modulo Modulus.
+	HashMod = Action("hashmod")
+	// LabelMap copies the labels whose names match Regex to the names Replacement expands to.
+	LabelMap = Action("labelmap")
+	// LabelDrop removes the labels whose names match Regex.
+	LabelDrop = Action("labeldrop")
+	// LabelKeep removes the labels whose names don't match Regex.
+	LabelKeep = Action("labelkeep")
+)
+
+// MetricNameLabel holds the name of the metric of a series. It can be matched but not changed, renaming metrics
+// isn't supported.
+const MetricNameLabel = "__name__"
+
+const (
+	defaultSeparator   = ";"
+	defaultRegex       = "(.*)"
+	defaultReplacement = "$1"
+)
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Config is a single relabeling step. Separator, Regex and Replacement default to ";", "(.*)" and "$1", and Action to
+// replace.
+type Config struct {
+	SourceLabels []string `json:"source_labels,omitempty"`
+	Separator    *string  `json:"separator,omitempty"`
+	Regex        *string  `json:"regex,omitempty"`
+	Modulus      uint64   `json:"modulus,omitempty"`
+	TargetLabel  string   `json:"target_label,omitempty"`
+	Replacement  *string  `json:"replacement,omitempty"`
+	Action       Action   `json:"action,omitempty"`
+}
+
+type configFile struct {
+	RelabelConfigs []Config `json:"relabel_configs"`
+}
+
+// Relabeler applies relabel configs to the labels of series.
+type Relabeler struct {
+	steps []step
+}
+
+type step struct {
+	cfg         Config
+	separator   string
+	regex       *regexp.Regexp
+	replacement string
+}
+
+// LoadFile reads relabel configs from a YAML, or JSON, file in the format
+//
+//	relabel_configs:
+//	  - action: labeldrop
+//	    regex: pci_bus_id|DCGM_FI_DRIVER_VERSION
+func LoadFile(path string) (*Relabeler, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading relabel configs: %w", err)
+	}
+	var file configFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing relabel configs: %w", err)
+	}
+	return New(file.RelabelConfigs)
+}
+
+// New validates the configs and compiles their regular expressions, which are anchored at both ends.
+func New(cfgs []Config) (*Relabeler, error) {
+	steps := make([]step, 0, len(cfgs))
+	for i, cfg := range cfgs {
+		s, err := newStep(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("relabel config %d: %w", i, err)
+		}
+		steps = append(steps, s)
+	}
+	return &Relabeler{steps: steps}, nil
+}
+
+func newStep(cfg Config) (step, error) {
+	if cfg.Action == "" {
+		cfg.Action = Replace
+	}
+	s := step{
+		cfg:         cfg,
+		separator:   valueOr(cfg.Separator, defaultSeparator),
+		replacement: valueOr(cfg.Replacement, defaultReplacement),
+	}
+
+	regex, err := regexp.Compile("^(?:" + valueOr(cfg.Regex, defaultRegex) + ")$")
+	if err != nil {
+		return step{}, fmt.Errorf("invalid regex: %w", err)
+	}
+	s.regex = regex
+
+	switch cfg.Action {
+	case Replace:
+		if cfg.TargetLabel == "" {
+			return step{}, errors.New("replace requires target_label")
+		}
+		// the target label may reference groups of the regex, it's validated once it's expanded
+		if !strings.Contains(cfg.TargetLabel, "$") && !labelNameRE.MatchString(cfg.TargetLabel) {
+			return step{}, fmt.Errorf("invalid target_label %q", cfg.TargetLabel)
+		}
+	case HashMod:
+		if !labelNameRE.MatchString(cfg.TargetLabel) {
+			return step{}, fmt.Errorf("hashmod requires a valid target_label, got %q", cfg.TargetLabel)
+		}
+		if cfg.Modulus == 0 {
+			return step{}, errors.New("hashmod requires a modulus greater than 0")
+		}
+	case Keep, Drop:
+		if len(cfg.SourceLabels) == 0 {
+			return step{}, fmt.Errorf("%s requires source_labels", cfg.Action)
+		}
+	case LabelMap:
+	case LabelDrop, LabelKeep:
+		if len(cfg.SourceLabels) > 0 || cfg.TargetLabel != "" {
+			return step{}, fmt.Errorf("%s only matches label names with regex, source_labels and target_label aren't allowed", cfg.Action)
+		}
+	default:
+		return step{}, fmt.Errorf("unsupported action %q", cfg.Action)
+	}
+	if cfg.TargetLabel == MetricNameLabel {
+		return step{}, fmt.Errorf("target_label can't be %s, renaming metrics isn't supported", MetricNameLabel)
+	}
+	return s, nil
+}
+
+// Process applies the configs in order to the labels, which it modifies, and returns false when the series is
+// dropped. The labels hold the metric name as MetricNameLabel.
+func (r *Relabeler) Process(labels map[string]string) bool {
+	for _, s := range r.steps {
+		if !s.apply(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s step) apply(labels map[string]string) bool {
+	cfg := s.cfg
+	switch cfg.Action {
+	case Keep:
+		return s.regex.MatchString(s.sourceValue(labels))
+	case Drop:
+		return !s.regex.MatchString(s.sourceValue(labels))
+	case Replace:
+		value := s.sourceValue(labels)
+		match := s.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			return true
+		}
+		target := string(s.regex.ExpandString(nil, cfg.TargetLabel, value, match))
+		if !labelNameRE.MatchString(target) || target == MetricNameLabel {
+			return true
+		}
+		replacement := string(s.regex.ExpandString(nil, s.replacement, value, match))
+		if replacement == "" {
+			delete(labels, target)
+		} else {
+			labels[target] = replacement
+		}
+	case HashMod:
+		sum := md5.Sum([]byte(s.sourceValue(labels))) // nolint:gosec // G401: see import
+		labels[cfg.TargetLabel] = fmt.Sprint(binary.BigEndian.Uint64(sum[8:]) % cfg.Modulus)
+	case LabelMap:
+		mapped := make(map[string]string)
+		for name, value := range labels {
+			if s.regex.MatchString(name) {
+				mapped[s.regex.ReplaceAllString(name, s.replacement)] = value
+			}
+		}
+		for name, value := range mapped {
+			if labelNameRE.MatchString(name) && name != MetricNameLabel {
+				labels[name] = value
+			}
+		}
+	case LabelDrop, LabelKeep:
+		for name := range labels {
+			if name != MetricNameLabel && s.regex.MatchString(name) == (cfg.Action == LabelDrop) {
+				delete(labels, name)
+			}
+		}
+	}
+	return true
+}
+
+func (s step) sourceValue(labels map[string]string) string {
+	values := make([]string, len(s.cfg.SourceLabels))
+	for i, name := range s.cfg.SourceLabels {
+		values[i] = labels[name]
+	}
+	return strings.Join(values, s.separator)
+}
+
+func valueOr(value *string, fallback string) string {
+	if value == nil {
+		return fallback
+	}
+	return *value
+}
@@ -0,0 +1,250 @@
+package relabel_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/castai/gpu-metrics-exporter/internal/relabel"
+)
+
+func str(s string) *string {
+	return &s
+}
+
+func series() map[string]string {
+	return map[string]string{
+		"__name__":               "DCGM_FI_DEV_GPU_TEMP",
+		"gpu":                    "0",
+		"UUID":                   "GPU-1",
+		"pci_bus_id":             "00000000:00:1E.0",
+		"DCGM_FI_DRIVER_VERSION": "535.104.05",
+		"Hostname":               "node-1",
+		"modelName":              "NVIDIA A100",
+	}
+}
+
+func TestRelabeler_Process(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []relabel.Config
+		labels  map[string]string
+		want    map[string]string
+		dropped bool
+	}{
+		{
+			name:    "no configs keep the series as is",
+			configs: nil,
+			want:    series(),
+		},
+		{
+			name: "keep keeps matching series",
+			configs: []relabel.Config{
+				{Action: relabel.Keep, SourceLabels: []string{"__name__"}, Regex: str("DCGM_FI_DEV_.*")},
+			},
+			want: series(),
+		},
+		{
+			name: "keep drops series which don't match",
+			configs: []relabel.Config{
+				{Action: relabel.Keep, SourceLabels: []string{"__name__"}, Regex: str("DCGM_FI_PROF_.*")},
+			},
+			dropped: true,
+		},
+		{
+			name: "keep anchors the regex",
+			configs: []relabel.Config{
+				{Action: relabel.Keep, SourceLabels: []string{"modelName"}, Regex: str("A100")},
+			},
+			dropped: true,
+		},
+		{
+			name: "drop joins source labels with the separator",
+			configs: []relabel.Config{
+				{Action: relabel.Drop, SourceLabels: []string{"gpu", "UUID"}, Separator: str("/"), Regex: str("0/GPU-1")},
+			},
+			dropped: true,
+		},
+		{
+			name: "drop keeps series which don't match",
+			configs: []relabel.Config{
+				{Action: relabel.Drop, SourceLabels: []string{"gpu"}, Regex: str("1")},
+			},
+			want: series(),
+		},
+		{
+			name: "replace sets the target label from regex groups",
+			configs: []relabel.Config{
+				{SourceLabels: []string{"modelName"}, Regex: str("NVIDIA (.*)"), TargetLabel: "model", Replacement: str("nvidia-$1")},
+			},
+			want: with(series(), "model", "nvidia-A100"),
+		},
+		{
+			name: "replace expands groups in the target label",
+			configs: []relabel.Config{
+				{SourceLabels: []string{"gpu"}, TargetLabel: "gpu_${1}_index", Replacement: str("yes")},
+			},
+			want: with(series(), "gpu_0_index", "yes"),
+		},
+		{
+			name: "replace adds a static label",
+			configs: []relabel.Config{
+				{TargetLabel: "cluster", Replacement: str("prod")},
+			},
+			want: with(series(), "cluster", "prod"),
+		},
+		{
+			name: "replace with an empty replacement removes the label",
+			configs: []relabel.Config{
+				{SourceLabels: []string{"pci_bus_id"}, TargetLabel: "pci_bus_id", Replacement: str("")},
+			},
+			want: without(series(), "pci_bus_id"),
+		},
+		{
+			name: "replace leaves the label alone when the regex doesn't match",
+			configs: []relabel.Config{
+				{SourceLabels: []string{"modelName"}, Regex: str("AMD (.*)"), TargetLabel: "modelName"},
+			},
+			want: series(),
+		},
+		{
+			name: "labeldrop removes matching labels",
+			configs: []relabel.Config{
+				{Action: relabel.LabelDrop, Regex: str("pci_bus_id|DCGM_FI_DRIVER_VERSION")},
+			},
+			want: without(series(), "pci_bus_id", "DCGM_FI_DRIVER_VERSION"),
+		},
+		{
+			name: "labelkeep removes other labels but the metric name",
+			configs: []relabel.Config{
+				{Action: relabel.LabelKeep, Regex: str("UUID|Hostname")},
+			},
+			want: map[string]string{"__name__": "DCGM_FI_DEV_GPU_TEMP", "UUID": "GPU-1", "Hostname": "node-1"},
+		},
+		{
+			name: "labelmap copies matching labels to new names",
+			configs: []relabel.Config{
+				{Action: relabel.LabelMap, Regex: str("DCGM_FI_(.*)"), Replacement: str("dcgm_$1")},
+			},
+			want: with(series(), "dcgm_DRIVER_VERSION", "535.104.05"),
+		},
+		{
+			name: "hashmod sets the target label to the hash modulo",
+			configs: []relabel.Config{
+				{Action: relabel.HashMod, SourceLabels: []string{"UUID"}, Modulus: 1, TargetLabel: "shard"},
+			},
+			want: with(series(), "shard", "0"),
+		},
+		{
+			name: "configs are applied in order",
+			configs: []relabel.Config{
+				{SourceLabels: []string{"pci_bus_id"}, TargetLabel: "bus"},
+				{Action: relabel.LabelDrop, Regex: str("pci_bus_id")},
+				{Action: relabel.Drop, SourceLabels: []string{"bus"}, Regex: str("")},
+			},
+			want: with(without(series(), "pci_bus_id"), "bus", "00000000:00:1E.0"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := require.New(t)
+			relabeler, err := relabel.New(tt.configs)
+			r.NoError(err)
+
+			labels := tt.labels
+			if labels == nil {
+				labels = series()
+			}
+			kept := relabeler.Process(labels)
+			r.Equal(!tt.dropped, kept)
+			if kept {
+				r.Equal(tt.want, labels)
+			}
+		})
+	}
+}
+
+func TestRelabeler_HashMod(t *testing.T) {
+	r := require.New(t)
+	relabeler, err := relabel.New([]relabel.Config{
+		{Action: relabel.HashMod, SourceLabels: []string{"UUID"}, Modulus: 4, TargetLabel: "shard"},
+	})
+	r.NoError(err)
+
+	shards := make(map[string]struct{})
+	for _, uuid := range []string{"GPU-1", "GPU-2", "GPU-3", "GPU-4", "GPU-5", "GPU-6", "GPU-7", "GPU-8"} {
+		first := map[string]string{"UUID": uuid}
+		second := map[string]string{"UUID": uuid, "gpu": "1"}
+		r.True(relabeler.Process(first))
+		r.True(relabeler.Process(second))
+		r.Equal(first["shard"], second["shard"], "the shard only depends on the source labels")
+		r.Contains([]string{"0", "1", "2", "3"}, first["shard"])
+		shards[first["shard"]] = struct{}{}
+	}
+	r.Greater(len(shards), 1)
+}
+
+func TestNew_Validation(t *testing.T) {
+	tests := []struct {
+		name   string
+		config relabel.Config
+		err    string
+	}{
+		{"unknown action", relabel.Config{Action: "rename"}, `unsupported action "rename"`},
+		{"invalid regex", relabel.Config{Action: relabel.LabelDrop, Regex: str("(")}, "invalid regex"},
+		{"replace without target label", relabel.Config{SourceLabels: []string{"gpu"}}, "replace requires target_label"},
+		{"invalid target label", relabel.Config{TargetLabel: "gpu-index"}, `invalid target_label "gpu-index"`},
+		{"renaming metrics", relabel.Config{TargetLabel: "__name__"}, "target_label can't be __name__, renaming metrics isn't supported"},
+		{"hashmod without modulus", relabel.Config{Action: relabel.HashMod, TargetLabel: "shard"}, "hashmod requires a modulus greater than 0"},
+		{"hashmod without target label", relabel.Config{Action: relabel.HashMod, Modulus: 2}, "hashmod requires a valid target_label"},
+		{"keep without source labels", relabel.Config{Action: relabel.Keep}, "keep requires source_labels"},
+		{"labeldrop with source labels", relabel.Config{Action: relabel.LabelDrop, SourceLabels: []string{"gpu"}}, "labeldrop only matches label names with regex, source_labels and target_label aren't allowed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := relabel.New([]relabel.Config{tt.config})
+			require.ErrorContains(t, err, "relabel config 0: "+tt.err)
+		})
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	r := require.New(t)
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "relabel.yaml")
+	r.NoError(os.WriteFile(path, []byte(`
+relabel_configs:
+  - action: labeldrop
+    regex: pci_bus_id|DCGM_FI_DRIVER_VERSION
+  - source_labels: [modelName]
+    regex: "NVIDIA (.*)"
+    target_label: model
+`), 0o600))
+	relabeler, err := relabel.LoadFile(path)
+	r.NoError(err)
+	labels := series()
+	r.True(relabeler.Process(labels))
+	r.Equal(with(without(series(), "pci_bus_id", "DCGM_FI_DRIVER_VERSION"), "model", "A100"), labels)
+
+	invalid := filepath.Join(dir, "invalid.yaml")
+	r.NoError(os.WriteFile(invalid, []byte("relabel_configs:\n  - action: labeldrop\n    regexp: pci_bus_id\n"), 0o600))
+	_, err = relabel.LoadFile(invalid)
+	r.ErrorContains(err, "unknown field")
+}
+
+func with(labels map[string]string, name, value string) map[string]string {
+	labels[name] = value
+	return labels
+}
+
+func without(labels map[string]string, names ...string) map[string]string {
+	for _, name := range names {
+		delete(labels, name)
+	}
+	return labels
+}
@@ -0,0 +1,333 @@
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/snappy"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/castai/gpu-metrics-exporter/internal/castai"
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/gpu-metrics-exporter/pb"
+	"github.com/castai/logging"
+)
+
+const (
+	sinkName = "remote-write"
+
+	metricNameLabel    = "__name__"
+	nodeNameLabel      = "Hostname"
+	modelNameLabel     = "modelName"
+	deviceLabel        = "device"
+	gpuIDLabel         = "gpu"
+	gpuUUIDLabel       = "UUID"
+	gpuMIGProfile      = "GPU_I_PROFILE"
+	gpuInstanceID      = "GPU_I_ID"
+	podLabel           = "pod"
+	containerLabel     = "container"
+	namespaceLabel     = "namespace"
+	workloadNameLabel  = "workload_name"
+	workloadKindLabel  = "workload_kind"
+	remoteWriteVersion = "0.1.0"
+)
+
+var (
+	contentTypeHeader = http.CanonicalHeaderKey("Content-Type")
+	contentType       = "application/x-protobuf"
+
+	contentEncodingHeader = http.CanonicalHeaderKey("Content-Encoding")
+	contentEncoding       = "snappy"
+
+	versionHeader = http.CanonicalHeaderKey("X-Prometheus-Remote-Write-Version")
+
+	userAgentHeader = http.CanonicalHeaderKey("User-Agent")
+	userAgent       = "castai-gpu-metrics-exporter/"
+)
+
+type Config struct {
+	URL               string
+	Headers           map[string]string
+	ExternalLabels    map[string]string
+	Shards            int
+	QueueCapacity     int
+	MaxSamplesPerSend int
+	BatchSendDeadline time.Duration
+}
+
+// Sink pushes GPU metrics to a Prometheus remote-write endpoint. Samples are queued on Write
+// and sent by Start, which has to be running for anything to leave the process. Close has to be
+// called on shutdown, once nothing is written anymore, it waits for Start to return and sends the
+// samples which are still queued.
+type Sink interface {
+	exporter.Sink
+	Start(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+type sink struct {
+	cfg        Config
+	httpClient exporter.HTTPClient
+	log        *logging.Logger
+	userAgent  string
+	shards     []chan *pb.TimeSeries
+	// pending holds the samples every shard didn't send yet when Start returned, they're sent by Close
+	pending [][]*pb.TimeSeries
+	stopped chan struct{}
+}
+
+func NewSink(cfg Config, httpClient exporter.HTTPClient, log *logging.Logger, version string) (Sink, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("remote-write URL is required")
+	}
+	if cfg.Shards < 1 {
+		return nil, fmt.Errorf("remote-write shards must be positive, got %d", cfg.Shards)
+	}
+	if cfg.QueueCapacity < cfg.Shards {
+		return nil, fmt.Errorf("remote-write queue capacity %d is smaller than the number of shards %d", cfg.QueueCapacity, cfg.Shards)
+	}
+	if cfg.MaxSamplesPerSend < 1 {
+		return nil, fmt.Errorf("remote-write max samples per send must be positive, got %d", cfg.MaxSamplesPerSend)
+	}
+	if cfg.BatchSendDeadline <= 0 {
+		return nil, fmt.Errorf("remote-write batch send deadline must be positive, got %s", cfg.BatchSendDeadline)
+	}
+
+	shards := make([]chan *pb.TimeSeries, cfg.Shards)
+	for i := range shards {
+		shards[i] = make(chan *pb.TimeSeries, cfg.QueueCapacity/cfg.Shards)
+	}
+
+	return &sink{
+		cfg:        cfg,
+		httpClient: httpClient,
+		log:        log,
+		userAgent:  fmt.Sprintf("%s%s", userAgent, version),
+		shards:     shards,
+		pending:    make([][]*pb.TimeSeries, len(shards)),
+		stopped:    make(chan struct{}),
+	}, nil
+}
+
+func (s *sink) Name() string {
+	return sinkName
+}
+
+func (s *sink) Write(_ context.Context, metrics []exporter.GPUMetric) error {
+	dropped := 0
+	for i := range metrics {
+		for _, ts := range s.toTimeSeries(&metrics[i]) {
+			select {
+			case s.shards[shardFor(ts.Labels, len(s.shards))] <- ts:
+			default:
+				dropped++
+			}
+		}
+	}
+
+	if dropped > 0 {
+		return fmt.Errorf("remote-write queue is full, dropped %d samples", dropped)
+	}
+
+	return nil
+}
+
+func (s *sink) Start(ctx context.Context) error {
+	defer close(s.stopped)
+
+	var g errgroup.Group
+	for i := range s.shards {
+		g.Go(func() error {
+			s.pending[i] = s.runShard(ctx, s.shards[i])
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	return ctx.Err()
+}
+
+// runShard sends the samples of a shard until the context is done, and returns the ones which weren't sent yet.
+func (s *sink) runShard(ctx context.Context, queue <-chan *pb.TimeSeries) []*pb.TimeSeries {
+	ticker := time.NewTicker(s.cfg.BatchSendDeadline)
+	defer ticker.Stop()
+
+	pending := make([]*pb.TimeSeries, 0, s.cfg.MaxSamplesPerSend)
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		if err := s.send(ctx, pending); err != nil {
+			// samples interrupted by the shutdown are left to Close
+			if ctx.Err() != nil {
+				return
+			}
+			s.log.With("samples", len(pending), "error", err.Error()).Error("failed to send samples to remote-write endpoint")
+		}
+		pending = pending[:0]
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return pending
+		case ts := <-queue:
+			pending = append(pending, ts)
+			if len(pending) >= s.cfg.MaxSamplesPerSend {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (s *sink) Close(ctx context.Context) error {
+	select {
+	case <-s.stopped:
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for the remote-write shards to stop: %w", ctx.Err())
+	}
+
+	var g errgroup.Group
+	for i, queue := range s.shards {
+		g.Go(func() error {
+			pending := s.pending[i]
+			for drained := false; !drained; {
+				select {
+				case ts := <-queue:
+					pending = append(pending, ts)
+				default:
+					drained = true
+				}
+			}
+
+			for len(pending) > 0 {
+				n := min(len(pending), s.cfg.MaxSamplesPerSend)
+				if err := s.send(ctx, pending[:n]); err != nil {
+					return fmt.Errorf("flushing %d samples: %w", len(pending), err)
+				}
+				pending = pending[n:]
+			}
+			return nil
+		})
+	}
+
+	return g.Wait()
+}
+
+func (s *sink) send(ctx context.Context, series []*pb.TimeSeries) error {
+	data, err := proto.Marshal(&pb.WriteRequest{Timeseries: series})
+	if err != nil {
+		return fmt.Errorf("error marshaling write request %w", err)
+	}
+	payload := snappy.Encode(nil, data)
+
+	return castai.Retry(ctx, s.log, func(ctx context.Context) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.URL, bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("cannot create request %w", err)
+		}
+		for name, value := range s.cfg.Headers {
+			req.Header.Set(name, value)
+		}
+		req.Header.Set(contentTypeHeader, contentType)
+		req.Header.Set(contentEncodingHeader, contentEncoding)
+		req.Header.Set(versionHeader, remoteWriteVersion)
+		req.Header.Set(userAgentHeader, s.userAgent)
+
+		resp, err := s.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+
+		return resp, nil
+	})
+}
+
+func (s *sink) toTimeSeries(m *exporter.GPUMetric) []*pb.TimeSeries {
+	labels := s.seriesLabels(m)
+	timestamp := m.Timestamp.UnixMilli()
+
+	series := make([]*pb.TimeSeries, 0, len(exporter.GPUMetricFields))
+	for _, field := range exporter.GPUMetricFields {
+		value, ok := field.Value(m)
+		if !ok {
+			continue
+		}
+		seriesLabels := make([]*pb.Label, 0, len(labels)+1)
+		seriesLabels = append(seriesLabels, &pb.Label{Name: metricNameLabel, Value: field.Name})
+		seriesLabels = append(seriesLabels, labels...)
+		sortLabels(seriesLabels)
+
+		series = append(series, &pb.TimeSeries{
+			Labels:  seriesLabels,
+			Samples: []*pb.Sample{{Value: value, Timestamp: timestamp}},
+		})
+	}
+
+	return series
+}
+
+func (s *sink) seriesLabels(m *exporter.GPUMetric) []*pb.Label {
+	values := map[string]string{
+		nodeNameLabel:     m.NodeName,
+		modelNameLabel:    m.ModelName,
+		deviceLabel:       m.Device,
+		gpuIDLabel:        m.DeviceID,
+		gpuUUIDLabel:      m.DeviceUUID,
+		gpuMIGProfile:     m.MIGProfile,
+		gpuInstanceID:     m.MIGInstanceID,
+		podLabel:          m.Pod,
+		containerLabel:    m.Container,
+		namespaceLabel:    m.Namespace,
+		workloadNameLabel: m.WorkloadName,
+		workloadKindLabel: m.WorkloadKind,
+	}
+	// external labels never override labels of the series itself
+	for name, value := range s.cfg.ExternalLabels {
+		if values[name] == "" {
+			values[name] = value
+		}
+	}
+
+	labels := make([]*pb.Label, 0, len(values))
+	for name, value := range values {
+		// empty label values are equivalent to a missing label in Prometheus
+		if value == "" {
+			continue
+		}
+		labels = append(labels, &pb.Label{Name: name, Value: value})
+	}
+
+	return labels
+}
+
+func sortLabels(labels []*pb.Label) {
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+}
+
+// shardFor keeps every series on the same shard so that its samples are sent in order.
+func shardFor(labels []*pb.Label, shards int) int {
+	h := fnv.New64a()
+	for _, l := range labels {
+		_, _ = h.Write([]byte(l.Name))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(l.Value))
+		_, _ = h.Write([]byte{0})
+	}
+
+	return int(h.Sum64() % uint64(shards)) // nolint:gosec // G115: shards is a small positive number
+}
@@ -0,0 +1,251 @@
+package remotewrite_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/gpu-metrics-exporter/internal/remotewrite"
+	"github.com/castai/gpu-metrics-exporter/pb"
+	"github.com/castai/logging"
+)
+
+func newTestConfig(url string) remotewrite.Config {
+	return remotewrite.Config{
+		URL:               url,
+		Headers:           map[string]string{"X-Scope-OrgID": "tenant-1"},
+		ExternalLabels:    map[string]string{"cluster": "cluster-1", "namespace": "ignored"},
+		Shards:            2,
+		QueueCapacity:     1000,
+		MaxSamplesPerSend: 1000,
+		BatchSendDeadline: 50 * time.Millisecond,
+	}
+}
+
+func newTestMetric(ts time.Time) exporter.GPUMetric {
+	return exporter.GPUMetric{
+		NodeName:     "node-1",
+		ModelName:    "Tesla T4",
+		Device:       "nvidia0",
+		DeviceID:     "0",
+		DeviceUUID:   "GPU-93461651",
+		Pod:          "trainer-0",
+		Container:    "trainer",
+		Namespace:    "ml",
+		WorkloadName: "trainer",
+		WorkloadKind: "StatefulSet",
+		Temperature:  ptr(40.0),
+		Timestamp:    ts,
+	}
+}
+
+func decodeWriteRequest(t *testing.T, req *http.Request) *pb.WriteRequest {
+	t.Helper()
+
+	compressed, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	data, err := snappy.Decode(nil, compressed)
+	require.NoError(t, err)
+
+	writeRequest := &pb.WriteRequest{}
+	require.NoError(t, proto.Unmarshal(data, writeRequest))
+	return writeRequest
+}
+
+func labelsToMap(labels []*pb.Label) map[string]string {
+	m := make(map[string]string, len(labels))
+	for _, l := range labels {
+		m[l.Name] = l.Value
+	}
+	return m
+}
+
+func TestSink(t *testing.T) {
+	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
+
+	t.Run("pushes snappy compressed series with workload and external labels", func(t *testing.T) {
+		r := require.New(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		received := make(chan *pb.TimeSeries, 100)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			r.Equal("snappy", req.Header.Get("Content-Encoding"))
+			r.Equal("application/x-protobuf", req.Header.Get("Content-Type"))
+			r.Equal("0.1.0", req.Header.Get("X-Prometheus-Remote-Write-Version"))
+			r.Equal("tenant-1", req.Header.Get("X-Scope-OrgID"))
+			r.Equal("castai-gpu-metrics-exporter/test", req.Header.Get("User-Agent"))
+
+			for _, ts := range decodeWriteRequest(t, req).Timeseries {
+				received <- ts
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer srv.Close()
+
+		sink, err := remotewrite.NewSink(newTestConfig(srv.URL), srv.Client(), log, "test")
+		r.NoError(err)
+		go func() { _ = sink.Start(ctx) }()
+
+		now := time.Now()
+		row := newTestMetric(now)
+		r.NoError(sink.Write(ctx, []exporter.GPUMetric{row}))
+
+		// fields which weren't reported aren't pushed
+		var reported int
+		for _, field := range exporter.GPUMetricFields {
+			if _, ok := field.Value(&row); ok {
+				reported++
+			}
+		}
+		series := make(map[string]*pb.TimeSeries)
+		for len(series) < reported {
+			select {
+			case ts := <-received:
+				series[labelsToMap(ts.Labels)["__name__"]] = ts
+			case <-time.After(5 * time.Second):
+				r.FailNow("timed out waiting for series")
+			}
+		}
+
+		r.NotContains(series, exporter.MetricPowerUsage)
+		temperature := series[exporter.MetricGPUTemperature]
+		r.NotNil(temperature)
+		r.Equal(map[string]string{
+			"__name__":      exporter.MetricGPUTemperature,
+			"Hostname":      "node-1",
+			"modelName":     "Tesla T4",
+			"device":        "nvidia0",
+			"gpu":           "0",
+			"UUID":          "GPU-93461651",
+			"pod":           "trainer-0",
+			"container":     "trainer",
+			"namespace":     "ml",
+			"workload_name": "trainer",
+			"workload_kind": "StatefulSet",
+			"cluster":       "cluster-1",
+		}, labelsToMap(temperature.Labels))
+		r.IsIncreasing(func() []string {
+			names := make([]string, len(temperature.Labels))
+			for i, l := range temperature.Labels {
+				names[i] = l.Name
+			}
+			return names
+		}())
+		r.Equal([]*pb.Sample{{Value: 40, Timestamp: now.UnixMilli()}}, temperature.Samples)
+	})
+
+	t.Run("retries on server errors", func(t *testing.T) {
+		r := require.New(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var attempts atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if attempts.Add(1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer srv.Close()
+
+		cfg := newTestConfig(srv.URL)
+		cfg.Shards = 1
+		sink, err := remotewrite.NewSink(cfg, srv.Client(), log, "test")
+		r.NoError(err)
+		go func() { _ = sink.Start(ctx) }()
+
+		r.NoError(sink.Write(ctx, []exporter.GPUMetric{newTestMetric(time.Now())}))
+		r.Eventually(func() bool { return attempts.Load() == 2 }, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("sends the samples which are still queued on close", func(t *testing.T) {
+		r := require.New(t)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var received atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			received.Add(int32(len(decodeWriteRequest(t, req).Timeseries)))
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer srv.Close()
+
+		cfg := newTestConfig(srv.URL)
+		cfg.BatchSendDeadline = time.Hour
+		cfg.MaxSamplesPerSend = 2
+		sink, err := remotewrite.NewSink(cfg, srv.Client(), log, "test")
+		r.NoError(err)
+		started := make(chan error, 1)
+		go func() { started <- sink.Start(ctx) }()
+
+		row := newTestMetric(time.Now())
+		r.NoError(sink.Write(ctx, []exporter.GPUMetric{row, row}))
+		cancel()
+		r.ErrorIs(<-started, context.Canceled)
+		r.Zero(received.Load())
+
+		closeCtx, closeCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer closeCancel()
+		r.NoError(sink.Close(closeCtx))
+		var reported int32
+		for _, field := range exporter.GPUMetricFields {
+			if _, ok := field.Value(&row); ok {
+				reported++
+			}
+		}
+		r.Equal(2*reported, received.Load())
+	})
+
+	t.Run("doesn't wait for the shards to stop past the deadline of close", func(t *testing.T) {
+		r := require.New(t)
+
+		sink, err := remotewrite.NewSink(newTestConfig("http://localhost"), http.DefaultClient, log, "test")
+		r.NoError(err)
+		running, stop := context.WithCancel(context.Background())
+		defer stop()
+		go func() { _ = sink.Start(running) }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		r.ErrorIs(sink.Close(ctx), context.DeadlineExceeded)
+	})
+
+	t.Run("drops samples when the queue is full", func(t *testing.T) {
+		r := require.New(t)
+
+		cfg := newTestConfig("http://localhost")
+		cfg.Shards = 1
+		cfg.QueueCapacity = 1
+		sink, err := remotewrite.NewSink(cfg, http.DefaultClient, log, "test")
+		r.NoError(err)
+
+		// the temperature and the power don't fit into a queue of one sample
+		metric := newTestMetric(time.Now())
+		metric.PowerUsage = ptr(70.0)
+		err = sink.Write(context.Background(), []exporter.GPUMetric{metric})
+		r.ErrorContains(err, "dropped")
+	})
+
+	t.Run("rejects invalid configuration", func(t *testing.T) {
+		r := require.New(t)
+
+		cfg := newTestConfig("http://localhost")
+		cfg.Shards = 0
+		_, err := remotewrite.NewSink(cfg, http.DefaultClient, log, "test")
+		r.Error(err)
+	})
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,187 @@
+package rowsink
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/hamba/avro/v2"
+	"github.com/hamba/avro/v2/ocf"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+)
+
+const (
+	FormatJSON = "json"
+	FormatAvro = "avro"
+
+	// schemaName matches the collection the rows are written to in the custom metrics API.
+	schemaName = "gpu_metrics"
+)
+
+// singleObjectMagic prefixes Avro single-object encoded messages, see
+// https://avro.apache.org/docs/1.11.1/specification/#single-object-encoding
+var singleObjectMagic = []byte{0xC3, 0x01}
+
+// rowEncoder writes GPUMetric rows to a stream in one of the supported formats.
+type rowEncoder interface {
+	Encode(m *exporter.GPUMetric) error
+	// Flush writes buffered rows, it doesn't close the underlying writer.
+	Flush() error
+}
+
+func validateFormat(format string) error {
+	if format != FormatJSON && format != FormatAvro {
+		return fmt.Errorf("unsupported format %q, expected %q or %q", format, FormatJSON, FormatAvro)
+	}
+	return nil
+}
+
+func newStreamEncoder(format string, schema avro.Schema, w io.Writer) (rowEncoder, error) {
+	switch format {
+	case FormatJSON:
+		return &jsonEncoder{encoder: json.NewEncoder(w)}, nil
+	case FormatAvro:
+		encoder, err := ocf.NewEncoderWithSchema(schema, w)
+		if err != nil {
+			return nil, fmt.Errorf("creating avro container encoder: %w", err)
+		}
+		return &avroEncoder{encoder: encoder}, nil
+	default:
+		return nil, validateFormat(format)
+	}
+}
+
+type jsonEncoder struct {
+	encoder *json.Encoder
+}
+
+func (e *jsonEncoder) Encode(m *exporter.GPUMetric) error {
+	return e.encoder.Encode(m)
+}
+
+func (e *jsonEncoder) Flush() error {
+	return nil
+}
+
+type avroEncoder struct {
+	encoder *ocf.Encoder
+}
+
+func (e *avroEncoder) Encode(m *exporter.GPUMetric) error {
+	return e.encoder.Encode(m)
+}
+
+func (e *avroEncoder) Flush() error {
+	return e.encoder.Flush()
+}
+
+// messageEncoder encodes a single row as a self-contained message.
+type messageEncoder struct {
+	format string
+	schema avro.Schema
+	header []byte
+}
+
+func newMessageEncoder(format string, schema avro.Schema) (*messageEncoder, error) {
+	if err := validateFormat(format); err != nil {
+		return nil, err
+	}
+
+	fingerprint, err := schema.FingerprintUsing(avro.CRC64Avro)
+	if err != nil {
+		return nil, fmt.Errorf("computing schema fingerprint: %w", err)
+	}
+	// the single-object encoding stores the fingerprint in little-endian order
+	fingerprint = slices.Clone(fingerprint)
+	slices.Reverse(fingerprint)
+
+	return &messageEncoder{
+		format: format,
+		schema: schema,
+		header: append(slices.Clone(singleObjectMagic), fingerprint...),
+	}, nil
+}
+
+func (e *messageEncoder) Encode(m *exporter.GPUMetric) ([]byte, error) {
+	if e.format == FormatJSON {
+		return json.Marshal(m)
+	}
+
+	data, err := avro.Marshal(e.schema, m)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(slices.Clone(e.header), data...), nil
+}
+
+// Schema derives the Avro schema of GPUMetric from its avro tags the same way the metrics
+// library does for the custom metrics API, so rows from all destinations share one schema.
+func Schema() (avro.Schema, error) {
+	return structSchema(schemaName, reflect.TypeOf(exporter.GPUMetric{}))
+}
+
+func structSchema(name string, t reflect.Type) (*avro.RecordSchema, error) {
+	fields := make([]*avro.Field, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("avro")
+		if tag == "" {
+			continue
+		}
+
+		schema, err := typeSchema(f.Type)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.Name, err)
+		}
+		field, err := avro.NewField(tag, schema)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.Name, err)
+		}
+		fields = append(fields, field)
+	}
+
+	return avro.NewRecordSchema(name, "", fields)
+}
+
+func typeSchema(t reflect.Type) (avro.Schema, error) {
+	if t == reflect.TypeOf(time.Time{}) {
+		return avro.NewPrimitiveSchema(avro.Long, avro.NewPrimitiveLogicalSchema(avro.TimestampMillis)), nil
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		elem, err := typeSchema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return avro.NewUnionSchema([]avro.Schema{avro.NewPrimitiveSchema(avro.Null, nil), elem})
+	case reflect.String:
+		return avro.NewPrimitiveSchema(avro.String, nil), nil
+	case reflect.Bool:
+		return avro.NewPrimitiveSchema(avro.Boolean, nil), nil
+	case reflect.Int, reflect.Int64, reflect.Uint32:
+		return avro.NewPrimitiveSchema(avro.Long, nil), nil
+	case reflect.Int32, reflect.Int16, reflect.Int8, reflect.Uint16, reflect.Uint8:
+		return avro.NewPrimitiveSchema(avro.Int, nil), nil
+	case reflect.Float32:
+		return avro.NewPrimitiveSchema(avro.Float, nil), nil
+	case reflect.Float64:
+		return avro.NewPrimitiveSchema(avro.Double, nil), nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("unsupported map key type %v", t.Key())
+		}
+		values, err := typeSchema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return avro.NewMapSchema(values), nil
+	default:
+		return nil, fmt.Errorf("unsupported kind %v", t.Kind())
+	}
+}
@@ -0,0 +1,301 @@
+package rowsink
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hamba/avro/v2"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/logging"
+)
+
+const (
+	fileSinkName = "file"
+
+	rotatedTimeFormat = "20060102T150405.000"
+	gzipExtension     = ".gz"
+)
+
+type FileConfig struct {
+	// Path of the active file, rotated files are created next to it.
+	Path   string
+	Format string
+	// MaxSize rotates the file once it grows past the given number of bytes, 0 disables size based rotation.
+	MaxSize int64
+	// MaxAge rotates the file once it has been open for the given duration, 0 disables time based rotation.
+	MaxAge time.Duration
+	// MaxBackups is the number of rotated files to keep, 0 keeps all of them.
+	MaxBackups int
+	Compress   bool
+}
+
+// FileSink writes the GPU metric rows to a local file. Close has to be called on shutdown, it closes the file and
+// waits for rotated files to be compressed.
+type FileSink interface {
+	exporter.Sink
+	io.Closer
+}
+
+type fileSink struct {
+	cfg    FileConfig
+	log    *logging.Logger
+	schema avro.Schema
+
+	mu       sync.Mutex
+	file     *os.File
+	counter  *countingWriter
+	encoder  rowEncoder
+	openedAt time.Time
+	closed   bool
+
+	// archiveMu serializes compressing rotated files and removing old backups, which happen in the background
+	archiveMu sync.Mutex
+	archiving sync.WaitGroup
+}
+
+func NewFileSink(cfg FileConfig, log *logging.Logger) (FileSink, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("file sink path is required")
+	}
+	if err := validateFormat(cfg.Format); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0o750); err != nil {
+		return nil, fmt.Errorf("creating file sink directory: %w", err)
+	}
+
+	schema, err := Schema()
+	if err != nil {
+		return nil, fmt.Errorf("creating avro schema: %w", err)
+	}
+
+	return &fileSink{
+		cfg:    cfg,
+		log:    log,
+		schema: schema,
+	}, nil
+}
+
+func (s *fileSink) Name() string {
+	return fileSinkName
+}
+
+func (s *fileSink) Write(_ context.Context, metrics []exporter.GPUMetric) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errors.New("file sink is closed")
+	}
+	if s.file != nil && s.shouldRotate() {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	for i := range metrics {
+		if err := s.encoder.Encode(&metrics[i]); err != nil {
+			return fmt.Errorf("encoding row: %w", err)
+		}
+	}
+
+	return s.encoder.Flush()
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.file != nil {
+		if closeErr := s.file.Close(); closeErr != nil {
+			err = fmt.Errorf("closing %s: %w", s.cfg.Path, closeErr)
+		}
+		s.file = nil
+		s.counter = nil
+		s.encoder = nil
+	}
+	s.closed = true
+	s.archiving.Wait()
+
+	return err
+}
+
+func (s *fileSink) shouldRotate() bool {
+	if s.cfg.MaxSize > 0 && s.counter.n >= s.cfg.MaxSize {
+		return true
+	}
+	return s.cfg.MaxAge > 0 && time.Since(s.openedAt) >= s.cfg.MaxAge
+}
+
+func (s *fileSink) open() error {
+	// A file left behind by a previous run is rotated instead of appended to, Avro container
+	// files can't be continued by a new writer.
+	if info, err := os.Stat(s.cfg.Path); err == nil && info.Size() > 0 {
+		if err := s.archive(); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(s.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", s.cfg.Path, err)
+	}
+
+	counter := &countingWriter{w: f}
+	encoder, err := newStreamEncoder(s.cfg.Format, s.schema, counter)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	s.file = f
+	s.counter = counter
+	s.encoder = encoder
+	s.openedAt = time.Now()
+
+	return nil
+}
+
+func (s *fileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("closing %s: %w", s.cfg.Path, err)
+	}
+	s.file = nil
+	s.counter = nil
+	s.encoder = nil
+
+	return s.archive()
+}
+
+// archive moves the active file aside, then compresses it when configured and removes the oldest backups in the
+// background, so that writing rows isn't held up by them.
+func (s *fileSink) archive() error {
+	ext := filepath.Ext(s.cfg.Path)
+	base := strings.TrimSuffix(s.cfg.Path, ext)
+	rotated := fmt.Sprintf("%s-%s%s", base, time.Now().UTC().Format(rotatedTimeFormat), ext)
+
+	if err := os.Rename(s.cfg.Path, rotated); err != nil {
+		return fmt.Errorf("rotating %s: %w", s.cfg.Path, err)
+	}
+
+	s.archiving.Add(1)
+	go func() {
+		defer s.archiving.Done()
+		s.archiveMu.Lock()
+		defer s.archiveMu.Unlock()
+
+		if s.cfg.Compress {
+			if err := compressFile(rotated); err != nil {
+				// the uncompressed file is kept, so no rows are lost
+				s.log.With("file", rotated, "error", err.Error()).Warn("failed to compress rotated file")
+			}
+		}
+		if err := s.removeOldBackups(base, ext); err != nil {
+			s.log.WithField("error", err.Error()).Warn("failed to remove old rotated files")
+		}
+	}()
+
+	return nil
+}
+
+func (s *fileSink) removeOldBackups(base, ext string) error {
+	if s.cfg.MaxBackups <= 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(base))
+	if err != nil {
+		return fmt.Errorf("listing rotated files: %w", err)
+	}
+	var rotated []string
+	for _, entry := range entries {
+		if !entry.IsDir() && isRotatedFile(entry.Name(), filepath.Base(base), ext) {
+			rotated = append(rotated, filepath.Join(filepath.Dir(base), entry.Name()))
+		}
+	}
+	if len(rotated) <= s.cfg.MaxBackups {
+		return nil
+	}
+
+	// the timestamp in the name sorts chronologically
+	sort.Strings(rotated)
+	for _, old := range rotated[:len(rotated)-s.cfg.MaxBackups] {
+		if err := os.Remove(old); err != nil {
+			s.log.With("file", old, "error", err.Error()).Warn("failed to remove rotated file")
+		}
+	}
+
+	return nil
+}
+
+// isRotatedFile tells whether name is a file rotated by archive, base-<timestamp><ext>, compressed or not.
+func isRotatedFile(name, base, ext string) bool {
+	timestamp, found := strings.CutPrefix(name, base+"-")
+	if !found {
+		return false
+	}
+	timestamp = strings.TrimSuffix(timestamp, gzipExtension)
+	if timestamp, found = strings.CutSuffix(timestamp, ext); !found {
+		return false
+	}
+	_, err := time.Parse(rotatedTimeFormat, timestamp)
+	return err == nil
+}
+
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+gzipExtension, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+
+	writer := gzip.NewWriter(dst)
+	if _, err := io.Copy(writer, src); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(dst.Name())
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(dst.Name())
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		_ = os.Remove(dst.Name())
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,228 @@
+package rowsink_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hamba/avro/v2/ocf"
+	"github.com/stretchr/testify/require"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/gpu-metrics-exporter/internal/rowsink"
+	"github.com/castai/logging"
+)
+
+func newTestRows(ts time.Time) []exporter.GPUMetric {
+	return []exporter.GPUMetric{
+		{
+			NodeName:     "node-1",
+			ModelName:    "NVIDIA A100",
+			DeviceID:     "0",
+			DeviceUUID:   "GPU-1",
+			Pod:          "trainer-0",
+			Namespace:    "ml",
+			WorkloadName: "trainer",
+			WorkloadKind: "StatefulSet",
+			PowerUsage:   ptr(250.0),
+			Timestamp:    ts,
+		},
+		{
+			NodeName:   "node-1",
+			DeviceID:   "1",
+			DeviceUUID: "GPU-2",
+			PowerUsage: ptr(70.0),
+			Timestamp:  ts,
+		},
+	}
+}
+
+func readJSONLines(r *require.Assertions, path string) []exporter.GPUMetric {
+	f, err := os.Open(path)
+	r.NoError(err)
+	defer f.Close()
+
+	var rows []exporter.GPUMetric
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var row exporter.GPUMetric
+		r.NoError(json.Unmarshal(scanner.Bytes(), &row))
+		rows = append(rows, row)
+	}
+	r.NoError(scanner.Err())
+
+	return rows
+}
+
+func rotatedFiles(r *require.Assertions, dir string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, "gpu-metrics-*"))
+	r.NoError(err)
+	return matches
+}
+
+func TestFileSink(t *testing.T) {
+	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
+	ctx := context.Background()
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("writes json lines", func(t *testing.T) {
+		r := require.New(t)
+		path := filepath.Join(t.TempDir(), "gpu-metrics.ndjson")
+
+		sink, err := rowsink.NewFileSink(rowsink.FileConfig{Path: path, Format: rowsink.FormatJSON}, log)
+		r.NoError(err)
+		r.Equal("file", sink.Name())
+
+		r.NoError(sink.Write(ctx, newTestRows(ts)))
+		r.NoError(sink.Write(ctx, newTestRows(ts)[:1]))
+
+		rows := readJSONLines(r, path)
+		r.Len(rows, 3)
+		r.Equal("GPU-1", rows[0].DeviceUUID)
+		r.Equal("trainer", rows[0].WorkloadName)
+		r.Equal(250.0, *rows[0].PowerUsage)
+		r.True(ts.Equal(rows[0].Timestamp))
+		r.Equal("GPU-2", rows[1].DeviceUUID)
+	})
+
+	t.Run("writes an avro container file", func(t *testing.T) {
+		r := require.New(t)
+		path := filepath.Join(t.TempDir(), "gpu-metrics.avro")
+
+		sink, err := rowsink.NewFileSink(rowsink.FileConfig{Path: path, Format: rowsink.FormatAvro}, log)
+		r.NoError(err)
+		r.NoError(sink.Write(ctx, newTestRows(ts)))
+
+		f, err := os.Open(path)
+		r.NoError(err)
+		defer f.Close()
+		decoder, err := ocf.NewDecoder(f)
+		r.NoError(err)
+
+		var rows []exporter.GPUMetric
+		for decoder.HasNext() {
+			var row exporter.GPUMetric
+			r.NoError(decoder.Decode(&row))
+			rows = append(rows, row)
+		}
+		r.NoError(decoder.Error())
+		r.Len(rows, 2)
+		r.Equal("GPU-1", rows[0].DeviceUUID)
+		r.Equal(250.0, *rows[0].PowerUsage)
+		r.True(ts.Equal(rows[0].Timestamp))
+		// fields which weren't reported are null rather than 0
+		r.Nil(rows[0].Temperature)
+	})
+
+	t.Run("rotates by size and compresses rotated files", func(t *testing.T) {
+		r := require.New(t)
+		dir := t.TempDir()
+		path := filepath.Join(dir, "gpu-metrics.ndjson")
+
+		sink, err := rowsink.NewFileSink(rowsink.FileConfig{
+			Path:     path,
+			Format:   rowsink.FormatJSON,
+			MaxSize:  1,
+			Compress: true,
+		}, log)
+		r.NoError(err)
+
+		r.NoError(sink.Write(ctx, newTestRows(ts)))
+		r.NoError(sink.Write(ctx, newTestRows(ts)[:1]))
+		// rotated files are compressed in the background, closing waits for them
+		r.NoError(sink.Close())
+		r.Error(sink.Write(ctx, newTestRows(ts)))
+
+		rotated := rotatedFiles(r, dir)
+		r.Len(rotated, 1)
+		r.Equal(".gz", filepath.Ext(rotated[0]))
+
+		f, err := os.Open(rotated[0])
+		r.NoError(err)
+		defer f.Close()
+		reader, err := gzip.NewReader(f)
+		r.NoError(err)
+		var rows []exporter.GPUMetric
+		decoder := json.NewDecoder(reader)
+		for decoder.More() {
+			var row exporter.GPUMetric
+			r.NoError(decoder.Decode(&row))
+			rows = append(rows, row)
+		}
+		r.Len(rows, 2)
+
+		r.Len(readJSONLines(r, path), 1)
+	})
+
+	t.Run("rotates by age and keeps max backups", func(t *testing.T) {
+		r := require.New(t)
+		dir := t.TempDir()
+		path := filepath.Join(dir, "gpu-metrics.ndjson")
+
+		sink, err := rowsink.NewFileSink(rowsink.FileConfig{
+			Path:       path,
+			Format:     rowsink.FormatJSON,
+			MaxAge:     10 * time.Millisecond,
+			MaxBackups: 2,
+		}, log)
+		r.NoError(err)
+
+		// files which merely look like rotated ones are left alone
+		unrelated := []string{
+			filepath.Join(dir, "gpu-metrics-backup.ndjson"),
+			filepath.Join(dir, "gpu-metrics-20240501T120000.000.ndjson.bak"),
+		}
+		for _, name := range unrelated {
+			r.NoError(os.WriteFile(name, []byte("unrelated"), 0o600))
+		}
+
+		for i := 0; i < 4; i++ {
+			r.NoError(sink.Write(ctx, newTestRows(ts)[:1]))
+			time.Sleep(20 * time.Millisecond)
+		}
+		r.NoError(sink.Close())
+
+		r.Len(rotatedFiles(r, dir), 2+len(unrelated))
+		for _, name := range unrelated {
+			r.FileExists(name)
+		}
+		r.Len(readJSONLines(r, path), 1)
+	})
+
+	t.Run("rotates a file left by a previous run", func(t *testing.T) {
+		r := require.New(t)
+		dir := t.TempDir()
+		path := filepath.Join(dir, "gpu-metrics.avro")
+		r.NoError(os.WriteFile(path, []byte("previous"), 0o600))
+
+		sink, err := rowsink.NewFileSink(rowsink.FileConfig{Path: path, Format: rowsink.FormatAvro}, log)
+		r.NoError(err)
+		r.NoError(sink.Write(ctx, newTestRows(ts)))
+		r.NoError(sink.Close())
+
+		rotated := rotatedFiles(r, dir)
+		r.Len(rotated, 1)
+		content, err := os.ReadFile(rotated[0])
+		r.NoError(err)
+		r.Equal("previous", string(content))
+	})
+
+	t.Run("rejects invalid configuration", func(t *testing.T) {
+		r := require.New(t)
+
+		_, err := rowsink.NewFileSink(rowsink.FileConfig{Format: rowsink.FormatJSON}, log)
+		r.Error(err)
+
+		_, err = rowsink.NewFileSink(rowsink.FileConfig{Path: filepath.Join(t.TempDir(), "rows"), Format: "csv"}, log)
+		r.Error(err)
+	})
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,120 @@
+package rowsink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+)
+
+const (
+	kafkaSinkName = "kafka"
+
+	KeyDeviceUUID   = "device_uuid"
+	KeyNodeName     = "node_name"
+	KeyPod          = "pod"
+	KeyWorkloadName = "workload_name"
+	KeyNone         = "none"
+)
+
+var messageKeys = map[string]func(m *exporter.GPUMetric) string{
+	KeyDeviceUUID:   func(m *exporter.GPUMetric) string { return m.DeviceUUID },
+	KeyNodeName:     func(m *exporter.GPUMetric) string { return m.NodeName },
+	KeyPod:          func(m *exporter.GPUMetric) string { return m.Namespace + "/" + m.Pod },
+	KeyWorkloadName: func(m *exporter.GPUMetric) string { return m.Namespace + "/" + m.WorkloadName },
+	KeyNone:         nil,
+}
+
+type KafkaConfig struct {
+	Brokers []string
+	Topic   string
+	// Key selects the row field used as the message key, which decides the partition of the row.
+	Key          string
+	Format       string
+	WriteTimeout time.Duration
+}
+
+// MessageWriter is implemented by *kafka.Writer.
+type MessageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+type kafkaSink struct {
+	writer  MessageWriter
+	encoder *messageEncoder
+	key     func(m *exporter.GPUMetric) string
+}
+
+// NewKafkaWriter creates a writer which hashes message keys to partitions, so rows with the same key stay ordered.
+func NewKafkaWriter(cfg KafkaConfig) (*kafka.Writer, error) {
+	if len(cfg.Brokers) == 0 {
+		return nil, errors.New("kafka brokers are required")
+	}
+	if cfg.Topic == "" {
+		return nil, errors.New("kafka topic is required")
+	}
+
+	return &kafka.Writer{
+		Addr:         kafka.TCP(cfg.Brokers...),
+		Topic:        cfg.Topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		Compression:  kafka.Snappy,
+		WriteTimeout: cfg.WriteTimeout,
+	}, nil
+}
+
+func NewKafkaSink(cfg KafkaConfig, writer MessageWriter) (exporter.Sink, error) {
+	key, found := messageKeys[cfg.Key]
+	if !found {
+		return nil, fmt.Errorf("unsupported kafka message key %q", cfg.Key)
+	}
+
+	schema, err := Schema()
+	if err != nil {
+		return nil, fmt.Errorf("creating avro schema: %w", err)
+	}
+	encoder, err := newMessageEncoder(cfg.Format, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kafkaSink{
+		writer:  writer,
+		encoder: encoder,
+		key:     key,
+	}, nil
+}
+
+func (s *kafkaSink) Name() string {
+	return kafkaSinkName
+}
+
+func (s *kafkaSink) Write(ctx context.Context, metrics []exporter.GPUMetric) error {
+	messages := make([]kafka.Message, 0, len(metrics))
+	for i := range metrics {
+		value, err := s.encoder.Encode(&metrics[i])
+		if err != nil {
+			return fmt.Errorf("encoding row: %w", err)
+		}
+
+		message := kafka.Message{
+			Value: value,
+			Time:  metrics[i].Timestamp,
+		}
+		if s.key != nil {
+			message.Key = []byte(s.key(&metrics[i]))
+		}
+		messages = append(messages, message)
+	}
+
+	if err := s.writer.WriteMessages(ctx, messages...); err != nil {
+		return fmt.Errorf("writing %d messages to kafka: %w", len(messages), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package rowsink_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/hamba/avro/v2"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/gpu-metrics-exporter/internal/rowsink"
+)
+
+type fakeWriter struct {
+	messages []kafka.Message
+	err      error
+}
+
+func (w *fakeWriter) WriteMessages(_ context.Context, msgs ...kafka.Message) error {
+	w.messages = append(w.messages, msgs...)
+	return w.err
+}
+
+func TestKafkaSink(t *testing.T) {
+	ctx := context.Background()
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("produces json rows keyed by device uuid", func(t *testing.T) {
+		r := require.New(t)
+		writer := &fakeWriter{}
+
+		sink, err := rowsink.NewKafkaSink(rowsink.KafkaConfig{
+			Topic:  "gpu-metrics",
+			Key:    rowsink.KeyDeviceUUID,
+			Format: rowsink.FormatJSON,
+		}, writer)
+		r.NoError(err)
+		r.Equal("kafka", sink.Name())
+
+		r.NoError(sink.Write(ctx, newTestRows(ts)))
+
+		r.Len(writer.messages, 2)
+		r.Equal("GPU-1", string(writer.messages[0].Key))
+		r.Equal("GPU-2", string(writer.messages[1].Key))
+		r.True(ts.Equal(writer.messages[0].Time))
+
+		var row exporter.GPUMetric
+		r.NoError(json.Unmarshal(writer.messages[0].Value, &row))
+		r.Equal("trainer-0", row.Pod)
+		r.Equal(250.0, *row.PowerUsage)
+	})
+
+	t.Run("produces avro single-object encoded rows", func(t *testing.T) {
+		r := require.New(t)
+		writer := &fakeWriter{}
+
+		sink, err := rowsink.NewKafkaSink(rowsink.KafkaConfig{
+			Topic:  "gpu-metrics",
+			Key:    rowsink.KeyPod,
+			Format: rowsink.FormatAvro,
+		}, writer)
+		r.NoError(err)
+
+		r.NoError(sink.Write(ctx, newTestRows(ts)[:1]))
+
+		r.Len(writer.messages, 1)
+		r.Equal("ml/trainer-0", string(writer.messages[0].Key))
+
+		value := writer.messages[0].Value
+		r.True(bytes.HasPrefix(value, []byte{0xC3, 0x01}))
+
+		schema, err := rowsink.Schema()
+		r.NoError(err)
+		fingerprint, err := schema.FingerprintUsing(avro.CRC64Avro)
+		r.NoError(err)
+		slices.Reverse(fingerprint)
+		r.Equal(fingerprint, value[2:10])
+
+		var row exporter.GPUMetric
+		r.NoError(avro.Unmarshal(schema, value[10:], &row))
+		r.Equal("GPU-1", row.DeviceUUID)
+		r.Equal(250.0, *row.PowerUsage)
+		r.True(ts.Equal(row.Timestamp))
+	})
+
+	t.Run("produces rows without key", func(t *testing.T) {
+		r := require.New(t)
+		writer := &fakeWriter{}
+
+		sink, err := rowsink.NewKafkaSink(rowsink.KafkaConfig{Key: rowsink.KeyNone, Format: rowsink.FormatJSON}, writer)
+		r.NoError(err)
+
+		r.NoError(sink.Write(ctx, newTestRows(ts)))
+		r.Nil(writer.messages[0].Key)
+	})
+
+	t.Run("returns write errors", func(t *testing.T) {
+		r := require.New(t)
+		writer := &fakeWriter{err: errors.New("broker unavailable")}
+
+		sink, err := rowsink.NewKafkaSink(rowsink.KafkaConfig{Key: rowsink.KeyNodeName, Format: rowsink.FormatJSON}, writer)
+		r.NoError(err)
+
+		r.ErrorContains(sink.Write(ctx, newTestRows(ts)), "broker unavailable")
+	})
+
+	t.Run("rejects invalid configuration", func(t *testing.T) {
+		r := require.New(t)
+
+		_, err := rowsink.NewKafkaSink(rowsink.KafkaConfig{Key: "gpu", Format: rowsink.FormatJSON}, &fakeWriter{})
+		r.Error(err)
+
+		_, err = rowsink.NewKafkaSink(rowsink.KafkaConfig{Key: rowsink.KeyDeviceUUID, Format: "csv"}, &fakeWriter{})
+		r.Error(err)
+
+		_, err = rowsink.NewKafkaWriter(rowsink.KafkaConfig{Topic: "gpu-metrics"})
+		r.Error(err)
+
+		_, err = rowsink.NewKafkaWriter(rowsink.KafkaConfig{Brokers: []string{"kafka:9092"}})
+		r.Error(err)
+	})
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/pprof"
 )
@@ -22,3 +23,13 @@ func NewServerMux() *http.ServeMux {
 
 	return mux
 }
+
+// JSONHandler serves the value returned by report as JSON, e.g. the idle report.
+func JSONHandler(report func() any) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/castai/gpu-metrics-exporter/internal/alerting"
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/logging"
+)
+
+// AlertPayload is the request body of alert notifications.
+type AlertPayload struct {
+	ClusterID string         `json:"cluster_id,omitempty"`
+	Alert     alerting.Alert `json:"alert"`
+}
+
+type alertNotifier struct {
+	sink *sink
+}
+
+// NewAlertNotifier posts every alert which fires, or resolves, as an AlertPayload. Requests carry the same headers
+// and signature as the ones of the sink, the template and the request size limit don't apply to alerts.
+func NewAlertNotifier(cfg Config, httpClient exporter.HTTPClient, log *logging.Logger, version string) (alerting.Notifier, error) {
+	cfg.TemplateFile = ""
+	cfg.MaxRequestBytes = 0
+	s, err := newSink(cfg, httpClient, log, version)
+	if err != nil {
+		return nil, err
+	}
+	return &alertNotifier{sink: s}, nil
+}
+
+func (n *alertNotifier) Name() string {
+	return sinkName
+}
+
+func (n *alertNotifier) Notify(ctx context.Context, alert alerting.Alert) error {
+	body, err := json.Marshal(AlertPayload{ClusterID: n.sink.cfg.ClusterID, Alert: alert})
+	if err != nil {
+		return err
+	}
+	return n.sink.send(ctx, body)
+}
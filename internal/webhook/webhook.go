@@ -0,0 +1,206 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/castai/gpu-metrics-exporter/internal/castai"
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/logging"
+)
+
+const (
+	sinkName = "webhook"
+
+	signaturePrefix = "sha256="
+)
+
+var (
+	contentTypeHeader = http.CanonicalHeaderKey("Content-Type")
+	contentType       = "application/json"
+
+	// signatureHeader carries the hex encoded HMAC-SHA256 of the request body, in the same format GitHub uses.
+	signatureHeader = http.CanonicalHeaderKey("X-Signature-256")
+
+	userAgentHeader = http.CanonicalHeaderKey("User-Agent")
+	userAgent       = "castai-gpu-metrics-exporter/"
+)
+
+type Config struct {
+	URL     string
+	Headers map[string]string
+	// Secret signs request bodies when set.
+	Secret string // nolint:gosec // G117: false positive
+	// TemplateFile is a text/template rendering Payload into the request body, the payload is sent as JSON when empty.
+	TemplateFile string
+	// MaxRequestBytes splits the rows into several requests so that no body is larger, 0 disables the limit.
+	MaxRequestBytes int
+	ClusterID       string
+}
+
+// Payload is the request body sent when no template is configured, and the data templates are executed with.
+type Payload struct {
+	ClusterID string               `json:"cluster_id,omitempty"`
+	Timestamp time.Time            `json:"timestamp"`
+	Metrics   []exporter.GPUMetric `json:"metrics"`
+}
+
+type sink struct {
+	cfg        Config
+	httpClient exporter.HTTPClient
+	log        *logging.Logger
+	template   *template.Template
+	userAgent  string
+}
+
+func NewSink(cfg Config, httpClient exporter.HTTPClient, log *logging.Logger, version string) (exporter.Sink, error) {
+	return newSink(cfg, httpClient, log, version)
+}
+
+func newSink(cfg Config, httpClient exporter.HTTPClient, log *logging.Logger, version string) (*sink, error) {
+	endpoint, err := url.Parse(cfg.URL)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL %q, expected an http:// or https:// URL", cfg.URL)
+	}
+	if cfg.MaxRequestBytes < 0 {
+		return nil, errors.New("webhook max request bytes can't be negative")
+	}
+
+	s := &sink{
+		cfg:        cfg,
+		httpClient: httpClient,
+		log:        log,
+		userAgent:  userAgent + version,
+	}
+
+	if cfg.TemplateFile != "" {
+		content, err := os.ReadFile(cfg.TemplateFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading webhook template: %w", err)
+		}
+		s.template, err = template.New("webhook").Funcs(template.FuncMap{"json": toJSON}).Parse(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("parsing webhook template: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+func toJSON(v any) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+func (s *sink) Name() string {
+	return sinkName
+}
+
+func (s *sink) Write(ctx context.Context, metrics []exporter.GPUMetric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	bodies, err := s.render(metrics, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, body := range bodies {
+		if err := s.send(ctx, body); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// render encodes the rows into request bodies, halving the rows of a body until it fits into MaxRequestBytes.
+func (s *sink) render(metrics []exporter.GPUMetric, ts time.Time) ([][]byte, error) {
+	body, err := s.encode(Payload{
+		ClusterID: s.cfg.ClusterID,
+		Timestamp: ts,
+		Metrics:   metrics,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if s.cfg.MaxRequestBytes == 0 || len(body) <= s.cfg.MaxRequestBytes {
+		return [][]byte{body}, nil
+	}
+	if len(metrics) == 1 {
+		return nil, fmt.Errorf("a single row takes %d bytes, more than the limit of %d bytes", len(body), s.cfg.MaxRequestBytes)
+	}
+
+	half := len(metrics) / 2
+	first, err := s.render(metrics[:half], ts)
+	if err != nil {
+		return nil, err
+	}
+	second, err := s.render(metrics[half:], ts)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(first, second...), nil
+}
+
+func (s *sink) encode(payload Payload) ([]byte, error) {
+	if s.template == nil {
+		return json.Marshal(payload)
+	}
+
+	var buf bytes.Buffer
+	if err := s.template.Execute(&buf, payload); err != nil {
+		return nil, fmt.Errorf("executing webhook template: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (s *sink) send(ctx context.Context, body []byte) error {
+	return castai.Retry(ctx, s.log, func(ctx context.Context) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.URL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		for k, v := range s.cfg.Headers {
+			req.Header.Set(k, v)
+		}
+		req.Header.Set(contentTypeHeader, contentType)
+		req.Header.Set(userAgentHeader, s.userAgent)
+		if s.cfg.Secret != "" {
+			req.Header.Set(signatureHeader, sign(s.cfg.Secret, body))
+		}
+
+		resp, err := s.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		_, _ = io.Copy(io.Discard, resp.Body)
+
+		return resp, nil
+	})
+}
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
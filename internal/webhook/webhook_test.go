@@ -0,0 +1,270 @@
+package webhook_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/castai/gpu-metrics-exporter/internal/alerting"
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	"github.com/castai/gpu-metrics-exporter/internal/webhook"
+	"github.com/castai/logging"
+)
+
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+func newTestServer(t *testing.T, status func(n int32) int) (*httptest.Server, chan request) {
+	requests := make(chan request, 100)
+	var n atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		requests <- request{header: req.Header, body: body}
+		w.WriteHeader(status(n.Add(1)))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+func ok(int32) int { return http.StatusOK }
+
+func newTestMetrics(n int) []exporter.GPUMetric {
+	metrics := make([]exporter.GPUMetric, n)
+	for i := range metrics {
+		metrics[i] = exporter.GPUMetric{
+			NodeName:   "node-1",
+			DeviceUUID: "GPU-" + string(rune('a'+i)),
+			PowerUsage: ptr(100.0),
+			Timestamp:  time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		}
+	}
+	return metrics
+}
+
+func TestSink(t *testing.T) {
+	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
+	ctx := context.Background()
+
+	t.Run("posts signed json payload with custom headers", func(t *testing.T) {
+		r := require.New(t)
+		srv, requests := newTestServer(t, ok)
+
+		sink, err := webhook.NewSink(webhook.Config{
+			URL:       srv.URL,
+			Headers:   map[string]string{"Authorization": "Bearer token"},
+			Secret:    "secret",
+			ClusterID: "cluster-1",
+		}, srv.Client(), log, "test")
+		r.NoError(err)
+		r.Equal("webhook", sink.Name())
+
+		r.NoError(sink.Write(ctx, newTestMetrics(2)))
+
+		req := <-requests
+		r.Equal("application/json", req.header.Get("Content-Type"))
+		r.Equal("Bearer token", req.header.Get("Authorization"))
+		r.Equal("castai-gpu-metrics-exporter/test", req.header.Get("User-Agent"))
+
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(req.body)
+		r.Equal("sha256="+hex.EncodeToString(mac.Sum(nil)), req.header.Get("X-Signature-256"))
+
+		var payload webhook.Payload
+		r.NoError(json.Unmarshal(req.body, &payload))
+		r.Equal("cluster-1", payload.ClusterID)
+		r.Len(payload.Metrics, 2)
+		r.Equal("GPU-a", payload.Metrics[0].DeviceUUID)
+	})
+
+	t.Run("renders the payload through a template", func(t *testing.T) {
+		r := require.New(t)
+		srv, requests := newTestServer(t, ok)
+
+		templateFile := filepath.Join(t.TempDir(), "payload.tmpl")
+		r.NoError(os.WriteFile(templateFile, []byte(
+			`{"text":"{{len .Metrics}} GPUs on {{(index .Metrics 0).NodeName}}","uuids":[{{range $i, $m := .Metrics}}{{if $i}},{{end}}{{json $m.DeviceUUID}}{{end}}]}`,
+		), 0o600))
+
+		sink, err := webhook.NewSink(webhook.Config{URL: srv.URL, TemplateFile: templateFile}, srv.Client(), log, "test")
+		r.NoError(err)
+
+		r.NoError(sink.Write(ctx, newTestMetrics(2)))
+
+		req := <-requests
+		r.JSONEq(`{"text":"2 GPUs on node-1","uuids":["GPU-a","GPU-b"]}`, string(req.body))
+		r.Empty(req.header.Get("X-Signature-256"))
+	})
+
+	t.Run("splits rows to fit the request size limit", func(t *testing.T) {
+		r := require.New(t)
+		srv, requests := newTestServer(t, ok)
+
+		single, err := json.Marshal(webhook.Payload{Timestamp: time.Now().UTC(), Metrics: newTestMetrics(2)})
+		r.NoError(err)
+
+		sink, err := webhook.NewSink(webhook.Config{URL: srv.URL, MaxRequestBytes: len(single)}, srv.Client(), log, "test")
+		r.NoError(err)
+
+		r.NoError(sink.Write(ctx, newTestMetrics(8)))
+		close(requests)
+
+		var rows int
+		for req := range requests {
+			r.LessOrEqual(len(req.body), len(single))
+			var payload webhook.Payload
+			r.NoError(json.Unmarshal(req.body, &payload))
+			rows += len(payload.Metrics)
+		}
+		r.Equal(8, rows)
+	})
+
+	t.Run("fails when a single row exceeds the limit", func(t *testing.T) {
+		r := require.New(t)
+		srv, _ := newTestServer(t, ok)
+
+		sink, err := webhook.NewSink(webhook.Config{URL: srv.URL, MaxRequestBytes: 10}, srv.Client(), log, "test")
+		r.NoError(err)
+
+		r.Error(sink.Write(ctx, newTestMetrics(1)))
+	})
+
+	t.Run("retries server errors", func(t *testing.T) {
+		r := require.New(t)
+		srv, requests := newTestServer(t, func(n int32) int {
+			if n == 1 {
+				return http.StatusServiceUnavailable
+			}
+			return http.StatusOK
+		})
+
+		sink, err := webhook.NewSink(webhook.Config{URL: srv.URL}, srv.Client(), log, "test")
+		r.NoError(err)
+
+		r.NoError(sink.Write(ctx, newTestMetrics(1)))
+		r.Len(requests, 2)
+	})
+
+	t.Run("retries rate limited requests after Retry-After", func(t *testing.T) {
+		r := require.New(t)
+		var requests atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if requests.Add(1) == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer srv.Close()
+
+		sink, err := webhook.NewSink(webhook.Config{URL: srv.URL}, srv.Client(), log, "test")
+		r.NoError(err)
+
+		started := time.Now()
+		r.NoError(sink.Write(ctx, newTestMetrics(1)))
+		r.Equal(int32(2), requests.Load())
+		r.GreaterOrEqual(time.Since(started), time.Second)
+	})
+
+	t.Run("gives up on rate limited requests when Retry-After is past the deadline", func(t *testing.T) {
+		r := require.New(t)
+		var requests atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			requests.Add(1)
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+		defer srv.Close()
+
+		sink, err := webhook.NewSink(webhook.Config{URL: srv.URL}, srv.Client(), log, "test")
+		r.NoError(err)
+
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		started := time.Now()
+		r.ErrorContains(sink.Write(ctx, newTestMetrics(1)), "status code: 429")
+		r.Equal(int32(1), requests.Load())
+		r.Less(time.Since(started), time.Second)
+	})
+
+	t.Run("doesn't retry client errors", func(t *testing.T) {
+		r := require.New(t)
+		srv, requests := newTestServer(t, func(int32) int { return http.StatusBadRequest })
+
+		sink, err := webhook.NewSink(webhook.Config{URL: srv.URL}, srv.Client(), log, "test")
+		r.NoError(err)
+
+		r.Error(sink.Write(ctx, newTestMetrics(1)))
+		r.Len(requests, 1)
+	})
+
+	t.Run("rejects invalid configuration", func(t *testing.T) {
+		r := require.New(t)
+
+		_, err := webhook.NewSink(webhook.Config{URL: "hooks.local/gpu"}, http.DefaultClient, log, "test")
+		r.Error(err)
+
+		_, err = webhook.NewSink(webhook.Config{URL: "http://hooks.local", TemplateFile: "/does/not/exist"}, http.DefaultClient, log, "test")
+		r.Error(err)
+
+		templateFile := filepath.Join(t.TempDir(), "payload.tmpl")
+		r.NoError(os.WriteFile(templateFile, []byte("{{.Metrics"), 0o600))
+		_, err = webhook.NewSink(webhook.Config{URL: "http://hooks.local", TemplateFile: templateFile}, http.DefaultClient, log, "test")
+		r.Error(err)
+	})
+}
+
+func TestAlertNotifier(t *testing.T) {
+	r := require.New(t)
+	log := logging.New(logging.NewTextHandler(logging.TextHandlerConfig{}))
+	srv, requests := newTestServer(t, ok)
+
+	notifier, err := webhook.NewAlertNotifier(webhook.Config{
+		URL:       srv.URL,
+		Headers:   map[string]string{"Authorization": "Bearer token"},
+		Secret:    "secret",
+		ClusterID: "cluster-1",
+	}, srv.Client(), log, "test")
+	r.NoError(err)
+	r.Equal("webhook", notifier.Name())
+
+	r.NoError(notifier.Notify(context.Background(), alerting.Alert{
+		Rule:    "GPUHot",
+		State:   alerting.StateFiring,
+		GroupBy: alerting.GroupByGPU,
+		Labels:  map[string]string{"device_uuid": "GPU-1"},
+		Value:   91,
+	}))
+
+	req := <-requests
+	r.Equal("Bearer token", req.header.Get("Authorization"))
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(req.body)
+	r.Equal("sha256="+hex.EncodeToString(mac.Sum(nil)), req.header.Get("X-Signature-256"))
+
+	var payload webhook.AlertPayload
+	r.NoError(json.Unmarshal(req.body, &payload))
+	r.Equal("cluster-1", payload.ClusterID)
+	r.Equal("GPUHot", payload.Alert.Rule)
+	r.Equal(alerting.StateFiring, payload.Alert.State)
+	r.Equal(map[string]string{"device_uuid": "GPU-1"}, payload.Alert.Labels)
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
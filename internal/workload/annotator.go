@@ -0,0 +1,47 @@
+package workload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+// ErrUnsupportedKind is returned for workloads of kinds which can't be annotated.
+var ErrUnsupportedKind = errors.New("unsupported kind")
+
+// Annotator sets annotations of workloads, nil values remove an annotation.
+type Annotator interface {
+	Annotate(ctx context.Context, w Workload, annotations map[string]*string) error
+}
+
+type annotator struct {
+	dynamic dynamic.Interface
+}
+
+func NewAnnotator(dynClient dynamic.Interface) Annotator {
+	return &annotator{dynamic: dynClient}
+}
+
+func (a *annotator) Annotate(ctx context.Context, w Workload, annotations map[string]*string) error {
+	gvr, found := kindToGVR[w.Kind]
+	if !found {
+		return fmt.Errorf("can't annotate %s %s/%s: %w", w.Kind, w.Namespace, w.Name, ErrUnsupportedKind)
+	}
+
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{"annotations": annotations},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = a.dynamic.Resource(gvr).Namespace(w.Namespace).Patch(ctx, w.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("annotating %s %s/%s: %w", w.Kind, w.Namespace, w.Name, err)
+	}
+	return nil
+}
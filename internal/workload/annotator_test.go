@@ -0,0 +1,41 @@
+package workload
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+)
+
+func TestAnnotator(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	job := newUnstructuredObj("batch/v1", "Job", "training", "ml", nil, nil)
+	job.SetAnnotations(map[string]string{"owner": "team-a"})
+	dynClient := fakedynamic.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), testGVRs, job)
+	annotator := NewAnnotator(dynClient)
+	w := Workload{Namespace: "ml", Kind: KindJob, Name: "training"}
+
+	annotations := func() map[string]string {
+		obj, err := dynClient.Resource(kindToGVR[KindJob]).Namespace("ml").Get(ctx, "training", metav1.GetOptions{})
+		r.NoError(err)
+		return obj.GetAnnotations()
+	}
+
+	since := "2024-05-01T12:00:00Z"
+	r.NoError(annotator.Annotate(ctx, w, map[string]*string{"idle-since": &since}))
+	r.Equal(map[string]string{"owner": "team-a", "idle-since": since}, annotations())
+
+	r.NoError(annotator.Annotate(ctx, w, map[string]*string{"idle-since": nil}))
+	r.Equal(map[string]string{"owner": "team-a"}, annotations())
+
+	r.ErrorIs(annotator.Annotate(ctx, Workload{Namespace: "ml", Kind: "Notebook", Name: "nb"}, nil), ErrUnsupportedKind)
+	err := annotator.Annotate(ctx, Workload{Namespace: "ml", Kind: KindJob, Name: "gone"}, nil)
+	r.ErrorContains(err, "annotating Job ml/gone")
+	r.True(apierrors.IsNotFound(err))
+}
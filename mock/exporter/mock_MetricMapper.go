@@ -40,16 +40,16 @@ func (_m *MockMetricMapper) EXPECT() *MockMetricMapper_Expecter {
 }
 
 // Map provides a mock function for the type MockMetricMapper
-func (_mock *MockMetricMapper) Map(metrics []exporter.MetricFamilyMap) *pb.MetricsBatch {
-	ret := _mock.Called(metrics)
+func (_mock *MockMetricMapper) Map(results []exporter.ScrapeResult) *pb.MetricsBatch {
+	ret := _mock.Called(results)
 
 	if len(ret) == 0 {
 		panic("no return value specified for Map")
 	}
 
 	var r0 *pb.MetricsBatch
-	if returnFunc, ok := ret.Get(0).(func([]exporter.MetricFamilyMap) *pb.MetricsBatch); ok {
-		r0 = returnFunc(metrics)
+	if returnFunc, ok := ret.Get(0).(func([]exporter.ScrapeResult) *pb.MetricsBatch); ok {
+		r0 = returnFunc(results)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*pb.MetricsBatch)
@@ -64,16 +64,16 @@ type MockMetricMapper_Map_Call struct {
 }
 
 // Map is a helper method to define mock.On call
-//   - metrics []exporter.MetricFamilyMap
-func (_e *MockMetricMapper_Expecter) Map(metrics interface{}) *MockMetricMapper_Map_Call {
-	return &MockMetricMapper_Map_Call{Call: _e.mock.On("Map", metrics)}
+//   - results []exporter.ScrapeResult
+func (_e *MockMetricMapper_Expecter) Map(results interface{}) *MockMetricMapper_Map_Call {
+	return &MockMetricMapper_Map_Call{Call: _e.mock.On("Map", results)}
 }
 
-func (_c *MockMetricMapper_Map_Call) Run(run func(metrics []exporter.MetricFamilyMap)) *MockMetricMapper_Map_Call {
+func (_c *MockMetricMapper_Map_Call) Run(run func(results []exporter.ScrapeResult)) *MockMetricMapper_Map_Call {
 	_c.Call.Run(func(args mock.Arguments) {
-		var arg0 []exporter.MetricFamilyMap
+		var arg0 []exporter.ScrapeResult
 		if args[0] != nil {
-			arg0 = args[0].([]exporter.MetricFamilyMap)
+			arg0 = args[0].([]exporter.ScrapeResult)
 		}
 		run(
 			arg0,
@@ -87,22 +87,22 @@ func (_c *MockMetricMapper_Map_Call) Return(metricsBatch *pb.MetricsBatch) *Mock
 	return _c
 }
 
-func (_c *MockMetricMapper_Map_Call) RunAndReturn(run func(metrics []exporter.MetricFamilyMap) *pb.MetricsBatch) *MockMetricMapper_Map_Call {
+func (_c *MockMetricMapper_Map_Call) RunAndReturn(run func(results []exporter.ScrapeResult) *pb.MetricsBatch) *MockMetricMapper_Map_Call {
 	_c.Call.Return(run)
 	return _c
 }
 
 // MapToAvro provides a mock function for the type MockMetricMapper
-func (_mock *MockMetricMapper) MapToAvro(ctx context.Context, metrics []exporter.MetricFamilyMap) []exporter.GPUMetric {
-	ret := _mock.Called(ctx, metrics)
+func (_mock *MockMetricMapper) MapToAvro(ctx context.Context, results []exporter.ScrapeResult) []exporter.GPUMetric {
+	ret := _mock.Called(ctx, results)
 
 	if len(ret) == 0 {
 		panic("no return value specified for MapToAvro")
 	}
 
 	var r0 []exporter.GPUMetric
-	if returnFunc, ok := ret.Get(0).(func(context.Context, []exporter.MetricFamilyMap) []exporter.GPUMetric); ok {
-		r0 = returnFunc(ctx, metrics)
+	if returnFunc, ok := ret.Get(0).(func(context.Context, []exporter.ScrapeResult) []exporter.GPUMetric); ok {
+		r0 = returnFunc(ctx, results)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).([]exporter.GPUMetric)
@@ -118,20 +118,20 @@ type MockMetricMapper_MapToAvro_Call struct {
 
 // MapToAvro is a helper method to define mock.On call
 //   - ctx context.Context
-//   - metrics []exporter.MetricFamilyMap
-func (_e *MockMetricMapper_Expecter) MapToAvro(ctx interface{}, metrics interface{}) *MockMetricMapper_MapToAvro_Call {
-	return &MockMetricMapper_MapToAvro_Call{Call: _e.mock.On("MapToAvro", ctx, metrics)}
+//   - results []exporter.ScrapeResult
+func (_e *MockMetricMapper_Expecter) MapToAvro(ctx interface{}, results interface{}) *MockMetricMapper_MapToAvro_Call {
+	return &MockMetricMapper_MapToAvro_Call{Call: _e.mock.On("MapToAvro", ctx, results)}
 }
 
-func (_c *MockMetricMapper_MapToAvro_Call) Run(run func(ctx context.Context, metrics []exporter.MetricFamilyMap)) *MockMetricMapper_MapToAvro_Call {
+func (_c *MockMetricMapper_MapToAvro_Call) Run(run func(ctx context.Context, results []exporter.ScrapeResult)) *MockMetricMapper_MapToAvro_Call {
 	_c.Call.Run(func(args mock.Arguments) {
 		var arg0 context.Context
 		if args[0] != nil {
 			arg0 = args[0].(context.Context)
 		}
-		var arg1 []exporter.MetricFamilyMap
+		var arg1 []exporter.ScrapeResult
 		if args[1] != nil {
-			arg1 = args[1].([]exporter.MetricFamilyMap)
+			arg1 = args[1].([]exporter.ScrapeResult)
 		}
 		run(
 			arg0,
@@ -146,7 +146,7 @@ func (_c *MockMetricMapper_MapToAvro_Call) Return(gPUMetrics []exporter.GPUMetri
 	return _c
 }
 
-func (_c *MockMetricMapper_MapToAvro_Call) RunAndReturn(run func(ctx context.Context, metrics []exporter.MetricFamilyMap) []exporter.GPUMetric) *MockMetricMapper_MapToAvro_Call {
+func (_c *MockMetricMapper_MapToAvro_Call) RunAndReturn(run func(ctx context.Context, results []exporter.ScrapeResult) []exporter.GPUMetric) *MockMetricMapper_MapToAvro_Call {
 	_c.Call.Return(run)
 	return _c
 }
@@ -39,31 +39,22 @@ func (_m *MockScraper) EXPECT() *MockScraper_Expecter {
 }
 
 // Scrape provides a mock function for the type MockScraper
-func (_mock *MockScraper) Scrape(ctx context.Context, urls []string) ([]exporter.MetricFamilyMap, error) {
-	ret := _mock.Called(ctx, urls)
+func (_mock *MockScraper) Scrape(ctx context.Context, targets []exporter.Target) []exporter.ScrapeResult {
+	ret := _mock.Called(ctx, targets)
 
 	if len(ret) == 0 {
 		panic("no return value specified for Scrape")
 	}
 
-	var r0 []exporter.MetricFamilyMap
-	var r1 error
-	if returnFunc, ok := ret.Get(0).(func(context.Context, []string) ([]exporter.MetricFamilyMap, error)); ok {
-		return returnFunc(ctx, urls)
-	}
-	if returnFunc, ok := ret.Get(0).(func(context.Context, []string) []exporter.MetricFamilyMap); ok {
-		r0 = returnFunc(ctx, urls)
+	var r0 []exporter.ScrapeResult
+	if returnFunc, ok := ret.Get(0).(func(context.Context, []exporter.Target) []exporter.ScrapeResult); ok {
+		r0 = returnFunc(ctx, targets)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).([]exporter.MetricFamilyMap)
+			r0 = ret.Get(0).([]exporter.ScrapeResult)
 		}
 	}
-	if returnFunc, ok := ret.Get(1).(func(context.Context, []string) error); ok {
-		r1 = returnFunc(ctx, urls)
-	} else {
-		r1 = ret.Error(1)
-	}
-	return r0, r1
+	return r0
 }
 
 // MockScraper_Scrape_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Scrape'
@@ -73,20 +64,20 @@ type MockScraper_Scrape_Call struct {
 
 // Scrape is a helper method to define mock.On call
 //   - ctx context.Context
-//   - urls []string
-func (_e *MockScraper_Expecter) Scrape(ctx interface{}, urls interface{}) *MockScraper_Scrape_Call {
-	return &MockScraper_Scrape_Call{Call: _e.mock.On("Scrape", ctx, urls)}
+//   - targets []exporter.Target
+func (_e *MockScraper_Expecter) Scrape(ctx interface{}, targets interface{}) *MockScraper_Scrape_Call {
+	return &MockScraper_Scrape_Call{Call: _e.mock.On("Scrape", ctx, targets)}
 }
 
-func (_c *MockScraper_Scrape_Call) Run(run func(ctx context.Context, urls []string)) *MockScraper_Scrape_Call {
+func (_c *MockScraper_Scrape_Call) Run(run func(ctx context.Context, targets []exporter.Target)) *MockScraper_Scrape_Call {
 	_c.Call.Run(func(args mock.Arguments) {
 		var arg0 context.Context
 		if args[0] != nil {
 			arg0 = args[0].(context.Context)
 		}
-		var arg1 []string
+		var arg1 []exporter.Target
 		if args[1] != nil {
-			arg1 = args[1].([]string)
+			arg1 = args[1].([]exporter.Target)
 		}
 		run(
 			arg0,
@@ -96,12 +87,12 @@ func (_c *MockScraper_Scrape_Call) Run(run func(ctx context.Context, urls []stri
 	return _c
 }
 
-func (_c *MockScraper_Scrape_Call) Return(metricFamilyMaps []exporter.MetricFamilyMap, err error) *MockScraper_Scrape_Call {
-	_c.Call.Return(metricFamilyMaps, err)
+func (_c *MockScraper_Scrape_Call) Return(scrapeResults []exporter.ScrapeResult) *MockScraper_Scrape_Call {
+	_c.Call.Return(scrapeResults)
 	return _c
 }
 
-func (_c *MockScraper_Scrape_Call) RunAndReturn(run func(ctx context.Context, urls []string) ([]exporter.MetricFamilyMap, error)) *MockScraper_Scrape_Call {
+func (_c *MockScraper_Scrape_Call) RunAndReturn(run func(ctx context.Context, targets []exporter.Target) []exporter.ScrapeResult) *MockScraper_Scrape_Call {
 	_c.Call.Return(run)
 	return _c
 }
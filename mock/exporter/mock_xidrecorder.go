@@ -0,0 +1,85 @@
+// Code generated by mockery; DO NOT EDIT.
+// github.com/vektra/mockery
+// template: testify
+
+package exporter
+
+import (
+	"context"
+
+	"github.com/castai/gpu-metrics-exporter/internal/exporter"
+	mock "github.com/stretchr/testify/mock"
+)
+
+// NewMockXIDRecorder creates a new instance of MockXIDRecorder. It also registers a testing interface on the mock and a cleanup function to assert the mocks expectations.
+// The first argument is typically a *testing.T value.
+func NewMockXIDRecorder(t interface {
+	mock.TestingT
+	Cleanup(func())
+}) *MockXIDRecorder {
+	mock := &MockXIDRecorder{}
+	mock.Mock.Test(t)
+
+	t.Cleanup(func() { mock.AssertExpectations(t) })
+
+	return mock
+}
+
+// MockXIDRecorder is an autogenerated mock type for the XIDRecorder type
+type MockXIDRecorder struct {
+	mock.Mock
+}
+
+type MockXIDRecorder_Expecter struct {
+	mock *mock.Mock
+}
+
+func (_m *MockXIDRecorder) EXPECT() *MockXIDRecorder_Expecter {
+	return &MockXIDRecorder_Expecter{mock: &_m.Mock}
+}
+
+// RecordXID provides a mock function for the type MockXIDRecorder
+func (_mock *MockXIDRecorder) RecordXID(ctx context.Context, xid exporter.XIDError) {
+	_mock.Called(ctx, xid)
+	return
+}
+
+// MockXIDRecorder_RecordXID_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'RecordXID'
+type MockXIDRecorder_RecordXID_Call struct {
+	*mock.Call
+}
+
+// RecordXID is a helper method to define mock.On call
+//   - ctx context.Context
+//   - xid exporter.XIDError
+func (_e *MockXIDRecorder_Expecter) RecordXID(ctx interface{}, xid interface{}) *MockXIDRecorder_RecordXID_Call {
+	return &MockXIDRecorder_RecordXID_Call{Call: _e.mock.On("RecordXID", ctx, xid)}
+}
+
+func (_c *MockXIDRecorder_RecordXID_Call) Run(run func(ctx context.Context, xid exporter.XIDError)) *MockXIDRecorder_RecordXID_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		var arg0 context.Context
+		if args[0] != nil {
+			arg0 = args[0].(context.Context)
+		}
+		var arg1 exporter.XIDError
+		if args[1] != nil {
+			arg1 = args[1].(exporter.XIDError)
+		}
+		run(
+			arg0,
+			arg1,
+		)
+	})
+	return _c
+}
+
+func (_c *MockXIDRecorder_RecordXID_Call) Return() *MockXIDRecorder_RecordXID_Call {
+	_c.Call.Return()
+	return _c
+}
+
+func (_c *MockXIDRecorder_RecordXID_Call) RunAndReturn(run func(ctx context.Context, xid exporter.XIDError)) *MockXIDRecorder_RecordXID_Call {
+	_c.Run(run)
+	return _c
+}
@@ -0,0 +1,102 @@
+// Code generated by mockery; DO NOT EDIT.
+// github.com/vektra/mockery
+// template: testify
+
+package workload
+
+import (
+	"context"
+
+	"github.com/castai/gpu-metrics-exporter/internal/workload"
+	mock "github.com/stretchr/testify/mock"
+)
+
+// NewMockAnnotator creates a new instance of MockAnnotator. It also registers a testing interface on the mock and a cleanup function to assert the mocks expectations.
+// The first argument is typically a *testing.T value.
+func NewMockAnnotator(t interface {
+	mock.TestingT
+	Cleanup(func())
+}) *MockAnnotator {
+	mock := &MockAnnotator{}
+	mock.Mock.Test(t)
+
+	t.Cleanup(func() { mock.AssertExpectations(t) })
+
+	return mock
+}
+
+// MockAnnotator is an autogenerated mock type for the Annotator type
+type MockAnnotator struct {
+	mock.Mock
+}
+
+type MockAnnotator_Expecter struct {
+	mock *mock.Mock
+}
+
+func (_m *MockAnnotator) EXPECT() *MockAnnotator_Expecter {
+	return &MockAnnotator_Expecter{mock: &_m.Mock}
+}
+
+// Annotate provides a mock function for the type MockAnnotator
+func (_mock *MockAnnotator) Annotate(ctx context.Context, w workload.Workload, annotations map[string]*string) error {
+	ret := _mock.Called(ctx, w, annotations)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Annotate")
+	}
+
+	var r0 error
+	if returnFunc, ok := ret.Get(0).(func(context.Context, workload.Workload, map[string]*string) error); ok {
+		r0 = returnFunc(ctx, w, annotations)
+	} else {
+		r0 = ret.Error(0)
+	}
+	return r0
+}
+
+// MockAnnotator_Annotate_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Annotate'
+type MockAnnotator_Annotate_Call struct {
+	*mock.Call
+}
+
+// Annotate is a helper method to define mock.On call
+//   - ctx context.Context
+//   - w workload.Workload
+//   - annotations map[string]*string
+func (_e *MockAnnotator_Expecter) Annotate(ctx interface{}, w interface{}, annotations interface{}) *MockAnnotator_Annotate_Call {
+	return &MockAnnotator_Annotate_Call{Call: _e.mock.On("Annotate", ctx, w, annotations)}
+}
+
+func (_c *MockAnnotator_Annotate_Call) Run(run func(ctx context.Context, w workload.Workload, annotations map[string]*string)) *MockAnnotator_Annotate_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		var arg0 context.Context
+		if args[0] != nil {
+			arg0 = args[0].(context.Context)
+		}
+		var arg1 workload.Workload
+		if args[1] != nil {
+			arg1 = args[1].(workload.Workload)
+		}
+		var arg2 map[string]*string
+		if args[2] != nil {
+			arg2 = args[2].(map[string]*string)
+		}
+		run(
+			arg0,
+			arg1,
+			arg2,
+		)
+	})
+	return _c
+}
+
+func (_c *MockAnnotator_Annotate_Call) Return(err error) *MockAnnotator_Annotate_Call {
+	_c.Call.Return(err)
+	return _c
+}
+
+func (_c *MockAnnotator_Annotate_Call) RunAndReturn(run func(ctx context.Context, w workload.Workload, annotations map[string]*string) error) *MockAnnotator_Annotate_Call {
+	_c.Call.Return(run)
+	return _c
+}
@@ -80,7 +80,8 @@ type MetricsBatch struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Metrics []*Metric `protobuf:"bytes,1,rep,name=metrics,proto3" json:"metrics,omitempty"`
+	Metrics   []*Metric        `protobuf:"bytes,1,rep,name=metrics,proto3" json:"metrics,omitempty"`
+	Inventory []*NodeInventory `protobuf:"bytes,2,rep,name=inventory,proto3" json:"inventory,omitempty"`
 }
 
 func (x *MetricsBatch) Reset() {
@@ -122,6 +123,94 @@ func (x *MetricsBatch) GetMetrics() []*Metric {
 	return nil
 }
 
+func (x *MetricsBatch) GetInventory() []*NodeInventory {
+	if x != nil {
+		return x.Inventory
+	}
+	return nil
+}
+
+// NodeInventory lists the GPUs of a node and how they changed since the previous batch.
+type NodeInventory struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	NodeName string `protobuf:"bytes,1,opt,name=node_name,json=nodeName,proto3" json:"node_name,omitempty"`
+	// stale is set when the node's dcgm-exporter couldn't be scraped, gpus then holds the GPUs last seen.
+	Stale   bool                 `protobuf:"varint,2,opt,name=stale,proto3" json:"stale,omitempty"`
+	Gpus    []*NodeInventory_GPU `protobuf:"bytes,3,rep,name=gpus,proto3" json:"gpus,omitempty"`
+	Added   []*NodeInventory_GPU `protobuf:"bytes,4,rep,name=added,proto3" json:"added,omitempty"`
+	Removed []*NodeInventory_GPU `protobuf:"bytes,5,rep,name=removed,proto3" json:"removed,omitempty"`
+}
+
+func (x *NodeInventory) Reset() {
+	*x = NodeInventory{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pb_metrics_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *NodeInventory) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NodeInventory) ProtoMessage() {}
+
+func (x *NodeInventory) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_metrics_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NodeInventory.ProtoReflect.Descriptor instead.
+func (*NodeInventory) Descriptor() ([]byte, []int) {
+	return file_pb_metrics_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *NodeInventory) GetNodeName() string {
+	if x != nil {
+		return x.NodeName
+	}
+	return ""
+}
+
+func (x *NodeInventory) GetStale() bool {
+	if x != nil {
+		return x.Stale
+	}
+	return false
+}
+
+func (x *NodeInventory) GetGpus() []*NodeInventory_GPU {
+	if x != nil {
+		return x.Gpus
+	}
+	return nil
+}
+
+func (x *NodeInventory) GetAdded() []*NodeInventory_GPU {
+	if x != nil {
+		return x.Added
+	}
+	return nil
+}
+
+func (x *NodeInventory) GetRemoved() []*NodeInventory_GPU {
+	if x != nil {
+		return x.Removed
+	}
+	return nil
+}
+
 type Metric_Label struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -134,7 +223,7 @@ type Metric_Label struct {
 func (x *Metric_Label) Reset() {
 	*x = Metric_Label{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_pb_metrics_proto_msgTypes[2]
+		mi := &file_pb_metrics_proto_msgTypes[3]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -147,7 +236,7 @@ func (x *Metric_Label) String() string {
 func (*Metric_Label) ProtoMessage() {}
 
 func (x *Metric_Label) ProtoReflect() protoreflect.Message {
-	mi := &file_pb_metrics_proto_msgTypes[2]
+	mi := &file_pb_metrics_proto_msgTypes[3]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -189,7 +278,7 @@ type Metric_Measurement struct {
 func (x *Metric_Measurement) Reset() {
 	*x = Metric_Measurement{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_pb_metrics_proto_msgTypes[3]
+		mi := &file_pb_metrics_proto_msgTypes[4]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -202,7 +291,7 @@ func (x *Metric_Measurement) String() string {
 func (*Metric_Measurement) ProtoMessage() {}
 
 func (x *Metric_Measurement) ProtoReflect() protoreflect.Message {
-	mi := &file_pb_metrics_proto_msgTypes[3]
+	mi := &file_pb_metrics_proto_msgTypes[4]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -232,6 +321,85 @@ func (x *Metric_Measurement) GetLabels() []*Metric_Label {
 	return nil
 }
 
+type NodeInventory_GPU struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Uuid          string `protobuf:"bytes,1,opt,name=uuid,proto3" json:"uuid,omitempty"`
+	DeviceId      string `protobuf:"bytes,2,opt,name=device_id,json=deviceId,proto3" json:"device_id,omitempty"`
+	ModelName     string `protobuf:"bytes,3,opt,name=model_name,json=modelName,proto3" json:"model_name,omitempty"`
+	MigProfile    string `protobuf:"bytes,4,opt,name=mig_profile,json=migProfile,proto3" json:"mig_profile,omitempty"`
+	MigInstanceId string `protobuf:"bytes,5,opt,name=mig_instance_id,json=migInstanceId,proto3" json:"mig_instance_id,omitempty"`
+}
+
+func (x *NodeInventory_GPU) Reset() {
+	*x = NodeInventory_GPU{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pb_metrics_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *NodeInventory_GPU) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NodeInventory_GPU) ProtoMessage() {}
+
+func (x *NodeInventory_GPU) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_metrics_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NodeInventory_GPU.ProtoReflect.Descriptor instead.
+func (*NodeInventory_GPU) Descriptor() ([]byte, []int) {
+	return file_pb_metrics_proto_rawDescGZIP(), []int{2, 0}
+}
+
+func (x *NodeInventory_GPU) GetUuid() string {
+	if x != nil {
+		return x.Uuid
+	}
+	return ""
+}
+
+func (x *NodeInventory_GPU) GetDeviceId() string {
+	if x != nil {
+		return x.DeviceId
+	}
+	return ""
+}
+
+func (x *NodeInventory_GPU) GetModelName() string {
+	if x != nil {
+		return x.ModelName
+	}
+	return ""
+}
+
+func (x *NodeInventory_GPU) GetMigProfile() string {
+	if x != nil {
+		return x.MigProfile
+	}
+	return ""
+}
+
+func (x *NodeInventory_GPU) GetMigInstanceId() string {
+	if x != nil {
+		return x.MigInstanceId
+	}
+	return ""
+}
+
 var File_pb_metrics_proto protoreflect.FileDescriptor
 
 var file_pb_metrics_proto_rawDesc = []byte{
@@ -249,14 +417,39 @@ var file_pb_metrics_proto_rawDesc = []byte{
 	0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x01, 0x52, 0x05, 0x76, 0x61, 0x6c,
 	0x75, 0x65, 0x12, 0x25, 0x0a, 0x06, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x18, 0x02, 0x20, 0x03,
 	0x28, 0x0b, 0x32, 0x0d, 0x2e, 0x4d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x2e, 0x4c, 0x61, 0x62, 0x65,
-	0x6c, 0x52, 0x06, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x22, 0x31, 0x0a, 0x0c, 0x4d, 0x65, 0x74,
+	0x6c, 0x52, 0x06, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x22, 0x5f, 0x0a, 0x0c, 0x4d, 0x65, 0x74,
 	0x72, 0x69, 0x63, 0x73, 0x42, 0x61, 0x74, 0x63, 0x68, 0x12, 0x21, 0x0a, 0x07, 0x6d, 0x65, 0x74,
 	0x72, 0x69, 0x63, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x07, 0x2e, 0x4d, 0x65, 0x74,
-	0x72, 0x69, 0x63, 0x52, 0x07, 0x6d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x73, 0x42, 0x2b, 0x5a, 0x29,
-	0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x63, 0x61, 0x73, 0x74, 0x61,
-	0x69, 0x2f, 0x67, 0x70, 0x75, 0x2d, 0x6d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x73, 0x2d, 0x65, 0x78,
-	0x70, 0x6f, 0x72, 0x74, 0x65, 0x72, 0x2f, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f,
-	0x33,
+	0x72, 0x69, 0x63, 0x52, 0x07, 0x6d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x73, 0x12, 0x2c, 0x0a, 0x09,
+	0x69, 0x6e, 0x76, 0x65, 0x6e, 0x74, 0x6f, 0x72, 0x79, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32,
+	0x0e, 0x2e, 0x4e, 0x6f, 0x64, 0x65, 0x49, 0x6e, 0x76, 0x65, 0x6e, 0x74, 0x6f, 0x72, 0x79, 0x52,
+	0x09, 0x69, 0x6e, 0x76, 0x65, 0x6e, 0x74, 0x6f, 0x72, 0x79, 0x22, 0xe3, 0x02, 0x0a, 0x0d, 0x4e,
+	0x6f, 0x64, 0x65, 0x49, 0x6e, 0x76, 0x65, 0x6e, 0x74, 0x6f, 0x72, 0x79, 0x12, 0x1b, 0x0a, 0x09,
+	0x6e, 0x6f, 0x64, 0x65, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x08, 0x6e, 0x6f, 0x64, 0x65, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x73, 0x74, 0x61,
+	0x6c, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x08, 0x52, 0x05, 0x73, 0x74, 0x61, 0x6c, 0x65, 0x12,
+	0x26, 0x0a, 0x04, 0x67, 0x70, 0x75, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x12, 0x2e,
+	0x4e, 0x6f, 0x64, 0x65, 0x49, 0x6e, 0x76, 0x65, 0x6e, 0x74, 0x6f, 0x72, 0x79, 0x2e, 0x47, 0x50,
+	0x55, 0x52, 0x04, 0x67, 0x70, 0x75, 0x73, 0x12, 0x28, 0x0a, 0x05, 0x61, 0x64, 0x64, 0x65, 0x64,
+	0x18, 0x04, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x12, 0x2e, 0x4e, 0x6f, 0x64, 0x65, 0x49, 0x6e, 0x76,
+	0x65, 0x6e, 0x74, 0x6f, 0x72, 0x79, 0x2e, 0x47, 0x50, 0x55, 0x52, 0x05, 0x61, 0x64, 0x64, 0x65,
+	0x64, 0x12, 0x2c, 0x0a, 0x07, 0x72, 0x65, 0x6d, 0x6f, 0x76, 0x65, 0x64, 0x18, 0x05, 0x20, 0x03,
+	0x28, 0x0b, 0x32, 0x12, 0x2e, 0x4e, 0x6f, 0x64, 0x65, 0x49, 0x6e, 0x76, 0x65, 0x6e, 0x74, 0x6f,
+	0x72, 0x79, 0x2e, 0x47, 0x50, 0x55, 0x52, 0x07, 0x72, 0x65, 0x6d, 0x6f, 0x76, 0x65, 0x64, 0x1a,
+	0x9e, 0x01, 0x0a, 0x03, 0x47, 0x50, 0x55, 0x12, 0x12, 0x0a, 0x04, 0x75, 0x75, 0x69, 0x64, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x75, 0x75, 0x69, 0x64, 0x12, 0x1b, 0x0a, 0x09, 0x64,
+	0x65, 0x76, 0x69, 0x63, 0x65, 0x5f, 0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08,
+	0x64, 0x65, 0x76, 0x69, 0x63, 0x65, 0x49, 0x64, 0x12, 0x1d, 0x0a, 0x0a, 0x6d, 0x6f, 0x64, 0x65,
+	0x6c, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x6d, 0x6f,
+	0x64, 0x65, 0x6c, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x1f, 0x0a, 0x0b, 0x6d, 0x69, 0x67, 0x5f, 0x70,
+	0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x6d, 0x69,
+	0x67, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x12, 0x26, 0x0a, 0x0f, 0x6d, 0x69, 0x67, 0x5f,
+	0x69, 0x6e, 0x73, 0x74, 0x61, 0x6e, 0x63, 0x65, 0x5f, 0x69, 0x64, 0x18, 0x05, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x0d, 0x6d, 0x69, 0x67, 0x49, 0x6e, 0x73, 0x74, 0x61, 0x6e, 0x63, 0x65, 0x49, 0x64,
+	0x42, 0x2b, 0x5a, 0x29, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x63,
+	0x61, 0x73, 0x74, 0x61, 0x69, 0x2f, 0x67, 0x70, 0x75, 0x2d, 0x6d, 0x65, 0x74, 0x72, 0x69, 0x63,
+	0x73, 0x2d, 0x65, 0x78, 0x70, 0x6f, 0x72, 0x74, 0x65, 0x72, 0x2f, 0x70, 0x62, 0x62, 0x06, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -271,22 +464,28 @@ func file_pb_metrics_proto_rawDescGZIP() []byte {
 	return file_pb_metrics_proto_rawDescData
 }
 
-var file_pb_metrics_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_pb_metrics_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
 var file_pb_metrics_proto_goTypes = []interface{}{
 	(*Metric)(nil),             // 0: Metric
 	(*MetricsBatch)(nil),       // 1: MetricsBatch
-	(*Metric_Label)(nil),       // 2: Metric.Label
-	(*Metric_Measurement)(nil), // 3: Metric.Measurement
+	(*NodeInventory)(nil),      // 2: NodeInventory
+	(*Metric_Label)(nil),       // 3: Metric.Label
+	(*Metric_Measurement)(nil), // 4: Metric.Measurement
+	(*NodeInventory_GPU)(nil),  // 5: NodeInventory.GPU
 }
 var file_pb_metrics_proto_depIdxs = []int32{
-	3, // 0: Metric.measurements:type_name -> Metric.Measurement
+	4, // 0: Metric.measurements:type_name -> Metric.Measurement
 	0, // 1: MetricsBatch.metrics:type_name -> Metric
-	2, // 2: Metric.Measurement.labels:type_name -> Metric.Label
-	3, // [3:3] is the sub-list for method output_type
-	3, // [3:3] is the sub-list for method input_type
-	3, // [3:3] is the sub-list for extension type_name
-	3, // [3:3] is the sub-list for extension extendee
-	0, // [0:3] is the sub-list for field type_name
+	2, // 2: MetricsBatch.inventory:type_name -> NodeInventory
+	5, // 3: NodeInventory.gpus:type_name -> NodeInventory.GPU
+	5, // 4: NodeInventory.added:type_name -> NodeInventory.GPU
+	5, // 5: NodeInventory.removed:type_name -> NodeInventory.GPU
+	3, // 6: Metric.Measurement.labels:type_name -> Metric.Label
+	7, // [7:7] is the sub-list for method output_type
+	7, // [7:7] is the sub-list for method input_type
+	7, // [7:7] is the sub-list for extension type_name
+	7, // [7:7] is the sub-list for extension extendee
+	0, // [0:7] is the sub-list for field type_name
 }
 
 func init() { file_pb_metrics_proto_init() }
@@ -320,7 +519,7 @@ func file_pb_metrics_proto_init() {
 			}
 		}
 		file_pb_metrics_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*Metric_Label); i {
+			switch v := v.(*NodeInventory); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -332,6 +531,18 @@ func file_pb_metrics_proto_init() {
 			}
 		}
 		file_pb_metrics_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Metric_Label); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pb_metrics_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*Metric_Measurement); i {
 			case 0:
 				return &v.state
@@ -343,6 +554,18 @@ func file_pb_metrics_proto_init() {
 				return nil
 			}
 		}
+		file_pb_metrics_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*NodeInventory_GPU); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -350,7 +573,7 @@ func file_pb_metrics_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_pb_metrics_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   4,
+			NumMessages:   6,
 			NumExtensions: 0,
 			NumServices:   0,
 		},